@@ -0,0 +1,163 @@
+package main
+
+import (
+	"crypto/subtle"
+	"encoding/json"
+	"fmt"
+	"os"
+	"time"
+
+	"github.com/dgraph-io/badger/v3"
+	"github.com/mguentner/passwordless/state"
+)
+
+type ErrInvalidConfirmationToken struct{}
+
+func (e *ErrInvalidConfirmationToken) Error() string {
+	return "InvalidConfirmationToken"
+}
+
+// tombstonePrefix contains `-`, so it never collides with the keys of an
+// account, which start with a base64 encoded identifier
+const tombstonePrefix = "tombstone-"
+
+// Tombstone records the deletion of an account for operators. It only
+// contains the encoded identifier, which can be compared with
+// state.EncodeIdentifier of a known identifier.
+type Tombstone struct {
+	EncodedIdentifier string    `json:"encodedIdentifier"`
+	DeletedAt         time.Time `json:"deletedAt"`
+	Buckets           int       `json:"buckets"`
+	Keys              uint64    `json:"keys"`
+	Bytes             uint64    `json:"bytes"`
+}
+
+// tombstoneKey is ordered by the time of the deletion, an account can be
+// deleted more than once
+func tombstoneKey(deletedAt time.Time, encodedIdentifier string) string {
+	return fmt.Sprintf("%s%020d-%s", tombstonePrefix, deletedAt.UnixNano(), encodedIdentifier)
+}
+
+// consumeLoginToken deletes a login token issued by /api/login. Only the
+// token keys of the identifier are compared, as any other value of the
+// account could be chosen by the client.
+func consumeLoginToken(identifier string, token string, txn *badger.Txn) error {
+	if len(token) == 0 {
+		return &ErrInvalidConfirmationToken{}
+	}
+	prefix := []byte(fmt.Sprintf("%s-token-", state.EncodeIdentifier(identifier)))
+	it := txn.NewIterator(badger.DefaultIteratorOptions)
+	defer it.Close()
+	for it.Seek(prefix); it.ValidForPrefix(prefix); it.Next() {
+		item := it.Item()
+		matches := false
+		err := item.Value(func(v []byte) error {
+			matches = subtle.ConstantTimeCompare(v, []byte(token)) == 1
+			return nil
+		})
+		if err != nil {
+			return err
+		}
+		if matches {
+			return txn.Delete(item.KeyCopy(nil))
+		}
+	}
+	return &ErrInvalidConfirmationToken{}
+}
+
+// AuthenticateIdentifier consumes a login token of the identifier. It
+// replaces the lookup of passwordless, which compares the token with every
+// value stored below the encoded identifier, including values written by
+// a grantee with write access.
+func AuthenticateIdentifier(s *state.State, identifier string, token string) error {
+	return s.DB.Update(func(txn *badger.Txn) error {
+		return consumeLoginToken(identifier, token, txn)
+	})
+}
+
+// DeleteAccountForIdentifier deletes all buckets, keys, versions and the
+// trash of an account. The deletion has to be confirmed using a login
+// token, so a leaked access token is not enough to erase an account.
+// Access tokens stay valid until they expire, so a client can still
+// write new keys afterwards.
+func DeleteAccountForIdentifier(s *state.State, identifier string, token string) (Tombstone, error) {
+	identifier, _ = splitIdentifier(identifier)
+	encodedIdentifier := state.EncodeIdentifier(identifier)
+	tombstone := Tombstone{
+		EncodedIdentifier: encodedIdentifier,
+		DeletedAt:         time.Now(),
+	}
+	err := s.DB.Update(func(txn *badger.Txn) error {
+		err := consumeLoginToken(identifier, token, txn)
+		if err != nil {
+			return err
+		}
+		usage, err := accountUsageForIdentifier(identifier, txn)
+		if err != nil {
+			return err
+		}
+		buckets, err := bucketsForIdentifier(identifier, txn)
+		if err != nil {
+			return err
+		}
+		tombstone.Buckets = len(buckets)
+		tombstone.Keys = usage.Keys
+		tombstone.Bytes = usage.Bytes
+		encodedTombstone, err := json.Marshal(tombstone)
+		if err != nil {
+			return err
+		}
+		return txn.Set([]byte(tombstoneKey(tombstone.DeletedAt, encodedIdentifier)), encodedTombstone)
+	})
+	if err != nil {
+		return Tombstone{}, err
+	}
+	// all keys of an account, including those of its buckets, start with
+	// the encoded identifier, which has the same length for all accounts.
+	// The keys shared with the account are indexed separately.
+	return tombstone, s.DB.DropPrefix([]byte(encodedIdentifier), []byte(sharedPrefix(identifier)))
+}
+
+// Tombstones lists all deleted accounts, the oldest deletion first
+func Tombstones(s *state.State) ([]Tombstone, error) {
+	tombstones := []Tombstone{}
+	prefix := []byte(tombstonePrefix)
+	err := s.DB.View(func(txn *badger.Txn) error {
+		it := txn.NewIterator(badger.DefaultIteratorOptions)
+		defer it.Close()
+		for it.Seek(prefix); it.ValidForPrefix(prefix); it.Next() {
+			var tombstone Tombstone
+			err := it.Item().Value(func(v []byte) error {
+				return json.Unmarshal(v, &tombstone)
+			})
+			if err != nil {
+				return err
+			}
+			tombstones = append(tombstones, tombstone)
+		}
+		return nil
+	})
+	return tombstones, err
+}
+
+// printTombstones writes one JSON object per deleted account to stdout.
+// This must not be run while the database is used by a running instance.
+func printTombstones(config *Config) error {
+	db, err := openDB(config)
+	if err != nil {
+		return err
+	}
+	defer db.Close()
+	tombstones, err := Tombstones(&state.State{DB: db})
+	if err != nil {
+		return err
+	}
+	encoder := json.NewEncoder(os.Stdout)
+	for _, tombstone := range tombstones {
+		err = encoder.Encode(tombstone)
+		if err != nil {
+			return err
+		}
+	}
+	return nil
+}
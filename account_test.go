@@ -0,0 +1,109 @@
+package main
+
+import (
+	"bytes"
+	"testing"
+
+	"github.com/dgraph-io/badger/v3"
+	"github.com/mguentner/passwordless/state"
+)
+
+func TestDeleteAccount(t *testing.T) {
+	config := DefaultConfig()
+	config.StorageOptions.ChunkSizeBytes = 4
+	config.StorageOptions.TrashRetentionSeconds = 3600
+	db, err := badger.Open(badger.DefaultOptions("").WithInMemory(true))
+	if err != nil {
+		t.Fatal(err)
+	}
+	appState := state.State{
+		DB: db,
+	}
+	// tokens are inserted first, as the passwordless library counts all
+	// keys of an identifier as tokens
+	err = appState.InsertToken(config.Config, "alice@example.com", "12345678")
+	if err != nil {
+		t.Fatal(err)
+	}
+	_, err = InsertKeyValueForIdentifier(&appState, config, "alice@example.com", "guess", []byte("guess"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	_, err = InsertKeyValueForIdentifier(&appState, config, "alice@example.com", "trashed", []byte("trashed"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	err = TrashKeyValueForIdentifier(&appState, config, "alice@example.com", "trashed", Preconditions{})
+	if err != nil {
+		t.Fatal(err)
+	}
+	_, err = CreateBucketForIdentifier(&appState, config, "alice@example.com", Bucket{Name: "files"})
+	if err != nil {
+		t.Fatal(err)
+	}
+	files, err := scopedIdentifier("alice@example.com", "files")
+	if err != nil {
+		t.Fatal(err)
+	}
+	_, err = InsertKeyValueFromReader(&appState, config, files, "large", bytes.NewBufferString("0123456789"), InsertOptions{})
+	if err != nil {
+		t.Fatal(err)
+	}
+	_, err = InsertKeyValueForIdentifier(&appState, config, "bob@example.com", "needle", []byte("bob"))
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	// stored values must not be accepted as tokens
+	for _, token := range []string{"", "guess", "87654321"} {
+		_, err = DeleteAccountForIdentifier(&appState, "alice@example.com", token)
+		if _, ok := err.(*ErrInvalidConfirmationToken); !ok {
+			t.Errorf("Expected ErrInvalidConfirmationToken for %q, got %v", token, err)
+		}
+	}
+	keys, err := KeysForIdentifier(&appState, "alice@example.com")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(keys) != 1 {
+		t.Errorf("Expected the keys to be untouched, got %v", keys)
+	}
+
+	tombstone, err := DeleteAccountForIdentifier(&appState, "alice@example.com", "12345678")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if tombstone.EncodedIdentifier != state.EncodeIdentifier("alice@example.com") || tombstone.Keys != 3 || tombstone.Buckets != 1 {
+		t.Errorf("Unexpected tombstone %+v", tombstone)
+	}
+	err = appState.DB.View(func(txn *badger.Txn) error {
+		it := txn.NewIterator(badger.DefaultIteratorOptions)
+		defer it.Close()
+		prefix := []byte(state.EncodeIdentifier("alice@example.com"))
+		for it.Seek(prefix); it.ValidForPrefix(prefix); it.Next() {
+			t.Errorf("Expected all keys to be deleted, found %s", it.Item().Key())
+		}
+		return nil
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	value, err := RetrieveValueIdentifierAndKey(&appState, "bob@example.com", "needle")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if string(value) != "bob" {
+		t.Errorf("Expected other accounts to be untouched, got %s", value)
+	}
+	tombstones, err := Tombstones(&appState)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(tombstones) != 1 || tombstones[0].EncodedIdentifier != tombstone.EncodedIdentifier {
+		t.Errorf("Unexpected tombstones %+v", tombstones)
+	}
+	_, err = DeleteAccountForIdentifier(&appState, "alice@example.com", "12345678")
+	if _, ok := err.(*ErrInvalidConfirmationToken); !ok {
+		t.Errorf("Expected the token to be consumed, got %v", err)
+	}
+}
@@ -0,0 +1,199 @@
+package main
+
+import (
+	"time"
+
+	"github.com/dgraph-io/badger/v3"
+	"github.com/mguentner/passwordless/state"
+)
+
+type ErrInvalidBatchOperation struct{}
+
+func (e *ErrInvalidBatchOperation) Error() string {
+	return "InvalidBatchOperation"
+}
+
+type ErrBatchTooLarge struct{}
+
+func (e *ErrBatchTooLarge) Error() string {
+	return "BatchTooLarge"
+}
+
+const (
+	BatchPut    = "put"
+	BatchCreate = "create"
+	BatchDelete = "delete"
+	BatchCheck  = "check"
+)
+
+// BatchOperation is a single operation of a batch. Op is one of
+// BatchPut, BatchCreate, BatchDelete or BatchCheck.
+type BatchOperation struct {
+	Op  string `json:"op"`
+	Key string `json:"key"`
+	// base64 encoded in JSON
+	Value           []byte `json:"value,omitempty"`
+	ContentType     string `json:"contentType,omitempty"`
+	ContentEncoding string `json:"contentEncoding,omitempty"`
+	Filename        string `json:"filename,omitempty"`
+	TTLSeconds      uint64 `json:"ttl,omitempty"`
+	// ETags without quotes, "*" matches any existing value
+	IfMatch     []string `json:"ifMatch,omitempty"`
+	IfNoneMatch []string `json:"ifNoneMatch,omitempty"`
+	// only used by BatchCheck, the current version has to match if set
+	Version uint64 `json:"version,omitempty"`
+}
+
+// BatchResult contains the written or checked version on success.
+// Operations following a failed operation are not executed.
+type BatchResult struct {
+	Key     string        `json:"key"`
+	Error   string        `json:"error,omitempty"`
+	Version *ValueVersion `json:"version,omitempty"`
+}
+
+// isBatchOperationError returns true for errors caused by the operation
+// itself, which are reported as part of its result
+func isBatchOperationError(err error) bool {
+	switch err.(type) {
+	case *ErrInvalidBatchOperation, *ErrPreconditionFailed, *ErrKeyNotFound, *ErrKeyExists,
+		*ErrKeyHasVersions, *ErrDataTooBig, *ErrContentTypeNotAllowed:
+		return true
+	}
+	return false
+}
+
+func checkKeyValue(identifier string, operation BatchOperation, txn *badger.Txn) (*ValueVersion, error) {
+	metadata, err := metadataForKey(identifier, operation.Key, txn)
+	if err != nil {
+		if _, ok := err.(*ErrKeyNotFound); !ok {
+			return nil, err
+		}
+		metadata = nil
+	}
+	preconditions := Preconditions{
+		IfMatch:     operation.IfMatch,
+		IfNoneMatch: operation.IfNoneMatch,
+	}
+	err = preconditions.check(metadata)
+	if err != nil {
+		return nil, err
+	}
+	if metadata == nil {
+		// checking for absence requires If-None-Match: *
+		if len(operation.IfNoneMatch) == 0 || operation.Version > 0 {
+			return nil, &ErrKeyNotFound{}
+		}
+		return nil, nil
+	}
+	if operation.Version > 0 && operation.Version != metadata.Version {
+		return nil, &ErrPreconditionFailed{}
+	}
+	return &metadata.ValueVersion, nil
+}
+
+func executeBatchOperation(config Config, identifier string, operation BatchOperation, txn *badger.Txn) (*ValueVersion, error) {
+	if len(operation.Key) == 0 {
+		return nil, &ErrInvalidBatchOperation{}
+	}
+	preconditions := Preconditions{
+		IfMatch:     operation.IfMatch,
+		IfNoneMatch: operation.IfNoneMatch,
+	}
+	switch operation.Op {
+	case BatchPut, BatchCreate:
+		if config.StorageOptions.MaxValueSizeBytes > 0 && uint64(len(operation.Value)) > config.StorageOptions.MaxValueSizeBytes {
+			return nil, &ErrDataTooBig{}
+		}
+		options := InsertOptions{
+			Preconditions:   preconditions,
+			CreateOnly:      operation.Op == BatchCreate,
+			TTL:             time.Duration(operation.TTLSeconds) * time.Second,
+			ContentType:     operation.ContentType,
+			ContentEncoding: operation.ContentEncoding,
+			Filename:        operation.Filename,
+			deferLimits:     true,
+		}
+		return insertKeyValue(config, identifier, operation.Key, inlineValue(config, operation.Value, options), options, txn)
+	case BatchDelete:
+		return nil, trashKeyValue(config, identifier, operation.Key, preconditions, txn)
+	case BatchCheck:
+		return checkKeyValue(identifier, operation, txn)
+	}
+	return nil, &ErrInvalidBatchOperation{}
+}
+
+// executeBatch stops at the first failing operation and returns its
+// error. The key limit and the byte quota are applied to the result of
+// the whole batch, so a batch may e.g. delete a key to make room for a
+// new one.
+func executeBatch(config Config, identifier string, operations []BatchOperation, txn *badger.Txn) ([]BatchResult, error) {
+	results := []BatchResult{}
+	before, err := limitUsageForIdentifier(identifier, txn)
+	if err != nil {
+		return nil, err
+	}
+	var operationErr error
+	for _, operation := range operations {
+		result := BatchResult{
+			Key: operation.Key,
+		}
+		if operationErr != nil {
+			result.Error = "NotExecuted"
+			results = append(results, result)
+			continue
+		}
+		version, err := executeBatchOperation(config, identifier, operation, txn)
+		if err == badger.ErrTxnTooBig {
+			return nil, &ErrBatchTooLarge{}
+		}
+		if err != nil {
+			if !isBatchOperationError(err) {
+				return nil, err
+			}
+			operationErr = err
+			result.Error = err.Error()
+		}
+		result.Version = version
+		results = append(results, result)
+	}
+	if operationErr != nil {
+		return results, operationErr
+	}
+	after, err := limitUsageForIdentifier(identifier, txn)
+	if err != nil {
+		return nil, err
+	}
+	bucket, err := bucketForIdentifier(identifier, txn)
+	if err != nil {
+		return nil, err
+	}
+	err = checkLimits(config, bucket, before, after)
+	if err != nil {
+		return results, err
+	}
+	return results, nil
+}
+
+// ExecuteBatchForIdentifier executes all operations in a single
+// transaction, either all of them are committed or none.
+// If the batch fails because of an operation or a limit, the results
+// are returned together with the error.
+func ExecuteBatchForIdentifier(s *state.State, config Config, identifier string, operations []BatchOperation) ([]BatchResult, error) {
+	var results []BatchResult
+	err := updateRetryingConflicts(s, func(txn *badger.Txn) error {
+		r, err := executeBatch(config, identifier, operations, txn)
+		results = r
+		return err
+	})
+	if err == badger.ErrTxnTooBig {
+		return nil, &ErrBatchTooLarge{}
+	}
+	if err != nil && results != nil {
+		// nothing was written
+		for i := range results {
+			results[i].Version = nil
+		}
+	}
+	return results, err
+}
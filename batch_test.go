@@ -0,0 +1,136 @@
+package main
+
+import (
+	"testing"
+
+	"github.com/dgraph-io/badger/v3"
+	"github.com/mguentner/passwordless/state"
+)
+
+func TestBatch(t *testing.T) {
+	config := DefaultConfig()
+	db, err := badger.Open(badger.DefaultOptions("").WithInMemory(true))
+	if err != nil {
+		t.Fatal(err)
+	}
+	appState := state.State{
+		DB: db,
+	}
+	_, err = InsertKeyValueForIdentifier(&appState, config, "alice@example.com", "index", []byte("v1"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	_, err = InsertKeyValueForIdentifier(&appState, config, "alice@example.com", "old", []byte("old"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	operations := []BatchOperation{
+		{Op: BatchCheck, Key: "index", Version: 1},
+		{Op: BatchPut, Key: "index", Value: []byte("v2")},
+		{Op: BatchCreate, Key: "data", Value: []byte("data")},
+		{Op: BatchDelete, Key: "old"},
+	}
+	results, err := ExecuteBatchForIdentifier(&appState, config, "alice@example.com", operations)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(results) != 4 {
+		t.Fatalf("Expected 4 results, got %d", len(results))
+	}
+	if results[1].Version == nil || results[1].Version.Version != 2 {
+		t.Errorf("Expected version 2, got %+v", results[1].Version)
+	}
+	keys, err := KeysForIdentifier(&appState, "alice@example.com")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(keys) != 2 {
+		t.Errorf("Expected 2 keys, got %v", keys)
+	}
+
+	// the failing check rolls back the put before it
+	operations = []BatchOperation{
+		{Op: BatchPut, Key: "data", Value: []byte("changed")},
+		{Op: BatchCheck, Key: "index", Version: 1},
+		{Op: BatchDelete, Key: "index"},
+	}
+	results, err = ExecuteBatchForIdentifier(&appState, config, "alice@example.com", operations)
+	if _, ok := err.(*ErrPreconditionFailed); !ok {
+		t.Errorf("Expected ErrPreconditionFailed, got %v", err)
+	}
+	if results[0].Error != "" || results[0].Version != nil {
+		t.Errorf("Unexpected result %+v", results[0])
+	}
+	if results[1].Error != "PreconditionFailed" {
+		t.Errorf("Expected PreconditionFailed, got %s", results[1].Error)
+	}
+	if results[2].Error != "NotExecuted" {
+		t.Errorf("Expected NotExecuted, got %s", results[2].Error)
+	}
+	value, err := RetrieveValueIdentifierAndKey(&appState, "alice@example.com", "data")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if string(value) != "data" {
+		t.Errorf("Expected data, got %s", value)
+	}
+
+	operations = []BatchOperation{
+		{Op: "rename", Key: "data"},
+	}
+	_, err = ExecuteBatchForIdentifier(&appState, config, "alice@example.com", operations)
+	if _, ok := err.(*ErrInvalidBatchOperation); !ok {
+		t.Errorf("Expected ErrInvalidBatchOperation, got %v", err)
+	}
+}
+
+func TestBatchLimits(t *testing.T) {
+	config := DefaultConfig()
+	config.StorageOptions.MaxKeysPerAccount = 2
+	config.StorageOptions.MaxBytesPerAccount = 10
+	db, err := badger.Open(badger.DefaultOptions("").WithInMemory(true))
+	if err != nil {
+		t.Fatal(err)
+	}
+	appState := state.State{
+		DB: db,
+	}
+	_, err = InsertKeyValueForIdentifier(&appState, config, "alice@example.com", "a", []byte("aaaaa"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	_, err = InsertKeyValueForIdentifier(&appState, config, "alice@example.com", "b", []byte("bbbbb"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	// the limits apply to the result of the batch, not to every operation
+	operations := []BatchOperation{
+		{Op: BatchCreate, Key: "c", Value: []byte("ccccc")},
+		{Op: BatchDelete, Key: "a"},
+	}
+	_, err = ExecuteBatchForIdentifier(&appState, config, "alice@example.com", operations)
+	if err != nil {
+		t.Fatalf("Unexpected failure: %v", err)
+	}
+	operations = []BatchOperation{
+		{Op: BatchCreate, Key: "d", Value: []byte("d")},
+	}
+	_, err = ExecuteBatchForIdentifier(&appState, config, "alice@example.com", operations)
+	if _, ok := err.(*ErrKeyLimitReached); !ok {
+		t.Errorf("Expected ErrKeyLimitReached, got %v", err)
+	}
+	operations = []BatchOperation{
+		{Op: BatchPut, Key: "b", Value: []byte("bbbbbb")},
+	}
+	_, err = ExecuteBatchForIdentifier(&appState, config, "alice@example.com", operations)
+	if _, ok := err.(*ErrQuotaExceeded); !ok {
+		t.Errorf("Expected ErrQuotaExceeded, got %v", err)
+	}
+	keys, err := KeysForIdentifier(&appState, "alice@example.com")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(keys) != 2 || keys[0] != "b" || keys[1] != "c" {
+		t.Errorf("Expected b and c, got %v", keys)
+	}
+}
@@ -0,0 +1,424 @@
+package main
+
+import (
+	"encoding/base64"
+	"encoding/json"
+	"fmt"
+	"regexp"
+	"strings"
+	"time"
+
+	"github.com/dgraph-io/badger/v3"
+	"github.com/mguentner/passwordless/state"
+)
+
+type ErrBucketNotFound struct{}
+
+func (e *ErrBucketNotFound) Error() string {
+	return "BucketNotFound"
+}
+
+type ErrBucketExists struct{}
+
+func (e *ErrBucketExists) Error() string {
+	return "BucketExists"
+}
+
+type ErrInvalidBucketName struct{}
+
+func (e *ErrInvalidBucketName) Error() string {
+	return "InvalidBucketName"
+}
+
+type ErrBucketLimitReached struct{}
+
+func (e *ErrBucketLimitReached) Error() string {
+	return "BucketLimitReached"
+}
+
+type ErrBucketDeletionPending struct{}
+
+func (e *ErrBucketDeletionPending) Error() string {
+	return "BucketDeletionPending"
+}
+
+// DefaultBucket contains the keys of the /api/store routes. Its keys are
+// stored without a bucket, so keys written before buckets existed are
+// part of it.
+const DefaultBucket = "default"
+
+// bucketSeparator separates the identifier and the bucket of a scoped
+// identifier. It can not be part of an e-mail address or phone number.
+const bucketSeparator = "\x00"
+
+var bucketNamePattern = regexp.MustCompile(`^[a-zA-Z0-9._-]{1,64}$`)
+
+// bucketDeletionPrefix marks buckets whose keys are still being deleted,
+// it contains `-` so it never collides with the keys of an account
+const bucketDeletionPrefix = "bucketdeletion-"
+
+// bucketDeletionBatchSize bounds the keys deleted in one transaction
+const bucketDeletionBatchSize = 1000
+
+// Bucket limits apply in addition to the limits of the account,
+// 0 means no limit
+type Bucket struct {
+	Name      string    `json:"name"`
+	CreatedAt time.Time `json:"createdAt"`
+	MaxKeys   uint64    `json:"maxKeys"`
+	MaxBytes  uint64    `json:"maxBytes"`
+}
+
+// scopedIdentifier returns the identifier used by all operations on keys
+// of the bucket
+func scopedIdentifier(identifier string, bucket string) (string, error) {
+	if strings.Contains(identifier, bucketSeparator) || !bucketNamePattern.MatchString(bucket) {
+		return "", &ErrInvalidBucketName{}
+	}
+	// `.` and `..` would be resolved as path segments in the routes of
+	// the bucket
+	if len(strings.Trim(bucket, ".")) == 0 {
+		return "", &ErrInvalidBucketName{}
+	}
+	if bucket == DefaultBucket {
+		return identifier, nil
+	}
+	return identifier + bucketSeparator + bucket, nil
+}
+
+// splitIdentifier returns DefaultBucket for identifiers without bucket
+func splitIdentifier(identifier string) (string, string) {
+	parts := strings.SplitN(identifier, bucketSeparator, 2)
+	if len(parts) == 1 {
+		return identifier, DefaultBucket
+	}
+	return parts[0], parts[1]
+}
+
+// encodeScope replaces state.EncodeIdentifier for all keys that belong to
+// a bucket. The bucket is appended using a separator that is neither part
+// of base64 nor `-`, so the keys of a bucket never share a prefix with
+// the keys of the default bucket or another bucket.
+func encodeScope(identifier string) string {
+	identifier, bucket := splitIdentifier(identifier)
+	encodedIdentifier := state.EncodeIdentifier(identifier)
+	if bucket == DefaultBucket {
+		return encodedIdentifier
+	}
+	return fmt.Sprintf("%s:%s", encodedIdentifier, base64.StdEncoding.EncodeToString([]byte(bucket)))
+}
+
+// bucketKey is stored using the identifier of the account
+func bucketKey(identifier string, bucket string) string {
+	encodedIdentifier := state.EncodeIdentifier(identifier)
+	encodedBucket := base64.StdEncoding.EncodeToString([]byte(bucket))
+	return fmt.Sprintf("%s-bucket-%s", encodedIdentifier, encodedBucket)
+}
+
+// bucketForIdentifier returns the bucket of a scoped identifier and nil
+// for the default bucket, which always exists
+func bucketForIdentifier(identifier string, txn *badger.Txn) (*Bucket, error) {
+	identifier, name := splitIdentifier(identifier)
+	if name == DefaultBucket {
+		return nil, nil
+	}
+	item, err := txn.Get([]byte(bucketKey(identifier, name)))
+	if err != nil {
+		if err == badger.ErrKeyNotFound {
+			return nil, &ErrBucketNotFound{}
+		}
+		return nil, err
+	}
+	var bucket Bucket
+	err = item.Value(func(v []byte) error {
+		return json.Unmarshal(v, &bucket)
+	})
+	if err != nil {
+		return nil, err
+	}
+	return &bucket, nil
+}
+
+// bucketsForIdentifier does not include the default bucket
+func bucketsForIdentifier(identifier string, txn *badger.Txn) ([]Bucket, error) {
+	buckets := []Bucket{}
+	prefix := []byte(fmt.Sprintf("%s-bucket-", state.EncodeIdentifier(identifier)))
+	it := txn.NewIterator(badger.DefaultIteratorOptions)
+	defer it.Close()
+	for it.Seek(prefix); it.ValidForPrefix(prefix); it.Next() {
+		var bucket Bucket
+		err := it.Item().Value(func(v []byte) error {
+			return json.Unmarshal(v, &bucket)
+		})
+		if err != nil {
+			return nil, err
+		}
+		buckets = append(buckets, bucket)
+	}
+	return buckets, nil
+}
+
+// accountUsageForIdentifier sums up the usage of all buckets
+func accountUsageForIdentifier(identifier string, txn *badger.Txn) (Usage, error) {
+	identifier, _ = splitIdentifier(identifier)
+	usage, err := usageForIdentifier(identifier, txn)
+	if err != nil {
+		return usage, err
+	}
+	buckets, err := bucketsForIdentifier(identifier, txn)
+	if err != nil {
+		return usage, err
+	}
+	for _, bucket := range buckets {
+		scoped, err := scopedIdentifier(identifier, bucket.Name)
+		if err != nil {
+			return usage, err
+		}
+		bucketUsage, err := usageForIdentifier(scoped, txn)
+		if err != nil {
+			return usage, err
+		}
+		usage.Keys += bucketUsage.Keys
+		usage.Bytes += bucketUsage.Bytes
+	}
+	return usage, nil
+}
+
+// checkUsage only rejects usage that grows, so accounts and buckets
+// above their limits can still shrink
+func checkUsage(before Usage, after Usage, maxKeys uint64, maxBytes uint64) error {
+	if maxKeys > 0 && after.Keys > before.Keys && after.Keys > maxKeys {
+		return &ErrKeyLimitReached{}
+	}
+	if maxBytes > 0 && after.Bytes > before.Bytes && after.Bytes > maxBytes {
+		return &ErrQuotaExceeded{}
+	}
+	return nil
+}
+
+// limitUsage is the usage of the account and the bucket of an identifier
+type limitUsage struct {
+	account Usage
+	bucket  Usage
+}
+
+func limitUsageForIdentifier(identifier string, txn *badger.Txn) (limitUsage, error) {
+	account, err := accountUsageForIdentifier(identifier, txn)
+	if err != nil {
+		return limitUsage{}, err
+	}
+	bucket, err := usageForIdentifier(identifier, txn)
+	if err != nil {
+		return limitUsage{}, err
+	}
+	return limitUsage{account: account, bucket: bucket}, nil
+}
+
+// checkLimits applies the limits of the account and of the bucket,
+// which is nil for the default bucket
+func checkLimits(config Config, bucket *Bucket, before limitUsage, after limitUsage) error {
+	err := checkUsage(before.account, after.account, config.StorageOptions.MaxKeysPerAccount, config.StorageOptions.MaxBytesPerAccount)
+	if err != nil || bucket == nil {
+		return err
+	}
+	return checkUsage(before.bucket, after.bucket, bucket.MaxKeys, bucket.MaxBytes)
+}
+
+func CreateBucketForIdentifier(s *state.State, config Config, identifier string, bucket Bucket) (Bucket, error) {
+	if bucket.Name == DefaultBucket {
+		return Bucket{}, &ErrBucketExists{}
+	}
+	scoped, err := scopedIdentifier(identifier, bucket.Name)
+	if err != nil {
+		return Bucket{}, err
+	}
+	bucket.CreatedAt = time.Now()
+	err = s.DB.Update(func(txn *badger.Txn) error {
+		_, err := bucketForIdentifier(scoped, txn)
+		if err == nil {
+			return &ErrBucketExists{}
+		}
+		if _, ok := err.(*ErrBucketNotFound); !ok {
+			return err
+		}
+		// the new bucket would share the keys that are not deleted yet
+		_, err = txn.Get([]byte(bucketDeletionKey(scoped)))
+		if err == nil {
+			return &ErrBucketDeletionPending{}
+		}
+		if err != badger.ErrKeyNotFound {
+			return err
+		}
+		if config.StorageOptions.MaxBucketsPerAccount > 0 {
+			buckets, err := bucketsForIdentifier(identifier, txn)
+			if err != nil {
+				return err
+			}
+			if uint64(len(buckets)) >= config.StorageOptions.MaxBucketsPerAccount {
+				return &ErrBucketLimitReached{}
+			}
+		}
+		encodedBucket, err := json.Marshal(bucket)
+		if err != nil {
+			return err
+		}
+		return txn.Set([]byte(bucketKey(identifier, bucket.Name)), encodedBucket)
+	})
+	return bucket, err
+}
+
+type BucketDetails struct {
+	Bucket
+	Usage Usage `json:"usage"`
+}
+
+// BucketsForIdentifier lists all buckets including the default bucket,
+// which is always listed first
+func BucketsForIdentifier(s *state.State, identifier string) ([]BucketDetails, error) {
+	details := []BucketDetails{}
+	err := s.DB.View(func(txn *badger.Txn) error {
+		buckets, err := bucketsForIdentifier(identifier, txn)
+		if err != nil {
+			return err
+		}
+		buckets = append([]Bucket{{Name: DefaultBucket}}, buckets...)
+		for _, bucket := range buckets {
+			scoped, err := scopedIdentifier(identifier, bucket.Name)
+			if err != nil {
+				return err
+			}
+			usage, err := usageForIdentifier(scoped, txn)
+			if err != nil {
+				return err
+			}
+			details = append(details, BucketDetails{
+				Bucket: bucket,
+				Usage:  usage,
+			})
+		}
+		return nil
+	})
+	return details, err
+}
+
+// AccountUsageForIdentifier returns the usage of all buckets of an account
+func AccountUsageForIdentifier(s *state.State, identifier string) (Usage, error) {
+	var usage Usage
+	err := s.DB.View(func(txn *badger.Txn) error {
+		u, err := accountUsageForIdentifier(identifier, txn)
+		usage = u
+		return err
+	})
+	return usage, err
+}
+
+func bucketDeletionKey(scoped string) string {
+	return bucketDeletionPrefix + encodeScope(scoped)
+}
+
+// deleteKeysWithPrefix deletes the keys in transactions of at most
+// bucketDeletionBatchSize keys. Unlike DropPrefix, which blocks all writes
+// until it is done, other writes continue in between.
+func deleteKeysWithPrefix(s *state.State, prefix []byte) error {
+	for {
+		keys := [][]byte{}
+		err := s.DB.View(func(txn *badger.Txn) error {
+			opts := badger.DefaultIteratorOptions
+			opts.PrefetchValues = false
+			it := txn.NewIterator(opts)
+			defer it.Close()
+			for it.Seek(prefix); it.ValidForPrefix(prefix) && len(keys) < bucketDeletionBatchSize; it.Next() {
+				keys = append(keys, it.Item().KeyCopy(nil))
+			}
+			return nil
+		})
+		if err != nil || len(keys) == 0 {
+			return err
+		}
+		err = s.DB.Update(func(txn *badger.Txn) error {
+			for _, key := range keys {
+				err := txn.Delete(key)
+				if err != nil {
+					return err
+				}
+			}
+			return nil
+		})
+		if err != nil {
+			return err
+		}
+	}
+}
+
+// deleteBucketKeys removes the keys of a deleted bucket and the mark of
+// the pending deletion afterwards
+func deleteBucketKeys(s *state.State, encodedScope string) error {
+	err := deleteKeysWithPrefix(s, []byte(encodedScope+"-"))
+	if err != nil {
+		return err
+	}
+	return s.DB.Update(func(txn *badger.Txn) error {
+		return txn.Delete([]byte(bucketDeletionPrefix + encodedScope))
+	})
+}
+
+// DeleteBucketForIdentifier deletes a bucket together with all its keys.
+// Removing the bucket first makes writes to the bucket that are still
+// in progress fail, as they read the bucket in their transaction. The
+// deletion is marked in the same transaction, so it is resumed by
+// ResumeBucketDeletions if the keys could not be deleted.
+func DeleteBucketForIdentifier(s *state.State, config Config, identifier string, name string) error {
+	if name == DefaultBucket {
+		return &ErrInvalidBucketName{}
+	}
+	scoped, err := scopedIdentifier(identifier, name)
+	if err != nil {
+		return err
+	}
+	err = updateRetryingConflicts(s, func(txn *badger.Txn) error {
+		_, err := bucketForIdentifier(scoped, txn)
+		if err != nil {
+			return err
+		}
+		err = txn.Delete([]byte(bucketKey(identifier, name)))
+		if err != nil {
+			return err
+		}
+		err = txn.Set([]byte(bucketDeletionKey(scoped)), []byte{})
+		if err != nil {
+			return err
+		}
+		return recordChange(config, scoped, Change{Type: ChangeDeleteBucket}, txn)
+	})
+	if err != nil {
+		return err
+	}
+	return deleteBucketKeys(s, encodeScope(scoped))
+}
+
+// ResumeBucketDeletions deletes the keys of buckets whose deletion was
+// interrupted and returns how many buckets were processed
+func ResumeBucketDeletions(s *state.State) (int, error) {
+	encodedScopes := []string{}
+	err := s.DB.View(func(txn *badger.Txn) error {
+		opts := badger.DefaultIteratorOptions
+		opts.PrefetchValues = false
+		it := txn.NewIterator(opts)
+		defer it.Close()
+		prefix := []byte(bucketDeletionPrefix)
+		for it.Seek(prefix); it.ValidForPrefix(prefix); it.Next() {
+			encodedScopes = append(encodedScopes, strings.TrimPrefix(string(it.Item().Key()), bucketDeletionPrefix))
+		}
+		return nil
+	})
+	if err != nil {
+		return 0, err
+	}
+	for i, encodedScope := range encodedScopes {
+		err = deleteBucketKeys(s, encodedScope)
+		if err != nil {
+			return i, err
+		}
+	}
+	return len(encodedScopes), nil
+}
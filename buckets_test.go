@@ -0,0 +1,270 @@
+package main
+
+import (
+	"bytes"
+	"testing"
+
+	"github.com/dgraph-io/badger/v3"
+	"github.com/mguentner/passwordless/state"
+)
+
+func TestBuckets(t *testing.T) {
+	config := DefaultConfig()
+	config.StorageOptions.MaxBucketsPerAccount = 2
+	db, err := badger.Open(badger.DefaultOptions("").WithInMemory(true))
+	if err != nil {
+		t.Fatal(err)
+	}
+	appState := state.State{
+		DB: db,
+	}
+	_, err = CreateBucketForIdentifier(&appState, config, "alice@example.com", Bucket{Name: "notes"})
+	if err != nil {
+		t.Fatal(err)
+	}
+	_, err = CreateBucketForIdentifier(&appState, config, "alice@example.com", Bucket{Name: "notes"})
+	if _, ok := err.(*ErrBucketExists); !ok {
+		t.Errorf("Expected ErrBucketExists, got %v", err)
+	}
+	_, err = CreateBucketForIdentifier(&appState, config, "alice@example.com", Bucket{Name: DefaultBucket})
+	if _, ok := err.(*ErrBucketExists); !ok {
+		t.Errorf("Expected ErrBucketExists, got %v", err)
+	}
+	for _, name := range []string{"no/slash", ".", "..", "..."} {
+		_, err = CreateBucketForIdentifier(&appState, config, "alice@example.com", Bucket{Name: name})
+		if _, ok := err.(*ErrInvalidBucketName); !ok {
+			t.Errorf("Expected ErrInvalidBucketName for %s, got %v", name, err)
+		}
+	}
+	// the prefix of the bucket name must not matter
+	_, err = CreateBucketForIdentifier(&appState, config, "alice@example.com", Bucket{Name: "notes2"})
+	if err != nil {
+		t.Fatal(err)
+	}
+	_, err = CreateBucketForIdentifier(&appState, config, "alice@example.com", Bucket{Name: "photos"})
+	if _, ok := err.(*ErrBucketLimitReached); !ok {
+		t.Errorf("Expected ErrBucketLimitReached, got %v", err)
+	}
+
+	notes, err := scopedIdentifier("alice@example.com", "notes")
+	if err != nil {
+		t.Fatal(err)
+	}
+	notes2, err := scopedIdentifier("alice@example.com", "notes2")
+	if err != nil {
+		t.Fatal(err)
+	}
+	_, err = InsertKeyValueForIdentifier(&appState, config, "alice@example.com", "key", []byte("default"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	_, err = InsertKeyValueForIdentifier(&appState, config, notes, "key", []byte("notes"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	_, err = InsertKeyValueForIdentifier(&appState, config, notes2, "other", []byte("notes2"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	for identifier, expected := range map[string]string{"alice@example.com": "default", notes: "notes"} {
+		value, err := RetrieveValueIdentifierAndKey(&appState, identifier, "key")
+		if err != nil {
+			t.Fatal(err)
+		}
+		if string(value) != expected {
+			t.Errorf("Expected %s, got %s", expected, value)
+		}
+		keys, err := KeysForIdentifier(&appState, identifier)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if len(keys) != 1 {
+			t.Errorf("Expected one key in %s, got %v", expected, keys)
+		}
+	}
+	usage, err := AccountUsageForIdentifier(&appState, "alice@example.com")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if usage.Keys != 3 || usage.Bytes != 18 {
+		t.Errorf("Unexpected usage %+v", usage)
+	}
+	buckets, err := BucketsForIdentifier(&appState, "alice@example.com")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(buckets) != 3 || buckets[0].Name != DefaultBucket || buckets[1].Name != "notes" || buckets[1].Usage.Keys != 1 {
+		t.Errorf("Unexpected buckets %+v", buckets)
+	}
+
+	err = DeleteBucketForIdentifier(&appState, config, "alice@example.com", "notes")
+	if err != nil {
+		t.Fatal(err)
+	}
+	_, err = InsertKeyValueForIdentifier(&appState, config, notes, "key", []byte("notes"))
+	if _, ok := err.(*ErrBucketNotFound); !ok {
+		t.Errorf("Expected ErrBucketNotFound, got %v", err)
+	}
+	// a new bucket with the same name does not contain the old keys
+	_, err = CreateBucketForIdentifier(&appState, config, "alice@example.com", Bucket{Name: "notes"})
+	if err != nil {
+		t.Fatal(err)
+	}
+	keys, err := KeysForIdentifier(&appState, notes)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(keys) != 0 {
+		t.Errorf("Expected no keys, got %v", keys)
+	}
+	keys, err = KeysForIdentifier(&appState, notes2)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(keys) != 1 {
+		t.Errorf("Expected the other bucket to be untouched, got %v", keys)
+	}
+	err = DeleteBucketForIdentifier(&appState, config, "alice@example.com", DefaultBucket)
+	if _, ok := err.(*ErrInvalidBucketName); !ok {
+		t.Errorf("Expected ErrInvalidBucketName, got %v", err)
+	}
+}
+
+func TestBucketLimits(t *testing.T) {
+	config := DefaultConfig()
+	config.StorageOptions.MaxKeysPerAccount = 3
+	db, err := badger.Open(badger.DefaultOptions("").WithInMemory(true))
+	if err != nil {
+		t.Fatal(err)
+	}
+	appState := state.State{
+		DB: db,
+	}
+	_, err = CreateBucketForIdentifier(&appState, config, "alice@example.com", Bucket{Name: "small", MaxKeys: 1, MaxBytes: 5})
+	if err != nil {
+		t.Fatal(err)
+	}
+	small, err := scopedIdentifier("alice@example.com", "small")
+	if err != nil {
+		t.Fatal(err)
+	}
+	_, err = InsertKeyValueForIdentifier(&appState, config, small, "a", []byte("12345"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	_, err = InsertKeyValueForIdentifier(&appState, config, small, "b", []byte("1"))
+	if _, ok := err.(*ErrKeyLimitReached); !ok {
+		t.Errorf("Expected ErrKeyLimitReached, got %v", err)
+	}
+	_, err = InsertKeyValueForIdentifier(&appState, config, small, "a", []byte("123456"))
+	if _, ok := err.(*ErrQuotaExceeded); !ok {
+		t.Errorf("Expected ErrQuotaExceeded, got %v", err)
+	}
+	// the account limit counts the keys of all buckets
+	_, err = InsertKeyValueForIdentifier(&appState, config, "alice@example.com", "b", []byte("1"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	_, err = InsertKeyValueForIdentifier(&appState, config, "alice@example.com", "c", []byte("1"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	_, err = InsertKeyValueForIdentifier(&appState, config, "alice@example.com", "d", []byte("1"))
+	if _, ok := err.(*ErrKeyLimitReached); !ok {
+		t.Errorf("Expected ErrKeyLimitReached, got %v", err)
+	}
+}
+
+func TestDeleteBucketRemovesChunks(t *testing.T) {
+	config := DefaultConfig()
+	config.StorageOptions.ChunkSizeBytes = 4
+	db, err := badger.Open(badger.DefaultOptions("").WithInMemory(true))
+	if err != nil {
+		t.Fatal(err)
+	}
+	appState := state.State{
+		DB: db,
+	}
+	_, err = CreateBucketForIdentifier(&appState, config, "alice@example.com", Bucket{Name: "files"})
+	if err != nil {
+		t.Fatal(err)
+	}
+	files, err := scopedIdentifier("alice@example.com", "files")
+	if err != nil {
+		t.Fatal(err)
+	}
+	_, err = InsertKeyValueFromReader(&appState, config, files, "large", bytes.NewBufferString("0123456789"), InsertOptions{})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if chunks := countChunks(t, &appState, files); chunks != 3 {
+		t.Errorf("Expected 3 chunks, got %d", chunks)
+	}
+	err = DeleteBucketForIdentifier(&appState, config, "alice@example.com", "files")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if chunks := countChunks(t, &appState, files); chunks != 0 {
+		t.Errorf("Expected the chunks to be deleted with the bucket, got %d", chunks)
+	}
+}
+
+func TestResumeBucketDeletions(t *testing.T) {
+	config := DefaultConfig()
+	config.StorageOptions.ChunkSizeBytes = 4
+	db, err := badger.Open(badger.DefaultOptions("").WithInMemory(true))
+	if err != nil {
+		t.Fatal(err)
+	}
+	appState := state.State{
+		DB: db,
+	}
+	_, err = CreateBucketForIdentifier(&appState, config, "alice@example.com", Bucket{Name: "files"})
+	if err != nil {
+		t.Fatal(err)
+	}
+	files, err := scopedIdentifier("alice@example.com", "files")
+	if err != nil {
+		t.Fatal(err)
+	}
+	_, err = InsertKeyValueFromReader(&appState, config, files, "large", bytes.NewBufferString("0123456789"), InsertOptions{})
+	if err != nil {
+		t.Fatal(err)
+	}
+	// a deletion that was interrupted before the keys were deleted
+	err = db.Update(func(txn *badger.Txn) error {
+		err := txn.Delete([]byte(bucketKey("alice@example.com", "files")))
+		if err != nil {
+			return err
+		}
+		return txn.Set([]byte(bucketDeletionKey(files)), []byte{})
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	_, err = CreateBucketForIdentifier(&appState, config, "alice@example.com", Bucket{Name: "files"})
+	if _, ok := err.(*ErrBucketDeletionPending); !ok {
+		t.Errorf("Expected ErrBucketDeletionPending, got %v", err)
+	}
+	resumed, err := ResumeBucketDeletions(&appState)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if resumed != 1 {
+		t.Errorf("Expected one resumed deletion, got %d", resumed)
+	}
+	if chunks := countChunks(t, &appState, files); chunks != 0 {
+		t.Errorf("Expected the chunks to be deleted, got %d", chunks)
+	}
+	_, err = CreateBucketForIdentifier(&appState, config, "alice@example.com", Bucket{Name: "files"})
+	if err != nil {
+		t.Fatal(err)
+	}
+	keys, err := KeysForIdentifier(&appState, files)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(keys) != 0 {
+		t.Errorf("Expected the new bucket to be empty, got %v", keys)
+	}
+}
@@ -0,0 +1,187 @@
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"strconv"
+	"time"
+
+	"github.com/dgraph-io/badger/v3"
+	"github.com/mguentner/passwordless/state"
+)
+
+type ErrChangesExpired struct{}
+
+func (e *ErrChangesExpired) Error() string {
+	return "ChangesExpired"
+}
+
+const (
+	ChangePut          = "put"
+	ChangeDelete       = "delete"
+	ChangeDeleteBucket = "deleteBucket"
+)
+
+// maxChangesPerRequest bounds the changes returned at once
+const maxChangesPerRequest = 1000
+
+// Change is recorded for every put and delete of a key and for the
+// deletion of a bucket. The sequence numbers of an account have no gaps.
+type Change struct {
+	Sequence  uint64        `json:"sequence"`
+	Type      string        `json:"type"`
+	Bucket    string        `json:"bucket"`
+	Key       string        `json:"key,omitempty"`
+	Version   *ValueVersion `json:"version,omitempty"`
+	Timestamp time.Time     `json:"timestamp"`
+}
+
+type ChangeLog struct {
+	Changes []Change `json:"changes"`
+	// Cursor is the sequence of the last change, it is passed as since
+	// to continue
+	Cursor uint64 `json:"cursor"`
+	// More is set if there are changes after the cursor
+	More bool `json:"more"`
+}
+
+// sequenceKey is stored using the identifier of the account, the
+// sequence is shared by all buckets
+func sequenceKey(identifier string) string {
+	return fmt.Sprintf("%s-sequence", state.EncodeIdentifier(identifier))
+}
+
+func changePrefix(identifier string) string {
+	return fmt.Sprintf("%s-change-", state.EncodeIdentifier(identifier))
+}
+
+// changeKey is zero padded so that the changes are ordered
+func changeKey(identifier string, sequence uint64) string {
+	return fmt.Sprintf("%s%020d", changePrefix(identifier), sequence)
+}
+
+// sequenceForIdentifier returns the sequence of the last change, 0 if
+// nothing was changed yet
+func sequenceForIdentifier(identifier string, txn *badger.Txn) (uint64, error) {
+	item, err := txn.Get([]byte(sequenceKey(identifier)))
+	if err != nil {
+		if err == badger.ErrKeyNotFound {
+			return 0, nil
+		}
+		return 0, err
+	}
+	var sequence uint64
+	err = item.Value(func(v []byte) error {
+		sequence, err = strconv.ParseUint(string(v), 10, 64)
+		return err
+	})
+	return sequence, err
+}
+
+// recordChange assigns the next sequence of the account to the change.
+// All writes of an account read the sequence, so concurrent writes
+// conflict and have to be retried.
+func recordChange(config Config, identifier string, change Change, txn *badger.Txn) error {
+	identifier, change.Bucket = splitIdentifier(identifier)
+	sequence, err := sequenceForIdentifier(identifier, txn)
+	if err != nil {
+		return err
+	}
+	change.Sequence = sequence + 1
+	change.Timestamp = time.Now()
+	err = txn.Set([]byte(sequenceKey(identifier)), []byte(strconv.FormatUint(change.Sequence, 10)))
+	if err != nil {
+		return err
+	}
+	encodedChange, err := json.Marshal(change)
+	if err != nil {
+		return err
+	}
+	e := badger.NewEntry([]byte(changeKey(identifier, change.Sequence)), encodedChange)
+	if config.StorageOptions.ChangeRetentionSeconds > 0 {
+		retention := time.Duration(config.StorageOptions.ChangeRetentionSeconds) * time.Second
+		e.ExpiresAt = uint64(change.Timestamp.Add(retention).Unix())
+	}
+	err = txn.SetEntry(e)
+	if err != nil {
+		return err
+	}
+	err = enqueueWebhooks(config, identifier, change, txn)
+	if err != nil {
+		return err
+	}
+	changeNotifications.recorded(identifier, txn)
+	return nil
+}
+
+// changesSince returns ErrChangesExpired if a change after since is no
+// longer retained or since is ahead of the account, e.g. because the
+// account was deleted in the meantime
+func changesSince(identifier string, since uint64, limit int, txn *badger.Txn) (*ChangeLog, error) {
+	sequence, err := sequenceForIdentifier(identifier, txn)
+	if err != nil {
+		return nil, err
+	}
+	if since > sequence {
+		return nil, &ErrChangesExpired{}
+	}
+	changeLog := ChangeLog{
+		Changes: []Change{},
+		Cursor:  since,
+	}
+	prefix := []byte(changePrefix(identifier))
+	it := txn.NewIterator(badger.DefaultIteratorOptions)
+	defer it.Close()
+	for it.Seek([]byte(changeKey(identifier, since+1))); it.ValidForPrefix(prefix) && len(changeLog.Changes) < limit; it.Next() {
+		var change Change
+		err := it.Item().Value(func(v []byte) error {
+			return json.Unmarshal(v, &change)
+		})
+		if err != nil {
+			return nil, err
+		}
+		if change.Sequence != changeLog.Cursor+1 {
+			return nil, &ErrChangesExpired{}
+		}
+		changeLog.Changes = append(changeLog.Changes, change)
+		changeLog.Cursor = change.Sequence
+	}
+	if len(changeLog.Changes) == 0 && since < sequence {
+		return nil, &ErrChangesExpired{}
+	}
+	changeLog.More = changeLog.Cursor < sequence
+	return &changeLog, nil
+}
+
+// ChangesForIdentifier returns up to limit changes of all buckets after
+// since in the order they were made
+func ChangesForIdentifier(s *state.State, identifier string, since uint64, limit int) (ChangeLog, error) {
+	if limit <= 0 || limit > maxChangesPerRequest {
+		limit = maxChangesPerRequest
+	}
+	identifier, _ = splitIdentifier(identifier)
+	var changeLog ChangeLog
+	err := s.DB.View(func(txn *badger.Txn) error {
+		c, err := changesSince(identifier, since, limit, txn)
+		if err != nil {
+			return err
+		}
+		changeLog = *c
+		return nil
+	})
+	return changeLog, err
+}
+
+// CursorForIdentifier returns the sequence of the last change, clients
+// fetch it before listing all keys to continue with the changes
+// afterwards
+func CursorForIdentifier(s *state.State, identifier string) (uint64, error) {
+	identifier, _ = splitIdentifier(identifier)
+	var sequence uint64
+	err := s.DB.View(func(txn *badger.Txn) error {
+		var err error
+		sequence, err = sequenceForIdentifier(identifier, txn)
+		return err
+	})
+	return sequence, err
+}
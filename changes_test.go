@@ -0,0 +1,168 @@
+package main
+
+import (
+	"fmt"
+	"sync"
+	"testing"
+
+	"github.com/dgraph-io/badger/v3"
+	"github.com/mguentner/passwordless/state"
+)
+
+func TestChanges(t *testing.T) {
+	config := DefaultConfig()
+	config.StorageOptions.TrashRetentionSeconds = 3600
+	db, err := badger.Open(badger.DefaultOptions("").WithInMemory(true))
+	if err != nil {
+		t.Fatal(err)
+	}
+	appState := state.State{
+		DB: db,
+	}
+	cursor, err := CursorForIdentifier(&appState, "alice@example.com")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if cursor != 0 {
+		t.Errorf("Expected no changes, got cursor %d", cursor)
+	}
+	_, err = InsertKeyValueForIdentifier(&appState, config, "alice@example.com", "a", []byte("a"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	_, err = InsertKeyValueForIdentifier(&appState, config, "bob@example.com", "a", []byte("bob"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	_, err = ExecuteBatchForIdentifier(&appState, config, "alice@example.com", []BatchOperation{
+		{Op: BatchPut, Key: "b", Value: []byte("b")},
+		{Op: BatchDelete, Key: "a"},
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	_, err = RestoreTrashedKeyForIdentifier(&appState, config, "alice@example.com", "a")
+	if err != nil {
+		t.Fatal(err)
+	}
+	_, err = CreateBucketForIdentifier(&appState, config, "alice@example.com", Bucket{Name: "files"})
+	if err != nil {
+		t.Fatal(err)
+	}
+	files, err := scopedIdentifier("alice@example.com", "files")
+	if err != nil {
+		t.Fatal(err)
+	}
+	_, err = InsertKeyValueForIdentifier(&appState, config, files, "c", []byte("c"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	err = DeleteBucketForIdentifier(&appState, config, "alice@example.com", "files")
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	expected := []Change{
+		{Sequence: 1, Type: ChangePut, Bucket: DefaultBucket, Key: "a"},
+		{Sequence: 2, Type: ChangePut, Bucket: DefaultBucket, Key: "b"},
+		{Sequence: 3, Type: ChangeDelete, Bucket: DefaultBucket, Key: "a"},
+		{Sequence: 4, Type: ChangePut, Bucket: DefaultBucket, Key: "a"},
+		{Sequence: 5, Type: ChangePut, Bucket: "files", Key: "c"},
+		{Sequence: 6, Type: ChangeDeleteBucket, Bucket: "files"},
+	}
+	changeLog, err := ChangesForIdentifier(&appState, "alice@example.com", 0, 0)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(changeLog.Changes) != len(expected) || changeLog.Cursor != 6 || changeLog.More {
+		t.Fatalf("Unexpected changes %+v", changeLog)
+	}
+	for i, change := range changeLog.Changes {
+		e := expected[i]
+		if change.Sequence != e.Sequence || change.Type != e.Type || change.Bucket != e.Bucket || change.Key != e.Key {
+			t.Errorf("Expected %+v, got %+v", e, change)
+		}
+		if (change.Type == ChangePut) != (change.Version != nil) {
+			t.Errorf("Expected a version only for puts, got %+v", change)
+		}
+	}
+
+	// paging
+	changeLog, err = ChangesForIdentifier(&appState, "alice@example.com", 2, 3)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(changeLog.Changes) != 3 || changeLog.Changes[0].Sequence != 3 || changeLog.Cursor != 5 || !changeLog.More {
+		t.Errorf("Unexpected page %+v", changeLog)
+	}
+	changeLog, err = ChangesForIdentifier(&appState, "alice@example.com", 6, 0)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(changeLog.Changes) != 0 || changeLog.Cursor != 6 || changeLog.More {
+		t.Errorf("Expected no more changes, got %+v", changeLog)
+	}
+	_, err = ChangesForIdentifier(&appState, "alice@example.com", 7, 0)
+	if _, ok := err.(*ErrChangesExpired); !ok {
+		t.Errorf("Expected ErrChangesExpired for a cursor ahead of the account, got %v", err)
+	}
+
+	// changes that are no longer retained can not be skipped
+	err = appState.DB.Update(func(txn *badger.Txn) error {
+		return txn.Delete([]byte(changeKey("alice@example.com", 1)))
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	_, err = ChangesForIdentifier(&appState, "alice@example.com", 0, 0)
+	if _, ok := err.(*ErrChangesExpired); !ok {
+		t.Errorf("Expected ErrChangesExpired, got %v", err)
+	}
+	_, err = ChangesForIdentifier(&appState, "alice@example.com", 1, 0)
+	if err != nil {
+		t.Errorf("Expected the changes after 1 to be retained, got %v", err)
+	}
+}
+
+func TestChangesConcurrent(t *testing.T) {
+	config := DefaultConfig()
+	db, err := badger.Open(badger.DefaultOptions("").WithInMemory(true))
+	if err != nil {
+		t.Fatal(err)
+	}
+	appState := state.State{
+		DB: db,
+	}
+	// all writes of an account conflict on the sequence
+	var wg sync.WaitGroup
+	errs := make(chan error, 10)
+	for i := 0; i < 10; i++ {
+		wg.Add(1)
+		go func(i int) {
+			defer wg.Done()
+			_, err := InsertKeyValueForIdentifier(&appState, config, "alice@example.com", fmt.Sprintf("key%d", i), []byte("value"))
+			errs <- err
+		}(i)
+	}
+	wg.Wait()
+	close(errs)
+	for err := range errs {
+		if err != nil {
+			t.Fatal(err)
+		}
+	}
+	changeLog, err := ChangesForIdentifier(&appState, "alice@example.com", 0, 0)
+	if err != nil {
+		t.Fatal(err)
+	}
+	keys := map[string]bool{}
+	for i, change := range changeLog.Changes {
+		if change.Sequence != uint64(i+1) {
+			t.Errorf("Expected sequence %d, got %d", i+1, change.Sequence)
+		}
+		keys[change.Key] = true
+	}
+	if len(keys) != 10 {
+		t.Errorf("Expected a change for every key, got %+v", changeLog.Changes)
+	}
+}
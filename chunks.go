@@ -0,0 +1,547 @@
+package main
+
+import (
+	"bufio"
+	"crypto/rand"
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"io/ioutil"
+
+	"github.com/dgraph-io/badger/v3"
+	"github.com/mguentner/passwordless/state"
+)
+
+// chunkedValue is set as the user meta of entries that contain a
+// chunkManifest instead of the value itself
+const chunkedValue byte = 1 << 0
+
+// chunkManifest references the chunks of a value that is too large to
+// be stored in a single entry
+type chunkManifest struct {
+	ID        string `json:"id"`
+	Size      uint64 `json:"size"`
+	ChunkSize uint64 `json:"chunkSize"`
+	// sizes of the stored chunks if they are compressed, Size and
+	// ChunkSize refer to the decompressed value
+	CompressedSizes []uint64 `json:"compressedSizes,omitempty"`
+}
+
+func (m chunkManifest) chunks() uint64 {
+	return (m.Size + m.ChunkSize - 1) / m.ChunkSize
+}
+
+// chunkKey is zero padded so that the chunks of a value are ordered
+func chunkKey(identifier string, id string, index uint64) string {
+	return chunkKeyForScope(encodeScope(identifier), id, index)
+}
+
+func chunkKeyForScope(encodedScope string, id string, index uint64) string {
+	return fmt.Sprintf("%s-chunk-%s-%020d", encodedScope, id, index)
+}
+
+func newChunkID() (string, error) {
+	id := make([]byte, 16)
+	_, err := rand.Read(id)
+	if err != nil {
+		return "", err
+	}
+	return hex.EncodeToString(id), nil
+}
+
+// pendingUploadPrefix marks chunked values whose manifest is not committed
+// yet, it contains `-` so it never collides with the keys of an account
+const pendingUploadPrefix = "pendingupload-"
+
+// pendingUploadKey stores the encoded scope of the chunks, so they can be
+// removed if the process stops before the value is committed
+func pendingUploadKey(id string) string {
+	return pendingUploadPrefix + id
+}
+
+// manifestForItem returns nil if the item contains the value itself
+func manifestForItem(item *badger.Item) (*chunkManifest, error) {
+	if item.UserMeta()&chunkedValue == 0 {
+		return nil, nil
+	}
+	var manifest chunkManifest
+	err := item.Value(func(v []byte) error {
+		return json.Unmarshal(v, &manifest)
+	})
+	if err != nil {
+		return nil, err
+	}
+	return &manifest, nil
+}
+
+// manifestsForKey returns the manifests referenced by the current value
+// and the retained versions of a key. Restoring a version lets several
+// versions reference the same chunks.
+func manifestsForKey(identifier string, key string, metadata *valueMetadata, txn *badger.Txn) (map[string]chunkManifest, error) {
+	manifests := map[string]chunkManifest{}
+	if metadata == nil {
+		return manifests, nil
+	}
+	entryKeys := []string{fullKey(identifier, key)}
+	for _, previous := range metadata.History {
+		entryKeys = append(entryKeys, versionKey(identifier, key, previous.Version))
+	}
+	for _, entryKey := range entryKeys {
+		item, err := txn.Get([]byte(entryKey))
+		if err == badger.ErrKeyNotFound {
+			continue
+		}
+		if err != nil {
+			return nil, err
+		}
+		manifest, err := manifestForItem(item)
+		if err != nil {
+			return nil, err
+		}
+		if manifest != nil {
+			manifests[manifest.ID] = *manifest
+		}
+	}
+	return manifests, nil
+}
+
+// releaseChunks deletes the chunks of all manifests that were referenced
+// before but are not referenced anymore
+func releaseChunks(identifier string, before map[string]chunkManifest, after map[string]chunkManifest, txn *badger.Txn) error {
+	for id, manifest := range before {
+		if _, ok := after[id]; ok {
+			continue
+		}
+		err := deleteChunks(encodeScope(identifier), manifest, txn)
+		if err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+func deleteChunks(encodedScope string, manifest chunkManifest, txn *badger.Txn) error {
+	for index := uint64(0); index < manifest.chunks(); index++ {
+		err := txn.Delete([]byte(chunkKeyForScope(encodedScope, manifest.ID, index)))
+		if err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// removeChunks deletes the chunks of a value that was never committed
+func removeChunks(s *state.State, identifier string, manifest chunkManifest) error {
+	batch := s.DB.NewWriteBatch()
+	defer batch.Cancel()
+	for index := uint64(0); index < manifest.chunks(); index++ {
+		err := batch.Delete([]byte(chunkKey(identifier, manifest.ID, index)))
+		if err != nil {
+			return err
+		}
+	}
+	err := batch.Delete([]byte(pendingUploadKey(manifest.ID)))
+	if err != nil {
+		return err
+	}
+	return batch.Flush()
+}
+
+// RemovePendingUploads deletes the chunks of values that were still being
+// written when the process stopped. It has to run before any value is
+// inserted.
+func RemovePendingUploads(s *state.State) (int, error) {
+	pending := map[string]string{}
+	prefix := []byte(pendingUploadPrefix)
+	err := s.DB.View(func(txn *badger.Txn) error {
+		it := txn.NewIterator(badger.DefaultIteratorOptions)
+		defer it.Close()
+		for it.Seek(prefix); it.ValidForPrefix(prefix); it.Next() {
+			encodedScope, err := it.Item().ValueCopy(nil)
+			if err != nil {
+				return err
+			}
+			pending[string(it.Item().Key()[len(prefix):])] = string(encodedScope)
+		}
+		return nil
+	})
+	if err != nil {
+		return 0, err
+	}
+	for id, encodedScope := range pending {
+		err = deleteKeysWithPrefix(s, []byte(fmt.Sprintf("%s-chunk-%s-", encodedScope, id)))
+		if err != nil {
+			return 0, err
+		}
+		err = s.DB.Update(func(txn *badger.Txn) error {
+			return txn.Delete([]byte(pendingUploadKey(id)))
+		})
+		if err != nil {
+			return 0, err
+		}
+	}
+	return len(pending), nil
+}
+
+// ValueReader reads a value chunk by chunk, so only a single chunk is
+// held in memory. The reader needs to be closed to release the
+// underlying transaction.
+type ValueReader struct {
+	txn        *badger.Txn
+	identifier string
+	// nil for values that are not chunked
+	manifest *chunkManifest
+	size     int64
+	offset   int64
+	chunk    []byte
+	index    uint64
+	// empty if the value is stored verbatim
+	compression string
+	// the stored bytes of a compressed value or chunk
+	raw []byte
+}
+
+func newValueReader(identifier string, item *badger.Item, txn *badger.Txn) (*ValueReader, error) {
+	reader := ValueReader{
+		txn:         txn,
+		identifier:  identifier,
+		compression: compressionForUserMeta(item.UserMeta()),
+	}
+	manifest, err := manifestForItem(item)
+	if err != nil {
+		return nil, err
+	}
+	if manifest != nil {
+		reader.manifest = manifest
+		reader.size = int64(manifest.Size)
+		return &reader, nil
+	}
+	reader.chunk, err = item.ValueCopy(nil)
+	if err != nil {
+		return nil, err
+	}
+	if len(reader.compression) > 0 {
+		reader.raw = reader.chunk
+		reader.chunk, err = decompress(reader.compression, reader.raw, nil)
+		if err != nil {
+			return nil, err
+		}
+	}
+	reader.size = int64(len(reader.chunk))
+	return &reader, nil
+}
+
+func (r *ValueReader) Size() int64 {
+	return r.size
+}
+
+// Compression returns the algorithm the value is stored with, an empty
+// string if it is stored verbatim
+func (r *ValueReader) Compression() string {
+	return r.compression
+}
+
+// Encoded returns a reader for the compressed value as it is stored, so
+// it can be sent to clients that accept the encoding. It shares the
+// transaction of r and is only valid until r is closed.
+func (r *ValueReader) Encoded() (io.ReadSeeker, int64) {
+	reader := newEncodedReader(r)
+	return reader, reader.Size()
+}
+
+func (r *ValueReader) Read(p []byte) (int, error) {
+	if r.offset >= r.size {
+		return 0, io.EOF
+	}
+	chunkStart := int64(0)
+	if r.manifest != nil {
+		index := uint64(r.offset) / r.manifest.ChunkSize
+		if r.chunk == nil || index != r.index {
+			item, err := r.txn.Get([]byte(chunkKey(r.identifier, r.manifest.ID, index)))
+			if err != nil {
+				return 0, err
+			}
+			if len(r.compression) > 0 {
+				r.raw, err = item.ValueCopy(r.raw[:0])
+				if err != nil {
+					return 0, err
+				}
+				r.chunk, err = decompress(r.compression, r.raw, r.chunk[:0])
+			} else {
+				r.chunk, err = item.ValueCopy(r.chunk[:0])
+			}
+			if err != nil {
+				return 0, err
+			}
+			r.index = index
+		}
+		chunkStart = int64(index * r.manifest.ChunkSize)
+	}
+	n := copy(p, r.chunk[r.offset-chunkStart:])
+	r.offset += int64(n)
+	return n, nil
+}
+
+// Seek only moves the offset, the chunk containing it is read by the
+// next call to Read
+func (r *ValueReader) Seek(offset int64, whence int) (int64, error) {
+	switch whence {
+	case io.SeekStart:
+	case io.SeekCurrent:
+		offset += r.offset
+	case io.SeekEnd:
+		offset += r.size
+	default:
+		return 0, errors.New("ValueReader.Seek: invalid whence")
+	}
+	if offset < 0 {
+		return 0, errors.New("ValueReader.Seek: negative position")
+	}
+	r.offset = offset
+	return offset, nil
+}
+
+func (r *ValueReader) Close() error {
+	r.txn.Discard()
+	return nil
+}
+
+// readValue reads a whole value into memory
+func readValue(identifier string, item *badger.Item, txn *badger.Txn) ([]byte, error) {
+	reader, err := newValueReader(identifier, item, txn)
+	if err != nil {
+		return nil, err
+	}
+	return ioutil.ReadAll(reader)
+}
+
+// OpenVersionForIdentifierAndKey opens the current value if version is 0
+func OpenVersionForIdentifierAndKey(s *state.State, identifier string, key string, version uint64) (*ValueReader, ValueVersion, error) {
+	return openVersion(identifier, key, version, s.DB.NewTransaction(false))
+}
+
+// openVersion discards txn if the version can not be opened
+func openVersion(identifier string, key string, version uint64, txn *badger.Txn) (*ValueReader, ValueVersion, error) {
+	item, valueVersion, err := itemForVersion(identifier, key, version, txn)
+	if err != nil {
+		txn.Discard()
+		return nil, ValueVersion{}, err
+	}
+	reader, err := newValueReader(identifier, item, txn)
+	if err != nil {
+		txn.Discard()
+		return nil, ValueVersion{}, err
+	}
+	return reader, *valueVersion, nil
+}
+
+// maxSizeForLimits returns the largest size a value of the key can have
+// without exceeding the byte limits, 0 if there is no byte limit. The
+// value can at most release the usage of all versions of the key, so the
+// size is an upper bound and insertKeyValue applies the limits exactly.
+func maxSizeForLimits(config Config, bucket *Bucket, key string, metadata *valueMetadata, usage limitUsage) (uint64, error) {
+	type limit struct {
+		usage    Usage
+		maxKeys  uint64
+		maxBytes uint64
+	}
+	limits := []limit{{usage.account, config.StorageOptions.MaxKeysPerAccount, config.StorageOptions.MaxBytesPerAccount}}
+	if bucket != nil {
+		limits = append(limits, limit{usage.bucket, bucket.MaxKeys, bucket.MaxBytes})
+	}
+	released := uint64(0)
+	for _, piece := range usagePiecesForKey(key, metadata) {
+		released += piece.usage.Bytes
+	}
+	maxSize := uint64(0)
+	for _, limit := range limits {
+		if limit.maxKeys > 0 && metadata == nil && limit.usage.Keys >= limit.maxKeys {
+			return 0, &ErrKeyLimitReached{}
+		}
+		if limit.maxBytes == 0 {
+			continue
+		}
+		if limit.usage.Bytes >= limit.maxBytes+released {
+			return 0, &ErrQuotaExceeded{}
+		}
+		remaining := limit.maxBytes + released - limit.usage.Bytes
+		if maxSize == 0 || remaining < maxSize {
+			maxSize = remaining
+		}
+	}
+	return maxSize, nil
+}
+
+// checkStreamedInsert rejects a value before it is read if it could not be
+// stored anyway and returns the result of maxSizeForLimits. The key and
+// the usage can change while the value is read, they are checked again
+// when it is committed.
+func checkStreamedInsert(s *state.State, config Config, identifier string, key string, options InsertOptions) (uint64, error) {
+	maxSize := uint64(0)
+	err := s.DB.View(func(txn *badger.Txn) error {
+		metadata, bucket, err := checkInsert(config, identifier, key, expiresAtForTTL(config, options.TTL), options, txn)
+		if err != nil || options.deferLimits {
+			return err
+		}
+		usage, err := limitUsageForIdentifier(identifier, txn)
+		if err != nil {
+			return err
+		}
+		maxSize, err = maxSizeForLimits(config, bucket, key, metadata, usage)
+		return err
+	})
+	return maxSize, err
+}
+
+// InsertKeyValueFromReader stores values larger than chunkSizeBytes in
+// chunks, so they are never held in memory as a whole. The chunks are
+// written before the manifest is committed together with the metadata,
+// so readers either see the previous or the new value. The key and the
+// limits are checked before the value is read, which stops reading once
+// the value can not fit anymore.
+func InsertKeyValueFromReader(s *state.State, config Config, identifier string, key string, reader io.Reader, options InsertOptions) (ValueVersion, error) {
+	chunkSize := config.StorageOptions.ChunkSizeBytes
+	maxSize := config.StorageOptions.MaxValueSizeBytes
+	if chunkSize == 0 {
+		maxSizeForLimits, err := checkStreamedInsert(s, config, identifier, key, options)
+		if err != nil {
+			return ValueVersion{}, err
+		}
+		if maxSizeForLimits > 0 && (maxSize == 0 || maxSizeForLimits < maxSize) {
+			maxSize = maxSizeForLimits
+		}
+		if maxSize > 0 {
+			// reading a single byte more is enough to reject the value
+			reader = io.LimitReader(reader, int64(maxSize)+1)
+		}
+		value, err := ioutil.ReadAll(reader)
+		if err != nil {
+			return ValueVersion{}, err
+		}
+		return InsertKeyValueWithOptions(s, config, identifier, key, value, options)
+	}
+	bufferedReader := bufio.NewReaderSize(reader, int(chunkSize)+1)
+	peeked, err := bufferedReader.Peek(int(chunkSize) + 1)
+	if err != nil && err != io.EOF {
+		return ValueVersion{}, err
+	}
+	if uint64(len(peeked)) <= chunkSize {
+		value := append([]byte{}, peeked...)
+		return InsertKeyValueWithOptions(s, config, identifier, key, value, options)
+	}
+	maxSizeForLimits, err := checkStreamedInsert(s, config, identifier, key, options)
+	if err != nil {
+		return ValueVersion{}, err
+	}
+
+	id, err := newChunkID()
+	if err != nil {
+		return ValueVersion{}, err
+	}
+	manifest := chunkManifest{
+		ID:        id,
+		ChunkSize: chunkSize,
+	}
+	// chunks are only removed on failures while the process runs, the
+	// marker lets RemovePendingUploads find them after a crash
+	err = s.DB.Update(func(txn *badger.Txn) error {
+		return txn.Set([]byte(pendingUploadKey(id)), []byte(encodeScope(identifier)))
+	})
+	if err != nil {
+		return ValueVersion{}, err
+	}
+	// the chunks expire together with the manifest
+	expiresAt := expiresAtForTTL(config, options.TTL)
+	// compression is only used if the first chunk gets smaller
+	compression := config.StorageOptions.Compression
+	if len(options.ContentEncoding) > 0 {
+		compression = ""
+	}
+	hash := sha256.New()
+	batch := s.DB.NewWriteBatch()
+	defer batch.Cancel()
+	buf := make([]byte, chunkSize)
+	for index := uint64(0); ; index++ {
+		n, err := io.ReadFull(bufferedReader, buf)
+		if n > 0 {
+			manifest.Size += uint64(n)
+			if maxSize > 0 && manifest.Size > maxSize {
+				batch.Cancel()
+				removeChunks(s, identifier, manifest)
+				return ValueVersion{}, &ErrDataTooBig{}
+			}
+			if maxSizeForLimits > 0 && manifest.Size > maxSizeForLimits {
+				batch.Cancel()
+				removeChunks(s, identifier, manifest)
+				return ValueVersion{}, &ErrQuotaExceeded{}
+			}
+			hash.Write(buf[:n])
+			chunk := append([]byte{}, buf[:n]...)
+			if len(compression) > 0 {
+				compressed, compressErr := compress(compression, chunk)
+				if compressErr != nil {
+					batch.Cancel()
+					removeChunks(s, identifier, manifest)
+					return ValueVersion{}, compressErr
+				}
+				if index == 0 && len(compressed) >= len(chunk) {
+					compression = ""
+				} else {
+					chunk = compressed
+					manifest.CompressedSizes = append(manifest.CompressedSizes, uint64(len(chunk)))
+				}
+			}
+			e := badger.NewEntry([]byte(chunkKey(identifier, id, index)), chunk)
+			e.ExpiresAt = expiresAt
+			setErr := batch.SetEntry(e)
+			if setErr != nil {
+				batch.Cancel()
+				removeChunks(s, identifier, manifest)
+				return ValueVersion{}, setErr
+			}
+		}
+		if err == io.EOF || err == io.ErrUnexpectedEOF {
+			break
+		}
+		if err != nil {
+			batch.Cancel()
+			removeChunks(s, identifier, manifest)
+			return ValueVersion{}, err
+		}
+	}
+	err = batch.Flush()
+	if err != nil {
+		removeChunks(s, identifier, manifest)
+		return ValueVersion{}, err
+	}
+
+	encodedManifest, err := json.Marshal(manifest)
+	if err != nil {
+		removeChunks(s, identifier, manifest)
+		return ValueVersion{}, err
+	}
+	value := storedValue{
+		entry:     encodedManifest,
+		userMeta:  chunkedValue | compressionFlag(compression),
+		size:      manifest.Size,
+		etag:      hex.EncodeToString(hash.Sum(nil)),
+		expiresAt: expiresAt,
+	}
+	var version ValueVersion
+	err = updateRetryingConflicts(s, func(txn *badger.Txn) error {
+		v, err := insertKeyValue(config, identifier, key, value, options, txn)
+		if err != nil {
+			return err
+		}
+		version = *v
+		return txn.Delete([]byte(pendingUploadKey(id)))
+	})
+	if err != nil {
+		removeChunks(s, identifier, manifest)
+		return ValueVersion{}, err
+	}
+	return version, nil
+}
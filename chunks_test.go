@@ -0,0 +1,267 @@
+package main
+
+import (
+	"bytes"
+	"fmt"
+	"io/ioutil"
+	"testing"
+
+	"github.com/dgraph-io/badger/v3"
+	"github.com/mguentner/passwordless/state"
+)
+
+func countChunks(t *testing.T, s *state.State, identifier string) int {
+	count := 0
+	prefix := []byte(fmt.Sprintf("%s-chunk-", encodeScope(identifier)))
+	err := s.DB.View(func(txn *badger.Txn) error {
+		opts := badger.DefaultIteratorOptions
+		opts.PrefetchValues = false
+		it := txn.NewIterator(opts)
+		defer it.Close()
+		for it.Seek(prefix); it.ValidForPrefix(prefix); it.Next() {
+			count++
+		}
+		return nil
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	return count
+}
+
+func readCurrentValue(t *testing.T, s *state.State, identifier string, key string) []byte {
+	reader, _, err := OpenVersionForIdentifierAndKey(s, identifier, key, 0)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer reader.Close()
+	value, err := ioutil.ReadAll(reader)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return value
+}
+
+// endlessReader counts the bytes read from a value that never ends
+type endlessReader struct {
+	read int
+}
+
+func (r *endlessReader) Read(p []byte) (int, error) {
+	r.read += len(p)
+	return len(p), nil
+}
+
+func TestChunkedValue(t *testing.T) {
+	config := DefaultConfig()
+	config.StorageOptions.ChunkSizeBytes = 4
+	config.StorageOptions.MaxVersionsPerKey = 1
+	db, err := badger.Open(badger.DefaultOptions("").WithInMemory(true))
+	if err != nil {
+		t.Fatal(err)
+	}
+	appState := state.State{
+		DB: db,
+	}
+	_, err = InsertKeyValueFromReader(&appState, config, "alice@example.com", "small", bytes.NewBufferString("tiny"), InsertOptions{})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if chunks := countChunks(t, &appState, "alice@example.com"); chunks != 0 {
+		t.Errorf("Expected no chunks for a small value, got %d", chunks)
+	}
+
+	first := []byte("0123456789")
+	version, err := InsertKeyValueFromReader(&appState, config, "alice@example.com", "archive", bytes.NewBuffer(first), InsertOptions{})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if version.Size != 10 || version.ETag != etagForValue(first) {
+		t.Errorf("Unexpected version %+v", version)
+	}
+	if chunks := countChunks(t, &appState, "alice@example.com"); chunks != 3 {
+		t.Errorf("Expected 3 chunks, got %d", chunks)
+	}
+	if value := readCurrentValue(t, &appState, "alice@example.com", "archive"); !bytes.Equal(value, first) {
+		t.Errorf("Expected %s, got %s", first, value)
+	}
+	value, err := RetrieveValueIdentifierAndKey(&appState, "alice@example.com", "archive")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !bytes.Equal(value, first) {
+		t.Errorf("Expected %s, got %s", first, value)
+	}
+	usage, err := UsageForIdentifier(&appState, "alice@example.com")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if usage.Bytes != 14 {
+		t.Errorf("Expected 14 bytes, got %d", usage.Bytes)
+	}
+
+	// the previous version keeps its chunks
+	second := []byte("abcdefgh")
+	_, err = InsertKeyValueFromReader(&appState, config, "alice@example.com", "archive", bytes.NewBuffer(second), InsertOptions{})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if chunks := countChunks(t, &appState, "alice@example.com"); chunks != 5 {
+		t.Errorf("Expected 5 chunks, got %d", chunks)
+	}
+	previous, _, err := RetrieveVersionForIdentifierAndKey(&appState, "alice@example.com", "archive", 1)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !bytes.Equal(previous, first) {
+		t.Errorf("Expected %s, got %s", first, previous)
+	}
+
+	// the restored version shares the chunks of the first version, the
+	// chunks of the second version are still referenced by the history
+	err = RestoreVersionForIdentifierAndKey(&appState, config, "alice@example.com", "archive", 1)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if chunks := countChunks(t, &appState, "alice@example.com"); chunks != 5 {
+		t.Errorf("Expected 5 chunks, got %d", chunks)
+	}
+	if value := readCurrentValue(t, &appState, "alice@example.com", "archive"); !bytes.Equal(value, first) {
+		t.Errorf("Expected %s, got %s", first, value)
+	}
+
+	// replacing with a small value drops the chunks of the second version
+	_, err = InsertKeyValueFromReader(&appState, config, "alice@example.com", "archive", bytes.NewBufferString("abc"), InsertOptions{})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if chunks := countChunks(t, &appState, "alice@example.com"); chunks != 3 {
+		t.Errorf("Expected 3 chunks, got %d", chunks)
+	}
+
+	err = DeleteKeyValueForIdentifier(&appState, config, "alice@example.com", "archive")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if chunks := countChunks(t, &appState, "alice@example.com"); chunks != 0 {
+		t.Errorf("Expected no chunks after delete, got %d", chunks)
+	}
+}
+
+func TestChunkedValueRejected(t *testing.T) {
+	config := DefaultConfig()
+	config.StorageOptions.ChunkSizeBytes = 4
+	config.StorageOptions.MaxValueSizeBytes = 10
+	config.StorageOptions.MaxBytesPerAccount = 8
+	db, err := badger.Open(badger.DefaultOptions("").WithInMemory(true))
+	if err != nil {
+		t.Fatal(err)
+	}
+	appState := state.State{
+		DB: db,
+	}
+	_, err = InsertKeyValueFromReader(&appState, config, "alice@example.com", "archive", bytes.NewBufferString("0123456789a"), InsertOptions{})
+	if _, ok := err.(*ErrDataTooBig); !ok {
+		t.Errorf("Expected ErrDataTooBig, got %v", err)
+	}
+	_, err = InsertKeyValueFromReader(&appState, config, "alice@example.com", "archive", bytes.NewBufferString("0123456789"), InsertOptions{})
+	if _, ok := err.(*ErrQuotaExceeded); !ok {
+		t.Errorf("Expected ErrQuotaExceeded, got %v", err)
+	}
+	if chunks := countChunks(t, &appState, "alice@example.com"); chunks != 0 {
+		t.Errorf("Expected rejected values to leave no chunks, got %d", chunks)
+	}
+	_, err = RetrieveValueIdentifierAndKey(&appState, "alice@example.com", "archive")
+	if _, ok := err.(*ErrKeyNotFound); !ok {
+		t.Errorf("Expected ErrKeyNotFound, got %v", err)
+	}
+}
+
+func TestChunkedValueCheckedFirst(t *testing.T) {
+	config := DefaultConfig()
+	config.StorageOptions.ChunkSizeBytes = 16
+	config.StorageOptions.MaxBytesPerAccount = 64
+	db, err := badger.Open(badger.DefaultOptions("").WithInMemory(true))
+	if err != nil {
+		t.Fatal(err)
+	}
+	appState := state.State{
+		DB: db,
+	}
+	_, err = InsertKeyValueForIdentifier(&appState, config, "alice@example.com", "existing", []byte("value"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	reader := &endlessReader{}
+	_, err = InsertKeyValueFromReader(&appState, config, "alice@example.com", "existing", reader, InsertOptions{CreateOnly: true})
+	if _, ok := err.(*ErrKeyExists); !ok {
+		t.Errorf("Expected ErrKeyExists, got %v", err)
+	}
+	if reader.read > 17 {
+		t.Errorf("Expected only the first chunk to be read, got %d bytes", reader.read)
+	}
+	reader = &endlessReader{}
+	_, err = InsertKeyValueFromReader(&appState, config, "alice@example.com", "endless", reader, InsertOptions{})
+	if _, ok := err.(*ErrQuotaExceeded); !ok {
+		t.Errorf("Expected ErrQuotaExceeded, got %v", err)
+	}
+	if reader.read > 128 {
+		t.Errorf("Expected reading to stop at the quota, got %d bytes", reader.read)
+	}
+	if chunks := countChunks(t, &appState, "alice@example.com"); chunks != 0 {
+		t.Errorf("Expected rejected values to leave no chunks, got %d", chunks)
+	}
+}
+
+func TestRemovePendingUploads(t *testing.T) {
+	config := DefaultConfig()
+	config.StorageOptions.ChunkSizeBytes = 4
+	db, err := badger.Open(badger.DefaultOptions("").WithInMemory(true))
+	if err != nil {
+		t.Fatal(err)
+	}
+	appState := state.State{
+		DB: db,
+	}
+	_, err = InsertKeyValueFromReader(&appState, config, "alice@example.com", "committed", bytes.NewBufferString("0123456789"), InsertOptions{})
+	if err != nil {
+		t.Fatal(err)
+	}
+	// the chunks of a value the process was writing when it stopped
+	err = db.Update(func(txn *badger.Txn) error {
+		err := txn.Set([]byte(pendingUploadKey("interrupted")), []byte(encodeScope("alice@example.com")))
+		if err != nil {
+			return err
+		}
+		for index := uint64(0); index < 2; index++ {
+			err = txn.Set([]byte(chunkKey("alice@example.com", "interrupted", index)), []byte("0123"))
+			if err != nil {
+				return err
+			}
+		}
+		return nil
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	removed, err := RemovePendingUploads(&appState)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if removed != 1 {
+		t.Errorf("Expected 1 pending upload, got %d", removed)
+	}
+	if chunks := countChunks(t, &appState, "alice@example.com"); chunks != 3 {
+		t.Errorf("Expected only the chunks of the committed value, got %d", chunks)
+	}
+	if value := readCurrentValue(t, &appState, "alice@example.com", "committed"); string(value) != "0123456789" {
+		t.Errorf("Unexpected value %s", value)
+	}
+	removed, err = RemovePendingUploads(&appState)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if removed != 0 {
+		t.Errorf("Expected no pending uploads, got %d", removed)
+	}
+}
@@ -0,0 +1,211 @@
+package main
+
+import (
+	"bytes"
+	"compress/gzip"
+	"errors"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"sort"
+	"strconv"
+	"strings"
+
+	"github.com/klauspost/compress/zstd"
+)
+
+// Algorithms that can be configured as StorageOptions.Compression, the
+// names are used as the Content-Encoding of compressed responses
+const (
+	CompressionGzip = "gzip"
+	CompressionZstd = "zstd"
+)
+
+// The user meta of compressed entries has one of these bits set. The
+// chunks of a chunked value are compressed one by one using the algorithm
+// set on the entry of the manifest.
+const (
+	gzipCompressed byte = 1 << 1
+	zstdCompressed byte = 1 << 2
+)
+
+// the encoder and the decoder can be used concurrently
+var (
+	zstdEncoder, _ = zstd.NewWriter(nil)
+	zstdDecoder, _ = zstd.NewReader(nil)
+)
+
+func validateCompression(compression string) error {
+	switch compression {
+	case "", CompressionGzip, CompressionZstd:
+		return nil
+	}
+	return fmt.Errorf("unknown compression %s", compression)
+}
+
+func compressionFlag(compression string) byte {
+	switch compression {
+	case CompressionGzip:
+		return gzipCompressed
+	case CompressionZstd:
+		return zstdCompressed
+	}
+	return 0
+}
+
+// compressionForUserMeta returns an empty string for values that are
+// stored verbatim
+func compressionForUserMeta(userMeta byte) string {
+	if userMeta&gzipCompressed != 0 {
+		return CompressionGzip
+	}
+	if userMeta&zstdCompressed != 0 {
+		return CompressionZstd
+	}
+	return ""
+}
+
+func compress(compression string, value []byte) ([]byte, error) {
+	switch compression {
+	case CompressionGzip:
+		var buf bytes.Buffer
+		writer := gzip.NewWriter(&buf)
+		_, err := writer.Write(value)
+		if err != nil {
+			return nil, err
+		}
+		err = writer.Close()
+		if err != nil {
+			return nil, err
+		}
+		return buf.Bytes(), nil
+	case CompressionZstd:
+		return zstdEncoder.EncodeAll(value, nil), nil
+	}
+	return nil, errors.New("compress: no compression")
+}
+
+// decompress appends the decompressed value to dst
+func decompress(compression string, value []byte, dst []byte) ([]byte, error) {
+	switch compression {
+	case CompressionGzip:
+		reader, err := gzip.NewReader(bytes.NewReader(value))
+		if err != nil {
+			return nil, err
+		}
+		defer reader.Close()
+		decompressed, err := ioutil.ReadAll(reader)
+		if err != nil {
+			return nil, err
+		}
+		return append(dst, decompressed...), nil
+	case CompressionZstd:
+		return zstdDecoder.DecodeAll(value, dst)
+	}
+	return append(dst, value...), nil
+}
+
+// compressValue compresses values that are stored in a single entry.
+// Values the client encoded itself, chunked or already compressed values
+// and values that do not get smaller are stored as they are.
+func compressValue(config Config, value storedValue, options InsertOptions) (storedValue, error) {
+	compression := config.StorageOptions.Compression
+	if len(compression) == 0 || len(options.ContentEncoding) > 0 || value.userMeta != 0 {
+		return value, nil
+	}
+	compressed, err := compress(compression, value.entry)
+	if err != nil {
+		return value, err
+	}
+	if len(compressed) >= len(value.entry) {
+		return value, nil
+	}
+	value.entry = compressed
+	value.userMeta = compressionFlag(compression)
+	return value, nil
+}
+
+// acceptsEncoding checks whether the Accept-Encoding header of a request
+// allows the encoding, entries with a quality of 0 are rejected
+func acceptsEncoding(header string, encoding string) bool {
+	accepted := false
+	for _, entry := range strings.Split(header, ",") {
+		parts := strings.Split(entry, ";")
+		name := strings.ToLower(strings.TrimSpace(parts[0]))
+		if name != encoding && name != "*" {
+			continue
+		}
+		quality := 1.0
+		for _, param := range parts[1:] {
+			param = strings.TrimSpace(param)
+			if strings.HasPrefix(param, "q=") {
+				q, err := strconv.ParseFloat(strings.TrimPrefix(param, "q="), 64)
+				if err == nil {
+					quality = q
+				}
+			}
+		}
+		// an explicit entry takes precedence over the wildcard
+		if name == encoding {
+			return quality > 0
+		}
+		accepted = quality > 0
+	}
+	return accepted
+}
+
+// encodedReader reads the stored bytes of a compressed value. The
+// compressed chunks of a chunked value are read one after another, which
+// is a valid stream for both gzip and zstd.
+type encodedReader struct {
+	*ValueReader
+	// offsets of the chunks within the stored bytes
+	offsets []int64
+}
+
+func newEncodedReader(r *ValueReader) *encodedReader {
+	reader := encodedReader{
+		ValueReader: &ValueReader{
+			txn:        r.txn,
+			identifier: r.identifier,
+			manifest:   r.manifest,
+		},
+	}
+	if r.manifest == nil {
+		reader.chunk = r.raw
+		reader.size = int64(len(r.raw))
+	} else {
+		for _, size := range r.manifest.CompressedSizes {
+			reader.offsets = append(reader.offsets, reader.size)
+			reader.size += int64(size)
+		}
+	}
+	return &reader
+}
+
+func (r *encodedReader) Read(p []byte) (int, error) {
+	if r.offset >= r.size {
+		return 0, io.EOF
+	}
+	chunkStart := int64(0)
+	if r.manifest != nil {
+		index := uint64(sort.Search(len(r.offsets), func(i int) bool {
+			return r.offsets[i] > r.offset
+		}) - 1)
+		if r.chunk == nil || index != r.index {
+			item, err := r.txn.Get([]byte(chunkKey(r.identifier, r.manifest.ID, index)))
+			if err != nil {
+				return 0, err
+			}
+			r.chunk, err = item.ValueCopy(r.chunk[:0])
+			if err != nil {
+				return 0, err
+			}
+			r.index = index
+		}
+		chunkStart = r.offsets[index]
+	}
+	n := copy(p, r.chunk[r.offset-chunkStart:])
+	r.offset += int64(n)
+	return n, nil
+}
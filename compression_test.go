@@ -0,0 +1,217 @@
+package main
+
+import (
+	"bytes"
+	"compress/gzip"
+	"crypto/rand"
+	"io"
+	"io/ioutil"
+	"strings"
+	"testing"
+
+	"github.com/dgraph-io/badger/v3"
+	"github.com/klauspost/compress/zstd"
+	"github.com/mguentner/passwordless/state"
+)
+
+func storedEntry(t *testing.T, s *state.State, identifier string, key string) ([]byte, byte) {
+	var entry []byte
+	var userMeta byte
+	err := s.DB.View(func(txn *badger.Txn) error {
+		item, err := txn.Get([]byte(fullKey(identifier, key)))
+		if err != nil {
+			return err
+		}
+		userMeta = item.UserMeta()
+		entry, err = item.ValueCopy(nil)
+		return err
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	return entry, userMeta
+}
+
+func decodeEncoded(t *testing.T, compression string, reader io.Reader) []byte {
+	var decoded io.Reader
+	switch compression {
+	case CompressionGzip:
+		gzipReader, err := gzip.NewReader(reader)
+		if err != nil {
+			t.Fatal(err)
+		}
+		decoded = gzipReader
+	case CompressionZstd:
+		zstdReader, err := zstd.NewReader(reader)
+		if err != nil {
+			t.Fatal(err)
+		}
+		defer zstdReader.Close()
+		decoded = zstdReader
+	}
+	value, err := ioutil.ReadAll(decoded)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return value
+}
+
+func TestCompression(t *testing.T) {
+	compressible := []byte(strings.Repeat(`{"name": "alice", "tags": ["a", "b"]}`, 100))
+	random := make([]byte, 1000)
+	_, err := rand.Read(random)
+	if err != nil {
+		t.Fatal(err)
+	}
+	for _, compression := range []string{CompressionGzip, CompressionZstd} {
+		config := DefaultConfig()
+		config.StorageOptions.Compression = compression
+		config.StorageOptions.ChunkSizeBytes = 1024
+		config.StorageOptions.MaxVersionsPerKey = 2
+		config.StorageOptions.MaxBytesPerAccount = uint64(2*len(compressible) + len(random))
+		db, err := badger.Open(badger.DefaultOptions("").WithInMemory(true))
+		if err != nil {
+			t.Fatal(err)
+		}
+		appState := state.State{
+			DB: db,
+		}
+		_, err = InsertKeyValueForIdentifier(&appState, config, "alice@example.com", "doc", compressible)
+		if err != nil {
+			t.Fatal(err)
+		}
+		entry, userMeta := storedEntry(t, &appState, "alice@example.com", "doc")
+		if compressionForUserMeta(userMeta) != compression || len(entry) >= len(compressible) {
+			t.Errorf("%s: expected a compressed entry, got %d bytes with user meta %d", compression, len(entry), userMeta)
+		}
+		if value := readCurrentValue(t, &appState, "alice@example.com", "doc"); !bytes.Equal(value, compressible) {
+			t.Errorf("%s: unexpected value %s", compression, value)
+		}
+
+		_, err = InsertKeyValueFromReader(&appState, config, "alice@example.com", "random", bytes.NewReader(random), InsertOptions{})
+		if err != nil {
+			t.Fatal(err)
+		}
+		if _, userMeta := storedEntry(t, &appState, "alice@example.com", "random"); userMeta != 0 {
+			t.Errorf("%s: expected values that do not get smaller to be stored verbatim, got user meta %d", compression, userMeta)
+		}
+		if value := readCurrentValue(t, &appState, "alice@example.com", "random"); !bytes.Equal(value, random) {
+			t.Errorf("%s: unexpected random value", compression)
+		}
+
+		// the chunks are compressed one by one
+		_, err = InsertKeyValueFromReader(&appState, config, "alice@example.com", "large", bytes.NewReader(compressible), InsertOptions{})
+		if err != nil {
+			t.Fatal(err)
+		}
+		reader, version, err := OpenVersionForIdentifierAndKey(&appState, "alice@example.com", "large", 0)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if reader.Compression() != compression || version.Size != uint64(len(compressible)) {
+			t.Errorf("%s: unexpected compression %s or size %d", compression, reader.Compression(), version.Size)
+		}
+		_, err = reader.Seek(2000, io.SeekStart)
+		if err != nil {
+			t.Fatal(err)
+		}
+		tail, err := ioutil.ReadAll(reader)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if !bytes.Equal(tail, compressible[2000:]) {
+			t.Errorf("%s: unexpected value after seeking", compression)
+		}
+		encoded, size := reader.Encoded()
+		if size >= int64(len(compressible)) {
+			t.Errorf("%s: expected the encoded value to be smaller, got %d bytes", compression, size)
+		}
+		if value := decodeEncoded(t, compression, encoded); !bytes.Equal(value, compressible) {
+			t.Errorf("%s: unexpected encoded value", compression)
+		}
+		reader.Close()
+
+		// limits apply to the decompressed size
+		usage, err := UsageForIdentifier(&appState, "alice@example.com")
+		if err != nil {
+			t.Fatal(err)
+		}
+		if usage.Bytes != uint64(2*len(compressible)+len(random)) {
+			t.Errorf("%s: expected the usage to be the decompressed size, got %d", compression, usage.Bytes)
+		}
+		_, err = InsertKeyValueForIdentifier(&appState, config, "alice@example.com", "more", []byte("more"))
+		if _, ok := err.(*ErrQuotaExceeded); !ok {
+			t.Errorf("%s: expected ErrQuotaExceeded, got %v", compression, err)
+		}
+
+		// previous versions and trashed values stay compressed, they
+		// count against the quota as well
+		config.StorageOptions.MaxBytesPerAccount = 0
+		_, err = InsertKeyValueForIdentifier(&appState, config, "alice@example.com", "doc", []byte("{}"))
+		if err != nil {
+			t.Fatal(err)
+		}
+		err = RestoreVersionForIdentifierAndKey(&appState, config, "alice@example.com", "doc", 1)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if value := readCurrentValue(t, &appState, "alice@example.com", "doc"); !bytes.Equal(value, compressible) {
+			t.Errorf("%s: unexpected restored value", compression)
+		}
+		config.StorageOptions.TrashRetentionSeconds = 60
+		err = TrashKeyValueForIdentifier(&appState, config, "alice@example.com", "large", Preconditions{})
+		if err != nil {
+			t.Fatal(err)
+		}
+		_, err = RestoreTrashedKeyForIdentifier(&appState, config, "alice@example.com", "large")
+		if err != nil {
+			t.Fatal(err)
+		}
+		if value := readCurrentValue(t, &appState, "alice@example.com", "large"); !bytes.Equal(value, compressible) {
+			t.Errorf("%s: unexpected value restored from the trash", compression)
+		}
+	}
+}
+
+func TestCompressionClientEncoding(t *testing.T) {
+	config := DefaultConfig()
+	config.StorageOptions.Compression = CompressionZstd
+	db, err := badger.Open(badger.DefaultOptions("").WithInMemory(true))
+	if err != nil {
+		t.Fatal(err)
+	}
+	appState := state.State{
+		DB: db,
+	}
+	value := []byte(strings.Repeat("encoded by the client ", 100))
+	_, err = InsertKeyValueWithOptions(&appState, config, "alice@example.com", "doc", value, InsertOptions{ContentEncoding: "br"})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if entry, userMeta := storedEntry(t, &appState, "alice@example.com", "doc"); userMeta != 0 || !bytes.Equal(entry, value) {
+		t.Errorf("Expected values encoded by the client to be stored verbatim")
+	}
+}
+
+func TestAcceptsEncoding(t *testing.T) {
+	cases := []struct {
+		header   string
+		encoding string
+		expected bool
+	}{
+		{"", "gzip", false},
+		{"gzip", "gzip", true},
+		{"deflate, gzip;q=1.0, *;q=0.5", "gzip", true},
+		{"br, zstd", "zstd", true},
+		{"br", "zstd", false},
+		{"*", "zstd", true},
+		{"gzip;q=0", "gzip", false},
+		{"*, gzip;q=0", "gzip", false},
+		{"GZIP", "gzip", true},
+	}
+	for _, c := range cases {
+		if accepted := acceptsEncoding(c.header, c.encoding); accepted != c.expected {
+			t.Errorf("Expected %v for %s in %q, got %v", c.expected, c.encoding, c.header, accepted)
+		}
+	}
+}
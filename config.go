@@ -8,13 +8,77 @@ import (
 )
 
 type StorageOptions struct {
+	// Keys and bytes are counted across all buckets of an account
 	MaxKeysPerAccount uint64 `yaml:"maxKeysPerAccount"`
 	MaxValueSizeBytes uint64 `yaml:"maxValueSizeBytes"`
+	// Total size of all values of an account including the
+	// previous versions
+	MaxBytesPerAccount uint64 `yaml:"maxBytesPerAccount"`
+	// How many previous versions of a value are kept, 0 disables
+	// the version history
+	MaxVersionsPerKey uint64 `yaml:"maxVersionsPerKey"`
+	// Upper bound for the TTL clients can set on a value, 0 means
+	// no upper bound
+	MaxTTLSeconds uint64 `yaml:"maxTTLSeconds"`
+	// Content types clients are allowed to store, e.g. `application/json`
+	// or `image/*`. All content types are allowed if empty.
+	AllowedContentTypes []string `yaml:"allowedContentTypes"`
+	// Values larger than a single chunk are streamed and stored in
+	// chunks of this size, 0 disables chunking
+	ChunkSizeBytes uint64 `yaml:"chunkSizeBytes"`
+	// How many buckets an account can create in addition to the
+	// default bucket, 0 means no limit
+	MaxBucketsPerAccount uint64 `yaml:"maxBucketsPerAccount"`
+	// How long deleted values are kept in the trash before they are
+	// purged, 0 deletes values immediately
+	TrashRetentionSeconds uint64 `yaml:"trashRetentionSeconds"`
+	// Upper bound for the lifetime of public links, 0 means no
+	// upper bound
+	MaxLinkLifetimeSeconds uint64 `yaml:"maxLinkLifetimeSeconds"`
+	// How long changes are kept for clients that sync incrementally,
+	// 0 keeps all changes
+	ChangeRetentionSeconds uint64 `yaml:"changeRetentionSeconds"`
+	// Compresses values before they are stored, either `gzip` or
+	// `zstd`. Quotas and limits apply to the decompressed size.
+	Compression string `yaml:"compression"`
+	// Upper bound for the size of an import archive, applies in
+	// addition to maxBytesPerAccount, defaults to 1 GB
+	MaxImportSizeBytes uint64 `yaml:"maxImportSizeBytes"`
+}
+
+type EncryptionOptions struct {
+	// file containing a raw AES key of 16, 24 or 32 bytes,
+	// encryption at rest is disabled if empty
+	KeyPath string `yaml:"keyPath"`
+	// badger caches the indices of the tables, defaults to 100 MB
+	IndexCacheSizeBytes int64 `yaml:"indexCacheSizeBytes"`
+}
+
+type OperatorWebhook struct {
+	URL string `yaml:"url"`
+	// used to sign the payloads, see the README
+	Secret string `yaml:"secret"`
+}
+
+type WebhookOptions struct {
+	// receive the changes of all accounts
+	Operator []OperatorWebhook `yaml:"operator"`
+	// How many webhooks an account can register, 0 disables
+	// webhooks of accounts
+	MaxWebhooksPerAccount uint64 `yaml:"maxWebhooksPerAccount"`
+	// How often a delivery is attempted before it is dropped,
+	// defaults to 8
+	MaxAttempts uint64 `yaml:"maxAttempts"`
+	// Allows webhooks on loopback and private networks, only enable
+	// this if accounts can not register webhooks or are trusted
+	AllowPrivateAddresses bool `yaml:"allowPrivateAddresses"`
 }
 
 type Config struct {
 	config.Config  `yaml:",inline"`
-	StorageOptions StorageOptions `yaml:"storageOptions"`
+	StorageOptions StorageOptions    `yaml:"storageOptions"`
+	Encryption     EncryptionOptions `yaml:"encryption"`
+	Webhooks       WebhookOptions    `yaml:"webhooks"`
 }
 
 func (c Config) Validate() error {
@@ -22,6 +86,16 @@ func (c Config) Validate() error {
 	if err != nil {
 		return err
 	}
+	err = validateCompression(c.StorageOptions.Compression)
+	if err != nil {
+		return err
+	}
+	for _, webhook := range c.Webhooks.Operator {
+		err = validateWebhookURL(webhook.URL)
+		if err != nil {
+			return err
+		}
+	}
 	return nil
 }
 
@@ -0,0 +1,215 @@
+package main
+
+import (
+	"math"
+	"math/rand"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/dgraph-io/badger/v3"
+	"github.com/mguentner/passwordless/state"
+)
+
+type ErrValueNotAnInteger struct{}
+
+func (e *ErrValueNotAnInteger) Error() string {
+	return "ValueNotAnInteger"
+}
+
+type ErrIntegerOverflow struct{}
+
+func (e *ErrIntegerOverflow) Error() string {
+	return "IntegerOverflow"
+}
+
+// ErrValueTooLargeToAppend is returned if appending would make a value
+// larger than chunkSizeBytes. Appending rewrites the whole value, which
+// is only cheap for values stored in a single entry.
+type ErrValueTooLargeToAppend struct{}
+
+func (e *ErrValueTooLargeToAppend) Error() string {
+	return "ValueTooLargeToAppend"
+}
+
+type ErrTooManyConflicts struct{}
+
+func (e *ErrTooManyConflicts) Error() string {
+	return "TooManyConflicts"
+}
+
+// maxConflictRetries bounds how often an update is retried if it
+// conflicts with a concurrent transaction, tests lower it to provoke
+// ErrTooManyConflicts
+var maxConflictRetries = 20
+
+// The delay before a retry is random and doubles with every retry up to
+// maxConflictBackoff, so concurrent updates of the same key spread out
+// instead of conflicting with each other again.
+const (
+	minConflictBackoff = time.Millisecond
+	maxConflictBackoff = 100 * time.Millisecond
+)
+
+// updateRetryingConflicts retries fn if badger detects that another
+// transaction modified the same keys in the meantime. fn must not have
+// side effects outside of the transaction. ErrTooManyConflicts is
+// returned once all retries conflicted. Changes recorded by fn must be
+// written using updateRetryingConflicts, as the event streams are woken
+// up once the transaction was committed.
+func updateRetryingConflicts(s *state.State, fn func(txn *badger.Txn) error) error {
+	backoff := minConflictBackoff
+	for retries := 0; ; retries++ {
+		var current *badger.Txn
+		err := s.DB.Update(func(txn *badger.Txn) error {
+			current = txn
+			return fn(txn)
+		})
+		changeNotifications.finished(s, current, err)
+		if err != badger.ErrConflict {
+			return err
+		}
+		if retries == maxConflictRetries {
+			return &ErrTooManyConflicts{}
+		}
+		time.Sleep(time.Duration(rand.Int63n(int64(backoff))) + minConflictBackoff)
+		if backoff < maxConflictBackoff {
+			backoff *= 2
+		}
+	}
+}
+
+// modifiedValue keeps the expiry of the value it replaces, as modifying
+// a value should not make it permanent
+func modifiedValue(metadata *valueMetadata, value []byte) storedValue {
+	modified := storedValue{
+		entry: value,
+		size:  uint64(len(value)),
+		etag:  etagForValue(value),
+	}
+	if metadata != nil && metadata.ExpiresAt != nil {
+		modified.expiresAt = uint64(metadata.ExpiresAt.Unix())
+	}
+	return modified
+}
+
+// modifyOptions carries the content headers of the current value over
+// to the modified value
+func modifyOptions(metadata *valueMetadata, preconditions Preconditions, contentType string) InsertOptions {
+	options := InsertOptions{
+		Preconditions: preconditions,
+		ContentType:   contentType,
+	}
+	if metadata != nil {
+		options.ContentType = metadata.ContentType
+		options.ContentEncoding = metadata.ContentEncoding
+		options.Filename = metadata.Filename
+	}
+	return options
+}
+
+// incrementKeyValue treats a missing key as 0. The value is stored as a
+// decimal string.
+func incrementKeyValue(config Config, identifier string, key string, delta int64, preconditions Preconditions, txn *badger.Txn) (int64, *ValueVersion, error) {
+	metadata, err := metadataForKey(identifier, key, txn)
+	if err != nil {
+		if _, ok := err.(*ErrKeyNotFound); !ok {
+			return 0, nil, err
+		}
+		metadata = nil
+	}
+	current := int64(0)
+	if metadata != nil {
+		value, _, err := valueForVersion(identifier, key, 0, txn)
+		if err != nil {
+			return 0, nil, err
+		}
+		current, err = strconv.ParseInt(strings.TrimSpace(string(value)), 10, 64)
+		if err != nil {
+			if numErr, ok := err.(*strconv.NumError); ok && numErr.Err == strconv.ErrRange {
+				return 0, nil, &ErrIntegerOverflow{}
+			}
+			return 0, nil, &ErrValueNotAnInteger{}
+		}
+	}
+	if (delta > 0 && current > math.MaxInt64-delta) || (delta < 0 && current < math.MinInt64-delta) {
+		return 0, nil, &ErrIntegerOverflow{}
+	}
+	current += delta
+	value := []byte(strconv.FormatInt(current, 10))
+	if config.StorageOptions.MaxValueSizeBytes > 0 && uint64(len(value)) > config.StorageOptions.MaxValueSizeBytes {
+		return 0, nil, &ErrDataTooBig{}
+	}
+	options := modifyOptions(metadata, preconditions, "text/plain")
+	version, err := insertKeyValue(config, identifier, key, modifiedValue(metadata, value), options, txn)
+	if err != nil {
+		return 0, nil, err
+	}
+	return current, version, nil
+}
+
+// appendKeyValue creates the key if it does not exist. The appended value
+// replaces the current version, previous versions are kept as they are.
+func appendKeyValue(config Config, identifier string, key string, data []byte, preconditions Preconditions, contentType string, txn *badger.Txn) (*ValueVersion, error) {
+	metadata, err := metadataForKey(identifier, key, txn)
+	if err != nil {
+		if _, ok := err.(*ErrKeyNotFound); !ok {
+			return nil, err
+		}
+		metadata = nil
+	}
+	size := uint64(len(data))
+	if metadata != nil {
+		size += metadata.Size
+	}
+	if config.StorageOptions.MaxValueSizeBytes > 0 && size > config.StorageOptions.MaxValueSizeBytes {
+		return nil, &ErrDataTooBig{}
+	}
+	if config.StorageOptions.ChunkSizeBytes > 0 && size > config.StorageOptions.ChunkSizeBytes {
+		return nil, &ErrValueTooLargeToAppend{}
+	}
+	value := []byte{}
+	if metadata != nil {
+		value, _, err = valueForVersion(identifier, key, 0, txn)
+		if err != nil {
+			return nil, err
+		}
+	}
+	value = append(value, data...)
+	options := modifyOptions(metadata, preconditions, contentType)
+	// every append would push a copy of the value into the history
+	options.replaceCurrent = true
+	return insertKeyValue(config, identifier, key, modifiedValue(metadata, value), options, txn)
+}
+
+// IncrementKeyValueForIdentifier adds delta to the integer stored at key
+// and returns the new value. A negative delta decrements the value.
+func IncrementKeyValueForIdentifier(s *state.State, config Config, identifier string, key string, delta int64, preconditions Preconditions) (int64, ValueVersion, error) {
+	var result int64
+	var version ValueVersion
+	err := updateRetryingConflicts(s, func(txn *badger.Txn) error {
+		r, v, err := incrementKeyValue(config, identifier, key, delta, preconditions, txn)
+		if err != nil {
+			return err
+		}
+		result = r
+		version = *v
+		return nil
+	})
+	return result, version, err
+}
+
+// AppendKeyValueForIdentifier appends data to the value stored at key.
+// contentType is only used if the key is created.
+func AppendKeyValueForIdentifier(s *state.State, config Config, identifier string, key string, data []byte, preconditions Preconditions, contentType string) (ValueVersion, error) {
+	var version ValueVersion
+	err := updateRetryingConflicts(s, func(txn *badger.Txn) error {
+		v, err := appendKeyValue(config, identifier, key, data, preconditions, contentType, txn)
+		if err != nil {
+			return err
+		}
+		version = *v
+		return nil
+	})
+	return version, err
+}
@@ -0,0 +1,179 @@
+package main
+
+import (
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/dgraph-io/badger/v3"
+	"github.com/mguentner/passwordless/state"
+)
+
+func TestIncrement(t *testing.T) {
+	config := DefaultConfig()
+	db, err := badger.Open(badger.DefaultOptions("").WithInMemory(true))
+	if err != nil {
+		t.Fatal(err)
+	}
+	appState := state.State{
+		DB: db,
+	}
+	value, version, err := IncrementKeyValueForIdentifier(&appState, config, "alice@example.com", "counter", 5, Preconditions{})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if value != 5 || version.Version != 1 || version.ContentType != "text/plain" {
+		t.Errorf("Unexpected value %d and version %+v", value, version)
+	}
+	value, _, err = IncrementKeyValueForIdentifier(&appState, config, "alice@example.com", "counter", -7, Preconditions{})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if value != -2 {
+		t.Errorf("Expected -2, got %d", value)
+	}
+	stored, err := RetrieveValueIdentifierAndKey(&appState, "alice@example.com", "counter")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if string(stored) != "-2" {
+		t.Errorf("Expected -2, got %s", stored)
+	}
+
+	var wg sync.WaitGroup
+	for i := 0; i < 10; i++ {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			for j := 0; j < 5; j++ {
+				_, _, err := IncrementKeyValueForIdentifier(&appState, config, "alice@example.com", "counter", 1, Preconditions{})
+				if err != nil {
+					t.Error(err)
+				}
+			}
+		}()
+	}
+	wg.Wait()
+	stored, err = RetrieveValueIdentifierAndKey(&appState, "alice@example.com", "counter")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if string(stored) != "48" {
+		t.Errorf("Expected 48, got %s", stored)
+	}
+
+	_, err = InsertKeyValueForIdentifier(&appState, config, "alice@example.com", "text", []byte("text"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	_, _, err = IncrementKeyValueForIdentifier(&appState, config, "alice@example.com", "text", 1, Preconditions{})
+	if _, ok := err.(*ErrValueNotAnInteger); !ok {
+		t.Errorf("Expected ErrValueNotAnInteger, got %v", err)
+	}
+	_, err = InsertKeyValueForIdentifier(&appState, config, "alice@example.com", "max", []byte("9223372036854775807"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	_, _, err = IncrementKeyValueForIdentifier(&appState, config, "alice@example.com", "max", 1, Preconditions{})
+	if _, ok := err.(*ErrIntegerOverflow); !ok {
+		t.Errorf("Expected ErrIntegerOverflow, got %v", err)
+	}
+}
+
+func TestAppend(t *testing.T) {
+	config := DefaultConfig()
+	config.StorageOptions.MaxValueSizeBytes = 10
+	db, err := badger.Open(badger.DefaultOptions("").WithInMemory(true))
+	if err != nil {
+		t.Fatal(err)
+	}
+	appState := state.State{
+		DB: db,
+	}
+	options := InsertOptions{
+		ContentType: "text/plain",
+		TTL:         time.Hour,
+	}
+	_, err = InsertKeyValueWithOptions(&appState, config, "alice@example.com", "log", []byte("a\n"), options)
+	if err != nil {
+		t.Fatal(err)
+	}
+	version, err := AppendKeyValueForIdentifier(&appState, config, "alice@example.com", "log", []byte("b\n"), Preconditions{}, "application/json")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if version.Size != 4 || version.ContentType != "text/plain" {
+		t.Errorf("Unexpected version %+v", version)
+	}
+	if version.ExpiresAt == nil {
+		t.Error("Expected the expiry to be kept")
+	}
+	value, err := RetrieveValueIdentifierAndKey(&appState, "alice@example.com", "log")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if string(value) != "a\nb\n" {
+		t.Errorf("Unexpected value %q", value)
+	}
+	_, err = AppendKeyValueForIdentifier(&appState, config, "alice@example.com", "log", []byte("1234567"), Preconditions{}, "")
+	if _, ok := err.(*ErrDataTooBig); !ok {
+		t.Errorf("Expected ErrDataTooBig, got %v", err)
+	}
+	_, err = AppendKeyValueForIdentifier(&appState, config, "alice@example.com", "log", []byte("c\n"), Preconditions{IfMatch: []string{"outdated"}}, "")
+	if _, ok := err.(*ErrPreconditionFailed); !ok {
+		t.Errorf("Expected ErrPreconditionFailed, got %v", err)
+	}
+	version, err = AppendKeyValueForIdentifier(&appState, config, "alice@example.com", "new", []byte("x"), Preconditions{}, "application/json")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if version.Version != 1 || version.ContentType != "application/json" {
+		t.Errorf("Unexpected version %+v", version)
+	}
+}
+
+func TestAppendLimits(t *testing.T) {
+	config := DefaultConfig()
+	config.StorageOptions.ChunkSizeBytes = 8
+	config.StorageOptions.MaxVersionsPerKey = 10
+	db, err := badger.Open(badger.DefaultOptions("").WithInMemory(true))
+	if err != nil {
+		t.Fatal(err)
+	}
+	appState := state.State{
+		DB: db,
+	}
+	_, err = InsertKeyValueForIdentifier(&appState, config, "alice@example.com", "log", []byte("a"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	_, err = InsertKeyValueForIdentifier(&appState, config, "alice@example.com", "log", []byte("b"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	for _, data := range []string{"c", "d", "e"} {
+		_, err = AppendKeyValueForIdentifier(&appState, config, "alice@example.com", "log", []byte(data), Preconditions{}, "")
+		if err != nil {
+			t.Fatal(err)
+		}
+	}
+	versions, err := VersionsForIdentifierAndKey(&appState, "alice@example.com", "log")
+	if err != nil {
+		t.Fatal(err)
+	}
+	// only the value replaced by the insert is kept
+	if len(versions) != 2 || versions[0].Size != 1 || versions[1].Size != 4 {
+		t.Errorf("Unexpected versions %+v", versions)
+	}
+	_, err = AppendKeyValueForIdentifier(&appState, config, "alice@example.com", "log", []byte("12345"), Preconditions{}, "")
+	if _, ok := err.(*ErrValueTooLargeToAppend); !ok {
+		t.Errorf("Expected ErrValueTooLargeToAppend, got %v", err)
+	}
+	value, err := RetrieveValueIdentifierAndKey(&appState, "alice@example.com", "log")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if string(value) != "bcde" {
+		t.Errorf("Unexpected value %q", value)
+	}
+}
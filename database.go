@@ -0,0 +1,235 @@
+package main
+
+import (
+	"errors"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"os"
+
+	"github.com/dgraph-io/badger/v3"
+	"github.com/mguentner/passwordless/crypto"
+	"github.com/mguentner/passwordless/state"
+)
+
+const defaultIndexCacheSizeBytes = 100 << 20
+
+// maxPendingMigrationWrites limits the memory used while a database is
+// copied by MigrateEncryption
+const maxPendingMigrationWrites = 256
+
+// readEncryptionKey reads a raw AES key, e.g. created using
+// `head -c 32 /dev/urandom > encryption.key`.
+// An empty path results in an empty key which disables encryption.
+func readEncryptionKey(path string) ([]byte, error) {
+	if len(path) == 0 {
+		return []byte{}, nil
+	}
+	key, err := ioutil.ReadFile(path)
+	if err != nil {
+		return nil, err
+	}
+	switch len(key) {
+	case 16, 24, 32:
+		return key, nil
+	}
+	return nil, fmt.Errorf("Encryption key %s must be 16, 24 or 32 bytes long, got %d bytes", path, len(key))
+}
+
+func badgerOptions(config *Config) (badger.Options, error) {
+	options := badger.DefaultOptions(config.StatePath).WithLogger(state.ZerologBadgerLogger{})
+	key, err := readEncryptionKey(config.Encryption.KeyPath)
+	if err != nil {
+		return options, err
+	}
+	// the cache is set without a key as well, tables that were written
+	// before encryption was disabled stay encrypted and cannot be read
+	// without it
+	indexCacheSize := config.Encryption.IndexCacheSizeBytes
+	if indexCacheSize == 0 {
+		indexCacheSize = defaultIndexCacheSizeBytes
+	}
+	options = options.WithIndexCacheSize(indexCacheSize)
+	if len(key) == 0 {
+		return options, nil
+	}
+	return options.WithEncryptionKey(key), nil
+}
+
+func openDB(config *Config) (*badger.DB, error) {
+	options, err := badgerOptions(config)
+	if err != nil {
+		return nil, err
+	}
+	db, err := badger.Open(options)
+	if errors.Is(err, badger.ErrEncryptionKeyMismatch) {
+		return nil, fmt.Errorf("The configured encryption key does not match the data in %s", config.StatePath)
+	}
+	return db, err
+}
+
+// OpenState replaces state.NewState as the latter does not allow to
+// configure encryption at rest
+func OpenState(config *Config, rsaKeyPairs []crypto.PublicPrivateRSAKeyPair) (*state.State, error) {
+	db, err := openDB(config)
+	if err != nil {
+		return nil, err
+	}
+	return &state.State{
+		DB:          db,
+		RSAKeyPairs: rsaKeyPairs,
+	}, nil
+}
+
+// ErrMissingEncryptionKey is returned if a key rotation has no new key,
+// encryption is only disabled by DisableEncryption
+type ErrMissingEncryptionKey struct{}
+
+func (m *ErrMissingEncryptionKey) Error() string {
+	return "MissingEncryptionKey"
+}
+
+// ErrNotEncrypted is returned if the key of a database is rotated that
+// was never encrypted, its data has to be rewritten by MigrateEncryption
+type ErrNotEncrypted struct{}
+
+func (m *ErrNotEncrypted) Error() string {
+	return "NotEncrypted"
+}
+
+// RotateEncryptionKey re-encrypts the key registry of the database with
+// the key stored in newKeyPath. The data of an encrypted database is
+// encrypted using data keys from the registry, only the registry has to be
+// rewritten.
+// This must not be run while the database is used by a running instance.
+func RotateEncryptionKey(config *Config, newKeyPath string) error {
+	if len(newKeyPath) == 0 {
+		return &ErrMissingEncryptionKey{}
+	}
+	// the tables and value logs of an unencrypted database would stay
+	// readable without the key
+	if len(config.Encryption.KeyPath) == 0 {
+		return &ErrNotEncrypted{}
+	}
+	newKey, err := readEncryptionKey(newKeyPath)
+	if err != nil {
+		return err
+	}
+	return rewriteKeyRegistry(config, newKey)
+}
+
+// DisableEncryption stores the key registry of the database unencrypted,
+// new data is no longer encrypted afterwards. Existing data stays
+// encrypted using the data keys of the registry.
+// This must not be run while the database is used by a running instance.
+func DisableEncryption(config *Config) error {
+	return rewriteKeyRegistry(config, []byte{})
+}
+
+// rewriteKeyRegistry stores the key registry encrypted with newKey, an
+// empty newKey disables encryption of new data
+func rewriteKeyRegistry(config *Config, newKey []byte) error {
+	oldKey, err := readEncryptionKey(config.Encryption.KeyPath)
+	if err != nil {
+		return err
+	}
+	// opening the database validates the current key and fails if the
+	// database is locked by a running instance
+	db, err := openDB(config)
+	if err != nil {
+		return err
+	}
+	err = db.Close()
+	if err != nil {
+		return err
+	}
+	registryOptions := badger.KeyRegistryOptions{
+		Dir:                           config.StatePath,
+		ReadOnly:                      true,
+		EncryptionKey:                 oldKey,
+		EncryptionKeyRotationDuration: badger.DefaultOptions(config.StatePath).EncryptionKeyRotationDuration,
+	}
+	registry, err := badger.OpenKeyRegistry(registryOptions)
+	if err != nil {
+		return err
+	}
+	registryOptions.EncryptionKey = newKey
+	return badger.WriteKeyRegistry(registry, registryOptions)
+}
+
+// MigrateEncryption encrypts an existing database with the key stored in
+// newKeyPath. All entries are copied into a new encrypted database, which
+// replaces the state directory, so no unencrypted table or value log is
+// left behind. The previous directory is kept as StatePath.old until the
+// copy is complete and removed afterwards.
+// This must not be run while the database is used by a running instance.
+func MigrateEncryption(config *Config, newKeyPath string) error {
+	if len(newKeyPath) == 0 {
+		return &ErrMissingEncryptionKey{}
+	}
+	migrated := *config
+	migrated.StatePath = config.StatePath + ".migrating"
+	migrated.Encryption.KeyPath = newKeyPath
+	previousPath := config.StatePath + ".old"
+	// both are only left behind by an interrupted migration, which has to
+	// be cleaned up by the operator
+	for _, path := range []string{migrated.StatePath, previousPath} {
+		_, err := os.Stat(path)
+		if err == nil {
+			return fmt.Errorf("%s exists, remove it after checking that %s contains the data", path, config.StatePath)
+		}
+		if !os.IsNotExist(err) {
+			return err
+		}
+	}
+	db, err := openDB(config)
+	if err != nil {
+		return err
+	}
+	migratedDB, err := openDB(&migrated)
+	if err != nil {
+		db.Close()
+		return err
+	}
+	err = copyDB(db, migratedDB)
+	closeErr := migratedDB.Close()
+	if err == nil {
+		err = closeErr
+	}
+	closeErr = db.Close()
+	if err == nil {
+		err = closeErr
+	}
+	if err != nil {
+		os.RemoveAll(migrated.StatePath)
+		return err
+	}
+	err = os.Rename(config.StatePath, previousPath)
+	if err != nil {
+		return err
+	}
+	err = os.Rename(migrated.StatePath, config.StatePath)
+	if err != nil {
+		return err
+	}
+	return os.RemoveAll(previousPath)
+}
+
+// copyDB streams a backup of db into target, keeping the expiry of every
+// entry
+func copyDB(db *badger.DB, target *badger.DB) error {
+	reader, writer := io.Pipe()
+	backupErr := make(chan error, 1)
+	go func() {
+		_, err := db.Backup(writer, 0)
+		writer.CloseWithError(err)
+		backupErr <- err
+	}()
+	err := target.Load(reader, maxPendingMigrationWrites)
+	// unblocks the backup if loading failed
+	reader.CloseWithError(err)
+	if backup := <-backupErr; backup != nil && err == nil {
+		err = backup
+	}
+	return err
+}
@@ -0,0 +1,230 @@
+package main
+
+import (
+	"bytes"
+	"crypto/rand"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+
+	"github.com/dgraph-io/badger/v3"
+)
+
+func writeKey(t *testing.T, dir string, name string, key []byte) string {
+	path := filepath.Join(dir, name)
+	err := ioutil.WriteFile(path, key, 0600)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return path
+}
+
+func TestOpenStateEncryption(t *testing.T) {
+	dir := t.TempDir()
+	config := DefaultConfig()
+	config.StatePath = filepath.Join(dir, "state")
+	config.Encryption.KeyPath = writeKey(t, dir, "invalid.key", []byte("tooshort"))
+	_, err := OpenState(&config, nil)
+	if err == nil {
+		t.Fatal("Expected invalid key to be rejected")
+	}
+	config.Encryption.KeyPath = writeKey(t, dir, "encryption.key", []byte("0123456789abcdef0123456789abcdef"))
+	appState, err := OpenState(&config, nil)
+	if err != nil {
+		t.Fatalf("Unexpected failure: %v", err)
+	}
+	_, err = InsertKeyValueForIdentifier(appState, config, "alice@example.com", "needle", []byte("value"))
+	if err != nil {
+		t.Fatalf("Unexpected failure: %v", err)
+	}
+	appState.DB.Close()
+	config.Encryption.KeyPath = writeKey(t, dir, "other.key", []byte("fedcba9876543210fedcba9876543210"))
+	_, err = OpenState(&config, nil)
+	if err == nil {
+		t.Fatal("Expected mismatching key to be rejected")
+	}
+	config.Encryption.KeyPath = ""
+	_, err = OpenState(&config, nil)
+	if err == nil {
+		t.Fatal("Expected missing key to be rejected")
+	}
+}
+
+func TestRotateEncryptionKey(t *testing.T) {
+	dir := t.TempDir()
+	config := DefaultConfig()
+	config.StatePath = filepath.Join(dir, "state")
+	config.Encryption.KeyPath = writeKey(t, dir, "old.key", []byte("0123456789abcdef"))
+	appState, err := OpenState(&config, nil)
+	if err != nil {
+		t.Fatalf("Unexpected failure: %v", err)
+	}
+	_, err = InsertKeyValueForIdentifier(appState, config, "alice@example.com", "needle", []byte("value"))
+	if err != nil {
+		t.Fatalf("Unexpected failure: %v", err)
+	}
+	err = RotateEncryptionKey(&config, writeKey(t, dir, "new.key", []byte("fedcba9876543210")))
+	if err == nil {
+		t.Fatal("Expected rotation of an opened database to fail")
+	}
+	appState.DB.Close()
+	err = RotateEncryptionKey(&config, "")
+	if _, ok := err.(*ErrMissingEncryptionKey); !ok {
+		t.Fatalf("Expected ErrMissingEncryptionKey, got %v", err)
+	}
+	newKeyPath := filepath.Join(dir, "new.key")
+	err = RotateEncryptionKey(&config, newKeyPath)
+	if err != nil {
+		t.Fatalf("Unexpected failure: %v", err)
+	}
+	_, err = OpenState(&config, nil)
+	if err == nil {
+		t.Fatal("Expected old key to be rejected")
+	}
+	config.Encryption.KeyPath = newKeyPath
+	appState, err = OpenState(&config, nil)
+	if err != nil {
+		t.Fatalf("Unexpected failure: %v", err)
+	}
+	defer appState.DB.Close()
+	value, err := RetrieveValueIdentifierAndKey(appState, "alice@example.com", "needle")
+	if err != nil {
+		t.Fatalf("Unexpected failure: %v", err)
+	}
+	if bytes.Compare(value, []byte("value")) != 0 {
+		t.Fatalf("Expected value, got %s", value)
+	}
+}
+
+// containedInFiles reports whether any file below dir contains needle
+func containedInFiles(t *testing.T, dir string, needle []byte) bool {
+	found := false
+	err := filepath.Walk(dir, func(path string, info os.FileInfo, err error) error {
+		if err != nil || info.IsDir() {
+			return err
+		}
+		content, err := ioutil.ReadFile(path)
+		if err != nil {
+			return err
+		}
+		found = found || bytes.Contains(content, needle)
+		return nil
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	return found
+}
+
+func TestMigrateEncryption(t *testing.T) {
+	dir := t.TempDir()
+	config := DefaultConfig()
+	config.StatePath = filepath.Join(dir, "state")
+	// random bytes, so badger does not compress the value
+	needle := make([]byte, 256)
+	_, err := rand.Read(needle)
+	if err != nil {
+		t.Fatal(err)
+	}
+	appState, err := OpenState(&config, nil)
+	if err != nil {
+		t.Fatalf("Unexpected failure: %v", err)
+	}
+	_, err = InsertKeyValueForIdentifier(appState, config, "alice@example.com", "needle", needle)
+	if err != nil {
+		t.Fatalf("Unexpected failure: %v", err)
+	}
+	_, err = InsertKeyValueFromReader(appState, config, "alice@example.com", "expiring", bytes.NewReader([]byte("value")), InsertOptions{TTL: time.Hour})
+	if err != nil {
+		t.Fatalf("Unexpected failure: %v", err)
+	}
+	appState.DB.Close()
+	if !containedInFiles(t, config.StatePath, needle) {
+		t.Fatal("Expected the unencrypted database to contain the value")
+	}
+	keyPath := writeKey(t, dir, "encryption.key", []byte("0123456789abcdef"))
+	err = RotateEncryptionKey(&config, keyPath)
+	if _, ok := err.(*ErrNotEncrypted); !ok {
+		t.Fatalf("Expected ErrNotEncrypted, got %v", err)
+	}
+	err = MigrateEncryption(&config, "")
+	if _, ok := err.(*ErrMissingEncryptionKey); !ok {
+		t.Fatalf("Expected ErrMissingEncryptionKey, got %v", err)
+	}
+	err = MigrateEncryption(&config, keyPath)
+	if err != nil {
+		t.Fatalf("Unexpected failure: %v", err)
+	}
+	if containedInFiles(t, dir, needle) {
+		t.Fatal("Expected no unencrypted value to be left on disk")
+	}
+	_, err = OpenState(&config, nil)
+	if err == nil {
+		t.Fatal("Expected missing key to be rejected")
+	}
+	config.Encryption.KeyPath = keyPath
+	appState, err = OpenState(&config, nil)
+	if err != nil {
+		t.Fatalf("Unexpected failure: %v", err)
+	}
+	defer appState.DB.Close()
+	value, err := RetrieveValueIdentifierAndKey(appState, "alice@example.com", "needle")
+	if err != nil {
+		t.Fatalf("Unexpected failure: %v", err)
+	}
+	if bytes.Compare(value, needle) != 0 {
+		t.Fatal("Expected the value to be kept")
+	}
+	expiring := 0
+	err = appState.DB.View(func(txn *badger.Txn) error {
+		it := txn.NewIterator(badger.DefaultIteratorOptions)
+		defer it.Close()
+		for it.Rewind(); it.Valid(); it.Next() {
+			if it.Item().ExpiresAt() > 0 {
+				expiring++
+			}
+		}
+		return nil
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if expiring == 0 {
+		t.Fatal("Expected the expiry of entries to be kept")
+	}
+}
+
+func TestDisableEncryption(t *testing.T) {
+	dir := t.TempDir()
+	config := DefaultConfig()
+	config.StatePath = filepath.Join(dir, "state")
+	config.Encryption.KeyPath = writeKey(t, dir, "encryption.key", []byte("0123456789abcdef"))
+	appState, err := OpenState(&config, nil)
+	if err != nil {
+		t.Fatalf("Unexpected failure: %v", err)
+	}
+	_, err = InsertKeyValueForIdentifier(appState, config, "alice@example.com", "needle", []byte("value"))
+	if err != nil {
+		t.Fatalf("Unexpected failure: %v", err)
+	}
+	appState.DB.Close()
+	err = DisableEncryption(&config)
+	if err != nil {
+		t.Fatalf("Unexpected failure: %v", err)
+	}
+	config.Encryption.KeyPath = ""
+	appState, err = OpenState(&config, nil)
+	if err != nil {
+		t.Fatalf("Unexpected failure: %v", err)
+	}
+	defer appState.DB.Close()
+	value, err := RetrieveValueIdentifierAndKey(appState, "alice@example.com", "needle")
+	if err != nil {
+		t.Fatalf("Unexpected failure: %v", err)
+	}
+	if bytes.Compare(value, []byte("value")) != 0 {
+		t.Fatalf("Expected value, got %s", value)
+	}
+}
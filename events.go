@@ -0,0 +1,163 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"sync"
+
+	"github.com/dgraph-io/badger/v3"
+	"github.com/mguentner/passwordless/state"
+)
+
+// changeListenerKey identifies the streams of an account, the database is
+// part of it as several databases might be open at the same time
+type changeListenerKey struct {
+	db         *badger.DB
+	identifier string
+}
+
+// changeNotifier wakes up the event streams of an account once a
+// transaction that recorded a change of the account was committed. The
+// streams read the changes from the change log, so a wake-up carries no
+// data and several commits may result in a single wake-up.
+type changeNotifier struct {
+	mutex sync.Mutex
+	// pending maps the transactions that recorded a change to the
+	// account until they are committed or discarded
+	pending   map[*badger.Txn]string
+	listeners map[changeListenerKey]map[chan struct{}]bool
+}
+
+var changeNotifications = changeNotifier{
+	pending:   map[*badger.Txn]string{},
+	listeners: map[changeListenerKey]map[chan struct{}]bool{},
+}
+
+// recorded is called by recordChange, identifier is the account
+func (n *changeNotifier) recorded(identifier string, txn *badger.Txn) {
+	n.mutex.Lock()
+	defer n.mutex.Unlock()
+	n.pending[txn] = identifier
+}
+
+// finished is called once txn was committed or discarded, the listeners
+// are only woken up if the commit succeeded
+func (n *changeNotifier) finished(s *state.State, txn *badger.Txn, err error) {
+	n.mutex.Lock()
+	defer n.mutex.Unlock()
+	identifier, ok := n.pending[txn]
+	if !ok {
+		return
+	}
+	delete(n.pending, txn)
+	if err != nil {
+		return
+	}
+	for wake := range n.listeners[changeListenerKey{db: s.DB, identifier: identifier}] {
+		select {
+		case wake <- struct{}{}:
+		default:
+			// a wake-up is already pending
+		}
+	}
+}
+
+// listen registers a listener for the changes of an account, it is
+// registered once listen returns. stop has to be called to remove it.
+func (n *changeNotifier) listen(s *state.State, identifier string) (wake chan struct{}, stop func()) {
+	key := changeListenerKey{db: s.DB, identifier: identifier}
+	wake = make(chan struct{}, 1)
+	n.mutex.Lock()
+	defer n.mutex.Unlock()
+	if n.listeners[key] == nil {
+		n.listeners[key] = map[chan struct{}]bool{}
+	}
+	n.listeners[key][wake] = true
+	return wake, func() {
+		n.mutex.Lock()
+		defer n.mutex.Unlock()
+		delete(n.listeners[key], wake)
+		if len(n.listeners[key]) == 0 {
+			delete(n.listeners, key)
+		}
+	}
+}
+
+// EventStream sends the changes of the keys of an account. The stream is
+// ready once it was opened: every change committed afterwards is sent.
+type EventStream struct {
+	state      *state.State
+	identifier string
+	cursor     uint64
+	wake       chan struct{}
+	stop       func()
+}
+
+// OpenEventStreamForIdentifier opens a stream that starts after since, or
+// with the changes made after the call if since is 0. ErrChangesExpired is
+// returned if the changes after since are no longer available. The stream
+// has to be closed.
+func OpenEventStreamForIdentifier(s *state.State, identifier string, since uint64) (*EventStream, error) {
+	identifier, _ = splitIdentifier(identifier)
+	stream := EventStream{
+		state:      s,
+		identifier: identifier,
+		cursor:     since,
+	}
+	// the listener is registered before the change log is read, so no
+	// change committed in between is missed
+	stream.wake, stream.stop = changeNotifications.listen(s, identifier)
+	err := s.DB.View(func(txn *badger.Txn) error {
+		if since > 0 {
+			_, err := changesSince(identifier, since, 1, txn)
+			return err
+		}
+		var err error
+		stream.cursor, err = sequenceForIdentifier(identifier, txn)
+		return err
+	})
+	if err != nil {
+		stream.stop()
+		return nil, err
+	}
+	return &stream, nil
+}
+
+func (e *EventStream) Close() {
+	e.stop()
+}
+
+// Run calls send for every change until ctx is done or send fails
+func (e *EventStream) Run(ctx context.Context, send func(Change) error) error {
+	for {
+		for more := true; more; {
+			changeLog, err := ChangesForIdentifier(e.state, e.identifier, e.cursor, maxChangesPerRequest)
+			if err != nil {
+				return err
+			}
+			for _, change := range changeLog.Changes {
+				err = send(change)
+				if err != nil {
+					return err
+				}
+			}
+			e.cursor = changeLog.Cursor
+			more = changeLog.More
+		}
+		select {
+		case <-e.wake:
+		case <-ctx.Done():
+			return ctx.Err()
+		}
+	}
+}
+
+// formatEvent formats a change as a server-sent event
+func formatEvent(change Change) ([]byte, error) {
+	data, err := json.Marshal(change)
+	if err != nil {
+		return nil, err
+	}
+	return []byte(fmt.Sprintf("id: %d\nevent: %s\ndata: %s\n\n", change.Sequence, change.Type, data)), nil
+}
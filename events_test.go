@@ -0,0 +1,102 @@
+package main
+
+import (
+	"context"
+	"testing"
+	"time"
+
+	"github.com/dgraph-io/badger/v3"
+	"github.com/mguentner/passwordless/state"
+)
+
+func TestStreamEvents(t *testing.T) {
+	config := DefaultConfig()
+	db, err := badger.Open(badger.DefaultOptions("").WithInMemory(true))
+	if err != nil {
+		t.Fatal(err)
+	}
+	appState := state.State{
+		DB: db,
+	}
+	_, err = InsertKeyValueForIdentifier(&appState, config, "alice@example.com", "a", []byte("a"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	_, err = CreateBucketForIdentifier(&appState, config, "alice@example.com", Bucket{Name: "files"})
+	if err != nil {
+		t.Fatal(err)
+	}
+	files, err := scopedIdentifier("alice@example.com", "files")
+	if err != nil {
+		t.Fatal(err)
+	}
+	_, err = OpenEventStreamForIdentifier(&appState, "alice@example.com", 5)
+	if _, ok := err.(*ErrChangesExpired); !ok {
+		t.Errorf("Expected ErrChangesExpired for a sequence ahead of the account, got %v", err)
+	}
+	// resuming after the first change also covers the changes made
+	// before the stream was opened
+	stream, err := OpenEventStreamForIdentifier(&appState, "alice@example.com", 1)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer stream.Close()
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+	changes := make(chan Change, 100)
+	streamed := make(chan error, 1)
+	go func() {
+		streamed <- stream.Run(ctx, func(change Change) error {
+			changes <- change
+			return nil
+		})
+	}()
+	_, err = InsertKeyValueForIdentifier(&appState, config, "alice@example.com", "b", []byte("b"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	_, err = InsertKeyValueForIdentifier(&appState, config, "bob@example.com", "b", []byte("bob"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	err = DeleteKeyValueForIdentifier(&appState, config, "alice@example.com", "a")
+	if err != nil {
+		t.Fatal(err)
+	}
+	_, err = InsertKeyValueForIdentifier(&appState, config, files, "c", []byte("c"))
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	expected := []Change{
+		{Sequence: 2, Type: ChangePut, Bucket: DefaultBucket, Key: "b"},
+		{Sequence: 3, Type: ChangeDelete, Bucket: DefaultBucket, Key: "a"},
+		{Sequence: 4, Type: ChangePut, Bucket: "files", Key: "c"},
+	}
+	timeout := time.After(5 * time.Second)
+	for _, e := range expected {
+		select {
+		case change := <-changes:
+			if change.Sequence != e.Sequence || change.Type != e.Type || change.Bucket != e.Bucket || change.Key != e.Key {
+				t.Errorf("Expected %+v, got %+v", e, change)
+			}
+			if change.Type == ChangePut && change.Version == nil {
+				t.Errorf("Expected a version for %+v", change)
+			}
+		case err = <-streamed:
+			t.Fatalf("Stream ended with %v", err)
+		case <-timeout:
+			t.Fatalf("Missing %+v", e)
+		}
+	}
+	cancel()
+	err = <-streamed
+	if err != context.Canceled {
+		t.Errorf("Expected context.Canceled, got %v", err)
+	}
+	select {
+	case change := <-changes:
+		t.Errorf("Unexpected change %+v", change)
+	default:
+	}
+}
@@ -0,0 +1,220 @@
+package main
+
+import (
+	"archive/tar"
+	"archive/zip"
+	"bytes"
+	"encoding/base64"
+	"encoding/json"
+	"fmt"
+	"io"
+	"time"
+
+	"github.com/dgraph-io/badger/v3"
+	"github.com/mguentner/passwordless/state"
+)
+
+type ErrInvalidExportFormat struct{}
+
+func (e *ErrInvalidExportFormat) Error() string {
+	return "InvalidExportFormat"
+}
+
+const (
+	ExportFormatTar = "tar"
+	ExportFormatZip = "zip"
+)
+
+// exportManifestName is the first file of an archive
+const exportManifestName = "manifest.json"
+
+// ExportManifest describes all buckets and keys of an archive. Only the
+// current version of every key is exported.
+type ExportManifest struct {
+	ExportedAt time.Time        `json:"exportedAt"`
+	Buckets    []ExportedBucket `json:"buckets"`
+}
+
+type ExportedBucket struct {
+	Bucket
+	Keys []ExportedKey `json:"keys"`
+}
+
+type ExportedKey struct {
+	Key string `json:"key"`
+	// path of the value within the archive
+	Path      string    `json:"path"`
+	CreatedAt time.Time `json:"createdAt"`
+	ValueVersion
+}
+
+// exportPath encodes the key, as keys can contain any character
+func exportPath(bucket string, key string) string {
+	return fmt.Sprintf("values/%s/%s", bucket, base64.RawURLEncoding.EncodeToString([]byte(key)))
+}
+
+// ExportContentType returns false for unknown formats
+func ExportContentType(format string) (string, bool) {
+	switch format {
+	case ExportFormatTar:
+		return "application/x-tar", true
+	case ExportFormatZip:
+		return "application/zip", true
+	}
+	return "", false
+}
+
+type exportWriter interface {
+	writeFile(name string, size int64, modifiedAt time.Time, content io.Reader) error
+	Close() error
+}
+
+type tarExportWriter struct {
+	writer *tar.Writer
+}
+
+func (e *tarExportWriter) writeFile(name string, size int64, modifiedAt time.Time, content io.Reader) error {
+	err := e.writer.WriteHeader(&tar.Header{
+		Typeflag: tar.TypeReg,
+		Name:     name,
+		Size:     size,
+		Mode:     0600,
+		ModTime:  modifiedAt,
+	})
+	if err != nil {
+		return err
+	}
+	_, err = io.Copy(e.writer, content)
+	return err
+}
+
+func (e *tarExportWriter) Close() error {
+	return e.writer.Close()
+}
+
+type zipExportWriter struct {
+	writer *zip.Writer
+}
+
+func (e *zipExportWriter) writeFile(name string, size int64, modifiedAt time.Time, content io.Reader) error {
+	writer, err := e.writer.CreateHeader(&zip.FileHeader{
+		Name:     name,
+		Method:   zip.Deflate,
+		Modified: modifiedAt,
+	})
+	if err != nil {
+		return err
+	}
+	_, err = io.Copy(writer, content)
+	return err
+}
+
+func (e *zipExportWriter) Close() error {
+	return e.writer.Close()
+}
+
+func newExportWriter(format string, w io.Writer) (exportWriter, error) {
+	switch format {
+	case ExportFormatTar:
+		return &tarExportWriter{writer: tar.NewWriter(w)}, nil
+	case ExportFormatZip:
+		return &zipExportWriter{writer: zip.NewWriter(w)}, nil
+	}
+	return nil, &ErrInvalidExportFormat{}
+}
+
+// exportManifestForIdentifier lists the keys of all buckets, keys that
+// expired are skipped
+func exportManifestForIdentifier(identifier string, txn *badger.Txn) (*ExportManifest, error) {
+	manifest := ExportManifest{
+		ExportedAt: time.Now(),
+		Buckets:    []ExportedBucket{},
+	}
+	buckets, err := bucketsForIdentifier(identifier, txn)
+	if err != nil {
+		return nil, err
+	}
+	buckets = append([]Bucket{{Name: DefaultBucket}}, buckets...)
+	for _, bucket := range buckets {
+		scoped, err := scopedIdentifier(identifier, bucket.Name)
+		if err != nil {
+			return nil, err
+		}
+		exported := ExportedBucket{
+			Bucket: bucket,
+			Keys:   []ExportedKey{},
+		}
+		for _, key := range keysForIdentifier(scoped, txn) {
+			metadata, err := metadataForKey(scoped, key, txn)
+			if err != nil {
+				if _, ok := err.(*ErrKeyNotFound); ok {
+					continue
+				}
+				return nil, err
+			}
+			if metadata.expired() {
+				continue
+			}
+			exported.Keys = append(exported.Keys, ExportedKey{
+				Key:          key,
+				Path:         exportPath(bucket.Name, key),
+				CreatedAt:    metadata.CreatedAt,
+				ValueVersion: metadata.ValueVersion,
+			})
+		}
+		manifest.Buckets = append(manifest.Buckets, exported)
+	}
+	return &manifest, nil
+}
+
+// ExportForIdentifier writes an archive of all buckets of an account to
+// w. The archive is read from a single transaction, so it is consistent
+// even if the account is modified while the archive is streamed.
+func ExportForIdentifier(s *state.State, identifier string, format string, w io.Writer) error {
+	writer, err := newExportWriter(format, w)
+	if err != nil {
+		return err
+	}
+	identifier, _ = splitIdentifier(identifier)
+	txn := s.DB.NewTransaction(false)
+	defer txn.Discard()
+	manifest, err := exportManifestForIdentifier(identifier, txn)
+	if err != nil {
+		return err
+	}
+	encodedManifest, err := json.MarshalIndent(manifest, "", "  ")
+	if err != nil {
+		return err
+	}
+	err = writer.writeFile(exportManifestName, int64(len(encodedManifest)), manifest.ExportedAt, bytes.NewReader(encodedManifest))
+	if err != nil {
+		return err
+	}
+	for _, bucket := range manifest.Buckets {
+		scoped, err := scopedIdentifier(identifier, bucket.Name)
+		if err != nil {
+			return err
+		}
+		for _, key := range bucket.Keys {
+			item, err := txn.Get([]byte(fullKey(scoped, key.Key)))
+			if err != nil {
+				return err
+			}
+			// the reader shares the transaction, so it is not closed
+			reader, err := newValueReader(scoped, item, txn)
+			if err != nil {
+				return err
+			}
+			modifiedAt := key.Timestamp
+			if modifiedAt.IsZero() {
+				// values stored before versioning was introduced
+				modifiedAt = manifest.ExportedAt
+			}
+			err = writer.writeFile(key.Path, reader.Size(), modifiedAt, reader)
+			if err != nil {
+				return err
+			}
+		}
+	}
+	return writer.Close()
+}
@@ -0,0 +1,134 @@
+package main
+
+import (
+	"archive/tar"
+	"archive/zip"
+	"bytes"
+	"encoding/json"
+	"io"
+	"io/ioutil"
+	"testing"
+
+	"github.com/dgraph-io/badger/v3"
+	"github.com/mguentner/passwordless/state"
+)
+
+// readTarExport returns the files of an archive in their order
+func readTarExport(t *testing.T, archive []byte) ([]string, map[string][]byte) {
+	names := []string{}
+	files := map[string][]byte{}
+	reader := tar.NewReader(bytes.NewReader(archive))
+	for {
+		header, err := reader.Next()
+		if err == io.EOF {
+			break
+		}
+		if err != nil {
+			t.Fatal(err)
+		}
+		content, err := ioutil.ReadAll(reader)
+		if err != nil {
+			t.Fatal(err)
+		}
+		names = append(names, header.Name)
+		files[header.Name] = content
+	}
+	return names, files
+}
+
+func setupExportTest(t *testing.T) state.State {
+	config := DefaultConfig()
+	config.StorageOptions.ChunkSizeBytes = 4
+	db, err := badger.Open(badger.DefaultOptions("").WithInMemory(true))
+	if err != nil {
+		t.Fatal(err)
+	}
+	appState := state.State{
+		DB: db,
+	}
+	_, err = InsertKeyValueWithOptions(&appState, config, "alice@example.com", "notes/1", []byte("{}"), InsertOptions{ContentType: "application/json"})
+	if err != nil {
+		t.Fatal(err)
+	}
+	_, err = CreateBucketForIdentifier(&appState, config, "alice@example.com", Bucket{Name: "files", MaxKeys: 5})
+	if err != nil {
+		t.Fatal(err)
+	}
+	files, err := scopedIdentifier("alice@example.com", "files")
+	if err != nil {
+		t.Fatal(err)
+	}
+	_, err = InsertKeyValueFromReader(&appState, config, files, "large", bytes.NewBufferString("0123456789"), InsertOptions{})
+	if err != nil {
+		t.Fatal(err)
+	}
+	_, err = InsertKeyValueForIdentifier(&appState, config, "bob@example.com", "secret", []byte("bob"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	return appState
+}
+
+func TestExportTar(t *testing.T) {
+	appState := setupExportTest(t)
+	var archive bytes.Buffer
+	err := ExportForIdentifier(&appState, "alice@example.com", ExportFormatTar, &archive)
+	if err != nil {
+		t.Fatal(err)
+	}
+	names, files := readTarExport(t, archive.Bytes())
+	if len(names) != 3 || names[0] != exportManifestName {
+		t.Fatalf("Unexpected files %v", names)
+	}
+	var manifest ExportManifest
+	err = json.Unmarshal(files[exportManifestName], &manifest)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(manifest.Buckets) != 2 || manifest.Buckets[0].Name != DefaultBucket || manifest.Buckets[1].Name != "files" || manifest.Buckets[1].MaxKeys != 5 {
+		t.Fatalf("Unexpected buckets %+v", manifest.Buckets)
+	}
+	notes := manifest.Buckets[0].Keys
+	if len(notes) != 1 || notes[0].Key != "notes/1" || notes[0].ContentType != "application/json" {
+		t.Errorf("Unexpected keys %+v", notes)
+	}
+	if string(files[notes[0].Path]) != "{}" {
+		t.Errorf("Unexpected value %s", files[notes[0].Path])
+	}
+	large := manifest.Buckets[1].Keys
+	if len(large) != 1 || string(files[large[0].Path]) != "0123456789" {
+		t.Errorf("Unexpected chunked value %+v", large)
+	}
+}
+
+func TestExportZip(t *testing.T) {
+	appState := setupExportTest(t)
+	var archive bytes.Buffer
+	err := ExportForIdentifier(&appState, "alice@example.com", ExportFormatZip, &archive)
+	if err != nil {
+		t.Fatal(err)
+	}
+	reader, err := zip.NewReader(bytes.NewReader(archive.Bytes()), int64(archive.Len()))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(reader.File) != 3 || reader.File[0].Name != exportManifestName {
+		t.Fatalf("Unexpected files %+v", reader.File)
+	}
+	file, err := reader.Open(exportPath("files", "large"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	value, err := ioutil.ReadAll(file)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if string(value) != "0123456789" {
+		t.Errorf("Unexpected value %s", value)
+	}
+
+	err = ExportForIdentifier(&appState, "alice@example.com", "rar", &archive)
+	if _, ok := err.(*ErrInvalidExportFormat); !ok {
+		t.Errorf("Expected ErrInvalidExportFormat, got %v", err)
+	}
+}
@@ -4,14 +4,14 @@ go 1.16
 
 require (
 	github.com/dgraph-io/badger/v3 v3.2103.1
-	github.com/golang-jwt/jwt v3.2.2+incompatible // indirect
+	github.com/golang-jwt/jwt v3.2.2+incompatible
 	github.com/golang/glog v0.0.0-20210429001901-424d2337a529 // indirect
 	github.com/golang/groupcache v0.0.0-20210331224755-41bb18bfe9da // indirect
 	github.com/golang/protobuf v1.5.2 // indirect
 	github.com/golang/snappy v0.0.4 // indirect
 	github.com/google/flatbuffers v2.0.0+incompatible // indirect
 	github.com/gorilla/mux v1.8.0
-	github.com/klauspost/compress v1.13.3 // indirect
+	github.com/klauspost/compress v1.13.3
 	github.com/mguentner/passwordless v0.0.0-20210808170501-8b7ce6beb603
 	github.com/rs/cors v1.8.0
 	github.com/rs/zerolog v1.23.0
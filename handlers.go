@@ -1,17 +1,49 @@
 package main
 
 import (
-	"bytes"
 	"encoding/json"
 	"errors"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"mime"
 	"net/http"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
 
 	"github.com/gorilla/mux"
 	"github.com/mguentner/passwordless/crypto"
+	"github.com/mguentner/passwordless/handlers"
 	"github.com/mguentner/passwordless/middleware"
 	"github.com/rs/zerolog/log"
 )
 
+// extractIdentifier scopes the identifier of the access token to the
+// bucket of the route, routes without a bucket use the default bucket
+func extractIdentifier(r *http.Request, accessToken *crypto.DefaultClaims) (string, error) {
+	bucket, ok := mux.Vars(r)["bucket"]
+	if !ok {
+		bucket = DefaultBucket
+	}
+	return scopedIdentifier(accessToken.Identifier, bucket)
+}
+
+// extractOwnerIdentifier returns the scoped identifier of the owner of a
+// shared key
+func extractOwnerIdentifier(r *http.Request) (string, error) {
+	owner, ok := mux.Vars(r)["owner"]
+	if !ok {
+		return "", errors.New("NoOwnerFoundInRequest")
+	}
+	bucket, ok := mux.Vars(r)["bucket"]
+	if !ok {
+		bucket = DefaultBucket
+	}
+	return scopedIdentifier(owner, bucket)
+}
+
 func extractKey(r *http.Request) (string, error) {
 	vars := mux.Vars(r)
 	key, ok := vars["key"]
@@ -21,6 +53,131 @@ func extractKey(r *http.Request) (string, error) {
 	return key, nil
 }
 
+// extractVersion reads the version either from the route or from the
+// `version` query parameter. ok is false if no version was requested.
+func extractVersion(r *http.Request) (version uint64, ok bool, err error) {
+	vars := mux.Vars(r)
+	versionString, ok := vars["version"]
+	if !ok {
+		versionString = r.URL.Query().Get("version")
+		if len(versionString) == 0 {
+			return 0, false, nil
+		}
+	}
+	version, err = strconv.ParseUint(versionString, 10, 64)
+	if err != nil {
+		return 0, true, errors.New("InvalidVersion")
+	}
+	return version, true, nil
+}
+
+// parseETags parses the value of an If-Match or If-None-Match header.
+// Weak validators are compared like strong ones.
+func parseETags(header string) []string {
+	etags := []string{}
+	for _, etag := range strings.Split(header, ",") {
+		etag = strings.TrimSpace(etag)
+		etag = strings.TrimPrefix(etag, "W/")
+		etag = strings.Trim(etag, "\"")
+		if len(etag) > 0 {
+			etags = append(etags, etag)
+		}
+	}
+	return etags
+}
+
+func extractPreconditions(r *http.Request) Preconditions {
+	return Preconditions{
+		IfMatch:     parseETags(r.Header.Get("If-Match")),
+		IfNoneMatch: parseETags(r.Header.Get("If-None-Match")),
+	}
+}
+
+func formatETag(etag string) string {
+	return fmt.Sprintf("\"%s\"", etag)
+}
+
+// extractTTL reads the TTL in seconds from the `ttl` query parameter
+func extractTTL(r *http.Request) (time.Duration, error) {
+	ttlString := r.URL.Query().Get("ttl")
+	if len(ttlString) == 0 {
+		return 0, nil
+	}
+	ttl, err := strconv.ParseUint(ttlString, 10, 32)
+	if err != nil {
+		return 0, errors.New("InvalidTTL")
+	}
+	return time.Duration(ttl) * time.Second, nil
+}
+
+// extractFilename reads the filename of a Content-Disposition header
+func extractFilename(r *http.Request) string {
+	contentDisposition := r.Header.Get("Content-Disposition")
+	if len(contentDisposition) == 0 {
+		return ""
+	}
+	_, params, err := mime.ParseMediaType(contentDisposition)
+	if err != nil {
+		return ""
+	}
+	return params["filename"]
+}
+
+func setContentHeaders(w http.ResponseWriter, version ValueVersion) {
+	contentType := version.ContentType
+	if len(contentType) == 0 {
+		contentType = "application/octet-stream"
+	}
+	w.Header().Set("Content-Type", contentType)
+	if len(version.ContentEncoding) > 0 {
+		w.Header().Set("Content-Encoding", version.ContentEncoding)
+	}
+	if len(version.Filename) > 0 {
+		w.Header().Set("Content-Disposition", mime.FormatMediaType("attachment", map[string]string{"filename": version.Filename}))
+	}
+}
+
+// setSandboxHeaders keeps browsers from rendering a stored value as a page
+// of safestore, its scripts would run with access to the origin. Called
+// after setContentHeaders, which sets the filename.
+func setSandboxHeaders(w http.ResponseWriter) {
+	w.Header().Set("X-Content-Type-Options", "nosniff")
+	w.Header().Set("Content-Security-Policy", "sandbox")
+	if len(w.Header().Get("Content-Disposition")) == 0 {
+		w.Header().Set("Content-Disposition", "attachment")
+	}
+}
+
+func setVersionHeaders(w http.ResponseWriter, version ValueVersion) {
+	w.Header().Set("ETag", formatETag(version.ETag))
+	if version.ExpiresAt != nil {
+		w.Header().Set("Expires", version.ExpiresAt.UTC().Format(http.TimeFormat))
+	}
+}
+
+// serveValue sends compressed values as they are stored if the client
+// accepts their compression. The ETag is weak then, as it refers to the
+// decompressed value.
+func serveValue(w http.ResponseWriter, r *http.Request, reader *ValueReader, version ValueVersion) {
+	setVersionHeaders(w, version)
+	setContentHeaders(w, version)
+	setSandboxHeaders(w)
+	var content io.ReadSeeker = reader
+	compression := reader.Compression()
+	if len(compression) > 0 {
+		w.Header().Add("Vary", "Accept-Encoding")
+		if acceptsEncoding(r.Header.Get("Accept-Encoding"), compression) {
+			content, _ = reader.Encoded()
+			w.Header().Set("Content-Encoding", compression)
+			w.Header().Set("ETag", "W/"+formatETag(version.ETag))
+		}
+	}
+	// ServeContent answers HEAD requests and handles Range and If-Range
+	// using the ETag and the modification time
+	http.ServeContent(w, r, "", version.Timestamp, content)
+}
+
+// InsertHandler only creates new keys on POST, PUT creates or replaces
 func InsertHandler(w http.ResponseWriter, r *http.Request) {
 	state, config, ok := GetStateAndConfig(w, r)
 	if !ok {
@@ -31,35 +188,77 @@ func InsertHandler(w http.ResponseWriter, r *http.Request) {
 		middleware.HttpJSONError(w, "NoAccessTokenFound", http.StatusUnauthorized)
 		return
 	}
+	identifier, err := extractIdentifier(r, accessToken)
+	if err != nil {
+		middleware.HttpJSONError(w, err.Error(), http.StatusBadRequest)
+		return
+	}
 	key, err := extractKey(r)
 	if err != nil {
 		middleware.HttpJSONError(w, err.Error(), http.StatusBadRequest)
 		return
 	}
-	var buf bytes.Buffer
-	_, err = buf.ReadFrom(r.Body)
+	ttl, err := extractTTL(r)
 	if err != nil {
-		log.Error().Msg("Could not read from request")
-		middleware.HttpJSONError(w, "InternalServerError", http.StatusInternalServerError)
+		middleware.HttpJSONError(w, err.Error(), http.StatusBadRequest)
 		return
 	}
-	_, err = InsertKeyValueForIdentifier(state, *config, accessToken.Identifier, key, buf.Bytes())
+	options := InsertOptions{
+		Preconditions:   extractPreconditions(r),
+		CreateOnly:      r.Method == http.MethodPost,
+		TTL:             ttl,
+		ContentType:     r.Header.Get("Content-Type"),
+		ContentEncoding: r.Header.Get("Content-Encoding"),
+		Filename:        extractFilename(r),
+	}
+	version, err := InsertKeyValueFromReader(state, *config, identifier, key, r.Body, options)
 	if err != nil {
 		if _, ok := err.(*ErrKeyLimitReached); ok {
 			middleware.HttpJSONError(w, "KeyLimitReached", http.StatusPreconditionFailed)
 			return
 		}
+		if _, ok := err.(*ErrPreconditionFailed); ok {
+			middleware.HttpJSONError(w, "PreconditionFailed", http.StatusPreconditionFailed)
+			return
+		}
+		if _, ok := err.(*ErrKeyExists); ok {
+			middleware.HttpJSONError(w, "KeyExists", http.StatusConflict)
+			return
+		}
+		if _, ok := err.(*ErrKeyHasVersions); ok {
+			middleware.HttpJSONError(w, "KeyHasVersions", http.StatusConflict)
+			return
+		}
+		if _, ok := err.(*ErrContentTypeNotAllowed); ok {
+			middleware.HttpJSONError(w, "ContentTypeNotAllowed", http.StatusUnsupportedMediaType)
+			return
+		}
+		if _, ok := err.(*ErrQuotaExceeded); ok {
+			middleware.HttpJSONError(w, "QuotaExceeded", http.StatusInsufficientStorage)
+			return
+		}
 		if _, ok := err.(*ErrDataTooBig); ok {
 			middleware.HttpJSONError(w, "PayloadTooLarge", http.StatusRequestEntityTooLarge)
 			return
 		}
+		if _, ok := err.(*ErrBucketNotFound); ok {
+			middleware.HttpJSONError(w, "BucketNotFound", http.StatusNotFound)
+			return
+		}
 		log.Error().Msgf("Operation error: %s", err.Error())
 		middleware.HttpJSONError(w, "InternalServerError", http.StatusInternalServerError)
 		return
 	}
-	w.WriteHeader(http.StatusCreated)
+	setVersionHeaders(w, version)
+	// the first version of a key is always a newly created key
+	if version.Version == 1 {
+		w.WriteHeader(http.StatusCreated)
+		return
+	}
+	w.WriteHeader(http.StatusOK)
 }
 
+// RetrieveHandler serves GET and HEAD requests
 func RetrieveHandler(w http.ResponseWriter, r *http.Request) {
 	state, _, ok := GetStateAndConfig(w, r)
 	if !ok {
@@ -70,26 +269,80 @@ func RetrieveHandler(w http.ResponseWriter, r *http.Request) {
 		middleware.HttpJSONError(w, "NoAccessTokenFound", http.StatusUnauthorized)
 		return
 	}
+	identifier, err := extractIdentifier(r, accessToken)
+	if err != nil {
+		middleware.HttpJSONError(w, err.Error(), http.StatusBadRequest)
+		return
+	}
 	key, err := extractKey(r)
 	if err != nil {
 		middleware.HttpJSONError(w, err.Error(), http.StatusBadRequest)
 		return
 	}
-	value, err := RetrieveValueIdentifierAndKey(state, accessToken.Identifier, key)
+	version, _, err := extractVersion(r)
+	if err != nil {
+		middleware.HttpJSONError(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+	reader, valueVersion, err := OpenVersionForIdentifierAndKey(state, identifier, key, version)
 	if err != nil {
 		if _, ok := err.(*ErrKeyNotFound); ok {
 			middleware.HttpJSONError(w, "KeyNotFound", http.StatusNotFound)
 			return
 		}
+		if _, ok := err.(*ErrVersionNotFound); ok {
+			middleware.HttpJSONError(w, "VersionNotFound", http.StatusNotFound)
+			return
+		}
 		log.Error().Msgf("Operation error: %s", err.Error())
 		middleware.HttpJSONError(w, "InternalServerError", http.StatusInternalServerError)
 		return
 	}
-	w.Write(value)
-	w.Header().Set("Content-Type", "application/octet-stream")
+	defer reader.Close()
+	serveValue(w, r, reader, valueVersion)
 }
 
 func DeleteHandler(w http.ResponseWriter, r *http.Request) {
+	state, config, ok := GetStateAndConfig(w, r)
+	if !ok {
+		return
+	}
+	accessToken, ok := r.Context().Value("accessToken").(*crypto.DefaultClaims)
+	if !ok || accessToken == nil {
+		middleware.HttpJSONError(w, "NoAccessTokenFound", http.StatusUnauthorized)
+		return
+	}
+	identifier, err := extractIdentifier(r, accessToken)
+	if err != nil {
+		middleware.HttpJSONError(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+	key, err := extractKey(r)
+	if err != nil {
+		middleware.HttpJSONError(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+	err = TrashKeyValueForIdentifier(state, *config, identifier, key, extractPreconditions(r))
+	if err != nil {
+		if _, ok := err.(*ErrKeyNotFound); ok {
+			middleware.HttpJSONError(w, "KeyNotFound", http.StatusNotFound)
+			return
+		}
+		if _, ok := err.(*ErrPreconditionFailed); ok {
+			middleware.HttpJSONError(w, "PreconditionFailed", http.StatusPreconditionFailed)
+			return
+		}
+		log.Error().Msgf("Operation error: %s", err.Error())
+		middleware.HttpJSONError(w, "InternalServerError", http.StatusInternalServerError)
+		return
+	}
+}
+
+type VersionsResponse struct {
+	Versions []ValueVersion `json:"versions"`
+}
+
+func VersionsHandler(w http.ResponseWriter, r *http.Request) {
 	state, _, ok := GetStateAndConfig(w, r)
 	if !ok {
 		return
@@ -99,25 +352,122 @@ func DeleteHandler(w http.ResponseWriter, r *http.Request) {
 		middleware.HttpJSONError(w, "NoAccessTokenFound", http.StatusUnauthorized)
 		return
 	}
+	identifier, err := extractIdentifier(r, accessToken)
+	if err != nil {
+		middleware.HttpJSONError(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+	key, err := extractKey(r)
+	if err != nil {
+		middleware.HttpJSONError(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+	versions, err := VersionsForIdentifierAndKey(state, identifier, key)
+	if err != nil {
+		if _, ok := err.(*ErrKeyNotFound); ok {
+			middleware.HttpJSONError(w, "KeyNotFound", http.StatusNotFound)
+			return
+		}
+		log.Error().Msgf("Operation error: %s", err.Error())
+		middleware.HttpJSONError(w, "InternalServerError", http.StatusInternalServerError)
+		return
+	}
+	w.Header().Set("Content-Type", "application/json")
+	response := VersionsResponse{
+		Versions: versions,
+	}
+	encoder := json.NewEncoder(w)
+	err = encoder.Encode(response)
+	if err != nil {
+		log.Error().Msgf("Encoder error: %s", err.Error())
+		middleware.HttpJSONError(w, "InternalServerError", http.StatusInternalServerError)
+		return
+	}
+}
+
+func RestoreHandler(w http.ResponseWriter, r *http.Request) {
+	state, config, ok := GetStateAndConfig(w, r)
+	if !ok {
+		return
+	}
+	accessToken, ok := r.Context().Value("accessToken").(*crypto.DefaultClaims)
+	if !ok || accessToken == nil {
+		middleware.HttpJSONError(w, "NoAccessTokenFound", http.StatusUnauthorized)
+		return
+	}
+	identifier, err := extractIdentifier(r, accessToken)
+	if err != nil {
+		middleware.HttpJSONError(w, err.Error(), http.StatusBadRequest)
+		return
+	}
 	key, err := extractKey(r)
 	if err != nil {
 		middleware.HttpJSONError(w, err.Error(), http.StatusBadRequest)
 		return
 	}
-	err = DeleteKeyValueForIdentifier(state, accessToken.Identifier, key)
+	version, versionRequested, err := extractVersion(r)
+	if err != nil {
+		middleware.HttpJSONError(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+	if !versionRequested {
+		middleware.HttpJSONError(w, "NoVersionFoundInRequest", http.StatusBadRequest)
+		return
+	}
+	err = RestoreVersionForIdentifierAndKey(state, *config, identifier, key, version)
 	if err != nil {
 		if _, ok := err.(*ErrKeyNotFound); ok {
 			middleware.HttpJSONError(w, "KeyNotFound", http.StatusNotFound)
 			return
 		}
+		if _, ok := err.(*ErrVersionNotFound); ok {
+			middleware.HttpJSONError(w, "VersionNotFound", http.StatusNotFound)
+			return
+		}
+		if _, ok := err.(*ErrKeyLimitReached); ok {
+			middleware.HttpJSONError(w, "KeyLimitReached", http.StatusPreconditionFailed)
+			return
+		}
+		if _, ok := err.(*ErrQuotaExceeded); ok {
+			middleware.HttpJSONError(w, "QuotaExceeded", http.StatusInsufficientStorage)
+			return
+		}
+		if _, ok := err.(*ErrContentTypeNotAllowed); ok {
+			middleware.HttpJSONError(w, "ContentTypeNotAllowed", http.StatusUnsupportedMediaType)
+			return
+		}
+		if _, ok := err.(*ErrBucketNotFound); ok {
+			middleware.HttpJSONError(w, "BucketNotFound", http.StatusNotFound)
+			return
+		}
 		log.Error().Msgf("Operation error: %s", err.Error())
 		middleware.HttpJSONError(w, "InternalServerError", http.StatusInternalServerError)
 		return
 	}
+	w.WriteHeader(http.StatusCreated)
 }
 
 type IndexReponse struct {
-	Keys []string `json:"keys"`
+	Keys       []string     `json:"keys"`
+	Details    []KeyDetails `json:"details,omitempty"`
+	NextCursor string       `json:"nextCursor,omitempty"`
+}
+
+func extractListOptions(r *http.Request) (ListOptions, error) {
+	query := r.URL.Query()
+	options := ListOptions{
+		Prefix: query.Get("prefix"),
+		Cursor: query.Get("cursor"),
+	}
+	limitString := query.Get("limit")
+	if len(limitString) > 0 {
+		limit, err := strconv.Atoi(limitString)
+		if err != nil || limit < 0 {
+			return options, errors.New("InvalidLimit")
+		}
+		options.Limit = limit
+	}
+	return options, nil
 }
 
 func IndexHandler(w http.ResponseWriter, r *http.Request) {
@@ -130,15 +480,54 @@ func IndexHandler(w http.ResponseWriter, r *http.Request) {
 		middleware.HttpJSONError(w, "NoAccessTokenFound", http.StatusUnauthorized)
 		return
 	}
-	keys, err := KeysForIdentifier(state, accessToken.Identifier)
+	identifier, err := extractIdentifier(r, accessToken)
+	if err != nil {
+		middleware.HttpJSONError(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+	options, err := extractListOptions(r)
+	if err != nil {
+		middleware.HttpJSONError(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+	withDetails := false
+	if detailsString := r.URL.Query().Get("details"); len(detailsString) > 0 {
+		withDetails, err = strconv.ParseBool(detailsString)
+		if err != nil {
+			middleware.HttpJSONError(w, "InvalidDetails", http.StatusBadRequest)
+			return
+		}
+	}
+	var keys []string
+	var details []KeyDetails
+	var nextCursor string
+	if withDetails {
+		details, nextCursor, err = KeyDetailsForIdentifierWithOptions(state, identifier, options)
+		keys = []string{}
+		for _, d := range details {
+			keys = append(keys, d.Key)
+		}
+	} else {
+		keys, nextCursor, err = KeysForIdentifierWithOptions(state, identifier, options)
+	}
 	if err != nil {
+		if _, ok := err.(*ErrInvalidCursor); ok {
+			middleware.HttpJSONError(w, "InvalidCursor", http.StatusBadRequest)
+			return
+		}
+		if _, ok := err.(*ErrBucketNotFound); ok {
+			middleware.HttpJSONError(w, "BucketNotFound", http.StatusNotFound)
+			return
+		}
 		log.Error().Msgf("Operation error: %s", err.Error())
 		middleware.HttpJSONError(w, "InternalServerError", http.StatusInternalServerError)
 		return
 	}
 	w.Header().Set("Content-Type", "application/json")
 	response := IndexReponse{
-		Keys: keys,
+		Keys:       keys,
+		Details:    details,
+		NextCursor: nextCursor,
 	}
 	encoder := json.NewEncoder(w)
 	err = encoder.Encode(response)
@@ -149,3 +538,1534 @@ func IndexHandler(w http.ResponseWriter, r *http.Request) {
 	}
 	return
 }
+
+type UsageResponse struct {
+	Usage
+	MaxKeys           uint64 `json:"maxKeys"`
+	MaxBytes          uint64 `json:"maxBytes"`
+	MaxValueSizeBytes uint64 `json:"maxValueSizeBytes"`
+}
+
+func UsageHandler(w http.ResponseWriter, r *http.Request) {
+	state, config, ok := GetStateAndConfig(w, r)
+	if !ok {
+		return
+	}
+	accessToken, ok := r.Context().Value("accessToken").(*crypto.DefaultClaims)
+	if !ok || accessToken == nil {
+		middleware.HttpJSONError(w, "NoAccessTokenFound", http.StatusUnauthorized)
+		return
+	}
+	usage, err := AccountUsageForIdentifier(state, accessToken.Identifier)
+	if err != nil {
+		log.Error().Msgf("Operation error: %s", err.Error())
+		middleware.HttpJSONError(w, "InternalServerError", http.StatusInternalServerError)
+		return
+	}
+	w.Header().Set("Content-Type", "application/json")
+	response := UsageResponse{
+		Usage:             usage,
+		MaxKeys:           config.StorageOptions.MaxKeysPerAccount,
+		MaxBytes:          config.StorageOptions.MaxBytesPerAccount,
+		MaxValueSizeBytes: config.StorageOptions.MaxValueSizeBytes,
+	}
+	encoder := json.NewEncoder(w)
+	err = encoder.Encode(response)
+	if err != nil {
+		log.Error().Msgf("Encoder error: %s", err.Error())
+		middleware.HttpJSONError(w, "InternalServerError", http.StatusInternalServerError)
+		return
+	}
+}
+
+type BatchRequest struct {
+	Operations []BatchOperation `json:"operations"`
+}
+
+type BatchResponse struct {
+	Committed bool          `json:"committed"`
+	Error     string        `json:"error,omitempty"`
+	Results   []BatchResult `json:"results"`
+}
+
+// batchErrorStatus returns the status code matching the error of a
+// failed batch and false if the error is not caused by the batch
+func batchErrorStatus(err error) (int, bool) {
+	switch err.(type) {
+	case *ErrInvalidBatchOperation:
+		return http.StatusBadRequest, true
+	case *ErrKeyNotFound, *ErrBucketNotFound:
+		return http.StatusNotFound, true
+	case *ErrKeyExists, *ErrKeyHasVersions:
+		return http.StatusConflict, true
+	case *ErrPreconditionFailed, *ErrKeyLimitReached:
+		return http.StatusPreconditionFailed, true
+	case *ErrDataTooBig, *ErrBatchTooLarge:
+		return http.StatusRequestEntityTooLarge, true
+	case *ErrContentTypeNotAllowed:
+		return http.StatusUnsupportedMediaType, true
+	case *ErrQuotaExceeded:
+		return http.StatusInsufficientStorage, true
+	}
+	return 0, false
+}
+
+// BatchHandler executes all operations of a batch atomically
+func BatchHandler(w http.ResponseWriter, r *http.Request) {
+	state, config, ok := GetStateAndConfig(w, r)
+	if !ok {
+		return
+	}
+	accessToken, ok := r.Context().Value("accessToken").(*crypto.DefaultClaims)
+	if !ok || accessToken == nil {
+		middleware.HttpJSONError(w, "NoAccessTokenFound", http.StatusUnauthorized)
+		return
+	}
+	identifier, err := extractIdentifier(r, accessToken)
+	if err != nil {
+		middleware.HttpJSONError(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+	var request BatchRequest
+	err = json.NewDecoder(r.Body).Decode(&request)
+	if err != nil {
+		middleware.HttpJSONError(w, "InvalidBatch", http.StatusBadRequest)
+		return
+	}
+	results, err := ExecuteBatchForIdentifier(state, *config, identifier, request.Operations)
+	response := BatchResponse{
+		Committed: err == nil,
+		Results:   results,
+	}
+	status := http.StatusOK
+	if err != nil {
+		var known bool
+		status, known = batchErrorStatus(err)
+		if !known {
+			log.Error().Msgf("Operation error: %s", err.Error())
+			middleware.HttpJSONError(w, "InternalServerError", http.StatusInternalServerError)
+			return
+		}
+		response.Error = err.Error()
+	}
+	if response.Results == nil {
+		response.Results = []BatchResult{}
+	}
+	w.Header().Set("Content-Type", "application/json")
+	w.WriteHeader(status)
+	encoder := json.NewEncoder(w)
+	err = encoder.Encode(response)
+	if err != nil {
+		log.Error().Msgf("Encoder error: %s", err.Error())
+	}
+}
+
+type IncrementResponse struct {
+	Value int64 `json:"value"`
+}
+
+// extractDelta reads the `delta` query parameter, which defaults to 1
+func extractDelta(r *http.Request) (int64, error) {
+	deltaString := r.URL.Query().Get("delta")
+	if len(deltaString) == 0 {
+		return 1, nil
+	}
+	delta, err := strconv.ParseInt(deltaString, 10, 64)
+	if err != nil {
+		return 0, errors.New("InvalidDelta")
+	}
+	return delta, nil
+}
+
+// IncrementHandler increments or, using a negative delta, decrements
+// an integer value
+func IncrementHandler(w http.ResponseWriter, r *http.Request) {
+	state, config, ok := GetStateAndConfig(w, r)
+	if !ok {
+		return
+	}
+	accessToken, ok := r.Context().Value("accessToken").(*crypto.DefaultClaims)
+	if !ok || accessToken == nil {
+		middleware.HttpJSONError(w, "NoAccessTokenFound", http.StatusUnauthorized)
+		return
+	}
+	identifier, err := extractIdentifier(r, accessToken)
+	if err != nil {
+		middleware.HttpJSONError(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+	key, err := extractKey(r)
+	if err != nil {
+		middleware.HttpJSONError(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+	delta, err := extractDelta(r)
+	if err != nil {
+		middleware.HttpJSONError(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+	value, version, err := IncrementKeyValueForIdentifier(state, *config, identifier, key, delta, extractPreconditions(r))
+	if err != nil {
+		if _, ok := err.(*ErrValueNotAnInteger); ok {
+			middleware.HttpJSONError(w, "ValueNotAnInteger", http.StatusConflict)
+			return
+		}
+		if _, ok := err.(*ErrIntegerOverflow); ok {
+			middleware.HttpJSONError(w, "IntegerOverflow", http.StatusConflict)
+			return
+		}
+		if _, ok := err.(*ErrPreconditionFailed); ok {
+			middleware.HttpJSONError(w, "PreconditionFailed", http.StatusPreconditionFailed)
+			return
+		}
+		if _, ok := err.(*ErrKeyLimitReached); ok {
+			middleware.HttpJSONError(w, "KeyLimitReached", http.StatusPreconditionFailed)
+			return
+		}
+		if _, ok := err.(*ErrContentTypeNotAllowed); ok {
+			middleware.HttpJSONError(w, "ContentTypeNotAllowed", http.StatusUnsupportedMediaType)
+			return
+		}
+		if _, ok := err.(*ErrQuotaExceeded); ok {
+			middleware.HttpJSONError(w, "QuotaExceeded", http.StatusInsufficientStorage)
+			return
+		}
+		if _, ok := err.(*ErrDataTooBig); ok {
+			middleware.HttpJSONError(w, "PayloadTooLarge", http.StatusRequestEntityTooLarge)
+			return
+		}
+		if _, ok := err.(*ErrTooManyConflicts); ok {
+			w.Header().Set("Retry-After", "1")
+			middleware.HttpJSONError(w, "TooManyConflicts", http.StatusServiceUnavailable)
+			return
+		}
+		if _, ok := err.(*ErrBucketNotFound); ok {
+			middleware.HttpJSONError(w, "BucketNotFound", http.StatusNotFound)
+			return
+		}
+		log.Error().Msgf("Operation error: %s", err.Error())
+		middleware.HttpJSONError(w, "InternalServerError", http.StatusInternalServerError)
+		return
+	}
+	setVersionHeaders(w, version)
+	w.Header().Set("Content-Type", "application/json")
+	if version.Version == 1 {
+		w.WriteHeader(http.StatusCreated)
+	}
+	encoder := json.NewEncoder(w)
+	err = encoder.Encode(IncrementResponse{Value: value})
+	if err != nil {
+		log.Error().Msgf("Encoder error: %s", err.Error())
+	}
+}
+
+// AppendHandler appends the request body to a value, creating it with
+// the request Content-Type if it does not exist
+func AppendHandler(w http.ResponseWriter, r *http.Request) {
+	state, config, ok := GetStateAndConfig(w, r)
+	if !ok {
+		return
+	}
+	accessToken, ok := r.Context().Value("accessToken").(*crypto.DefaultClaims)
+	if !ok || accessToken == nil {
+		middleware.HttpJSONError(w, "NoAccessTokenFound", http.StatusUnauthorized)
+		return
+	}
+	identifier, err := extractIdentifier(r, accessToken)
+	if err != nil {
+		middleware.HttpJSONError(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+	key, err := extractKey(r)
+	if err != nil {
+		middleware.HttpJSONError(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+	body := io.Reader(r.Body)
+	if config.StorageOptions.MaxValueSizeBytes > 0 {
+		body = io.LimitReader(body, int64(config.StorageOptions.MaxValueSizeBytes)+1)
+	}
+	data, err := ioutil.ReadAll(body)
+	if err != nil {
+		log.Error().Msg("Could not read from request")
+		middleware.HttpJSONError(w, "InternalServerError", http.StatusInternalServerError)
+		return
+	}
+	version, err := AppendKeyValueForIdentifier(state, *config, identifier, key, data, extractPreconditions(r), r.Header.Get("Content-Type"))
+	if err != nil {
+		if _, ok := err.(*ErrPreconditionFailed); ok {
+			middleware.HttpJSONError(w, "PreconditionFailed", http.StatusPreconditionFailed)
+			return
+		}
+		if _, ok := err.(*ErrKeyLimitReached); ok {
+			middleware.HttpJSONError(w, "KeyLimitReached", http.StatusPreconditionFailed)
+			return
+		}
+		if _, ok := err.(*ErrContentTypeNotAllowed); ok {
+			middleware.HttpJSONError(w, "ContentTypeNotAllowed", http.StatusUnsupportedMediaType)
+			return
+		}
+		if _, ok := err.(*ErrQuotaExceeded); ok {
+			middleware.HttpJSONError(w, "QuotaExceeded", http.StatusInsufficientStorage)
+			return
+		}
+		if _, ok := err.(*ErrDataTooBig); ok {
+			middleware.HttpJSONError(w, "PayloadTooLarge", http.StatusRequestEntityTooLarge)
+			return
+		}
+		if _, ok := err.(*ErrValueTooLargeToAppend); ok {
+			middleware.HttpJSONError(w, "ValueTooLargeToAppend", http.StatusRequestEntityTooLarge)
+			return
+		}
+		if _, ok := err.(*ErrTooManyConflicts); ok {
+			w.Header().Set("Retry-After", "1")
+			middleware.HttpJSONError(w, "TooManyConflicts", http.StatusServiceUnavailable)
+			return
+		}
+		if _, ok := err.(*ErrBucketNotFound); ok {
+			middleware.HttpJSONError(w, "BucketNotFound", http.StatusNotFound)
+			return
+		}
+		log.Error().Msgf("Operation error: %s", err.Error())
+		middleware.HttpJSONError(w, "InternalServerError", http.StatusInternalServerError)
+		return
+	}
+	setVersionHeaders(w, version)
+	if version.Version == 1 {
+		w.WriteHeader(http.StatusCreated)
+		return
+	}
+	w.WriteHeader(http.StatusOK)
+}
+
+// PatchHandler applies a merge patch or a JSON patch to a JSON value,
+// the patch format is selected using the Content-Type of the request
+func PatchHandler(w http.ResponseWriter, r *http.Request) {
+	state, config, ok := GetStateAndConfig(w, r)
+	if !ok {
+		return
+	}
+	accessToken, ok := r.Context().Value("accessToken").(*crypto.DefaultClaims)
+	if !ok || accessToken == nil {
+		middleware.HttpJSONError(w, "NoAccessTokenFound", http.StatusUnauthorized)
+		return
+	}
+	identifier, err := extractIdentifier(r, accessToken)
+	if err != nil {
+		middleware.HttpJSONError(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+	key, err := extractKey(r)
+	if err != nil {
+		middleware.HttpJSONError(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+	patchType, _, err := mime.ParseMediaType(r.Header.Get("Content-Type"))
+	if err != nil || (patchType != MergePatchContentType && patchType != JSONPatchContentType) {
+		middleware.HttpJSONError(w, "UnsupportedPatchType", http.StatusUnsupportedMediaType)
+		return
+	}
+	body := io.Reader(r.Body)
+	if config.StorageOptions.MaxValueSizeBytes > 0 {
+		body = io.LimitReader(body, int64(config.StorageOptions.MaxValueSizeBytes)+1)
+	}
+	patch, err := ioutil.ReadAll(body)
+	if err != nil {
+		log.Error().Msg("Could not read from request")
+		middleware.HttpJSONError(w, "InternalServerError", http.StatusInternalServerError)
+		return
+	}
+	version, err := PatchKeyValueForIdentifier(state, *config, identifier, key, patchType, patch, extractPreconditions(r))
+	if err != nil {
+		if _, ok := err.(*ErrKeyNotFound); ok {
+			middleware.HttpJSONError(w, "KeyNotFound", http.StatusNotFound)
+			return
+		}
+		if _, ok := err.(*ErrPreconditionFailed); ok {
+			middleware.HttpJSONError(w, "PreconditionFailed", http.StatusPreconditionFailed)
+			return
+		}
+		if _, ok := err.(*ErrValueNotJSON); ok {
+			middleware.HttpJSONError(w, "ValueNotJSON", http.StatusConflict)
+			return
+		}
+		if _, ok := err.(*ErrInvalidPatch); ok {
+			middleware.HttpJSONError(w, "InvalidPatch", http.StatusUnprocessableEntity)
+			return
+		}
+		if _, ok := err.(*ErrQuotaExceeded); ok {
+			middleware.HttpJSONError(w, "QuotaExceeded", http.StatusInsufficientStorage)
+			return
+		}
+		if _, ok := err.(*ErrDataTooBig); ok {
+			middleware.HttpJSONError(w, "PayloadTooLarge", http.StatusRequestEntityTooLarge)
+			return
+		}
+		if _, ok := err.(*ErrBucketNotFound); ok {
+			middleware.HttpJSONError(w, "BucketNotFound", http.StatusNotFound)
+			return
+		}
+		if _, ok := err.(*ErrTooManyConflicts); ok {
+			w.Header().Set("Retry-After", "1")
+			middleware.HttpJSONError(w, "TooManyConflicts", http.StatusServiceUnavailable)
+			return
+		}
+		log.Error().Msgf("Operation error: %s", err.Error())
+		middleware.HttpJSONError(w, "InternalServerError", http.StatusInternalServerError)
+		return
+	}
+	setVersionHeaders(w, version)
+	w.WriteHeader(http.StatusOK)
+}
+
+type BucketsResponse struct {
+	Buckets []BucketDetails `json:"buckets"`
+}
+
+func BucketsHandler(w http.ResponseWriter, r *http.Request) {
+	state, _, ok := GetStateAndConfig(w, r)
+	if !ok {
+		return
+	}
+	accessToken, ok := r.Context().Value("accessToken").(*crypto.DefaultClaims)
+	if !ok || accessToken == nil {
+		middleware.HttpJSONError(w, "NoAccessTokenFound", http.StatusUnauthorized)
+		return
+	}
+	buckets, err := BucketsForIdentifier(state, accessToken.Identifier)
+	if err != nil {
+		log.Error().Msgf("Operation error: %s", err.Error())
+		middleware.HttpJSONError(w, "InternalServerError", http.StatusInternalServerError)
+		return
+	}
+	w.Header().Set("Content-Type", "application/json")
+	encoder := json.NewEncoder(w)
+	err = encoder.Encode(BucketsResponse{Buckets: buckets})
+	if err != nil {
+		log.Error().Msgf("Encoder error: %s", err.Error())
+		middleware.HttpJSONError(w, "InternalServerError", http.StatusInternalServerError)
+		return
+	}
+}
+
+// CreateBucketHandler expects the name and the optional limits of the
+// bucket as JSON
+func CreateBucketHandler(w http.ResponseWriter, r *http.Request) {
+	state, config, ok := GetStateAndConfig(w, r)
+	if !ok {
+		return
+	}
+	accessToken, ok := r.Context().Value("accessToken").(*crypto.DefaultClaims)
+	if !ok || accessToken == nil {
+		middleware.HttpJSONError(w, "NoAccessTokenFound", http.StatusUnauthorized)
+		return
+	}
+	var bucket Bucket
+	err := json.NewDecoder(r.Body).Decode(&bucket)
+	if err != nil {
+		middleware.HttpJSONError(w, "InvalidBucket", http.StatusBadRequest)
+		return
+	}
+	bucket, err = CreateBucketForIdentifier(state, *config, accessToken.Identifier, bucket)
+	if err != nil {
+		if _, ok := err.(*ErrInvalidBucketName); ok {
+			middleware.HttpJSONError(w, "InvalidBucketName", http.StatusBadRequest)
+			return
+		}
+		if _, ok := err.(*ErrBucketExists); ok {
+			middleware.HttpJSONError(w, "BucketExists", http.StatusConflict)
+			return
+		}
+		if _, ok := err.(*ErrBucketDeletionPending); ok {
+			middleware.HttpJSONError(w, "BucketDeletionPending", http.StatusConflict)
+			return
+		}
+		if _, ok := err.(*ErrBucketLimitReached); ok {
+			middleware.HttpJSONError(w, "BucketLimitReached", http.StatusPreconditionFailed)
+			return
+		}
+		log.Error().Msgf("Operation error: %s", err.Error())
+		middleware.HttpJSONError(w, "InternalServerError", http.StatusInternalServerError)
+		return
+	}
+	w.Header().Set("Content-Type", "application/json")
+	w.WriteHeader(http.StatusCreated)
+	encoder := json.NewEncoder(w)
+	err = encoder.Encode(bucket)
+	if err != nil {
+		log.Error().Msgf("Encoder error: %s", err.Error())
+	}
+}
+
+// DeleteBucketHandler deletes a bucket and all of its keys
+func DeleteBucketHandler(w http.ResponseWriter, r *http.Request) {
+	state, config, ok := GetStateAndConfig(w, r)
+	if !ok {
+		return
+	}
+	accessToken, ok := r.Context().Value("accessToken").(*crypto.DefaultClaims)
+	if !ok || accessToken == nil {
+		middleware.HttpJSONError(w, "NoAccessTokenFound", http.StatusUnauthorized)
+		return
+	}
+	bucket, ok := mux.Vars(r)["bucket"]
+	if !ok {
+		middleware.HttpJSONError(w, "NoBucketFoundInRequest", http.StatusBadRequest)
+		return
+	}
+	err := DeleteBucketForIdentifier(state, *config, accessToken.Identifier, bucket)
+	if err != nil {
+		if _, ok := err.(*ErrInvalidBucketName); ok {
+			middleware.HttpJSONError(w, "InvalidBucketName", http.StatusBadRequest)
+			return
+		}
+		if _, ok := err.(*ErrBucketNotFound); ok {
+			middleware.HttpJSONError(w, "BucketNotFound", http.StatusNotFound)
+			return
+		}
+		log.Error().Msgf("Operation error: %s", err.Error())
+		middleware.HttpJSONError(w, "InternalServerError", http.StatusInternalServerError)
+		return
+	}
+	w.WriteHeader(http.StatusOK)
+}
+
+type TrashResponse struct {
+	Keys []TrashedKey `json:"keys"`
+}
+
+func TrashHandler(w http.ResponseWriter, r *http.Request) {
+	state, _, ok := GetStateAndConfig(w, r)
+	if !ok {
+		return
+	}
+	accessToken, ok := r.Context().Value("accessToken").(*crypto.DefaultClaims)
+	if !ok || accessToken == nil {
+		middleware.HttpJSONError(w, "NoAccessTokenFound", http.StatusUnauthorized)
+		return
+	}
+	identifier, err := extractIdentifier(r, accessToken)
+	if err != nil {
+		middleware.HttpJSONError(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+	trash, err := TrashForIdentifier(state, identifier)
+	if err != nil {
+		log.Error().Msgf("Operation error: %s", err.Error())
+		middleware.HttpJSONError(w, "InternalServerError", http.StatusInternalServerError)
+		return
+	}
+	w.Header().Set("Content-Type", "application/json")
+	encoder := json.NewEncoder(w)
+	err = encoder.Encode(TrashResponse{Keys: trash})
+	if err != nil {
+		log.Error().Msgf("Encoder error: %s", err.Error())
+		middleware.HttpJSONError(w, "InternalServerError", http.StatusInternalServerError)
+		return
+	}
+}
+
+// RestoreTrashHandler restores a trashed key and returns its new version
+func RestoreTrashHandler(w http.ResponseWriter, r *http.Request) {
+	state, config, ok := GetStateAndConfig(w, r)
+	if !ok {
+		return
+	}
+	accessToken, ok := r.Context().Value("accessToken").(*crypto.DefaultClaims)
+	if !ok || accessToken == nil {
+		middleware.HttpJSONError(w, "NoAccessTokenFound", http.StatusUnauthorized)
+		return
+	}
+	identifier, err := extractIdentifier(r, accessToken)
+	if err != nil {
+		middleware.HttpJSONError(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+	key, err := extractKey(r)
+	if err != nil {
+		middleware.HttpJSONError(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+	version, err := RestoreTrashedKeyForIdentifier(state, *config, identifier, key)
+	if err != nil {
+		if _, ok := err.(*ErrKeyNotFound); ok {
+			middleware.HttpJSONError(w, "KeyNotFound", http.StatusNotFound)
+			return
+		}
+		if _, ok := err.(*ErrKeyExists); ok {
+			middleware.HttpJSONError(w, "KeyExists", http.StatusConflict)
+			return
+		}
+		if _, ok := err.(*ErrKeyLimitReached); ok {
+			middleware.HttpJSONError(w, "KeyLimitReached", http.StatusPreconditionFailed)
+			return
+		}
+		if _, ok := err.(*ErrQuotaExceeded); ok {
+			middleware.HttpJSONError(w, "QuotaExceeded", http.StatusInsufficientStorage)
+			return
+		}
+		if _, ok := err.(*ErrBucketNotFound); ok {
+			middleware.HttpJSONError(w, "BucketNotFound", http.StatusNotFound)
+			return
+		}
+		log.Error().Msgf("Operation error: %s", err.Error())
+		middleware.HttpJSONError(w, "InternalServerError", http.StatusInternalServerError)
+		return
+	}
+	w.Header().Set("Content-Type", "application/json")
+	w.WriteHeader(http.StatusCreated)
+	encoder := json.NewEncoder(w)
+	err = encoder.Encode(version)
+	if err != nil {
+		log.Error().Msgf("Encoder error: %s", err.Error())
+	}
+}
+
+// ExportHandler streams an archive of all buckets of the account. Errors
+// that occur after the archive was started can only be logged.
+func ExportHandler(w http.ResponseWriter, r *http.Request) {
+	state, _, ok := GetStateAndConfig(w, r)
+	if !ok {
+		return
+	}
+	accessToken, ok := r.Context().Value("accessToken").(*crypto.DefaultClaims)
+	if !ok || accessToken == nil {
+		middleware.HttpJSONError(w, "NoAccessTokenFound", http.StatusUnauthorized)
+		return
+	}
+	format := r.URL.Query().Get("format")
+	if len(format) == 0 {
+		format = ExportFormatTar
+	}
+	contentType, ok := ExportContentType(format)
+	if !ok {
+		middleware.HttpJSONError(w, "InvalidExportFormat", http.StatusBadRequest)
+		return
+	}
+	w.Header().Set("Content-Type", contentType)
+	w.Header().Set("Content-Disposition", mime.FormatMediaType("attachment", map[string]string{"filename": "safestore-export." + format}))
+	err := ExportForIdentifier(state, accessToken.Identifier, format, w)
+	if err != nil {
+		log.Error().Msgf("Export error: %s", err.Error())
+	}
+}
+
+func importErrorStatus(err error) (int, bool) {
+	switch err.(type) {
+	case *ErrInvalidArchive, *ErrInvalidImportMode, *ErrInvalidExportFormat:
+		return http.StatusBadRequest, true
+	case *ErrImportConflict:
+		return http.StatusConflict, true
+	case *ErrKeyLimitReached, *ErrBucketLimitReached:
+		return http.StatusPreconditionFailed, true
+	case *ErrDataTooBig, *ErrArchiveTooBig:
+		return http.StatusRequestEntityTooLarge, true
+	case *ErrContentTypeNotAllowed:
+		return http.StatusUnsupportedMediaType, true
+	case *ErrQuotaExceeded:
+		return http.StatusInsufficientStorage, true
+	}
+	return 0, false
+}
+
+// ImportHandler imports an archive created by ExportHandler. `mode` is
+// one of fail (default), skip and overwrite, `dryRun=true` only returns
+// the report.
+func ImportHandler(w http.ResponseWriter, r *http.Request) {
+	state, config, ok := GetStateAndConfig(w, r)
+	if !ok {
+		return
+	}
+	accessToken, ok := r.Context().Value("accessToken").(*crypto.DefaultClaims)
+	if !ok || accessToken == nil {
+		middleware.HttpJSONError(w, "NoAccessTokenFound", http.StatusUnauthorized)
+		return
+	}
+	options := ImportOptions{
+		Format: r.URL.Query().Get("format"),
+		Mode:   r.URL.Query().Get("mode"),
+		DryRun: r.URL.Query().Get("dryRun") == "true",
+	}
+	if len(options.Format) == 0 {
+		options.Format = ExportFormatTar
+	}
+	if len(options.Mode) == 0 {
+		options.Mode = ImportFailOnConflict
+	}
+	report, err := ImportForIdentifier(state, *config, accessToken.Identifier, r.Body, options)
+	status := http.StatusOK
+	if err != nil {
+		var known bool
+		status, known = importErrorStatus(err)
+		if !known {
+			log.Error().Msgf("Operation error: %s", err.Error())
+			middleware.HttpJSONError(w, "InternalServerError", http.StatusInternalServerError)
+			return
+		}
+		report.Error = err.Error()
+	}
+	w.Header().Set("Content-Type", "application/json")
+	w.WriteHeader(status)
+	encoder := json.NewEncoder(w)
+	err = encoder.Encode(report)
+	if err != nil {
+		log.Error().Msgf("Encoder error: %s", err.Error())
+	}
+}
+
+type DeleteAccountRequest struct {
+	// login token requested using /api/login
+	Token string `json:"token"`
+}
+
+// DeleteAccountHandler erases all data of the account once the deletion
+// is confirmed with a fresh login token
+func DeleteAccountHandler(w http.ResponseWriter, r *http.Request) {
+	state, _, ok := GetStateAndConfig(w, r)
+	if !ok {
+		return
+	}
+	accessToken, ok := r.Context().Value("accessToken").(*crypto.DefaultClaims)
+	if !ok || accessToken == nil {
+		middleware.HttpJSONError(w, "NoAccessTokenFound", http.StatusUnauthorized)
+		return
+	}
+	var request DeleteAccountRequest
+	err := json.NewDecoder(r.Body).Decode(&request)
+	if err != nil {
+		middleware.HttpJSONError(w, "InvalidConfirmation", http.StatusBadRequest)
+		return
+	}
+	_, err = DeleteAccountForIdentifier(state, accessToken.Identifier, request.Token)
+	if err != nil {
+		if _, ok := err.(*ErrInvalidConfirmationToken); ok {
+			middleware.HttpJSONError(w, "InvalidConfirmationToken", http.StatusForbidden)
+			return
+		}
+		log.Error().Msgf("Operation error: %s", err.Error())
+		middleware.HttpJSONError(w, "InternalServerError", http.StatusInternalServerError)
+		return
+	}
+	w.WriteHeader(http.StatusOK)
+}
+
+// AuthenticateHandler replaces the handler of passwordless for /api/auth,
+// see AuthenticateIdentifier
+func AuthenticateHandler(w http.ResponseWriter, r *http.Request) {
+	state, config, ok := GetStateAndConfig(w, r)
+	if !ok {
+		return
+	}
+	var payload handlers.AuthenicatePayload
+	err := json.NewDecoder(r.Body).Decode(&payload)
+	if err != nil {
+		middleware.HttpJSONError(w, fmt.Sprintf("Bad payload: %v", err), http.StatusUnauthorized)
+		return
+	}
+	err = AuthenticateIdentifier(state, payload.Identifier, payload.Token)
+	if err != nil {
+		if _, ok := err.(*ErrInvalidConfirmationToken); ok {
+			middleware.HttpJSONError(w, "NoSuchIdentifierTokenPair", http.StatusUnauthorized)
+			return
+		}
+		log.Error().Msgf("Operation error: %s", err.Error())
+		middleware.HttpJSONError(w, "InternalServerError", http.StatusInternalServerError)
+		return
+	}
+	accessToken, err := crypto.CreateAccessToken(*config.GetConfig(), state.RSAKeyPairs, payload.Identifier)
+	if err != nil {
+		log.Error().Msgf("Operation error: %s", err.Error())
+		middleware.HttpJSONError(w, "InternalServerError", http.StatusInternalServerError)
+		return
+	}
+	refreshToken, err := crypto.CreateRefreshToken(*config.GetConfig(), state.RSAKeyPairs, payload.Identifier)
+	if err != nil {
+		log.Error().Msgf("Operation error: %s", err.Error())
+		middleware.HttpJSONError(w, "InternalServerError", http.StatusInternalServerError)
+		return
+	}
+	w.Header().Set("Content-Type", "application/json")
+	encoder := json.NewEncoder(w)
+	err = encoder.Encode(handlers.AccessRefreshKeysResponse{
+		AccessToken:  accessToken,
+		RefreshToken: refreshToken,
+	})
+	if err != nil {
+		log.Error().Msgf("Encoder error: %s", err.Error())
+		middleware.HttpJSONError(w, "InternalServerError", http.StatusInternalServerError)
+		return
+	}
+}
+
+type GrantsResponse struct {
+	Grants []Grant `json:"grants"`
+}
+
+func GrantsHandler(w http.ResponseWriter, r *http.Request) {
+	state, _, ok := GetStateAndConfig(w, r)
+	if !ok {
+		return
+	}
+	accessToken, ok := r.Context().Value("accessToken").(*crypto.DefaultClaims)
+	if !ok || accessToken == nil {
+		middleware.HttpJSONError(w, "NoAccessTokenFound", http.StatusUnauthorized)
+		return
+	}
+	identifier, err := extractIdentifier(r, accessToken)
+	if err != nil {
+		middleware.HttpJSONError(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+	key, err := extractKey(r)
+	if err != nil {
+		middleware.HttpJSONError(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+	grants, err := GrantsForIdentifierAndKey(state, identifier, key)
+	if err != nil {
+		if _, ok := err.(*ErrKeyNotFound); ok {
+			middleware.HttpJSONError(w, "KeyNotFound", http.StatusNotFound)
+			return
+		}
+		log.Error().Msgf("Operation error: %s", err.Error())
+		middleware.HttpJSONError(w, "InternalServerError", http.StatusInternalServerError)
+		return
+	}
+	w.Header().Set("Content-Type", "application/json")
+	encoder := json.NewEncoder(w)
+	err = encoder.Encode(GrantsResponse{Grants: grants})
+	if err != nil {
+		log.Error().Msgf("Encoder error: %s", err.Error())
+		middleware.HttpJSONError(w, "InternalServerError", http.StatusInternalServerError)
+		return
+	}
+}
+
+type GrantRequest struct {
+	// AccessRead or AccessReadWrite
+	Access string `json:"access"`
+}
+
+// GrantHandler shares a key with the account in the route or changes
+// its access
+func GrantHandler(w http.ResponseWriter, r *http.Request) {
+	state, _, ok := GetStateAndConfig(w, r)
+	if !ok {
+		return
+	}
+	accessToken, ok := r.Context().Value("accessToken").(*crypto.DefaultClaims)
+	if !ok || accessToken == nil {
+		middleware.HttpJSONError(w, "NoAccessTokenFound", http.StatusUnauthorized)
+		return
+	}
+	identifier, err := extractIdentifier(r, accessToken)
+	if err != nil {
+		middleware.HttpJSONError(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+	key, err := extractKey(r)
+	if err != nil {
+		middleware.HttpJSONError(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+	grantee, ok := mux.Vars(r)["grantee"]
+	if !ok {
+		middleware.HttpJSONError(w, "NoGranteeFoundInRequest", http.StatusBadRequest)
+		return
+	}
+	var request GrantRequest
+	err = json.NewDecoder(r.Body).Decode(&request)
+	if err != nil {
+		middleware.HttpJSONError(w, "InvalidGrant", http.StatusBadRequest)
+		return
+	}
+	grant, err := GrantAccessForIdentifier(state, identifier, key, grantee, request.Access)
+	if err != nil {
+		if _, ok := err.(*ErrKeyNotFound); ok {
+			middleware.HttpJSONError(w, "KeyNotFound", http.StatusNotFound)
+			return
+		}
+		if _, ok := err.(*ErrInvalidGrant); ok {
+			middleware.HttpJSONError(w, "InvalidGrant", http.StatusBadRequest)
+			return
+		}
+		log.Error().Msgf("Operation error: %s", err.Error())
+		middleware.HttpJSONError(w, "InternalServerError", http.StatusInternalServerError)
+		return
+	}
+	w.Header().Set("Content-Type", "application/json")
+	encoder := json.NewEncoder(w)
+	err = encoder.Encode(grant)
+	if err != nil {
+		log.Error().Msgf("Encoder error: %s", err.Error())
+	}
+}
+
+func RevokeHandler(w http.ResponseWriter, r *http.Request) {
+	state, _, ok := GetStateAndConfig(w, r)
+	if !ok {
+		return
+	}
+	accessToken, ok := r.Context().Value("accessToken").(*crypto.DefaultClaims)
+	if !ok || accessToken == nil {
+		middleware.HttpJSONError(w, "NoAccessTokenFound", http.StatusUnauthorized)
+		return
+	}
+	identifier, err := extractIdentifier(r, accessToken)
+	if err != nil {
+		middleware.HttpJSONError(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+	key, err := extractKey(r)
+	if err != nil {
+		middleware.HttpJSONError(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+	grantee, ok := mux.Vars(r)["grantee"]
+	if !ok {
+		middleware.HttpJSONError(w, "NoGranteeFoundInRequest", http.StatusBadRequest)
+		return
+	}
+	err = RevokeAccessForIdentifier(state, identifier, key, grantee)
+	if err != nil {
+		if _, ok := err.(*ErrGrantNotFound); ok {
+			middleware.HttpJSONError(w, "GrantNotFound", http.StatusNotFound)
+			return
+		}
+		log.Error().Msgf("Operation error: %s", err.Error())
+		middleware.HttpJSONError(w, "InternalServerError", http.StatusInternalServerError)
+		return
+	}
+	w.WriteHeader(http.StatusOK)
+}
+
+type SharedResponse struct {
+	Keys []SharedKey `json:"keys"`
+}
+
+// SharedHandler lists the keys other accounts shared with the account
+func SharedHandler(w http.ResponseWriter, r *http.Request) {
+	state, _, ok := GetStateAndConfig(w, r)
+	if !ok {
+		return
+	}
+	accessToken, ok := r.Context().Value("accessToken").(*crypto.DefaultClaims)
+	if !ok || accessToken == nil {
+		middleware.HttpJSONError(w, "NoAccessTokenFound", http.StatusUnauthorized)
+		return
+	}
+	sharedKeys, err := SharedKeysForIdentifier(state, accessToken.Identifier)
+	if err != nil {
+		log.Error().Msgf("Operation error: %s", err.Error())
+		middleware.HttpJSONError(w, "InternalServerError", http.StatusInternalServerError)
+		return
+	}
+	w.Header().Set("Content-Type", "application/json")
+	encoder := json.NewEncoder(w)
+	err = encoder.Encode(SharedResponse{Keys: sharedKeys})
+	if err != nil {
+		log.Error().Msgf("Encoder error: %s", err.Error())
+		middleware.HttpJSONError(w, "InternalServerError", http.StatusInternalServerError)
+		return
+	}
+}
+
+// SharedRetrieveHandler serves GET and HEAD requests for keys of other
+// accounts
+func SharedRetrieveHandler(w http.ResponseWriter, r *http.Request) {
+	state, _, ok := GetStateAndConfig(w, r)
+	if !ok {
+		return
+	}
+	accessToken, ok := r.Context().Value("accessToken").(*crypto.DefaultClaims)
+	if !ok || accessToken == nil {
+		middleware.HttpJSONError(w, "NoAccessTokenFound", http.StatusUnauthorized)
+		return
+	}
+	owner, err := extractOwnerIdentifier(r)
+	if err != nil {
+		middleware.HttpJSONError(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+	key, err := extractKey(r)
+	if err != nil {
+		middleware.HttpJSONError(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+	version, _, err := extractVersion(r)
+	if err != nil {
+		middleware.HttpJSONError(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+	reader, valueVersion, err := OpenSharedVersionForIdentifierAndKey(state, accessToken.Identifier, owner, key, version)
+	if err != nil {
+		if _, ok := err.(*ErrAccessDenied); ok {
+			middleware.HttpJSONError(w, "AccessDenied", http.StatusForbidden)
+			return
+		}
+		if _, ok := err.(*ErrKeyNotFound); ok {
+			middleware.HttpJSONError(w, "KeyNotFound", http.StatusNotFound)
+			return
+		}
+		if _, ok := err.(*ErrVersionNotFound); ok {
+			middleware.HttpJSONError(w, "VersionNotFound", http.StatusNotFound)
+			return
+		}
+		log.Error().Msgf("Operation error: %s", err.Error())
+		middleware.HttpJSONError(w, "InternalServerError", http.StatusInternalServerError)
+		return
+	}
+	defer reader.Close()
+	serveValue(w, r, reader, valueVersion)
+}
+
+// SharedInsertHandler replaces the value of a key of another account,
+// which requires read/write access
+func SharedInsertHandler(w http.ResponseWriter, r *http.Request) {
+	state, config, ok := GetStateAndConfig(w, r)
+	if !ok {
+		return
+	}
+	accessToken, ok := r.Context().Value("accessToken").(*crypto.DefaultClaims)
+	if !ok || accessToken == nil {
+		middleware.HttpJSONError(w, "NoAccessTokenFound", http.StatusUnauthorized)
+		return
+	}
+	owner, err := extractOwnerIdentifier(r)
+	if err != nil {
+		middleware.HttpJSONError(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+	key, err := extractKey(r)
+	if err != nil {
+		middleware.HttpJSONError(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+	ttl, err := extractTTL(r)
+	if err != nil {
+		middleware.HttpJSONError(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+	options := InsertOptions{
+		Preconditions:   extractPreconditions(r),
+		TTL:             ttl,
+		ContentType:     r.Header.Get("Content-Type"),
+		ContentEncoding: r.Header.Get("Content-Encoding"),
+		Filename:        extractFilename(r),
+	}
+	version, err := InsertSharedKeyValueFromReader(state, *config, accessToken.Identifier, owner, key, r.Body, options)
+	if err != nil {
+		if _, ok := err.(*ErrAccessDenied); ok {
+			middleware.HttpJSONError(w, "AccessDenied", http.StatusForbidden)
+			return
+		}
+		if _, ok := err.(*ErrPreconditionFailed); ok {
+			middleware.HttpJSONError(w, "PreconditionFailed", http.StatusPreconditionFailed)
+			return
+		}
+		if _, ok := err.(*ErrKeyHasVersions); ok {
+			middleware.HttpJSONError(w, "KeyHasVersions", http.StatusConflict)
+			return
+		}
+		if _, ok := err.(*ErrContentTypeNotAllowed); ok {
+			middleware.HttpJSONError(w, "ContentTypeNotAllowed", http.StatusUnsupportedMediaType)
+			return
+		}
+		if _, ok := err.(*ErrQuotaExceeded); ok {
+			middleware.HttpJSONError(w, "QuotaExceeded", http.StatusInsufficientStorage)
+			return
+		}
+		if _, ok := err.(*ErrDataTooBig); ok {
+			middleware.HttpJSONError(w, "PayloadTooLarge", http.StatusRequestEntityTooLarge)
+			return
+		}
+		log.Error().Msgf("Operation error: %s", err.Error())
+		middleware.HttpJSONError(w, "InternalServerError", http.StatusInternalServerError)
+		return
+	}
+	setVersionHeaders(w, version)
+	w.WriteHeader(http.StatusOK)
+}
+
+type CreateLinkRequest struct {
+	// lifetime of the link in seconds, defaults to a day
+	TTL uint64 `json:"ttl"`
+	// 0 means no limit
+	MaxDownloads uint64 `json:"maxDownloads"`
+}
+
+type LinksResponse struct {
+	Links []Link `json:"links"`
+}
+
+// CreateLinkHandler creates a public link, the value is downloaded from
+// /s/{token}
+func CreateLinkHandler(w http.ResponseWriter, r *http.Request) {
+	state, config, ok := GetStateAndConfig(w, r)
+	if !ok {
+		return
+	}
+	accessToken, ok := r.Context().Value("accessToken").(*crypto.DefaultClaims)
+	if !ok || accessToken == nil {
+		middleware.HttpJSONError(w, "NoAccessTokenFound", http.StatusUnauthorized)
+		return
+	}
+	identifier, err := extractIdentifier(r, accessToken)
+	if err != nil {
+		middleware.HttpJSONError(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+	key, err := extractKey(r)
+	if err != nil {
+		middleware.HttpJSONError(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+	var request CreateLinkRequest
+	err = json.NewDecoder(r.Body).Decode(&request)
+	if err != nil && err != io.EOF {
+		middleware.HttpJSONError(w, "InvalidLinkRequest", http.StatusBadRequest)
+		return
+	}
+	link, err := CreateLinkForIdentifier(state, *config, identifier, key, time.Duration(request.TTL)*time.Second, request.MaxDownloads)
+	if err != nil {
+		if _, ok := err.(*ErrKeyNotFound); ok {
+			middleware.HttpJSONError(w, "KeyNotFound", http.StatusNotFound)
+			return
+		}
+		if _, ok := err.(*ErrBucketNotFound); ok {
+			middleware.HttpJSONError(w, "BucketNotFound", http.StatusNotFound)
+			return
+		}
+		log.Error().Msgf("Operation error: %s", err.Error())
+		middleware.HttpJSONError(w, "InternalServerError", http.StatusInternalServerError)
+		return
+	}
+	w.Header().Set("Content-Type", "application/json")
+	w.WriteHeader(http.StatusCreated)
+	encoder := json.NewEncoder(w)
+	err = encoder.Encode(link)
+	if err != nil {
+		log.Error().Msgf("Encoder error: %s", err.Error())
+	}
+}
+
+func LinksHandler(w http.ResponseWriter, r *http.Request) {
+	state, _, ok := GetStateAndConfig(w, r)
+	if !ok {
+		return
+	}
+	accessToken, ok := r.Context().Value("accessToken").(*crypto.DefaultClaims)
+	if !ok || accessToken == nil {
+		middleware.HttpJSONError(w, "NoAccessTokenFound", http.StatusUnauthorized)
+		return
+	}
+	identifier, err := extractIdentifier(r, accessToken)
+	if err != nil {
+		middleware.HttpJSONError(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+	key, err := extractKey(r)
+	if err != nil {
+		middleware.HttpJSONError(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+	links, err := LinksForIdentifierAndKey(state, identifier, key)
+	if err != nil {
+		if _, ok := err.(*ErrKeyNotFound); ok {
+			middleware.HttpJSONError(w, "KeyNotFound", http.StatusNotFound)
+			return
+		}
+		log.Error().Msgf("Operation error: %s", err.Error())
+		middleware.HttpJSONError(w, "InternalServerError", http.StatusInternalServerError)
+		return
+	}
+	w.Header().Set("Content-Type", "application/json")
+	encoder := json.NewEncoder(w)
+	err = encoder.Encode(LinksResponse{Links: links})
+	if err != nil {
+		log.Error().Msgf("Encoder error: %s", err.Error())
+		middleware.HttpJSONError(w, "InternalServerError", http.StatusInternalServerError)
+		return
+	}
+}
+
+func RevokeLinkHandler(w http.ResponseWriter, r *http.Request) {
+	state, _, ok := GetStateAndConfig(w, r)
+	if !ok {
+		return
+	}
+	accessToken, ok := r.Context().Value("accessToken").(*crypto.DefaultClaims)
+	if !ok || accessToken == nil {
+		middleware.HttpJSONError(w, "NoAccessTokenFound", http.StatusUnauthorized)
+		return
+	}
+	identifier, err := extractIdentifier(r, accessToken)
+	if err != nil {
+		middleware.HttpJSONError(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+	key, err := extractKey(r)
+	if err != nil {
+		middleware.HttpJSONError(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+	id, ok := mux.Vars(r)["id"]
+	if !ok {
+		middleware.HttpJSONError(w, "NoLinkFoundInRequest", http.StatusBadRequest)
+		return
+	}
+	err = RevokeLinkForIdentifier(state, identifier, key, id)
+	if err != nil {
+		if _, ok := err.(*ErrLinkNotFound); ok {
+			middleware.HttpJSONError(w, "LinkNotFound", http.StatusNotFound)
+			return
+		}
+		log.Error().Msgf("Operation error: %s", err.Error())
+		middleware.HttpJSONError(w, "InternalServerError", http.StatusInternalServerError)
+		return
+	}
+	w.WriteHeader(http.StatusOK)
+}
+
+// PublicLinkHandler serves the value of a link without authentication.
+// Every request counts as a download, so it does not support ranges.
+func PublicLinkHandler(w http.ResponseWriter, r *http.Request) {
+	state, _, ok := GetStateAndConfig(w, r)
+	if !ok {
+		return
+	}
+	token, ok := mux.Vars(r)["token"]
+	if !ok {
+		middleware.HttpJSONError(w, "LinkNotFound", http.StatusNotFound)
+		return
+	}
+	reader, valueVersion, err := OpenLinkForToken(state, token)
+	if err != nil {
+		if _, ok := err.(*ErrLinkNotFound); ok {
+			middleware.HttpJSONError(w, "LinkNotFound", http.StatusNotFound)
+			return
+		}
+		if _, ok := err.(*ErrLinkExpired); ok {
+			middleware.HttpJSONError(w, "LinkExpired", http.StatusGone)
+			return
+		}
+		if _, ok := err.(*ErrKeyNotFound); ok {
+			middleware.HttpJSONError(w, "LinkNotFound", http.StatusNotFound)
+			return
+		}
+		log.Error().Msgf("Operation error: %s", err.Error())
+		middleware.HttpJSONError(w, "InternalServerError", http.StatusInternalServerError)
+		return
+	}
+	defer reader.Close()
+	setContentHeaders(w, valueVersion)
+	setSandboxHeaders(w)
+	var content io.Reader = reader
+	size := reader.Size()
+	if compression := reader.Compression(); len(compression) > 0 {
+		w.Header().Set("Vary", "Accept-Encoding")
+		if acceptsEncoding(r.Header.Get("Accept-Encoding"), compression) {
+			content, size = reader.Encoded()
+			w.Header().Set("Content-Encoding", compression)
+		}
+	}
+	w.Header().Set("Content-Length", strconv.FormatInt(size, 10))
+	w.Header().Set("Cache-Control", "no-store")
+	_, err = io.Copy(w, content)
+	if err != nil {
+		log.Error().Msgf("Could not write value: %s", err.Error())
+	}
+}
+
+// eventsKeepAliveInterval keeps proxies from closing idle streams
+const eventsKeepAliveInterval = 30 * time.Second
+
+// EventsHandler streams the changes of all keys of the account as
+// server-sent events. Clients resume a stream by sending the ID of the
+// last event in the Last-Event-ID header.
+func EventsHandler(w http.ResponseWriter, r *http.Request) {
+	state, _, ok := GetStateAndConfig(w, r)
+	if !ok {
+		return
+	}
+	accessToken, ok := r.Context().Value("accessToken").(*crypto.DefaultClaims)
+	if !ok || accessToken == nil {
+		middleware.HttpJSONError(w, "NoAccessTokenFound", http.StatusUnauthorized)
+		return
+	}
+	var since uint64
+	lastEventID := r.Header.Get("Last-Event-ID")
+	if len(lastEventID) > 0 {
+		var err error
+		since, err = strconv.ParseUint(lastEventID, 10, 64)
+		if err != nil {
+			middleware.HttpJSONError(w, "InvalidLastEventID", http.StatusBadRequest)
+			return
+		}
+	}
+	flusher, ok := w.(http.Flusher)
+	if !ok {
+		middleware.HttpJSONError(w, "StreamingNotSupported", http.StatusInternalServerError)
+		return
+	}
+	// clients that can not catch up have to list the keys again, which
+	// is only possible before the stream started
+	stream, err := OpenEventStreamForIdentifier(state, accessToken.Identifier, since)
+	if err != nil {
+		if _, ok := err.(*ErrChangesExpired); ok {
+			middleware.HttpJSONError(w, "ChangesExpired", http.StatusGone)
+			return
+		}
+		log.Error().Msgf("Operation error: %s", err.Error())
+		middleware.HttpJSONError(w, "InternalServerError", http.StatusInternalServerError)
+		return
+	}
+	defer stream.Close()
+	w.Header().Set("Content-Type", "text/event-stream")
+	w.Header().Set("Cache-Control", "no-cache")
+	w.WriteHeader(http.StatusOK)
+	flusher.Flush()
+	// the keep alive comments are written by another goroutine, so all
+	// writes are serialized and stop before the handler returns
+	var mutex sync.Mutex
+	write := func(data []byte) error {
+		mutex.Lock()
+		defer mutex.Unlock()
+		_, err := w.Write(data)
+		if err != nil {
+			return err
+		}
+		flusher.Flush()
+		return nil
+	}
+	done := make(chan struct{})
+	var wg sync.WaitGroup
+	wg.Add(1)
+	go func() {
+		defer wg.Done()
+		ticker := time.NewTicker(eventsKeepAliveInterval)
+		defer ticker.Stop()
+		for {
+			select {
+			case <-ticker.C:
+				write([]byte(": keep-alive\n\n"))
+			case <-done:
+				return
+			}
+		}
+	}()
+	err = stream.Run(r.Context(), func(change Change) error {
+		formatted, err := formatEvent(change)
+		if err != nil {
+			return err
+		}
+		return write(formatted)
+	})
+	close(done)
+	wg.Wait()
+	if err != nil && err != r.Context().Err() {
+		log.Error().Msgf("Event stream error: %s", err.Error())
+	}
+}
+
+// ChangesHandler returns the changes after the `since` query parameter.
+// Without `since` only the cursor of the last change is returned, so a
+// client can list all keys and continue with the changes afterwards.
+func ChangesHandler(w http.ResponseWriter, r *http.Request) {
+	state, _, ok := GetStateAndConfig(w, r)
+	if !ok {
+		return
+	}
+	accessToken, ok := r.Context().Value("accessToken").(*crypto.DefaultClaims)
+	if !ok || accessToken == nil {
+		middleware.HttpJSONError(w, "NoAccessTokenFound", http.StatusUnauthorized)
+		return
+	}
+	query := r.URL.Query()
+	limit := 0
+	limitString := query.Get("limit")
+	if len(limitString) > 0 {
+		var err error
+		limit, err = strconv.Atoi(limitString)
+		if err != nil || limit < 0 {
+			middleware.HttpJSONError(w, "InvalidLimit", http.StatusBadRequest)
+			return
+		}
+	}
+	var changeLog ChangeLog
+	var err error
+	sinceString := query.Get("since")
+	if len(sinceString) > 0 {
+		var since uint64
+		since, err = strconv.ParseUint(sinceString, 10, 64)
+		if err != nil {
+			middleware.HttpJSONError(w, "InvalidSince", http.StatusBadRequest)
+			return
+		}
+		changeLog, err = ChangesForIdentifier(state, accessToken.Identifier, since, limit)
+	} else {
+		changeLog.Changes = []Change{}
+		changeLog.Cursor, err = CursorForIdentifier(state, accessToken.Identifier)
+	}
+	if err != nil {
+		if _, ok := err.(*ErrChangesExpired); ok {
+			middleware.HttpJSONError(w, "ChangesExpired", http.StatusGone)
+			return
+		}
+		log.Error().Msgf("Operation error: %s", err.Error())
+		middleware.HttpJSONError(w, "InternalServerError", http.StatusInternalServerError)
+		return
+	}
+	w.Header().Set("Content-Type", "application/json")
+	encoder := json.NewEncoder(w)
+	err = encoder.Encode(changeLog)
+	if err != nil {
+		log.Error().Msgf("Encoder error: %s", err.Error())
+		middleware.HttpJSONError(w, "InternalServerError", http.StatusInternalServerError)
+		return
+	}
+}
+
+type CreateWebhookRequest struct {
+	URL string `json:"url"`
+}
+
+type WebhooksResponse struct {
+	Webhooks []Webhook `json:"webhooks"`
+}
+
+type WebhookDeliveriesResponse struct {
+	Deliveries []WebhookDelivery `json:"deliveries"`
+}
+
+func CreateWebhookHandler(w http.ResponseWriter, r *http.Request) {
+	state, config, ok := GetStateAndConfig(w, r)
+	if !ok {
+		return
+	}
+	accessToken, ok := r.Context().Value("accessToken").(*crypto.DefaultClaims)
+	if !ok || accessToken == nil {
+		middleware.HttpJSONError(w, "NoAccessTokenFound", http.StatusUnauthorized)
+		return
+	}
+	var request CreateWebhookRequest
+	err := json.NewDecoder(r.Body).Decode(&request)
+	if err != nil {
+		middleware.HttpJSONError(w, "InvalidWebhook", http.StatusBadRequest)
+		return
+	}
+	webhook, err := CreateWebhookForIdentifier(state, *config, accessToken.Identifier, request.URL)
+	if err != nil {
+		if _, ok := err.(*ErrInvalidWebhook); ok {
+			middleware.HttpJSONError(w, "InvalidWebhook", http.StatusBadRequest)
+			return
+		}
+		if _, ok := err.(*ErrWebhooksDisabled); ok {
+			middleware.HttpJSONError(w, "WebhooksDisabled", http.StatusForbidden)
+			return
+		}
+		if _, ok := err.(*ErrWebhookLimitReached); ok {
+			middleware.HttpJSONError(w, "WebhookLimitReached", http.StatusPreconditionFailed)
+			return
+		}
+		log.Error().Msgf("Operation error: %s", err.Error())
+		middleware.HttpJSONError(w, "InternalServerError", http.StatusInternalServerError)
+		return
+	}
+	w.Header().Set("Content-Type", "application/json")
+	w.WriteHeader(http.StatusCreated)
+	encoder := json.NewEncoder(w)
+	err = encoder.Encode(webhook)
+	if err != nil {
+		log.Error().Msgf("Encoder error: %s", err.Error())
+	}
+}
+
+func WebhooksHandler(w http.ResponseWriter, r *http.Request) {
+	state, _, ok := GetStateAndConfig(w, r)
+	if !ok {
+		return
+	}
+	accessToken, ok := r.Context().Value("accessToken").(*crypto.DefaultClaims)
+	if !ok || accessToken == nil {
+		middleware.HttpJSONError(w, "NoAccessTokenFound", http.StatusUnauthorized)
+		return
+	}
+	webhooks, err := WebhooksForIdentifier(state, accessToken.Identifier)
+	if err != nil {
+		log.Error().Msgf("Operation error: %s", err.Error())
+		middleware.HttpJSONError(w, "InternalServerError", http.StatusInternalServerError)
+		return
+	}
+	w.Header().Set("Content-Type", "application/json")
+	encoder := json.NewEncoder(w)
+	err = encoder.Encode(WebhooksResponse{Webhooks: webhooks})
+	if err != nil {
+		log.Error().Msgf("Encoder error: %s", err.Error())
+		middleware.HttpJSONError(w, "InternalServerError", http.StatusInternalServerError)
+		return
+	}
+}
+
+func DeleteWebhookHandler(w http.ResponseWriter, r *http.Request) {
+	state, _, ok := GetStateAndConfig(w, r)
+	if !ok {
+		return
+	}
+	accessToken, ok := r.Context().Value("accessToken").(*crypto.DefaultClaims)
+	if !ok || accessToken == nil {
+		middleware.HttpJSONError(w, "NoAccessTokenFound", http.StatusUnauthorized)
+		return
+	}
+	id, ok := mux.Vars(r)["id"]
+	if !ok {
+		middleware.HttpJSONError(w, "NoWebhookFoundInRequest", http.StatusBadRequest)
+		return
+	}
+	err := DeleteWebhookForIdentifier(state, accessToken.Identifier, id)
+	if err != nil {
+		if _, ok := err.(*ErrWebhookNotFound); ok {
+			middleware.HttpJSONError(w, "WebhookNotFound", http.StatusNotFound)
+			return
+		}
+		log.Error().Msgf("Operation error: %s", err.Error())
+		middleware.HttpJSONError(w, "InternalServerError", http.StatusInternalServerError)
+		return
+	}
+	w.WriteHeader(http.StatusOK)
+}
+
+func WebhookDeliveriesHandler(w http.ResponseWriter, r *http.Request) {
+	state, _, ok := GetStateAndConfig(w, r)
+	if !ok {
+		return
+	}
+	accessToken, ok := r.Context().Value("accessToken").(*crypto.DefaultClaims)
+	if !ok || accessToken == nil {
+		middleware.HttpJSONError(w, "NoAccessTokenFound", http.StatusUnauthorized)
+		return
+	}
+	id, ok := mux.Vars(r)["id"]
+	if !ok {
+		middleware.HttpJSONError(w, "NoWebhookFoundInRequest", http.StatusBadRequest)
+		return
+	}
+	deliveries, err := WebhookDeliveriesForIdentifier(state, accessToken.Identifier, id)
+	if err != nil {
+		if _, ok := err.(*ErrWebhookNotFound); ok {
+			middleware.HttpJSONError(w, "WebhookNotFound", http.StatusNotFound)
+			return
+		}
+		log.Error().Msgf("Operation error: %s", err.Error())
+		middleware.HttpJSONError(w, "InternalServerError", http.StatusInternalServerError)
+		return
+	}
+	w.Header().Set("Content-Type", "application/json")
+	encoder := json.NewEncoder(w)
+	err = encoder.Encode(WebhookDeliveriesResponse{Deliveries: deliveries})
+	if err != nil {
+		log.Error().Msgf("Encoder error: %s", err.Error())
+		middleware.HttpJSONError(w, "InternalServerError", http.StatusInternalServerError)
+		return
+	}
+}
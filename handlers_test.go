@@ -1,6 +1,7 @@
 package main
 
 import (
+	"bufio"
 	"bytes"
 	"context"
 	"encoding/json"
@@ -8,11 +9,14 @@ import (
 	"net/http"
 	"net/http/httptest"
 	"strings"
+	"sync"
 	"testing"
+	"time"
 
 	"github.com/dgraph-io/badger/v3"
 	"github.com/gorilla/mux"
 	"github.com/mguentner/passwordless/crypto"
+	"github.com/mguentner/passwordless/handlers"
 	"github.com/mguentner/passwordless/middleware"
 	"github.com/mguentner/passwordless/state"
 )
@@ -94,14 +98,154 @@ func TestHandlerUnauthorized(t *testing.T) {
 			route:  "/api/store/key",
 			method: "GET",
 		},
+		{
+			route:  "/api/store/key",
+			method: "HEAD",
+		},
 		{
 			route:  "/api/store/key",
 			method: "POST",
 		},
 		{
 			route:  "/api/store/key",
+			method: "PUT",
+		},
+		{
+			route:  "/api/store/key",
+			method: "DELETE",
+		},
+		{
+			route:  "/api/store/key",
+			method: "PATCH",
+		},
+		{
+			route:  "/api/store/key/versions",
+			method: "GET",
+		},
+		{
+			route:  "/api/store/key/versions/1/restore",
+			method: "POST",
+		},
+		{
+			route:  "/api/usage",
+			method: "GET",
+		},
+		{
+			route:  "/api/store/_batch",
+			method: "POST",
+		},
+		{
+			route:  "/api/store/key/increment",
+			method: "POST",
+		},
+		{
+			route:  "/api/store/key/append",
+			method: "POST",
+		},
+		{
+			route:  "/api/buckets",
+			method: "GET",
+		},
+		{
+			route:  "/api/buckets",
+			method: "POST",
+		},
+		{
+			route:  "/api/buckets/bucket",
+			method: "DELETE",
+		},
+		{
+			route:  "/api/buckets/bucket/store",
+			method: "GET",
+		},
+		{
+			route:  "/api/buckets/bucket/store/key",
+			method: "PUT",
+		},
+		{
+			route:  "/api/trash",
+			method: "GET",
+		},
+		{
+			route:  "/api/trash/key/restore",
+			method: "POST",
+		},
+		{
+			route:  "/api/export",
+			method: "GET",
+		},
+		{
+			route:  "/api/import",
+			method: "POST",
+		},
+		{
+			route:  "/api/account",
+			method: "DELETE",
+		},
+		{
+			route:  "/api/store/key/grants",
+			method: "GET",
+		},
+		{
+			route:  "/api/store/key/grants/bob",
+			method: "PUT",
+		},
+		{
+			route:  "/api/store/key/grants/bob",
 			method: "DELETE",
 		},
+		{
+			route:  "/api/shared",
+			method: "GET",
+		},
+		{
+			route:  "/api/shared/alice/store/key",
+			method: "GET",
+		},
+		{
+			route:  "/api/shared/alice/store/key",
+			method: "PUT",
+		},
+		{
+			route:  "/api/shared/alice/buckets/bucket/store/key",
+			method: "GET",
+		},
+		{
+			route:  "/api/store/key/links",
+			method: "GET",
+		},
+		{
+			route:  "/api/store/key/links",
+			method: "POST",
+		},
+		{
+			route:  "/api/store/key/links/id",
+			method: "DELETE",
+		},
+		{
+			route:  "/api/events",
+			method: "GET",
+		},
+		{
+			route:  "/api/changes",
+			method: "GET",
+		},
+		{
+			route:  "/api/webhooks",
+			method: "GET",
+		},
+		{
+			route:  "/api/webhooks",
+			method: "POST",
+		},
+		{
+			route:  "/api/webhooks/abc",
+			method: "DELETE",
+		},
+		{
+			route:  "/api/webhooks/abc/deliveries",
+			method: "GET",
+		},
 	}
 	handler := SetupHandler(&config, &appState)
 	for _, request := range requests {
@@ -283,7 +427,9 @@ func TestRetrieveHandler(t *testing.T) {
 	if status2 != http.StatusOK {
 		t.Errorf("Expected OK, got %d", status)
 	}
-
+	if len(recorder2.Header().Get("ETag")) == 0 {
+		t.Error("Expected an ETag")
+	}
 }
 
 func TestIndexHandler(t *testing.T) {
@@ -386,3 +532,2099 @@ func TestDeleteHandler(t *testing.T) {
 		t.Error("Key still in database")
 	}
 }
+
+func TestVersionsHandler(t *testing.T) {
+	config, appState, keyPairs, handler := setupHandlerTest(t, "/store/{key}/versions", VersionsHandler)
+	config.StorageOptions.MaxVersionsPerKey = 10
+	accessToken, err := crypto.CreateAccessToken(*config.GetConfig(), keyPairs, "alice@example.com")
+	if err != nil {
+		t.Fatal(err)
+	}
+	authHeader := fmt.Sprintf("Bearer %s", accessToken)
+
+	req, err := http.NewRequest("GET", "/store/foo/versions", nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	req.Header.Set("Authorization", authHeader)
+	recorder := httptest.NewRecorder()
+	handler.ServeHTTP(recorder, req)
+	if recorder.Code != http.StatusNotFound {
+		t.Errorf("Expected NotFound, got %d", recorder.Code)
+	}
+
+	for _, content := range []string{"first", "second"} {
+		_, err = InsertKeyValueForIdentifier(&appState, *config, "alice@example.com", "foo", []byte(content))
+		if err != nil {
+			t.Fatal(err)
+		}
+	}
+	req2, err := http.NewRequest("GET", "/store/foo/versions", nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	req2.Header.Set("Authorization", authHeader)
+	recorder2 := httptest.NewRecorder()
+	handler.ServeHTTP(recorder2, req2)
+	if recorder2.Code != http.StatusOK {
+		t.Errorf("Expected OK, got %d", recorder2.Code)
+	}
+	var result VersionsResponse
+	decoder := json.NewDecoder(recorder2.Body)
+	err = decoder.Decode(&result)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(result.Versions) != 2 {
+		t.Fatalf("Expected two versions, got %d", len(result.Versions))
+	}
+	if result.Versions[0].Version != 1 || result.Versions[0].Size != uint64(len("first")) {
+		t.Errorf("Unexpected version %v", result.Versions[0])
+	}
+}
+
+func TestRestoreHandler(t *testing.T) {
+	config, appState, keyPairs, handler := setupHandlerTest(t, "/store/{key}/versions/{version}/restore", RestoreHandler)
+	config.StorageOptions.MaxVersionsPerKey = 10
+	accessToken, err := crypto.CreateAccessToken(*config.GetConfig(), keyPairs, "alice@example.com")
+	if err != nil {
+		t.Fatal(err)
+	}
+	authHeader := fmt.Sprintf("Bearer %s", accessToken)
+	for _, content := range []string{"first", "second"} {
+		_, err = InsertKeyValueForIdentifier(&appState, *config, "alice@example.com", "foo", []byte(content))
+		if err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	req, err := http.NewRequest("POST", "/store/foo/versions/42/restore", nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	req.Header.Set("Authorization", authHeader)
+	recorder := httptest.NewRecorder()
+	handler.ServeHTTP(recorder, req)
+	if recorder.Code != http.StatusNotFound {
+		t.Errorf("Expected NotFound, got %d", recorder.Code)
+	}
+
+	req2, err := http.NewRequest("POST", "/store/foo/versions/1/restore", nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	req2.Header.Set("Authorization", authHeader)
+	recorder2 := httptest.NewRecorder()
+	handler.ServeHTTP(recorder2, req2)
+	if recorder2.Code != http.StatusCreated {
+		t.Errorf("Expected StatusCreated, got %d", recorder2.Code)
+	}
+	value, err := RetrieveValueIdentifierAndKey(&appState, "alice@example.com", "foo")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if bytes.Compare([]byte("first"), value) != 0 {
+		t.Fatalf("Expected restored value, got %s", value)
+	}
+
+	// versions stored before allowedContentTypes was changed are checked
+	// again when they are restored
+	config.StorageOptions.AllowedContentTypes = []string{"application/json"}
+	req3, err := http.NewRequest("POST", "/store/foo/versions/2/restore", nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	req3.Header.Set("Authorization", authHeader)
+	recorder3 := httptest.NewRecorder()
+	handler.ServeHTTP(recorder3, req3)
+	if recorder3.Code != http.StatusUnsupportedMediaType {
+		t.Errorf("Expected StatusUnsupportedMediaType, got %d", recorder3.Code)
+	}
+}
+
+func TestInsertHandlerPreconditions(t *testing.T) {
+	config, _, keyPairs, handler := setupHandlerTest(t, "/store/{key}", InsertHandler)
+	accessToken, err := crypto.CreateAccessToken(*config.GetConfig(), keyPairs, "alice@example.com")
+	if err != nil {
+		t.Fatal(err)
+	}
+	authHeader := fmt.Sprintf("Bearer %s", accessToken)
+
+	req, err := http.NewRequest("POST", "/store/foo", strings.NewReader("content"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	req.Header.Set("Authorization", authHeader)
+	recorder := httptest.NewRecorder()
+	handler.ServeHTTP(recorder, req)
+	if recorder.Code != http.StatusCreated {
+		t.Errorf("Expected StatusCreated, got %d", recorder.Code)
+	}
+	etag := recorder.Header().Get("ETag")
+	if len(etag) == 0 {
+		t.Fatal("Expected an ETag")
+	}
+
+	req2, err := http.NewRequest("PUT", "/store/foo", strings.NewReader("other"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	req2.Header.Set("Authorization", authHeader)
+	req2.Header.Set("If-Match", `"outdated"`)
+	recorder2 := httptest.NewRecorder()
+	handler.ServeHTTP(recorder2, req2)
+	if recorder2.Code != http.StatusPreconditionFailed {
+		t.Errorf("Expected StatusPreconditionFailed, got %d", recorder2.Code)
+	}
+
+	req3, err := http.NewRequest("PUT", "/store/foo", strings.NewReader("other"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	req3.Header.Set("Authorization", authHeader)
+	req3.Header.Set("If-Match", etag)
+	recorder3 := httptest.NewRecorder()
+	handler.ServeHTTP(recorder3, req3)
+	if recorder3.Code != http.StatusOK {
+		t.Errorf("Expected OK, got %d", recorder3.Code)
+	}
+	if recorder3.Header().Get("ETag") == etag {
+		t.Error("Expected ETag to change")
+	}
+}
+
+func TestDeleteHandlerPreconditions(t *testing.T) {
+	config, appState, keyPairs, handler := setupHandlerTest(t, "/store/{key}", DeleteHandler)
+	accessToken, err := crypto.CreateAccessToken(*config.GetConfig(), keyPairs, "alice@example.com")
+	if err != nil {
+		t.Fatal(err)
+	}
+	authHeader := fmt.Sprintf("Bearer %s", accessToken)
+	version, err := InsertKeyValueWithOptions(&appState, *config, "alice@example.com", "foo", []byte("content"), InsertOptions{})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	req, err := http.NewRequest("DELETE", "/store/foo", nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	req.Header.Set("Authorization", authHeader)
+	req.Header.Set("If-Match", `"outdated"`)
+	recorder := httptest.NewRecorder()
+	handler.ServeHTTP(recorder, req)
+	if recorder.Code != http.StatusPreconditionFailed {
+		t.Errorf("Expected StatusPreconditionFailed, got %d", recorder.Code)
+	}
+
+	req2, err := http.NewRequest("DELETE", "/store/foo", nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	req2.Header.Set("Authorization", authHeader)
+	req2.Header.Set("If-Match", formatETag(version.ETag))
+	recorder2 := httptest.NewRecorder()
+	handler.ServeHTTP(recorder2, req2)
+	if recorder2.Code != http.StatusOK {
+		t.Errorf("Expected OK, got %d", recorder2.Code)
+	}
+}
+
+func TestInsertHandlerTTL(t *testing.T) {
+	config, appState, keyPairs, handler := setupHandlerTest(t, "/store/{key}", InsertHandler)
+	config.StorageOptions.MaxVersionsPerKey = 10
+	accessToken, err := crypto.CreateAccessToken(*config.GetConfig(), keyPairs, "alice@example.com")
+	if err != nil {
+		t.Fatal(err)
+	}
+	authHeader := fmt.Sprintf("Bearer %s", accessToken)
+
+	req, err := http.NewRequest("POST", "/store/foo?ttl=invalid", strings.NewReader("content"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	req.Header.Set("Authorization", authHeader)
+	recorder := httptest.NewRecorder()
+	handler.ServeHTTP(recorder, req)
+	if recorder.Code != http.StatusBadRequest {
+		t.Errorf("Expected StatusBadRequest, got %d", recorder.Code)
+	}
+
+	req2, err := http.NewRequest("POST", "/store/foo?ttl=60", strings.NewReader("content"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	req2.Header.Set("Authorization", authHeader)
+	recorder2 := httptest.NewRecorder()
+	handler.ServeHTTP(recorder2, req2)
+	if recorder2.Code != http.StatusCreated {
+		t.Errorf("Expected StatusCreated, got %d", recorder2.Code)
+	}
+	expires, err := http.ParseTime(recorder2.Header().Get("Expires"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if expires.Before(time.Now()) || expires.After(time.Now().Add(2*time.Minute)) {
+		t.Errorf("Unexpected expiry %v", expires)
+	}
+
+	// a value with a TTL can not keep the previous versions of a key
+	for _, content := range []string{"first", "second"} {
+		_, err = InsertKeyValueForIdentifier(&appState, *config, "alice@example.com", "versioned", []byte(content))
+		if err != nil {
+			t.Fatal(err)
+		}
+	}
+	req3, err := http.NewRequest("PUT", "/store/versioned?ttl=60", strings.NewReader("content"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	req3.Header.Set("Authorization", authHeader)
+	recorder3 := httptest.NewRecorder()
+	handler.ServeHTTP(recorder3, req3)
+	if recorder3.Code != http.StatusConflict {
+		t.Errorf("Expected StatusConflict, got %d", recorder3.Code)
+	}
+	versions, err := VersionsForIdentifierAndKey(&appState, "alice@example.com", "versioned")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(versions) != 2 || versions[1].ExpiresAt != nil {
+		t.Errorf("Expected the versions to be kept, got %+v", versions)
+	}
+}
+
+func TestUsageHandler(t *testing.T) {
+	config, appState, keyPairs, handler := setupHandlerTest(t, "/usage", UsageHandler)
+	config.StorageOptions.MaxBytesPerAccount = 100
+	accessToken, err := crypto.CreateAccessToken(*config.GetConfig(), keyPairs, "alice@example.com")
+	if err != nil {
+		t.Fatal(err)
+	}
+	_, err = InsertKeyValueForIdentifier(&appState, *config, "alice@example.com", "foo", []byte("content"))
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	req, err := http.NewRequest("GET", "/usage", nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	authHeader := fmt.Sprintf("Bearer %s", accessToken)
+	req.Header.Set("Authorization", authHeader)
+	recorder := httptest.NewRecorder()
+	handler.ServeHTTP(recorder, req)
+	if recorder.Code != http.StatusOK {
+		t.Errorf("Expected OK, got %d", recorder.Code)
+	}
+	var result UsageResponse
+	decoder := json.NewDecoder(recorder.Body)
+	err = decoder.Decode(&result)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if result.Keys != 1 || result.Bytes != uint64(len("content")) || result.MaxBytes != 100 {
+		t.Errorf("Unexpected usage %v", result)
+	}
+}
+
+func TestInsertHandlerCreateAndUpdate(t *testing.T) {
+	config, appState, keyPairs, handler := setupHandlerTest(t, "/store/{key}", InsertHandler)
+	config.StorageOptions.MaxKeysPerAccount = 1
+	accessToken, err := crypto.CreateAccessToken(*config.GetConfig(), keyPairs, "alice@example.com")
+	if err != nil {
+		t.Fatal(err)
+	}
+	authHeader := fmt.Sprintf("Bearer %s", accessToken)
+	requests := []struct {
+		method       string
+		route        string
+		content      string
+		expectedCode int
+	}{
+		{method: "POST", route: "/store/foo", content: "first", expectedCode: http.StatusCreated},
+		{method: "POST", route: "/store/foo", content: "second", expectedCode: http.StatusConflict},
+		{method: "PUT", route: "/store/foo", content: "third", expectedCode: http.StatusOK},
+		{method: "PUT", route: "/store/bar", content: "fourth", expectedCode: http.StatusPreconditionFailed},
+	}
+	for _, request := range requests {
+		req, err := http.NewRequest(request.method, request.route, strings.NewReader(request.content))
+		if err != nil {
+			t.Fatal(err)
+		}
+		req.Header.Set("Authorization", authHeader)
+		recorder := httptest.NewRecorder()
+		handler.ServeHTTP(recorder, req)
+		if recorder.Code != request.expectedCode {
+			t.Errorf("Expected %d for %s %s, got %d", request.expectedCode, request.method, request.route, recorder.Code)
+		}
+	}
+	value, err := RetrieveValueIdentifierAndKey(&appState, "alice@example.com", "foo")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if bytes.Compare([]byte("third"), value) != 0 {
+		t.Fatalf("Expected stored value to be third, got %s", value)
+	}
+}
+
+func TestIndexHandlerPagination(t *testing.T) {
+	config, appState, keyPairs, handler := setupHandlerTest(t, "/store", IndexHandler)
+	accessToken, err := crypto.CreateAccessToken(*config.GetConfig(), keyPairs, "alice@example.com")
+	if err != nil {
+		t.Fatal(err)
+	}
+	authHeader := fmt.Sprintf("Bearer %s", accessToken)
+	for _, key := range []string{"a", "b", "c"} {
+		_, err = InsertKeyValueForIdentifier(&appState, *config, "alice@example.com", key, []byte("content"))
+		if err != nil {
+			t.Fatal(err)
+		}
+	}
+	keys := []string{}
+	route := "/store?limit=2"
+	for pages := 0; len(route) > 0; pages++ {
+		if pages > 2 {
+			t.Fatal("Expected two pages")
+		}
+		req, err := http.NewRequest("GET", route, nil)
+		if err != nil {
+			t.Fatal(err)
+		}
+		req.Header.Set("Authorization", authHeader)
+		recorder := httptest.NewRecorder()
+		handler.ServeHTTP(recorder, req)
+		if recorder.Code != http.StatusOK {
+			t.Fatalf("Expected OK, got %d", recorder.Code)
+		}
+		var result IndexReponse
+		decoder := json.NewDecoder(recorder.Body)
+		err = decoder.Decode(&result)
+		if err != nil {
+			t.Fatal(err)
+		}
+		keys = append(keys, result.Keys...)
+		route = ""
+		if len(result.NextCursor) > 0 {
+			route = fmt.Sprintf("/store?limit=2&cursor=%s", result.NextCursor)
+		}
+	}
+	if len(keys) != 3 {
+		t.Errorf("Expected three keys, got %v", keys)
+	}
+
+	req, err := http.NewRequest("GET", "/store?limit=-1", nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	req.Header.Set("Authorization", authHeader)
+	recorder := httptest.NewRecorder()
+	handler.ServeHTTP(recorder, req)
+	if recorder.Code != http.StatusBadRequest {
+		t.Errorf("Expected StatusBadRequest, got %d", recorder.Code)
+	}
+}
+
+func TestIndexHandlerDetails(t *testing.T) {
+	config, appState, keyPairs, handler := setupHandlerTest(t, "/store", IndexHandler)
+	accessToken, err := crypto.CreateAccessToken(*config.GetConfig(), keyPairs, "alice@example.com")
+	if err != nil {
+		t.Fatal(err)
+	}
+	version, err := InsertKeyValueWithOptions(&appState, *config, "alice@example.com", "foo", []byte("{}"), InsertOptions{ContentType: "application/json"})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	req, err := http.NewRequest("GET", "/store?details=true", nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	authHeader := fmt.Sprintf("Bearer %s", accessToken)
+	req.Header.Set("Authorization", authHeader)
+	recorder := httptest.NewRecorder()
+	handler.ServeHTTP(recorder, req)
+	if recorder.Code != http.StatusOK {
+		t.Errorf("Expected OK, got %d", recorder.Code)
+	}
+	var result IndexReponse
+	decoder := json.NewDecoder(recorder.Body)
+	err = decoder.Decode(&result)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(result.Keys) != 1 || len(result.Details) != 1 {
+		t.Fatalf("Expected one key with details, got %v", result)
+	}
+	if result.Details[0].ETag != version.ETag || result.Details[0].ContentType != "application/json" {
+		t.Errorf("Unexpected details %v", result.Details[0])
+	}
+}
+
+func TestRetrieveHandlerContentHeaders(t *testing.T) {
+	config, appState, keyPairs, handler := setupHandlerTest(t, "/store/{key}", RetrieveHandler)
+	accessToken, err := crypto.CreateAccessToken(*config.GetConfig(), keyPairs, "alice@example.com")
+	if err != nil {
+		t.Fatal(err)
+	}
+	options := InsertOptions{
+		ContentType:     "image/png",
+		ContentEncoding: "gzip",
+		Filename:        "cat.png",
+	}
+	_, err = InsertKeyValueWithOptions(&appState, *config, "alice@example.com", "foo", []byte("content"), options)
+	if err != nil {
+		t.Fatal(err)
+	}
+	_, err = InsertKeyValueForIdentifier(&appState, *config, "alice@example.com", "bar", []byte("content"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	authHeader := fmt.Sprintf("Bearer %s", accessToken)
+
+	req, err := http.NewRequest("GET", "/store/foo", nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	req.Header.Set("Authorization", authHeader)
+	recorder := httptest.NewRecorder()
+	handler.ServeHTTP(recorder, req)
+	if recorder.Code != http.StatusOK {
+		t.Errorf("Expected OK, got %d", recorder.Code)
+	}
+	if contentType := recorder.Header().Get("Content-Type"); contentType != "image/png" {
+		t.Errorf("Expected image/png, got %s", contentType)
+	}
+	if contentEncoding := recorder.Header().Get("Content-Encoding"); contentEncoding != "gzip" {
+		t.Errorf("Expected gzip, got %s", contentEncoding)
+	}
+	if contentDisposition := recorder.Header().Get("Content-Disposition"); contentDisposition != "attachment; filename=cat.png" {
+		t.Errorf("Unexpected Content-Disposition %s", contentDisposition)
+	}
+
+	req2, err := http.NewRequest("GET", "/store/bar", nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	req2.Header.Set("Authorization", authHeader)
+	recorder2 := httptest.NewRecorder()
+	handler.ServeHTTP(recorder2, req2)
+	if contentType := recorder2.Header().Get("Content-Type"); contentType != "application/octet-stream" {
+		t.Errorf("Expected application/octet-stream, got %s", contentType)
+	}
+	if contentDisposition := recorder2.Header().Get("Content-Disposition"); contentDisposition != "attachment" {
+		t.Errorf("Expected attachment, got %s", contentDisposition)
+	}
+	if recorder2.Header().Get("X-Content-Type-Options") != "nosniff" || recorder2.Header().Get("Content-Security-Policy") != "sandbox" {
+		t.Errorf("Expected nosniff and a sandbox, got %v", recorder2.Header())
+	}
+}
+
+func TestInsertHandlerChunked(t *testing.T) {
+	config, appState, keyPairs, handler := setupHandlerTest(t, "/store/{key}", InsertHandler)
+	config.StorageOptions.ChunkSizeBytes = 4
+	config.StorageOptions.MaxValueSizeBytes = 16
+	accessToken, err := crypto.CreateAccessToken(*config.GetConfig(), keyPairs, "alice@example.com")
+	if err != nil {
+		t.Fatal(err)
+	}
+	authHeader := fmt.Sprintf("Bearer %s", accessToken)
+
+	content := "0123456789"
+	req, err := http.NewRequest("PUT", "/store/foo", strings.NewReader(content))
+	if err != nil {
+		t.Fatal(err)
+	}
+	req.Header.Set("Authorization", authHeader)
+	recorder := httptest.NewRecorder()
+	handler.ServeHTTP(recorder, req)
+	if recorder.Code != http.StatusCreated {
+		t.Errorf("Expected Created, got %d", recorder.Code)
+	}
+	value, err := RetrieveValueIdentifierAndKey(&appState, "alice@example.com", "foo")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if string(value) != content {
+		t.Errorf("Expected %s, got %s", content, value)
+	}
+
+	req2, err := http.NewRequest("PUT", "/store/foo", strings.NewReader("0123456789abcdefg"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	req2.Header.Set("Authorization", authHeader)
+	recorder2 := httptest.NewRecorder()
+	handler.ServeHTTP(recorder2, req2)
+	if recorder2.Code != http.StatusRequestEntityTooLarge {
+		t.Errorf("Expected RequestEntityTooLarge, got %d", recorder2.Code)
+	}
+}
+
+func TestRetrieveHandlerChunked(t *testing.T) {
+	config, appState, keyPairs, handler := setupHandlerTest(t, "/store/{key}", RetrieveHandler)
+	config.StorageOptions.ChunkSizeBytes = 4
+	accessToken, err := crypto.CreateAccessToken(*config.GetConfig(), keyPairs, "alice@example.com")
+	if err != nil {
+		t.Fatal(err)
+	}
+	content := "0123456789"
+	_, err = InsertKeyValueFromReader(&appState, *config, "alice@example.com", "foo", strings.NewReader(content), InsertOptions{})
+	if err != nil {
+		t.Fatal(err)
+	}
+	req, err := http.NewRequest("GET", "/store/foo", nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	req.Header.Set("Authorization", fmt.Sprintf("Bearer %s", accessToken))
+	recorder := httptest.NewRecorder()
+	handler.ServeHTTP(recorder, req)
+	if recorder.Code != http.StatusOK {
+		t.Errorf("Expected OK, got %d", recorder.Code)
+	}
+	if body := recorder.Body.String(); body != content {
+		t.Errorf("Expected %s, got %s", content, body)
+	}
+	if contentLength := recorder.Header().Get("Content-Length"); contentLength != "10" {
+		t.Errorf("Expected Content-Length 10, got %s", contentLength)
+	}
+}
+
+func TestRetrieveHandlerHead(t *testing.T) {
+	config, appState, keyPairs, handler := setupHandlerTest(t, "/store/{key}", RetrieveHandler)
+	accessToken, err := crypto.CreateAccessToken(*config.GetConfig(), keyPairs, "alice@example.com")
+	if err != nil {
+		t.Fatal(err)
+	}
+	options := InsertOptions{
+		ContentType: "application/json",
+	}
+	version, err := InsertKeyValueWithOptions(&appState, *config, "alice@example.com", "foo", []byte(`{"a":1}`), options)
+	if err != nil {
+		t.Fatal(err)
+	}
+	req, err := http.NewRequest("HEAD", "/store/foo", nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	req.Header.Set("Authorization", fmt.Sprintf("Bearer %s", accessToken))
+	recorder := httptest.NewRecorder()
+	handler.ServeHTTP(recorder, req)
+	if recorder.Code != http.StatusOK {
+		t.Errorf("Expected OK, got %d", recorder.Code)
+	}
+	if recorder.Body.Len() != 0 {
+		t.Errorf("Expected no body, got %s", recorder.Body.String())
+	}
+	if contentLength := recorder.Header().Get("Content-Length"); contentLength != "7" {
+		t.Errorf("Expected Content-Length 7, got %s", contentLength)
+	}
+	if contentType := recorder.Header().Get("Content-Type"); contentType != "application/json" {
+		t.Errorf("Expected application/json, got %s", contentType)
+	}
+	if etag := recorder.Header().Get("ETag"); etag != formatETag(version.ETag) {
+		t.Errorf("Expected ETag %s, got %s", formatETag(version.ETag), etag)
+	}
+	if lastModified := recorder.Header().Get("Last-Modified"); lastModified != version.Timestamp.UTC().Format(http.TimeFormat) {
+		t.Errorf("Unexpected Last-Modified %s", lastModified)
+	}
+}
+
+func TestRetrieveHandlerRange(t *testing.T) {
+	config, appState, keyPairs, handler := setupHandlerTest(t, "/store/{key}", RetrieveHandler)
+	config.StorageOptions.ChunkSizeBytes = 4
+	accessToken, err := crypto.CreateAccessToken(*config.GetConfig(), keyPairs, "alice@example.com")
+	if err != nil {
+		t.Fatal(err)
+	}
+	authHeader := fmt.Sprintf("Bearer %s", accessToken)
+	version, err := InsertKeyValueFromReader(&appState, *config, "alice@example.com", "foo", strings.NewReader("0123456789"), InsertOptions{})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	requests := []struct {
+		rangeHeader   string
+		ifRange       string
+		expectedCode  int
+		expectedBody  string
+		expectedRange string
+	}{
+		{
+			// spans the first two chunks
+			rangeHeader:   "bytes=2-5",
+			expectedCode:  http.StatusPartialContent,
+			expectedBody:  "2345",
+			expectedRange: "bytes 2-5/10",
+		},
+		{
+			rangeHeader:   "bytes=-3",
+			expectedCode:  http.StatusPartialContent,
+			expectedBody:  "789",
+			expectedRange: "bytes 7-9/10",
+		},
+		{
+			rangeHeader:   "bytes=8-",
+			ifRange:       formatETag(version.ETag),
+			expectedCode:  http.StatusPartialContent,
+			expectedBody:  "89",
+			expectedRange: "bytes 8-9/10",
+		},
+		{
+			// the value changed, so the whole value is returned
+			rangeHeader:  "bytes=8-",
+			ifRange:      `"outdated"`,
+			expectedCode: http.StatusOK,
+			expectedBody: "0123456789",
+		},
+		{
+			rangeHeader:  "bytes=20-",
+			expectedCode: http.StatusRequestedRangeNotSatisfiable,
+		},
+	}
+	for _, request := range requests {
+		req, err := http.NewRequest("GET", "/store/foo", nil)
+		if err != nil {
+			t.Fatal(err)
+		}
+		req.Header.Set("Authorization", authHeader)
+		req.Header.Set("Range", request.rangeHeader)
+		if len(request.ifRange) > 0 {
+			req.Header.Set("If-Range", request.ifRange)
+		}
+		recorder := httptest.NewRecorder()
+		handler.ServeHTTP(recorder, req)
+		if recorder.Code != request.expectedCode {
+			t.Errorf("Expected %d for %s, got %d", request.expectedCode, request.rangeHeader, recorder.Code)
+			continue
+		}
+		if len(request.expectedBody) > 0 && recorder.Body.String() != request.expectedBody {
+			t.Errorf("Expected %s for %s, got %s", request.expectedBody, request.rangeHeader, recorder.Body.String())
+		}
+		if contentRange := recorder.Header().Get("Content-Range"); contentRange != request.expectedRange && len(request.expectedRange) > 0 {
+			t.Errorf("Expected Content-Range %s, got %s", request.expectedRange, contentRange)
+		}
+	}
+}
+
+func TestBatchHandler(t *testing.T) {
+	config, appState, keyPairs, handler := setupHandlerTest(t, "/store/_batch", BatchHandler)
+	accessToken, err := crypto.CreateAccessToken(*config.GetConfig(), keyPairs, "alice@example.com")
+	if err != nil {
+		t.Fatal(err)
+	}
+	authHeader := fmt.Sprintf("Bearer %s", accessToken)
+	_, err = InsertKeyValueForIdentifier(&appState, *config, "alice@example.com", "foo", []byte("foo"))
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	body := `{"operations": [{"op": "put", "key": "bar", "value": "YmFy"}, {"op": "delete", "key": "foo"}]}`
+	req, err := http.NewRequest("POST", "/store/_batch", strings.NewReader(body))
+	if err != nil {
+		t.Fatal(err)
+	}
+	req.Header.Set("Authorization", authHeader)
+	recorder := httptest.NewRecorder()
+	handler.ServeHTTP(recorder, req)
+	if recorder.Code != http.StatusOK {
+		t.Errorf("Expected OK, got %d", recorder.Code)
+	}
+	var response BatchResponse
+	err = json.NewDecoder(recorder.Body).Decode(&response)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !response.Committed || len(response.Results) != 2 {
+		t.Errorf("Unexpected response %+v", response)
+	}
+	value, err := RetrieveValueIdentifierAndKey(&appState, "alice@example.com", "bar")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if string(value) != "bar" {
+		t.Errorf("Expected bar, got %s", value)
+	}
+
+	body = `{"operations": [{"op": "put", "key": "baz", "value": "YmF6"}, {"op": "delete", "key": "foo"}]}`
+	req2, err := http.NewRequest("POST", "/store/_batch", strings.NewReader(body))
+	if err != nil {
+		t.Fatal(err)
+	}
+	req2.Header.Set("Authorization", authHeader)
+	recorder2 := httptest.NewRecorder()
+	handler.ServeHTTP(recorder2, req2)
+	if recorder2.Code != http.StatusNotFound {
+		t.Errorf("Expected NotFound, got %d", recorder2.Code)
+	}
+	var response2 BatchResponse
+	err = json.NewDecoder(recorder2.Body).Decode(&response2)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if response2.Committed || response2.Error != "KeyNotFound" || response2.Results[1].Error != "KeyNotFound" {
+		t.Errorf("Unexpected response %+v", response2)
+	}
+	_, err = RetrieveValueIdentifierAndKey(&appState, "alice@example.com", "baz")
+	if _, ok := err.(*ErrKeyNotFound); !ok {
+		t.Errorf("Expected the batch to be rolled back, got %v", err)
+	}
+
+	req3, err := http.NewRequest("POST", "/store/_batch", strings.NewReader("not json"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	req3.Header.Set("Authorization", authHeader)
+	recorder3 := httptest.NewRecorder()
+	handler.ServeHTTP(recorder3, req3)
+	if recorder3.Code != http.StatusBadRequest {
+		t.Errorf("Expected BadRequest, got %d", recorder3.Code)
+	}
+}
+
+func TestIncrementHandler(t *testing.T) {
+	config, appState, keyPairs, handler := setupHandlerTest(t, "/store/{key}/increment", IncrementHandler)
+	accessToken, err := crypto.CreateAccessToken(*config.GetConfig(), keyPairs, "alice@example.com")
+	if err != nil {
+		t.Fatal(err)
+	}
+	authHeader := fmt.Sprintf("Bearer %s", accessToken)
+	requests := []struct {
+		route         string
+		expectedCode  int
+		expectedValue int64
+	}{
+		{
+			route:         "/store/counter/increment",
+			expectedCode:  http.StatusCreated,
+			expectedValue: 1,
+		},
+		{
+			route:         "/store/counter/increment?delta=10",
+			expectedCode:  http.StatusOK,
+			expectedValue: 11,
+		},
+		{
+			route:         "/store/counter/increment?delta=-3",
+			expectedCode:  http.StatusOK,
+			expectedValue: 8,
+		},
+		{
+			route:        "/store/counter/increment?delta=one",
+			expectedCode: http.StatusBadRequest,
+		},
+		{
+			route:        "/store/text/increment",
+			expectedCode: http.StatusConflict,
+		},
+	}
+	_, err = InsertKeyValueForIdentifier(&appState, *config, "alice@example.com", "text", []byte("text"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	for _, request := range requests {
+		req, err := http.NewRequest("POST", request.route, nil)
+		if err != nil {
+			t.Fatal(err)
+		}
+		req.Header.Set("Authorization", authHeader)
+		recorder := httptest.NewRecorder()
+		handler.ServeHTTP(recorder, req)
+		if recorder.Code != request.expectedCode {
+			t.Errorf("Expected %d for %s, got %d", request.expectedCode, request.route, recorder.Code)
+			continue
+		}
+		if recorder.Code >= 300 {
+			continue
+		}
+		var response IncrementResponse
+		err = json.NewDecoder(recorder.Body).Decode(&response)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if response.Value != request.expectedValue {
+			t.Errorf("Expected %d for %s, got %d", request.expectedValue, request.route, response.Value)
+		}
+	}
+}
+
+func TestAppendHandler(t *testing.T) {
+	config, appState, keyPairs, handler := setupHandlerTest(t, "/store/{key}/append", AppendHandler)
+	config.StorageOptions.MaxValueSizeBytes = 8
+	accessToken, err := crypto.CreateAccessToken(*config.GetConfig(), keyPairs, "alice@example.com")
+	if err != nil {
+		t.Fatal(err)
+	}
+	authHeader := fmt.Sprintf("Bearer %s", accessToken)
+	requests := []struct {
+		body         string
+		expectedCode int
+	}{
+		{
+			body:         "abc",
+			expectedCode: http.StatusCreated,
+		},
+		{
+			body:         "def",
+			expectedCode: http.StatusOK,
+		},
+		{
+			body:         "ghi",
+			expectedCode: http.StatusRequestEntityTooLarge,
+		},
+	}
+	for _, request := range requests {
+		req, err := http.NewRequest("POST", "/store/log/append", strings.NewReader(request.body))
+		if err != nil {
+			t.Fatal(err)
+		}
+		req.Header.Set("Authorization", authHeader)
+		recorder := httptest.NewRecorder()
+		handler.ServeHTTP(recorder, req)
+		if recorder.Code != request.expectedCode {
+			t.Errorf("Expected %d for %s, got %d", request.expectedCode, request.body, recorder.Code)
+		}
+	}
+	value, err := RetrieveValueIdentifierAndKey(&appState, "alice@example.com", "log")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if string(value) != "abcdef" {
+		t.Errorf("Expected abcdef, got %s", value)
+	}
+}
+
+func TestPatchHandler(t *testing.T) {
+	config, appState, keyPairs, handler := setupHandlerTest(t, "/store/{key}", PatchHandler)
+	accessToken, err := crypto.CreateAccessToken(*config.GetConfig(), keyPairs, "alice@example.com")
+	if err != nil {
+		t.Fatal(err)
+	}
+	authHeader := fmt.Sprintf("Bearer %s", accessToken)
+	options := InsertOptions{
+		ContentType: "application/json; charset=utf-8",
+	}
+	version, err := InsertKeyValueWithOptions(&appState, *config, "alice@example.com", "settings", []byte(`{"theme": "dark", "tags": []}`), options)
+	if err != nil {
+		t.Fatal(err)
+	}
+	requests := []struct {
+		contentType  string
+		body         string
+		ifMatch      string
+		expectedCode int
+	}{
+		{
+			contentType:  MergePatchContentType,
+			body:         `{"theme": "light"}`,
+			ifMatch:      formatETag(version.ETag),
+			expectedCode: http.StatusOK,
+		},
+		{
+			contentType:  MergePatchContentType,
+			body:         `{"theme": "dark"}`,
+			ifMatch:      formatETag(version.ETag),
+			expectedCode: http.StatusPreconditionFailed,
+		},
+		{
+			contentType:  JSONPatchContentType,
+			body:         `[{"op": "add", "path": "/tags/-", "value": "new"}]`,
+			expectedCode: http.StatusOK,
+		},
+		{
+			contentType:  JSONPatchContentType,
+			body:         `[{"op": "test", "path": "/theme", "value": "dark"}]`,
+			expectedCode: http.StatusUnprocessableEntity,
+		},
+		{
+			contentType:  "application/json",
+			body:         `{"theme": "dark"}`,
+			expectedCode: http.StatusUnsupportedMediaType,
+		},
+	}
+	for _, request := range requests {
+		req, err := http.NewRequest("PATCH", "/store/settings", strings.NewReader(request.body))
+		if err != nil {
+			t.Fatal(err)
+		}
+		req.Header.Set("Authorization", authHeader)
+		req.Header.Set("Content-Type", request.contentType)
+		if len(request.ifMatch) > 0 {
+			req.Header.Set("If-Match", request.ifMatch)
+		}
+		recorder := httptest.NewRecorder()
+		handler.ServeHTTP(recorder, req)
+		if recorder.Code != request.expectedCode {
+			t.Errorf("Expected %d for %s, got %d", request.expectedCode, request.body, recorder.Code)
+		}
+	}
+	value, err := RetrieveValueIdentifierAndKey(&appState, "alice@example.com", "settings")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if string(value) != `{"tags":["new"],"theme":"light"}` {
+		t.Errorf("Unexpected value %s", value)
+	}
+}
+
+func TestPatchHandlerConflicts(t *testing.T) {
+	config, appState, keyPairs, handler := setupHandlerTest(t, "/store/{key}", PatchHandler)
+	accessToken, err := crypto.CreateAccessToken(*config.GetConfig(), keyPairs, "alice@example.com")
+	if err != nil {
+		t.Fatal(err)
+	}
+	_, err = InsertKeyValueWithOptions(&appState, *config, "alice@example.com", "settings", []byte(`{}`), InsertOptions{ContentType: "application/json"})
+	if err != nil {
+		t.Fatal(err)
+	}
+	retries := maxConflictRetries
+	maxConflictRetries = 0
+	defer func() { maxConflictRetries = retries }()
+	// concurrent patches of the same key conflict, without retries some
+	// of them fail
+	for round := 0; round < 20; round++ {
+		recorders := make([]*httptest.ResponseRecorder, 16)
+		var wg sync.WaitGroup
+		for i := range recorders {
+			req, err := http.NewRequest("PATCH", "/store/settings", strings.NewReader(fmt.Sprintf(`{"field%d": %d}`, i, round)))
+			if err != nil {
+				t.Fatal(err)
+			}
+			req.Header.Set("Authorization", fmt.Sprintf("Bearer %s", accessToken))
+			req.Header.Set("Content-Type", MergePatchContentType)
+			recorders[i] = httptest.NewRecorder()
+			wg.Add(1)
+			go func(recorder *httptest.ResponseRecorder, req *http.Request) {
+				defer wg.Done()
+				handler.ServeHTTP(recorder, req)
+			}(recorders[i], req)
+		}
+		wg.Wait()
+		conflicted := false
+		for _, recorder := range recorders {
+			switch recorder.Code {
+			case http.StatusOK:
+			case http.StatusServiceUnavailable:
+				if recorder.Header().Get("Retry-After") != "1" {
+					t.Errorf("Expected Retry-After, got %v", recorder.Header())
+				}
+				conflicted = true
+			default:
+				t.Fatalf("Expected StatusOK or StatusServiceUnavailable, got %d", recorder.Code)
+			}
+		}
+		if conflicted {
+			return
+		}
+	}
+	t.Error("Expected concurrent patches to conflict")
+}
+
+func TestBucketHandlers(t *testing.T) {
+	config := DefaultConfig()
+	db, err := badger.Open(badger.DefaultOptions("").WithInMemory(true))
+	if err != nil {
+		t.Fatal(err)
+	}
+	keyPairs := crypto.KeyPairForTesting()
+	appState := state.State{
+		DB:          db,
+		RSAKeyPairs: keyPairs,
+	}
+	accessToken, err := crypto.CreateAccessToken(*config.GetConfig(), keyPairs, "alice@example.com")
+	if err != nil {
+		t.Fatal(err)
+	}
+	handler := SetupHandler(&config, &appState)
+	requests := []struct {
+		method       string
+		route        string
+		body         string
+		expectedCode int
+		expectedBody string
+	}{
+		{
+			method:       "POST",
+			route:        "/api/buckets",
+			body:         `{"name": "notes", "maxKeys": 10}`,
+			expectedCode: http.StatusCreated,
+		},
+		{
+			method:       "POST",
+			route:        "/api/buckets",
+			body:         `{"name": "notes"}`,
+			expectedCode: http.StatusConflict,
+		},
+		{
+			method:       "PUT",
+			route:        "/api/buckets/notes/store/foo",
+			body:         "notes",
+			expectedCode: http.StatusCreated,
+		},
+		{
+			method:       "PUT",
+			route:        "/api/buckets/missing/store/foo",
+			body:         "missing",
+			expectedCode: http.StatusNotFound,
+		},
+		{
+			method:       "GET",
+			route:        "/api/store/foo",
+			expectedCode: http.StatusNotFound,
+		},
+		{
+			method:       "GET",
+			route:        "/api/buckets/notes/store/foo",
+			expectedCode: http.StatusOK,
+			expectedBody: "notes",
+		},
+		{
+			method:       "PUT",
+			route:        "/api/buckets/default/store/foo",
+			body:         "default",
+			expectedCode: http.StatusCreated,
+		},
+		{
+			method:       "GET",
+			route:        "/api/store/foo",
+			expectedCode: http.StatusOK,
+			expectedBody: "default",
+		},
+		{
+			method:       "GET",
+			route:        "/api/buckets/notes/store",
+			expectedCode: http.StatusOK,
+			expectedBody: "{\"keys\":[\"foo\"]}\n",
+		},
+		{
+			method:       "DELETE",
+			route:        "/api/buckets/notes",
+			expectedCode: http.StatusOK,
+		},
+		{
+			method:       "GET",
+			route:        "/api/buckets/notes/store/foo",
+			expectedCode: http.StatusNotFound,
+		},
+		{
+			method:       "DELETE",
+			route:        "/api/buckets/default",
+			expectedCode: http.StatusBadRequest,
+		},
+	}
+	for _, request := range requests {
+		req, err := http.NewRequest(request.method, request.route, strings.NewReader(request.body))
+		if err != nil {
+			t.Fatal(err)
+		}
+		req.Header.Set("Authorization", fmt.Sprintf("Bearer %s", accessToken))
+		recorder := httptest.NewRecorder()
+		handler.ServeHTTP(recorder, req)
+		if recorder.Code != request.expectedCode {
+			t.Errorf("Expected %d for %s on %s, got %d", request.expectedCode, request.method, request.route, recorder.Code)
+		}
+		if len(request.expectedBody) > 0 && recorder.Body.String() != request.expectedBody {
+			t.Errorf("Expected %q for %s on %s, got %q", request.expectedBody, request.method, request.route, recorder.Body.String())
+		}
+	}
+
+	req, err := http.NewRequest("GET", "/api/buckets", nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	req.Header.Set("Authorization", fmt.Sprintf("Bearer %s", accessToken))
+	recorder := httptest.NewRecorder()
+	handler.ServeHTTP(recorder, req)
+	var response BucketsResponse
+	err = json.NewDecoder(recorder.Body).Decode(&response)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(response.Buckets) != 1 || response.Buckets[0].Name != DefaultBucket || response.Buckets[0].Usage.Keys != 1 {
+		t.Errorf("Unexpected buckets %+v", response.Buckets)
+	}
+}
+
+func TestTrashHandlers(t *testing.T) {
+	config := DefaultConfig()
+	config.StorageOptions.TrashRetentionSeconds = 3600
+	db, err := badger.Open(badger.DefaultOptions("").WithInMemory(true))
+	if err != nil {
+		t.Fatal(err)
+	}
+	keyPairs := crypto.KeyPairForTesting()
+	appState := state.State{
+		DB:          db,
+		RSAKeyPairs: keyPairs,
+	}
+	accessToken, err := crypto.CreateAccessToken(*config.GetConfig(), keyPairs, "alice@example.com")
+	if err != nil {
+		t.Fatal(err)
+	}
+	handler := SetupHandler(&config, &appState)
+	requests := []struct {
+		method       string
+		route        string
+		body         string
+		expectedCode int
+		expectedBody string
+	}{
+		{
+			method:       "PUT",
+			route:        "/api/store/foo",
+			body:         "content",
+			expectedCode: http.StatusCreated,
+		},
+		{
+			method:       "DELETE",
+			route:        "/api/store/foo",
+			expectedCode: http.StatusOK,
+		},
+		{
+			method:       "GET",
+			route:        "/api/store/foo",
+			expectedCode: http.StatusNotFound,
+		},
+		{
+			method:       "POST",
+			route:        "/api/trash/bar/restore",
+			expectedCode: http.StatusNotFound,
+		},
+		{
+			method:       "PUT",
+			route:        "/api/store/foo",
+			body:         "recreated",
+			expectedCode: http.StatusCreated,
+		},
+		{
+			method:       "POST",
+			route:        "/api/trash/foo/restore",
+			expectedCode: http.StatusConflict,
+		},
+		{
+			method:       "DELETE",
+			route:        "/api/store/foo",
+			expectedCode: http.StatusOK,
+		},
+		{
+			method:       "POST",
+			route:        "/api/trash/foo/restore",
+			expectedCode: http.StatusCreated,
+		},
+		{
+			method:       "GET",
+			route:        "/api/store/foo",
+			expectedCode: http.StatusOK,
+			expectedBody: "recreated",
+		},
+		{
+			method:       "GET",
+			route:        "/api/trash",
+			expectedCode: http.StatusOK,
+			expectedBody: "{\"keys\":[]}\n",
+		},
+	}
+	for _, request := range requests {
+		req, err := http.NewRequest(request.method, request.route, strings.NewReader(request.body))
+		if err != nil {
+			t.Fatal(err)
+		}
+		req.Header.Set("Authorization", fmt.Sprintf("Bearer %s", accessToken))
+		recorder := httptest.NewRecorder()
+		handler.ServeHTTP(recorder, req)
+		if recorder.Code != request.expectedCode {
+			t.Errorf("Expected %d for %s on %s, got %d", request.expectedCode, request.method, request.route, recorder.Code)
+		}
+		if len(request.expectedBody) > 0 && recorder.Body.String() != request.expectedBody {
+			t.Errorf("Expected %q for %s on %s, got %q", request.expectedBody, request.method, request.route, recorder.Body.String())
+		}
+	}
+}
+
+func TestExportHandler(t *testing.T) {
+	config, appState, keyPairs, handler := setupHandlerTest(t, "/export", ExportHandler)
+	accessToken, err := crypto.CreateAccessToken(*config.GetConfig(), keyPairs, "alice@example.com")
+	if err != nil {
+		t.Fatal(err)
+	}
+	_, err = InsertKeyValueForIdentifier(&appState, *config, "alice@example.com", "foo", []byte("content"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	req, err := http.NewRequest("GET", "/export", nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	req.Header.Set("Authorization", fmt.Sprintf("Bearer %s", accessToken))
+	recorder := httptest.NewRecorder()
+	handler.ServeHTTP(recorder, req)
+	if recorder.Code != http.StatusOK {
+		t.Errorf("Expected OK, got %d", recorder.Code)
+	}
+	if contentType := recorder.Header().Get("Content-Type"); contentType != "application/x-tar" {
+		t.Errorf("Unexpected Content-Type %s", contentType)
+	}
+	names, files := readTarExport(t, recorder.Body.Bytes())
+	if len(names) != 2 || string(files[exportPath(DefaultBucket, "foo")]) != "content" {
+		t.Errorf("Unexpected files %v", names)
+	}
+
+	req, err = http.NewRequest("GET", "/export?format=rar", nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	req.Header.Set("Authorization", fmt.Sprintf("Bearer %s", accessToken))
+	recorder = httptest.NewRecorder()
+	handler.ServeHTTP(recorder, req)
+	if recorder.Code != http.StatusBadRequest {
+		t.Errorf("Expected BadRequest, got %d", recorder.Code)
+	}
+}
+
+func TestImportHandler(t *testing.T) {
+	config, appState, keyPairs, handler := setupHandlerTest(t, "/import", ImportHandler)
+	accessToken, err := crypto.CreateAccessToken(*config.GetConfig(), keyPairs, "carol@example.com")
+	if err != nil {
+		t.Fatal(err)
+	}
+	_, err = InsertKeyValueForIdentifier(&appState, *config, "alice@example.com", "foo", []byte("content"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	var archive bytes.Buffer
+	err = ExportForIdentifier(&appState, "alice@example.com", ExportFormatTar, &archive)
+	if err != nil {
+		t.Fatal(err)
+	}
+	requests := []struct {
+		route        string
+		expectedCode int
+		expectedKeys int
+	}{
+		{
+			route:        "/import?dryRun=true",
+			expectedCode: http.StatusOK,
+			expectedKeys: 0,
+		},
+		{
+			route:        "/import",
+			expectedCode: http.StatusOK,
+			expectedKeys: 1,
+		},
+		{
+			route:        "/import?mode=fail",
+			expectedCode: http.StatusConflict,
+			expectedKeys: 1,
+		},
+		{
+			route:        "/import?mode=skip",
+			expectedCode: http.StatusOK,
+			expectedKeys: 1,
+		},
+		{
+			route:        "/import?mode=merge",
+			expectedCode: http.StatusBadRequest,
+			expectedKeys: 1,
+		},
+	}
+	for _, request := range requests {
+		req, err := http.NewRequest("POST", request.route, bytes.NewReader(archive.Bytes()))
+		if err != nil {
+			t.Fatal(err)
+		}
+		req.Header.Set("Authorization", fmt.Sprintf("Bearer %s", accessToken))
+		recorder := httptest.NewRecorder()
+		handler.ServeHTTP(recorder, req)
+		if recorder.Code != request.expectedCode {
+			t.Errorf("Expected %d for %s, got %d", request.expectedCode, request.route, recorder.Code)
+		}
+		var report ImportReport
+		err = json.NewDecoder(recorder.Body).Decode(&report)
+		if err != nil {
+			t.Fatal(err)
+		}
+		keys, err := KeysForIdentifier(&appState, "carol@example.com")
+		if err != nil {
+			t.Fatal(err)
+		}
+		if len(keys) != request.expectedKeys {
+			t.Errorf("Expected %d keys after %s, got %v", request.expectedKeys, request.route, keys)
+		}
+	}
+}
+
+func TestDeleteAccountHandler(t *testing.T) {
+	config, appState, keyPairs, handler := setupHandlerTest(t, "/account", DeleteAccountHandler)
+	accessToken, err := crypto.CreateAccessToken(*config.GetConfig(), keyPairs, "alice@example.com")
+	if err != nil {
+		t.Fatal(err)
+	}
+	err = appState.InsertToken(config.Config, "alice@example.com", "12345678")
+	if err != nil {
+		t.Fatal(err)
+	}
+	_, err = InsertKeyValueForIdentifier(&appState, *config, "alice@example.com", "foo", []byte("content"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	requests := []struct {
+		body         string
+		expectedCode int
+		expectedKeys int
+	}{
+		{
+			body:         "",
+			expectedCode: http.StatusBadRequest,
+			expectedKeys: 1,
+		},
+		{
+			body:         `{"token": "content"}`,
+			expectedCode: http.StatusForbidden,
+			expectedKeys: 1,
+		},
+		{
+			body:         `{"token": "12345678"}`,
+			expectedCode: http.StatusOK,
+			expectedKeys: 0,
+		},
+	}
+	for _, request := range requests {
+		req, err := http.NewRequest("DELETE", "/account", strings.NewReader(request.body))
+		if err != nil {
+			t.Fatal(err)
+		}
+		req.Header.Set("Authorization", fmt.Sprintf("Bearer %s", accessToken))
+		recorder := httptest.NewRecorder()
+		handler.ServeHTTP(recorder, req)
+		if recorder.Code != request.expectedCode {
+			t.Errorf("Expected %d for %q, got %d", request.expectedCode, request.body, recorder.Code)
+		}
+		keys, err := KeysForIdentifier(&appState, "alice@example.com")
+		if err != nil {
+			t.Fatal(err)
+		}
+		if len(keys) != request.expectedKeys {
+			t.Errorf("Expected %d keys after %q, got %v", request.expectedKeys, request.body, keys)
+		}
+	}
+}
+
+func TestSharingHandlers(t *testing.T) {
+	config := DefaultConfig()
+	db, err := badger.Open(badger.DefaultOptions("").WithInMemory(true))
+	if err != nil {
+		t.Fatal(err)
+	}
+	keyPairs := crypto.KeyPairForTesting()
+	appState := state.State{
+		DB:          db,
+		RSAKeyPairs: keyPairs,
+	}
+	aliceToken, err := crypto.CreateAccessToken(*config.GetConfig(), keyPairs, "alice@example.com")
+	if err != nil {
+		t.Fatal(err)
+	}
+	bobToken, err := crypto.CreateAccessToken(*config.GetConfig(), keyPairs, "bob@example.com")
+	if err != nil {
+		t.Fatal(err)
+	}
+	handler := SetupHandler(&config, &appState)
+	requests := []struct {
+		method       string
+		route        string
+		token        string
+		body         string
+		expectedCode int
+		expectedBody string
+	}{
+		{
+			method:       "PUT",
+			route:        "/api/store/doc",
+			token:        aliceToken,
+			body:         "alice",
+			expectedCode: http.StatusCreated,
+		},
+		{
+			method:       "PUT",
+			route:        "/api/buckets/notes/store/doc",
+			token:        aliceToken,
+			body:         "notes",
+			expectedCode: http.StatusNotFound,
+		},
+		{
+			method:       "PUT",
+			route:        "/api/store/missing/grants/bob@example.com",
+			token:        aliceToken,
+			body:         `{"access": "read"}`,
+			expectedCode: http.StatusNotFound,
+		},
+		{
+			method:       "PUT",
+			route:        "/api/store/doc/grants/bob@example.com",
+			token:        aliceToken,
+			body:         `{"access": "write"}`,
+			expectedCode: http.StatusBadRequest,
+		},
+		{
+			method:       "GET",
+			route:        "/api/shared/alice@example.com/store/doc",
+			token:        bobToken,
+			expectedCode: http.StatusForbidden,
+		},
+		{
+			method:       "PUT",
+			route:        "/api/store/doc/grants/bob@example.com",
+			token:        aliceToken,
+			body:         `{"access": "read"}`,
+			expectedCode: http.StatusOK,
+		},
+		{
+			method:       "GET",
+			route:        "/api/shared/alice@example.com/store/doc",
+			token:        bobToken,
+			expectedCode: http.StatusOK,
+			expectedBody: "alice",
+		},
+		{
+			method:       "PUT",
+			route:        "/api/shared/alice@example.com/store/doc",
+			token:        bobToken,
+			body:         "bob",
+			expectedCode: http.StatusForbidden,
+		},
+		{
+			method:       "PUT",
+			route:        "/api/store/doc/grants/bob@example.com",
+			token:        aliceToken,
+			body:         `{"access": "readwrite"}`,
+			expectedCode: http.StatusOK,
+		},
+		{
+			method:       "PUT",
+			route:        "/api/shared/alice@example.com/store/doc",
+			token:        bobToken,
+			body:         "bob",
+			expectedCode: http.StatusOK,
+		},
+		{
+			method:       "GET",
+			route:        "/api/store/doc",
+			token:        aliceToken,
+			expectedCode: http.StatusOK,
+			expectedBody: "bob",
+		},
+		{
+			method:       "GET",
+			route:        "/api/shared/alice@example.com/buckets/notes/store/doc",
+			token:        bobToken,
+			expectedCode: http.StatusForbidden,
+		},
+		{
+			method:       "GET",
+			route:        "/api/store/doc/grants",
+			token:        bobToken,
+			expectedCode: http.StatusNotFound,
+		},
+		{
+			method:       "DELETE",
+			route:        "/api/store/doc/grants/bob@example.com",
+			token:        aliceToken,
+			expectedCode: http.StatusOK,
+		},
+		{
+			method:       "DELETE",
+			route:        "/api/store/doc/grants/bob@example.com",
+			token:        aliceToken,
+			expectedCode: http.StatusNotFound,
+		},
+		{
+			method:       "GET",
+			route:        "/api/shared/alice@example.com/store/doc",
+			token:        bobToken,
+			expectedCode: http.StatusForbidden,
+		},
+	}
+	for _, request := range requests {
+		req, err := http.NewRequest(request.method, request.route, strings.NewReader(request.body))
+		if err != nil {
+			t.Fatal(err)
+		}
+		req.Header.Set("Authorization", fmt.Sprintf("Bearer %s", request.token))
+		recorder := httptest.NewRecorder()
+		handler.ServeHTTP(recorder, req)
+		if recorder.Code != request.expectedCode {
+			t.Errorf("Expected %d for %s on %s, got %d", request.expectedCode, request.method, request.route, recorder.Code)
+		}
+		if len(request.expectedBody) > 0 && recorder.Body.String() != request.expectedBody {
+			t.Errorf("Expected %q for %s on %s, got %q", request.expectedBody, request.method, request.route, recorder.Body.String())
+		}
+	}
+
+	_, err = GrantAccessForIdentifier(&appState, "alice@example.com", "doc", "bob@example.com", AccessRead)
+	if err != nil {
+		t.Fatal(err)
+	}
+	req, err := http.NewRequest("GET", "/api/shared", nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	req.Header.Set("Authorization", fmt.Sprintf("Bearer %s", bobToken))
+	recorder := httptest.NewRecorder()
+	handler.ServeHTTP(recorder, req)
+	if recorder.Code != http.StatusOK {
+		t.Fatalf("Expected StatusOK, got %d", recorder.Code)
+	}
+	var response SharedResponse
+	err = json.NewDecoder(recorder.Body).Decode(&response)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(response.Keys) != 1 || response.Keys[0].Owner != "alice@example.com" || response.Keys[0].Key != "doc" {
+		t.Errorf("Unexpected shared keys %+v", response.Keys)
+	}
+}
+
+func TestSharedKeyIsNoLoginToken(t *testing.T) {
+	config := DefaultConfig()
+	db, err := badger.Open(badger.DefaultOptions("").WithInMemory(true))
+	if err != nil {
+		t.Fatal(err)
+	}
+	appState := state.State{
+		DB:          db,
+		RSAKeyPairs: crypto.KeyPairForTesting(),
+	}
+	_, err = InsertKeyValueFromReader(&appState, config, "alice@example.com", "doc", strings.NewReader("alice"), InsertOptions{})
+	if err != nil {
+		t.Fatal(err)
+	}
+	_, err = GrantAccessForIdentifier(&appState, "alice@example.com", "doc", "bob@example.com", AccessRead)
+	if err != nil {
+		t.Fatal(err)
+	}
+	var record []byte
+	err = db.View(func(txn *badger.Txn) error {
+		item, err := txn.Get([]byte(sharedKey("bob@example.com", "alice@example.com", "doc")))
+		if err != nil {
+			return err
+		}
+		record, err = item.ValueCopy(nil)
+		return err
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	// alice knows the record stored for bob and must not be able to log
+	// in as bob with it
+	body, err := json.Marshal(map[string]string{
+		"identifier": "bob@example.com",
+		"token":      string(record),
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	req, err := http.NewRequest("POST", "/api/auth", bytes.NewReader(body))
+	if err != nil {
+		t.Fatal(err)
+	}
+	recorder := httptest.NewRecorder()
+	SetupHandler(&config, &appState).ServeHTTP(recorder, req)
+	if recorder.Code != http.StatusUnauthorized {
+		t.Errorf("Expected StatusUnauthorized, got %d", recorder.Code)
+	}
+}
+
+func TestAuthenticateHandler(t *testing.T) {
+	config := DefaultConfig()
+	db, err := badger.Open(badger.DefaultOptions("").WithInMemory(true))
+	if err != nil {
+		t.Fatal(err)
+	}
+	appState := state.State{
+		DB:          db,
+		RSAKeyPairs: crypto.KeyPairForTesting(),
+	}
+	_, err = InsertKeyValueFromReader(&appState, config, "alice@example.com", "doc", strings.NewReader("alice"), InsertOptions{})
+	if err != nil {
+		t.Fatal(err)
+	}
+	_, err = GrantAccessForIdentifier(&appState, "alice@example.com", "doc", "bob@example.com", AccessReadWrite)
+	if err != nil {
+		t.Fatal(err)
+	}
+	// bob chooses a value stored below the prefix of alice
+	_, err = InsertSharedKeyValueFromReader(&appState, config, "bob@example.com", "alice@example.com", "doc", strings.NewReader("chosen-by-bob"), InsertOptions{})
+	if err != nil {
+		t.Fatal(err)
+	}
+	err = db.Update(func(txn *badger.Txn) error {
+		return txn.Set([]byte(fmt.Sprintf("%s-token-1-1", state.EncodeIdentifier("alice@example.com"))), []byte("login-token"))
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	handler := SetupHandler(&config, &appState)
+	authenticate := func(token string) *httptest.ResponseRecorder {
+		body, err := json.Marshal(map[string]string{
+			"identifier": "alice@example.com",
+			"token":      token,
+		})
+		if err != nil {
+			t.Fatal(err)
+		}
+		req, err := http.NewRequest("POST", "/api/auth", bytes.NewReader(body))
+		if err != nil {
+			t.Fatal(err)
+		}
+		recorder := httptest.NewRecorder()
+		handler.ServeHTTP(recorder, req)
+		return recorder
+	}
+	recorder := authenticate("chosen-by-bob")
+	if recorder.Code != http.StatusUnauthorized {
+		t.Errorf("Expected StatusUnauthorized for a stored value, got %d", recorder.Code)
+	}
+	recorder = authenticate("login-token")
+	if recorder.Code != http.StatusOK {
+		t.Fatalf("Expected StatusOK, got %d", recorder.Code)
+	}
+	var response handlers.AccessRefreshKeysResponse
+	err = json.NewDecoder(recorder.Body).Decode(&response)
+	if err != nil {
+		t.Fatal(err)
+	}
+	claims, err := crypto.ValidateAccessToken(appState.RSAKeyPairs, response.AccessToken)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if claims.Identifier != "alice@example.com" {
+		t.Errorf("Expected a token for alice@example.com, got %s", claims.Identifier)
+	}
+	recorder = authenticate("login-token")
+	if recorder.Code != http.StatusUnauthorized {
+		t.Errorf("Expected StatusUnauthorized for a consumed token, got %d", recorder.Code)
+	}
+}
+
+func TestLinkHandlers(t *testing.T) {
+	config := DefaultConfig()
+	db, err := badger.Open(badger.DefaultOptions("").WithInMemory(true))
+	if err != nil {
+		t.Fatal(err)
+	}
+	keyPairs := crypto.KeyPairForTesting()
+	appState := state.State{
+		DB:          db,
+		RSAKeyPairs: keyPairs,
+	}
+	accessToken, err := crypto.CreateAccessToken(*config.GetConfig(), keyPairs, "alice@example.com")
+	if err != nil {
+		t.Fatal(err)
+	}
+	_, err = InsertKeyValueFromReader(&appState, config, "alice@example.com", "doc", strings.NewReader("alice"), InsertOptions{ContentType: "text/plain"})
+	if err != nil {
+		t.Fatal(err)
+	}
+	handler := SetupHandler(&config, &appState)
+	request := func(method string, route string, body string, authorized bool) *httptest.ResponseRecorder {
+		req, err := http.NewRequest(method, route, strings.NewReader(body))
+		if err != nil {
+			t.Fatal(err)
+		}
+		if authorized {
+			req.Header.Set("Authorization", fmt.Sprintf("Bearer %s", accessToken))
+		}
+		recorder := httptest.NewRecorder()
+		handler.ServeHTTP(recorder, req)
+		return recorder
+	}
+
+	recorder := request("POST", "/api/store/missing/links", "", true)
+	if recorder.Code != http.StatusNotFound {
+		t.Errorf("Expected StatusNotFound for a missing key, got %d", recorder.Code)
+	}
+	recorder = request("POST", "/api/store/doc/links", "{", true)
+	if recorder.Code != http.StatusBadRequest {
+		t.Errorf("Expected StatusBadRequest for an invalid body, got %d", recorder.Code)
+	}
+	recorder = request("POST", "/api/store/doc/links", `{"ttl": 60, "maxDownloads": 1}`, true)
+	if recorder.Code != http.StatusCreated {
+		t.Fatalf("Expected StatusCreated, got %d", recorder.Code)
+	}
+	var link Link
+	err = json.NewDecoder(recorder.Body).Decode(&link)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	recorder = request("GET", "/s/invalid", "", false)
+	if recorder.Code != http.StatusNotFound {
+		t.Errorf("Expected StatusNotFound for an invalid token, got %d", recorder.Code)
+	}
+	recorder = request("GET", "/s/"+link.Token, "", false)
+	if recorder.Code != http.StatusOK {
+		t.Errorf("Expected StatusOK, got %d", recorder.Code)
+	}
+	if recorder.Body.String() != "alice" || recorder.Header().Get("Content-Type") != "text/plain" {
+		t.Errorf("Unexpected response %q with content type %q", recorder.Body.String(), recorder.Header().Get("Content-Type"))
+	}
+	// the value is chosen by the owner and must not run as a page of
+	// safestore
+	if recorder.Header().Get("X-Content-Type-Options") != "nosniff" || recorder.Header().Get("Content-Security-Policy") != "sandbox" {
+		t.Errorf("Expected nosniff and a sandbox, got %v", recorder.Header())
+	}
+	if contentDisposition := recorder.Header().Get("Content-Disposition"); contentDisposition != "attachment" {
+		t.Errorf("Expected attachment, got %s", contentDisposition)
+	}
+	recorder = request("GET", "/s/"+link.Token, "", false)
+	if recorder.Code != http.StatusGone {
+		t.Errorf("Expected StatusGone after the last download, got %d", recorder.Code)
+	}
+
+	recorder = request("GET", "/api/store/doc/links", "", true)
+	if recorder.Code != http.StatusOK {
+		t.Fatalf("Expected StatusOK, got %d", recorder.Code)
+	}
+	var response LinksResponse
+	err = json.NewDecoder(recorder.Body).Decode(&response)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(response.Links) != 1 || response.Links[0].ID != link.ID || response.Links[0].Downloads != 1 {
+		t.Errorf("Unexpected links %+v", response.Links)
+	}
+	recorder = request("DELETE", "/api/store/doc/links/"+link.ID, "", true)
+	if recorder.Code != http.StatusOK {
+		t.Errorf("Expected StatusOK, got %d", recorder.Code)
+	}
+	recorder = request("DELETE", "/api/store/doc/links/"+link.ID, "", true)
+	if recorder.Code != http.StatusNotFound {
+		t.Errorf("Expected StatusNotFound, got %d", recorder.Code)
+	}
+}
+
+func TestEventsHandler(t *testing.T) {
+	config := DefaultConfig()
+	db, err := badger.Open(badger.DefaultOptions("").WithInMemory(true))
+	if err != nil {
+		t.Fatal(err)
+	}
+	keyPairs := crypto.KeyPairForTesting()
+	appState := state.State{
+		DB:          db,
+		RSAKeyPairs: keyPairs,
+	}
+	accessToken, err := crypto.CreateAccessToken(*config.GetConfig(), keyPairs, "alice@example.com")
+	if err != nil {
+		t.Fatal(err)
+	}
+	server := httptest.NewServer(SetupHandler(&config, &appState))
+	defer server.Close()
+
+	req, err := http.NewRequest("GET", server.URL+"/api/events", nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	req.Header.Set("Authorization", fmt.Sprintf("Bearer %s", accessToken))
+	req.Header.Set("Last-Event-ID", "invalid")
+	resp, err := http.DefaultClient.Do(req)
+	if err != nil {
+		t.Fatal(err)
+	}
+	resp.Body.Close()
+	if resp.StatusCode != http.StatusBadRequest {
+		t.Errorf("Expected StatusBadRequest for an invalid Last-Event-ID, got %d", resp.StatusCode)
+	}
+
+	_, err = InsertKeyValueForIdentifier(&appState, config, "alice@example.com", "first", []byte("first"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	req.Header.Set("Last-Event-ID", "5")
+	resp, err = http.DefaultClient.Do(req)
+	if err != nil {
+		t.Fatal(err)
+	}
+	resp.Body.Close()
+	if resp.StatusCode != http.StatusGone {
+		t.Errorf("Expected StatusGone for an unknown Last-Event-ID, got %d", resp.StatusCode)
+	}
+
+	// the stream is ready once the response started, without a
+	// Last-Event-ID only the changes made afterwards are sent
+	ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+	defer cancel()
+	req = req.WithContext(ctx)
+	req.Header.Del("Last-Event-ID")
+	resp, err = http.DefaultClient.Do(req)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer resp.Body.Close()
+	if resp.StatusCode != http.StatusOK || resp.Header.Get("Content-Type") != "text/event-stream" {
+		t.Fatalf("Unexpected response %d with content type %q", resp.StatusCode, resp.Header.Get("Content-Type"))
+	}
+	_, err = InsertKeyValueForIdentifier(&appState, config, "alice@example.com", "foo", []byte("foo"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	scanner := bufio.NewScanner(resp.Body)
+	lines := []string{}
+	for scanner.Scan() {
+		if len(scanner.Text()) == 0 {
+			break
+		}
+		lines = append(lines, scanner.Text())
+	}
+	if len(lines) != 3 || !strings.HasPrefix(lines[0], "id: ") || lines[1] != "event: put" || !strings.HasPrefix(lines[2], "data: ") {
+		t.Fatalf("Unexpected event %v", lines)
+	}
+	var change Change
+	err = json.Unmarshal([]byte(strings.TrimPrefix(lines[2], "data: ")), &change)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if change.Key != "foo" || change.Sequence != 2 || lines[0] != "id: 2" {
+		t.Errorf("Unexpected change %+v", change)
+	}
+}
+
+func TestChangesHandler(t *testing.T) {
+	config, appState, keyPairs, handler := setupHandlerTest(t, "/changes", ChangesHandler)
+	accessToken, err := crypto.CreateAccessToken(*config.GetConfig(), keyPairs, "alice@example.com")
+	if err != nil {
+		t.Fatal(err)
+	}
+	for _, key := range []string{"a", "b", "c"} {
+		_, err = InsertKeyValueForIdentifier(&appState, *config, "alice@example.com", key, []byte(key))
+		if err != nil {
+			t.Fatal(err)
+		}
+	}
+	requests := []struct {
+		route          string
+		expectedCode   int
+		expectedKeys   []string
+		expectedCursor uint64
+		expectedMore   bool
+	}{
+		{
+			route:          "/changes",
+			expectedCode:   http.StatusOK,
+			expectedKeys:   []string{},
+			expectedCursor: 3,
+		},
+		{
+			route:          "/changes?since=0&limit=2",
+			expectedCode:   http.StatusOK,
+			expectedKeys:   []string{"a", "b"},
+			expectedCursor: 2,
+			expectedMore:   true,
+		},
+		{
+			route:          "/changes?since=2",
+			expectedCode:   http.StatusOK,
+			expectedKeys:   []string{"c"},
+			expectedCursor: 3,
+		},
+		{
+			route:        "/changes?since=4",
+			expectedCode: http.StatusGone,
+		},
+		{
+			route:        "/changes?since=-1",
+			expectedCode: http.StatusBadRequest,
+		},
+		{
+			route:        "/changes?since=0&limit=x",
+			expectedCode: http.StatusBadRequest,
+		},
+	}
+	for _, request := range requests {
+		req, err := http.NewRequest("GET", request.route, nil)
+		if err != nil {
+			t.Fatal(err)
+		}
+		req.Header.Set("Authorization", fmt.Sprintf("Bearer %s", accessToken))
+		recorder := httptest.NewRecorder()
+		handler.ServeHTTP(recorder, req)
+		if recorder.Code != request.expectedCode {
+			t.Errorf("Expected %d for %s, got %d", request.expectedCode, request.route, recorder.Code)
+			continue
+		}
+		if recorder.Code != http.StatusOK {
+			continue
+		}
+		var changeLog ChangeLog
+		err = json.NewDecoder(recorder.Body).Decode(&changeLog)
+		if err != nil {
+			t.Fatal(err)
+		}
+		keys := []string{}
+		for _, change := range changeLog.Changes {
+			keys = append(keys, change.Key)
+		}
+		if fmt.Sprint(keys) != fmt.Sprint(request.expectedKeys) || changeLog.Cursor != request.expectedCursor || changeLog.More != request.expectedMore {
+			t.Errorf("Unexpected changes for %s: %+v", request.route, changeLog)
+		}
+	}
+}
+
+func TestWebhookHandlers(t *testing.T) {
+	config := DefaultConfig()
+	config.Webhooks.MaxWebhooksPerAccount = 1
+	db, err := badger.Open(badger.DefaultOptions("").WithInMemory(true))
+	if err != nil {
+		t.Fatal(err)
+	}
+	keyPairs := crypto.KeyPairForTesting()
+	appState := state.State{
+		DB:          db,
+		RSAKeyPairs: keyPairs,
+	}
+	accessToken, err := crypto.CreateAccessToken(*config.GetConfig(), keyPairs, "alice@example.com")
+	if err != nil {
+		t.Fatal(err)
+	}
+	handler := SetupHandler(&config, &appState)
+	request := func(method string, route string, body string) *httptest.ResponseRecorder {
+		req, err := http.NewRequest(method, route, strings.NewReader(body))
+		if err != nil {
+			t.Fatal(err)
+		}
+		req.Header.Set("Authorization", fmt.Sprintf("Bearer %s", accessToken))
+		recorder := httptest.NewRecorder()
+		handler.ServeHTTP(recorder, req)
+		return recorder
+	}
+
+	recorder := request("POST", "/api/webhooks", `{"url": "not a url"}`)
+	if recorder.Code != http.StatusBadRequest {
+		t.Errorf("Expected StatusBadRequest for an invalid url, got %d", recorder.Code)
+	}
+	recorder = request("POST", "/api/webhooks", `{"url": "https://example.com/hook"}`)
+	if recorder.Code != http.StatusCreated {
+		t.Fatalf("Expected StatusCreated, got %d", recorder.Code)
+	}
+	var webhook Webhook
+	err = json.NewDecoder(recorder.Body).Decode(&webhook)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(webhook.Secret) == 0 {
+		t.Errorf("Expected the secret to be returned on creation")
+	}
+	recorder = request("POST", "/api/webhooks", `{"url": "https://example.com/other"}`)
+	if recorder.Code != http.StatusPreconditionFailed {
+		t.Errorf("Expected StatusPreconditionFailed above the limit, got %d", recorder.Code)
+	}
+
+	recorder = request("GET", "/api/webhooks", "")
+	if recorder.Code != http.StatusOK {
+		t.Fatalf("Expected StatusOK, got %d", recorder.Code)
+	}
+	var webhooks WebhooksResponse
+	err = json.NewDecoder(recorder.Body).Decode(&webhooks)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(webhooks.Webhooks) != 1 || webhooks.Webhooks[0].URL != "https://example.com/hook" || len(webhooks.Webhooks[0].Secret) != 0 {
+		t.Errorf("Unexpected webhooks %v", webhooks.Webhooks)
+	}
+
+	recorder = request("GET", "/api/webhooks/"+webhook.ID+"/deliveries", "")
+	if recorder.Code != http.StatusOK {
+		t.Fatalf("Expected StatusOK, got %d", recorder.Code)
+	}
+	var deliveries WebhookDeliveriesResponse
+	err = json.NewDecoder(recorder.Body).Decode(&deliveries)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(deliveries.Deliveries) != 0 {
+		t.Errorf("Expected no deliveries, got %v", deliveries.Deliveries)
+	}
+
+	recorder = request("DELETE", "/api/webhooks/"+webhook.ID, "")
+	if recorder.Code != http.StatusOK {
+		t.Errorf("Expected StatusOK, got %d", recorder.Code)
+	}
+	recorder = request("DELETE", "/api/webhooks/"+webhook.ID, "")
+	if recorder.Code != http.StatusNotFound {
+		t.Errorf("Expected StatusNotFound, got %d", recorder.Code)
+	}
+	recorder = request("GET", "/api/webhooks/"+webhook.ID+"/deliveries", "")
+	if recorder.Code != http.StatusNotFound {
+		t.Errorf("Expected StatusNotFound, got %d", recorder.Code)
+	}
+}
+
+func TestRetrieveHandlerCompression(t *testing.T) {
+	config, appState, keyPairs, handler := setupHandlerTest(t, "/store/{key}", RetrieveHandler)
+	config.StorageOptions.Compression = CompressionGzip
+	accessToken, err := crypto.CreateAccessToken(*config.GetConfig(), keyPairs, "alice@example.com")
+	if err != nil {
+		t.Fatal(err)
+	}
+	content := strings.Repeat(`{"name": "alice"}`, 100)
+	version, err := InsertKeyValueWithOptions(&appState, *config, "alice@example.com", "doc", []byte(content), InsertOptions{ContentType: "application/json"})
+	if err != nil {
+		t.Fatal(err)
+	}
+	requests := []struct {
+		acceptEncoding          string
+		expectedContentEncoding string
+		expectedETag            string
+	}{
+		{
+			acceptEncoding:          "",
+			expectedContentEncoding: "",
+			expectedETag:            formatETag(version.ETag),
+		},
+		{
+			acceptEncoding:          "gzip, deflate",
+			expectedContentEncoding: "gzip",
+			expectedETag:            "W/" + formatETag(version.ETag),
+		},
+		{
+			acceptEncoding:          "br, gzip;q=0",
+			expectedContentEncoding: "",
+			expectedETag:            formatETag(version.ETag),
+		},
+	}
+	for _, request := range requests {
+		req, err := http.NewRequest("GET", "/store/doc", nil)
+		if err != nil {
+			t.Fatal(err)
+		}
+		req.Header.Set("Authorization", fmt.Sprintf("Bearer %s", accessToken))
+		if len(request.acceptEncoding) > 0 {
+			req.Header.Set("Accept-Encoding", request.acceptEncoding)
+		}
+		recorder := httptest.NewRecorder()
+		handler.ServeHTTP(recorder, req)
+		if recorder.Code != http.StatusOK {
+			t.Fatalf("Expected StatusOK for %q, got %d", request.acceptEncoding, recorder.Code)
+		}
+		if encoding := recorder.Header().Get("Content-Encoding"); encoding != request.expectedContentEncoding {
+			t.Errorf("Expected Content-Encoding %q for %q, got %q", request.expectedContentEncoding, request.acceptEncoding, encoding)
+		}
+		if etag := recorder.Header().Get("ETag"); etag != request.expectedETag {
+			t.Errorf("Expected ETag %s for %q, got %s", request.expectedETag, request.acceptEncoding, etag)
+		}
+		if recorder.Header().Get("Vary") != "Accept-Encoding" {
+			t.Errorf("Expected Vary: Accept-Encoding for %q", request.acceptEncoding)
+		}
+		body := recorder.Body.Bytes()
+		if len(request.expectedContentEncoding) > 0 {
+			if len(body) >= len(content) {
+				t.Errorf("Expected the compressed value, got %d bytes", len(body))
+			}
+			body = decodeEncoded(t, request.expectedContentEncoding, bytes.NewReader(body))
+		}
+		if string(body) != content {
+			t.Errorf("Unexpected value for %q", request.acceptEncoding)
+		}
+	}
+}
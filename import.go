@@ -0,0 +1,482 @@
+package main
+
+import (
+	"archive/tar"
+	"archive/zip"
+	"encoding/json"
+	"io"
+	"io/ioutil"
+	"os"
+	"time"
+
+	"github.com/dgraph-io/badger/v3"
+	"github.com/mguentner/passwordless/state"
+)
+
+type ErrInvalidArchive struct{}
+
+func (e *ErrInvalidArchive) Error() string {
+	return "InvalidArchive"
+}
+
+type ErrInvalidImportMode struct{}
+
+func (e *ErrInvalidImportMode) Error() string {
+	return "InvalidImportMode"
+}
+
+type ErrImportConflict struct{}
+
+func (e *ErrImportConflict) Error() string {
+	return "ImportConflict"
+}
+
+type ErrArchiveTooBig struct{}
+
+func (e *ErrArchiveTooBig) Error() string {
+	return "ArchiveTooBig"
+}
+
+// maxImportManifestSizeBytes bounds the manifest of an archive. An archive
+// may exceed the remaining quota of the account by this size, which leaves
+// room for the manifest and the headers of the files.
+const maxImportManifestSizeBytes = 16 << 20
+
+// defaultMaxImportSizeBytes is used if StorageOptions.MaxImportSizeBytes
+// is not set
+const defaultMaxImportSizeBytes = 1 << 30
+
+// Import modes decide what happens to keys that already exist
+const (
+	ImportFailOnConflict = "fail"
+	ImportSkipExisting   = "skip"
+	ImportOverwrite      = "overwrite"
+)
+
+// Results of the keys of an import
+const (
+	ImportCreated     = "created"
+	ImportOverwritten = "overwritten"
+	ImportSkipped     = "skipped"
+	ImportConflict    = "conflict"
+)
+
+type ImportOptions struct {
+	// ExportFormatTar or ExportFormatZip
+	Format string
+	// ImportFailOnConflict, ImportSkipExisting or ImportOverwrite
+	Mode string
+	// only report what would be imported
+	DryRun bool
+}
+
+// ImportResult contains the written version on success. Error is set if
+// the key could not be written although it was planned to be.
+type ImportResult struct {
+	Bucket  string        `json:"bucket"`
+	Key     string        `json:"key"`
+	Result  string        `json:"result"`
+	Error   string        `json:"error,omitempty"`
+	Version *ValueVersion `json:"version,omitempty"`
+}
+
+type ImportReport struct {
+	DryRun  bool           `json:"dryRun"`
+	Error   string         `json:"error,omitempty"`
+	Results []ImportResult `json:"results"`
+}
+
+// limitedArchiveReader fails with ErrArchiveTooBig once more than
+// remaining bytes are read, unlike io.LimitReader which ends the archive
+type limitedArchiveReader struct {
+	reader    io.Reader
+	remaining int64
+}
+
+func (l *limitedArchiveReader) Read(p []byte) (int, error) {
+	if l.remaining < 0 {
+		return 0, &ErrArchiveTooBig{}
+	}
+	// one byte more than allowed is read to detect the oversize archive
+	if int64(len(p)) > l.remaining+1 {
+		p = p[:l.remaining+1]
+	}
+	n, err := l.reader.Read(p)
+	l.remaining -= int64(n)
+	if l.remaining < 0 {
+		return n, &ErrArchiveTooBig{}
+	}
+	return n, err
+}
+
+// importSizeLimit returns how large an archive may be, the values have to
+// fit into the remaining quota of the account and maxImportSizeBytes
+func importSizeLimit(config Config, usage Usage) int64 {
+	limit := config.StorageOptions.MaxImportSizeBytes
+	if limit == 0 {
+		limit = defaultMaxImportSizeBytes
+	}
+	if maxBytes := config.StorageOptions.MaxBytesPerAccount; maxBytes > 0 {
+		remaining := uint64(0)
+		if usage.Bytes < maxBytes {
+			remaining = maxBytes - usage.Bytes
+		}
+		if remaining+maxImportManifestSizeBytes < limit {
+			limit = remaining + maxImportManifestSizeBytes
+		}
+	}
+	return int64(limit)
+}
+
+// manifestSizeReader fails with ErrInvalidArchive if a value is larger or
+// smaller than its size in the manifest, which the limits were checked with
+type manifestSizeReader struct {
+	reader    io.Reader
+	remaining uint64
+}
+
+func (m *manifestSizeReader) Read(p []byte) (int, error) {
+	// one byte more than declared is read to detect the oversize value
+	if uint64(len(p)) > m.remaining+1 {
+		p = p[:m.remaining+1]
+	}
+	n, err := m.reader.Read(p)
+	if uint64(n) > m.remaining {
+		return 0, &ErrInvalidArchive{}
+	}
+	m.remaining -= uint64(n)
+	if err == io.EOF && m.remaining > 0 {
+		return n, &ErrInvalidArchive{}
+	}
+	return n, err
+}
+
+// archiveError keeps ErrArchiveTooBig, any other error of a damaged
+// archive becomes ErrInvalidArchive
+func archiveError(err error) error {
+	if _, ok := err.(*ErrArchiveTooBig); ok {
+		return err
+	}
+	return &ErrInvalidArchive{}
+}
+
+// importArchive returns the files of an archive in their order
+type importArchive interface {
+	// next returns io.EOF after the last file
+	next() (string, io.Reader, error)
+	Close() error
+}
+
+type tarImportArchive struct {
+	reader *tar.Reader
+}
+
+func (a *tarImportArchive) next() (string, io.Reader, error) {
+	for {
+		header, err := a.reader.Next()
+		if err != nil {
+			return "", nil, err
+		}
+		if header.Typeflag == tar.TypeReg {
+			return header.Name, a.reader, nil
+		}
+	}
+}
+
+func (a *tarImportArchive) Close() error {
+	return nil
+}
+
+// zipImportArchive reads from a temporary file, as zip archives can not
+// be read as a stream
+type zipImportArchive struct {
+	file    *os.File
+	reader  *zip.Reader
+	index   int
+	current io.ReadCloser
+}
+
+func (a *zipImportArchive) next() (string, io.Reader, error) {
+	if a.current != nil {
+		a.current.Close()
+		a.current = nil
+	}
+	for ; a.index < len(a.reader.File); a.index++ {
+		file := a.reader.File[a.index]
+		if file.FileInfo().IsDir() {
+			continue
+		}
+		current, err := file.Open()
+		if err != nil {
+			return "", nil, err
+		}
+		a.current = current
+		a.index++
+		return file.Name, current, nil
+	}
+	return "", nil, io.EOF
+}
+
+func (a *zipImportArchive) Close() error {
+	if a.current != nil {
+		a.current.Close()
+	}
+	a.file.Close()
+	return os.Remove(a.file.Name())
+}
+
+func newImportArchive(format string, r io.Reader) (importArchive, error) {
+	switch format {
+	case ExportFormatTar:
+		return &tarImportArchive{reader: tar.NewReader(r)}, nil
+	case ExportFormatZip:
+		file, err := ioutil.TempFile("", "safestore-import-*.zip")
+		if err != nil {
+			return nil, err
+		}
+		archive := zipImportArchive{file: file}
+		size, err := io.Copy(file, r)
+		if err != nil {
+			archive.Close()
+			return nil, archiveError(err)
+		}
+		archive.reader, err = zip.NewReader(file, size)
+		if err != nil {
+			archive.Close()
+			return nil, &ErrInvalidArchive{}
+		}
+		return &archive, nil
+	}
+	return nil, &ErrInvalidExportFormat{}
+}
+
+// importPlan maps the path of every value that is written to its result
+type importPlan struct {
+	results []ImportResult
+	paths   map[string]int
+	keys    []ExportedKey
+	buckets []Bucket
+}
+
+// planImport checks the whole manifest against the limits before anything
+// is written. With ImportFailOnConflict the plan fails if any key exists.
+func planImport(config Config, identifier string, manifest ExportManifest, mode string, txn *badger.Txn) (*importPlan, error) {
+	plan := importPlan{
+		results: []ImportResult{},
+		paths:   map[string]int{},
+		keys:    []ExportedKey{},
+		buckets: []Bucket{},
+	}
+	before, err := accountUsageForIdentifier(identifier, txn)
+	if err != nil {
+		return nil, err
+	}
+	after := before
+	buckets, err := bucketsForIdentifier(identifier, txn)
+	if err != nil {
+		return nil, err
+	}
+	existingBuckets := map[string]bool{DefaultBucket: true}
+	for _, bucket := range buckets {
+		existingBuckets[bucket.Name] = true
+	}
+	conflict := false
+	seenBuckets := map[string]bool{}
+	seenPaths := map[string]bool{}
+	for _, bucket := range manifest.Buckets {
+		scoped, err := scopedIdentifier(identifier, bucket.Name)
+		if err != nil || seenBuckets[bucket.Name] {
+			return nil, &ErrInvalidArchive{}
+		}
+		seenBuckets[bucket.Name] = true
+		seenKeys := map[string]bool{}
+		if !existingBuckets[bucket.Name] {
+			plan.buckets = append(plan.buckets, bucket.Bucket)
+		}
+		for _, key := range bucket.Keys {
+			if len(key.Key) == 0 || len(key.Path) == 0 || seenPaths[key.Path] || seenKeys[key.Key] {
+				return nil, &ErrInvalidArchive{}
+			}
+			seenPaths[key.Path] = true
+			seenKeys[key.Key] = true
+			if config.StorageOptions.MaxValueSizeBytes > 0 && key.Size > config.StorageOptions.MaxValueSizeBytes {
+				return nil, &ErrDataTooBig{}
+			}
+			if !contentTypeAllowed(config, key.ContentType) {
+				return nil, &ErrContentTypeNotAllowed{}
+			}
+			result := ImportResult{
+				Bucket: bucket.Name,
+				Key:    key.Key,
+			}
+			var metadata *valueMetadata
+			if existingBuckets[bucket.Name] {
+				metadata, err = metadataForKey(scoped, key.Key, txn)
+				if err != nil {
+					if _, ok := err.(*ErrKeyNotFound); !ok {
+						return nil, err
+					}
+					metadata = nil
+				}
+			}
+			switch {
+			case key.expired():
+				result.Result = ImportSkipped
+			case metadata == nil:
+				result.Result = ImportCreated
+				after.Keys++
+				after.Bytes += key.Size
+			case mode == ImportOverwrite:
+				result.Result = ImportOverwritten
+				after.Bytes = after.Bytes - metadata.Size + key.Size
+			case mode == ImportSkipExisting:
+				result.Result = ImportSkipped
+			default:
+				result.Result = ImportConflict
+				conflict = true
+			}
+			if result.Result == ImportCreated || result.Result == ImportOverwritten {
+				plan.paths[key.Path] = len(plan.results)
+			}
+			plan.results = append(plan.results, result)
+			plan.keys = append(plan.keys, key)
+		}
+	}
+	if conflict {
+		return &plan, &ErrImportConflict{}
+	}
+	maxBuckets := config.StorageOptions.MaxBucketsPerAccount
+	if maxBuckets > 0 && len(plan.buckets) > 0 && uint64(len(buckets)+len(plan.buckets)) > maxBuckets {
+		return &plan, &ErrBucketLimitReached{}
+	}
+	err = checkUsage(before, after, config.StorageOptions.MaxKeysPerAccount, config.StorageOptions.MaxBytesPerAccount)
+	if err != nil {
+		return &plan, err
+	}
+	return &plan, nil
+}
+
+// isImportError returns true for errors of a single key, which are
+// reported as part of its result
+func isImportError(err error) bool {
+	switch err.(type) {
+	case *ErrKeyExists, *ErrKeyHasVersions, *ErrDataTooBig, *ErrContentTypeNotAllowed,
+		*ErrKeyLimitReached, *ErrQuotaExceeded, *ErrBucketNotFound:
+		return true
+	}
+	return false
+}
+
+// ImportForIdentifier writes the keys of an archive created by
+// ExportForIdentifier. The archive is checked against the limits before
+// the first key is written, the keys are written one by one afterwards.
+// ErrArchiveTooBig is returned once the archive exceeds the remaining
+// quota of the account or maxImportSizeBytes, ErrInvalidArchive once a
+// value differs from its size in the manifest.
+// The report is returned together with the error if the import fails
+// because of a conflict or a limit.
+func ImportForIdentifier(s *state.State, config Config, identifier string, r io.Reader, options ImportOptions) (ImportReport, error) {
+	report := ImportReport{
+		DryRun:  options.DryRun,
+		Results: []ImportResult{},
+	}
+	switch options.Mode {
+	case ImportFailOnConflict, ImportSkipExisting, ImportOverwrite:
+	default:
+		return report, &ErrInvalidImportMode{}
+	}
+	identifier, _ = splitIdentifier(identifier)
+	var usage Usage
+	err := s.DB.View(func(txn *badger.Txn) error {
+		var err error
+		usage, err = accountUsageForIdentifier(identifier, txn)
+		return err
+	})
+	if err != nil {
+		return report, err
+	}
+	r = &limitedArchiveReader{reader: r, remaining: importSizeLimit(config, usage)}
+	archive, err := newImportArchive(options.Format, r)
+	if err != nil {
+		return report, err
+	}
+	defer archive.Close()
+	name, content, err := archive.next()
+	if err != nil {
+		return report, archiveError(err)
+	}
+	if name != exportManifestName {
+		return report, &ErrInvalidArchive{}
+	}
+	var manifest ExportManifest
+	err = json.NewDecoder(&limitedArchiveReader{reader: content, remaining: maxImportManifestSizeBytes}).Decode(&manifest)
+	if err != nil {
+		return report, archiveError(err)
+	}
+	var plan *importPlan
+	err = s.DB.View(func(txn *badger.Txn) error {
+		p, err := planImport(config, identifier, manifest, options.Mode, txn)
+		plan = p
+		return err
+	})
+	if plan != nil {
+		report.Results = plan.results
+	}
+	if err != nil || options.DryRun {
+		return report, err
+	}
+	for _, bucket := range plan.buckets {
+		_, err = CreateBucketForIdentifier(s, config, identifier, bucket)
+		if _, ok := err.(*ErrBucketExists); err != nil && !ok {
+			return report, err
+		}
+	}
+	for {
+		name, content, err = archive.next()
+		if err == io.EOF {
+			break
+		}
+		if err != nil {
+			return report, archiveError(err)
+		}
+		index, ok := plan.paths[name]
+		if !ok {
+			continue
+		}
+		result := &report.Results[index]
+		key := plan.keys[index]
+		scoped, err := scopedIdentifier(identifier, result.Bucket)
+		if err != nil {
+			return report, err
+		}
+		insertOptions := InsertOptions{
+			CreateOnly:      result.Result == ImportCreated,
+			ContentType:     key.ContentType,
+			ContentEncoding: key.ContentEncoding,
+			Filename:        key.Filename,
+		}
+		if key.ExpiresAt != nil {
+			insertOptions.TTL = time.Until(*key.ExpiresAt)
+			if insertOptions.TTL <= 0 {
+				result.Result = ImportSkipped
+				continue
+			}
+		}
+		version, err := InsertKeyValueFromReader(s, config, scoped, key.Key, &manifestSizeReader{reader: content, remaining: key.Size}, insertOptions)
+		if err != nil {
+			if !isImportError(err) {
+				return report, err
+			}
+			result.Error = err.Error()
+			continue
+		}
+		result.Version = &version
+	}
+	for _, index := range plan.paths {
+		result := &report.Results[index]
+		if result.Result != ImportSkipped && result.Version == nil && len(result.Error) == 0 {
+			result.Error = "ValueMissing"
+		}
+	}
+	return report, nil
+}
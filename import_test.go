@@ -0,0 +1,273 @@
+package main
+
+import (
+	"archive/tar"
+	"bytes"
+	"encoding/json"
+	"io"
+	"testing"
+
+	"github.com/mguentner/passwordless/state"
+)
+
+func exportForTest(t *testing.T, appState *state.State, identifier string, format string) []byte {
+	var archive bytes.Buffer
+	err := ExportForIdentifier(appState, identifier, format, &archive)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return archive.Bytes()
+}
+
+func countImportResults(report ImportReport, result string) int {
+	count := 0
+	for _, r := range report.Results {
+		if r.Result == result && len(r.Error) == 0 {
+			count++
+		}
+	}
+	return count
+}
+
+func TestImport(t *testing.T) {
+	appState := setupExportTest(t)
+	config := DefaultConfig()
+	config.StorageOptions.ChunkSizeBytes = 4
+	archive := exportForTest(t, &appState, "alice@example.com", ExportFormatTar)
+
+	report, err := ImportForIdentifier(&appState, config, "carol@example.com", bytes.NewReader(archive), ImportOptions{Format: ExportFormatTar, Mode: ImportFailOnConflict, DryRun: true})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !report.DryRun || countImportResults(report, ImportCreated) != 2 {
+		t.Errorf("Unexpected report %+v", report)
+	}
+	keys, err := KeysForIdentifier(&appState, "carol@example.com")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(keys) != 0 {
+		t.Errorf("Expected a dry run not to write keys, got %v", keys)
+	}
+
+	report, err = ImportForIdentifier(&appState, config, "carol@example.com", bytes.NewReader(archive), ImportOptions{Format: ExportFormatTar, Mode: ImportFailOnConflict})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if countImportResults(report, ImportCreated) != 2 {
+		t.Errorf("Unexpected report %+v", report)
+	}
+	files, err := scopedIdentifier("carol@example.com", "files")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if value := readCurrentValue(t, &appState, files, "large"); string(value) != "0123456789" {
+		t.Errorf("Unexpected value %s", value)
+	}
+	buckets, err := BucketsForIdentifier(&appState, "carol@example.com")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(buckets) != 2 || buckets[1].MaxKeys != 5 {
+		t.Errorf("Expected the bucket to be created with its limits, got %+v", buckets)
+	}
+
+	report, err = ImportForIdentifier(&appState, config, "carol@example.com", bytes.NewReader(archive), ImportOptions{Format: ExportFormatTar, Mode: ImportFailOnConflict})
+	if _, ok := err.(*ErrImportConflict); !ok {
+		t.Errorf("Expected ErrImportConflict, got %v", err)
+	}
+	if countImportResults(report, ImportConflict) != 2 {
+		t.Errorf("Unexpected report %+v", report)
+	}
+	report, err = ImportForIdentifier(&appState, config, "carol@example.com", bytes.NewReader(archive), ImportOptions{Format: ExportFormatTar, Mode: ImportSkipExisting})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if countImportResults(report, ImportSkipped) != 2 {
+		t.Errorf("Unexpected report %+v", report)
+	}
+	_, err = InsertKeyValueForIdentifier(&appState, config, "carol@example.com", "notes/1", []byte("modified"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	report, err = ImportForIdentifier(&appState, config, "carol@example.com", bytes.NewReader(archive), ImportOptions{Format: ExportFormatTar, Mode: ImportOverwrite})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if countImportResults(report, ImportOverwritten) != 2 {
+		t.Errorf("Unexpected report %+v", report)
+	}
+	value, err := RetrieveValueIdentifierAndKey(&appState, "carol@example.com", "notes/1")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if string(value) != "{}" {
+		t.Errorf("Expected the value to be overwritten, got %s", value)
+	}
+
+	_, err = ImportForIdentifier(&appState, config, "carol@example.com", bytes.NewReader(archive), ImportOptions{Format: ExportFormatTar, Mode: "merge"})
+	if _, ok := err.(*ErrInvalidImportMode); !ok {
+		t.Errorf("Expected ErrInvalidImportMode, got %v", err)
+	}
+	_, err = ImportForIdentifier(&appState, config, "carol@example.com", bytes.NewBufferString("garbage"), ImportOptions{Format: ExportFormatTar, Mode: ImportOverwrite})
+	if _, ok := err.(*ErrInvalidArchive); !ok {
+		t.Errorf("Expected ErrInvalidArchive, got %v", err)
+	}
+}
+
+func TestImportZip(t *testing.T) {
+	appState := setupExportTest(t)
+	config := DefaultConfig()
+	archive := exportForTest(t, &appState, "alice@example.com", ExportFormatZip)
+	report, err := ImportForIdentifier(&appState, config, "carol@example.com", bytes.NewReader(archive), ImportOptions{Format: ExportFormatZip, Mode: ImportFailOnConflict})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if countImportResults(report, ImportCreated) != 2 {
+		t.Errorf("Unexpected report %+v", report)
+	}
+	value, err := RetrieveValueIdentifierAndKey(&appState, "carol@example.com", "notes/1")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if string(value) != "{}" {
+		t.Errorf("Unexpected value %s", value)
+	}
+}
+
+func TestImportLimits(t *testing.T) {
+	appState := setupExportTest(t)
+	archive := exportForTest(t, &appState, "alice@example.com", ExportFormatTar)
+	config := DefaultConfig()
+	config.StorageOptions.MaxValueSizeBytes = 5
+	_, err := ImportForIdentifier(&appState, config, "carol@example.com", bytes.NewReader(archive), ImportOptions{Format: ExportFormatTar, Mode: ImportFailOnConflict})
+	if _, ok := err.(*ErrDataTooBig); !ok {
+		t.Errorf("Expected ErrDataTooBig, got %v", err)
+	}
+	config = DefaultConfig()
+	config.StorageOptions.MaxKeysPerAccount = 1
+	report, err := ImportForIdentifier(&appState, config, "carol@example.com", bytes.NewReader(archive), ImportOptions{Format: ExportFormatTar, Mode: ImportFailOnConflict, DryRun: true})
+	if _, ok := err.(*ErrKeyLimitReached); !ok {
+		t.Errorf("Expected ErrKeyLimitReached, got %v", err)
+	}
+	if len(report.Results) != 2 {
+		t.Errorf("Expected the report of the dry run, got %+v", report)
+	}
+	buckets, err := BucketsForIdentifier(&appState, "carol@example.com")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(buckets) != 1 {
+		t.Errorf("Expected nothing to be written, got %+v", buckets)
+	}
+}
+
+func TestImportArchiveTooBig(t *testing.T) {
+	appState := setupExportTest(t)
+	config := DefaultConfig()
+	config.StorageOptions.MaxBytesPerAccount = 1024
+	oversize := bytes.Repeat([]byte{0}, maxImportManifestSizeBytes+2048)
+	_, err := ImportForIdentifier(&appState, config, "carol@example.com", bytes.NewReader(oversize), ImportOptions{Format: ExportFormatZip, Mode: ImportFailOnConflict})
+	if _, ok := err.(*ErrArchiveTooBig); !ok {
+		t.Errorf("Expected ErrArchiveTooBig, got %v", err)
+	}
+	// without a quota the archive is limited by maxImportSizeBytes
+	config = DefaultConfig()
+	config.StorageOptions.MaxImportSizeBytes = 1024
+	_, err = ImportForIdentifier(&appState, config, "carol@example.com", bytes.NewReader(oversize), ImportOptions{Format: ExportFormatZip, Mode: ImportFailOnConflict})
+	if _, ok := err.(*ErrArchiveTooBig); !ok {
+		t.Errorf("Expected ErrArchiveTooBig without a quota, got %v", err)
+	}
+	// the manifest is limited even without a quota, the whitespace keeps
+	// the JSON valid
+	manifest := append([]byte("{"), bytes.Repeat([]byte(" "), maxImportManifestSizeBytes)...)
+	var archive bytes.Buffer
+	writer := tar.NewWriter(&archive)
+	err = writer.WriteHeader(&tar.Header{
+		Name:     exportManifestName,
+		Mode:     0600,
+		Size:     int64(len(manifest)),
+		Typeflag: tar.TypeReg,
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	_, err = writer.Write(manifest)
+	if err != nil {
+		t.Fatal(err)
+	}
+	writer.Close()
+	_, err = ImportForIdentifier(&appState, DefaultConfig(), "carol@example.com", &archive, ImportOptions{Format: ExportFormatTar, Mode: ImportFailOnConflict})
+	if _, ok := err.(*ErrArchiveTooBig); !ok {
+		t.Errorf("Expected ErrArchiveTooBig for the manifest, got %v", err)
+	}
+}
+
+// withManifestSize rewrites the size of key in the manifest of a tar archive
+func withManifestSize(t *testing.T, archive []byte, key string, size uint64) []byte {
+	reader := tar.NewReader(bytes.NewReader(archive))
+	var rewritten bytes.Buffer
+	writer := tar.NewWriter(&rewritten)
+	for {
+		header, err := reader.Next()
+		if err == io.EOF {
+			break
+		}
+		if err != nil {
+			t.Fatal(err)
+		}
+		content, err := io.ReadAll(reader)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if header.Name == exportManifestName {
+			var manifest ExportManifest
+			err = json.Unmarshal(content, &manifest)
+			if err != nil {
+				t.Fatal(err)
+			}
+			for i := range manifest.Buckets {
+				for j := range manifest.Buckets[i].Keys {
+					if manifest.Buckets[i].Keys[j].Key == key {
+						manifest.Buckets[i].Keys[j].Size = size
+					}
+				}
+			}
+			content, err = json.Marshal(manifest)
+			if err != nil {
+				t.Fatal(err)
+			}
+			header.Size = int64(len(content))
+		}
+		err = writer.WriteHeader(header)
+		if err != nil {
+			t.Fatal(err)
+		}
+		_, err = writer.Write(content)
+		if err != nil {
+			t.Fatal(err)
+		}
+	}
+	writer.Close()
+	return rewritten.Bytes()
+}
+
+func TestImportManifestSize(t *testing.T) {
+	appState := setupExportTest(t)
+	config := DefaultConfig()
+	archive := exportForTest(t, &appState, "alice@example.com", ExportFormatTar)
+	for _, size := range []uint64{2, 20} {
+		_, err := ImportForIdentifier(&appState, config, "carol@example.com", bytes.NewReader(withManifestSize(t, archive, "large", size)), ImportOptions{Format: ExportFormatTar, Mode: ImportOverwrite})
+		if _, ok := err.(*ErrInvalidArchive); !ok {
+			t.Errorf("Expected ErrInvalidArchive for size %d, got %v", size, err)
+		}
+	}
+	files, err := scopedIdentifier("carol@example.com", "files")
+	if err != nil {
+		t.Fatal(err)
+	}
+	_, err = RetrieveValueIdentifierAndKey(&appState, files, "large")
+	if _, ok := err.(*ErrKeyNotFound); !ok {
+		t.Errorf("Expected the value not to be written, got %v", err)
+	}
+}
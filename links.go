@@ -0,0 +1,327 @@
+package main
+
+import (
+	"encoding/base64"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"time"
+
+	"github.com/dgraph-io/badger/v3"
+	"github.com/golang-jwt/jwt"
+	"github.com/mguentner/passwordless/crypto"
+	"github.com/mguentner/passwordless/state"
+)
+
+type ErrLinkNotFound struct{}
+
+func (e *ErrLinkNotFound) Error() string {
+	return "LinkNotFound"
+}
+
+type ErrLinkExpired struct{}
+
+func (e *ErrLinkExpired) Error() string {
+	return "LinkExpired"
+}
+
+// linkTokenType keeps link tokens from being accepted as access tokens
+// and the other way around
+const linkTokenType = "link"
+
+// defaultLinkLifetime is used if the client does not set a lifetime
+const defaultLinkLifetime = 24 * time.Hour
+
+// linkIndexPrefix contains `-`, so it never collides with the keys of an
+// account, which start with a base64 encoded identifier
+const linkIndexPrefix = "linkindex-"
+
+// Link gives anyone knowing its token read access to the current value
+// of a key until it expires, is revoked or the key is deleted
+type Link struct {
+	ID        string    `json:"id"`
+	Key       string    `json:"key"`
+	Token     string    `json:"token"`
+	CreatedAt time.Time `json:"createdAt"`
+	ExpiresAt time.Time `json:"expiresAt"`
+	// 0 means no limit
+	MaxDownloads uint64 `json:"maxDownloads,omitempty"`
+	Downloads    uint64 `json:"downloads"`
+}
+
+// linkClaims only contain the ID of the link, the owner and the key are
+// looked up using the link index
+type linkClaims struct {
+	jwt.StandardClaims
+	TokenType string `json:"tokenType"`
+}
+
+// linkTarget is stored in the link index
+type linkTarget struct {
+	Identifier string `json:"identifier"`
+	Bucket     string `json:"bucket"`
+	Key        string `json:"key"`
+}
+
+func linkPrefix(identifier string, key string) string {
+	encodedKey := base64.StdEncoding.EncodeToString([]byte(key))
+	return fmt.Sprintf("%s-link-%s-", encodeScope(identifier), encodedKey)
+}
+
+func linkKey(identifier string, key string, id string) string {
+	return linkPrefix(identifier, key) + id
+}
+
+func linkIndexKey(id string) string {
+	return linkIndexPrefix + id
+}
+
+// expiresAtForLifetime caps the lifetime at MaxLinkLifetimeSeconds
+func expiresAtForLifetime(config Config, lifetime time.Duration) time.Time {
+	if lifetime <= 0 {
+		lifetime = defaultLinkLifetime
+	}
+	maxLifetime := time.Duration(config.StorageOptions.MaxLinkLifetimeSeconds) * time.Second
+	if maxLifetime > 0 && lifetime > maxLifetime {
+		lifetime = maxLifetime
+	}
+	return time.Now().Add(lifetime)
+}
+
+func signLinkToken(keyPairs []crypto.PublicPrivateRSAKeyPair, link Link) (string, error) {
+	token := jwt.NewWithClaims(jwt.SigningMethodRS256, &linkClaims{
+		StandardClaims: jwt.StandardClaims{
+			Id:        link.ID,
+			IssuedAt:  link.CreatedAt.Unix(),
+			ExpiresAt: link.ExpiresAt.Unix(),
+		},
+		TokenType: linkTokenType,
+	})
+	signingKey := crypto.GetKeyForTime(keyPairs, link.CreatedAt)
+	if signingKey == nil {
+		return "", errors.New("Could not find a suitable signing key")
+	}
+	return token.SignedString(signingKey.PrivateKey)
+}
+
+// parseLinkToken accepts tokens signed by any of the keys, so links stay
+// valid when the signing key is rotated
+func parseLinkToken(keyPairs []crypto.PublicPrivateRSAKeyPair, token string) (*linkClaims, error) {
+	for _, publicKey := range crypto.GetAllPublicKeys(keyPairs) {
+		publicKey := publicKey
+		parsed, err := jwt.ParseWithClaims(token, &linkClaims{}, func(token *jwt.Token) (interface{}, error) {
+			if _, ok := token.Method.(*jwt.SigningMethodRSA); !ok {
+				return nil, &ErrLinkNotFound{}
+			}
+			return &publicKey, nil
+		})
+		if err != nil {
+			if validationErr, ok := err.(*jwt.ValidationError); ok {
+				if validationErr.Errors&jwt.ValidationErrorExpired != 0 {
+					return nil, &ErrLinkExpired{}
+				}
+			}
+			continue
+		}
+		claims := parsed.Claims.(*linkClaims)
+		if claims.TokenType != linkTokenType || len(claims.Id) == 0 {
+			return nil, &ErrLinkNotFound{}
+		}
+		return claims, nil
+	}
+	return nil, &ErrLinkNotFound{}
+}
+
+// linkForKey returns ErrLinkNotFound if the link was revoked or expired
+func linkForKey(identifier string, key string, id string, txn *badger.Txn) (*Link, error) {
+	item, err := txn.Get([]byte(linkKey(identifier, key, id)))
+	if err != nil {
+		if err == badger.ErrKeyNotFound {
+			return nil, &ErrLinkNotFound{}
+		}
+		return nil, err
+	}
+	var link Link
+	err = item.Value(func(v []byte) error {
+		return json.Unmarshal(v, &link)
+	})
+	if err != nil {
+		return nil, err
+	}
+	return &link, nil
+}
+
+// linkTargetForID returns the scoped identifier and the key of a link
+func linkTargetForID(id string, txn *badger.Txn) (string, string, error) {
+	item, err := txn.Get([]byte(linkIndexKey(id)))
+	if err != nil {
+		if err == badger.ErrKeyNotFound {
+			return "", "", &ErrLinkNotFound{}
+		}
+		return "", "", err
+	}
+	var target linkTarget
+	err = item.Value(func(v []byte) error {
+		return json.Unmarshal(v, &target)
+	})
+	if err != nil {
+		return "", "", err
+	}
+	identifier, err := scopedIdentifier(target.Identifier, target.Bucket)
+	if err != nil {
+		return "", "", &ErrLinkNotFound{}
+	}
+	return identifier, target.Key, nil
+}
+
+// setLink expires the entry and its index entry together with the link
+func setLink(identifier string, link Link, txn *badger.Txn) error {
+	encodedLink, err := json.Marshal(link)
+	if err != nil {
+		return err
+	}
+	e := badger.NewEntry([]byte(linkKey(identifier, link.Key, link.ID)), encodedLink)
+	e.ExpiresAt = uint64(link.ExpiresAt.Unix())
+	err = txn.SetEntry(e)
+	if err != nil {
+		return err
+	}
+	owner, bucket := splitIdentifier(identifier)
+	encodedTarget, err := json.Marshal(linkTarget{
+		Identifier: owner,
+		Bucket:     bucket,
+		Key:        link.Key,
+	})
+	if err != nil {
+		return err
+	}
+	e = badger.NewEntry([]byte(linkIndexKey(link.ID)), encodedTarget)
+	e.ExpiresAt = uint64(link.ExpiresAt.Unix())
+	return txn.SetEntry(e)
+}
+
+// deleteLink removes a link and its index entry
+func deleteLink(identifier string, key string, id string, txn *badger.Txn) error {
+	err := txn.Delete([]byte(linkKey(identifier, key, id)))
+	if err != nil {
+		return err
+	}
+	return txn.Delete([]byte(linkIndexKey(id)))
+}
+
+func linksForKey(identifier string, key string, txn *badger.Txn) ([]Link, error) {
+	links := []Link{}
+	prefix := []byte(linkPrefix(identifier, key))
+	it := txn.NewIterator(badger.DefaultIteratorOptions)
+	defer it.Close()
+	for it.Seek(prefix); it.ValidForPrefix(prefix); it.Next() {
+		var link Link
+		err := it.Item().Value(func(v []byte) error {
+			return json.Unmarshal(v, &link)
+		})
+		if err != nil {
+			return nil, err
+		}
+		links = append(links, link)
+	}
+	return links, nil
+}
+
+// deleteLinksForKey is called whenever a key is deleted, so a new key
+// with the same name is not published
+func deleteLinksForKey(identifier string, key string, txn *badger.Txn) error {
+	links, err := linksForKey(identifier, key, txn)
+	if err != nil {
+		return err
+	}
+	for _, link := range links {
+		err = deleteLink(identifier, key, link.ID, txn)
+		if err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// CreateLinkForIdentifier creates a public link for an existing key
+func CreateLinkForIdentifier(s *state.State, config Config, identifier string, key string, lifetime time.Duration, maxDownloads uint64) (Link, error) {
+	id, err := newChunkID()
+	if err != nil {
+		return Link{}, err
+	}
+	link := Link{
+		ID:           id,
+		Key:          key,
+		CreatedAt:    time.Now(),
+		ExpiresAt:    expiresAtForLifetime(config, lifetime),
+		MaxDownloads: maxDownloads,
+	}
+	link.Token, err = signLinkToken(s.RSAKeyPairs, link)
+	if err != nil {
+		return Link{}, err
+	}
+	err = s.DB.Update(func(txn *badger.Txn) error {
+		_, err := metadataForKey(identifier, key, txn)
+		if err != nil {
+			return err
+		}
+		return setLink(identifier, link, txn)
+	})
+	if err != nil {
+		return Link{}, err
+	}
+	return link, nil
+}
+
+func LinksForIdentifierAndKey(s *state.State, identifier string, key string) ([]Link, error) {
+	var links []Link
+	err := s.DB.View(func(txn *badger.Txn) error {
+		_, err := metadataForKey(identifier, key, txn)
+		if err != nil {
+			return err
+		}
+		links, err = linksForKey(identifier, key, txn)
+		return err
+	})
+	return links, err
+}
+
+func RevokeLinkForIdentifier(s *state.State, identifier string, key string, id string) error {
+	return s.DB.Update(func(txn *badger.Txn) error {
+		_, err := linkForKey(identifier, key, id, txn)
+		if err != nil {
+			return err
+		}
+		return deleteLink(identifier, key, id, txn)
+	})
+}
+
+// OpenLinkForToken counts a download of the link and opens the current
+// value of its key. ErrLinkExpired is returned once the link expired or
+// all downloads were used.
+func OpenLinkForToken(s *state.State, token string) (*ValueReader, ValueVersion, error) {
+	claims, err := parseLinkToken(s.RSAKeyPairs, token)
+	if err != nil {
+		return nil, ValueVersion{}, err
+	}
+	var identifier, key string
+	err = updateRetryingConflicts(s, func(txn *badger.Txn) error {
+		identifier, key, err = linkTargetForID(claims.Id, txn)
+		if err != nil {
+			return err
+		}
+		link, err := linkForKey(identifier, key, claims.Id, txn)
+		if err != nil {
+			return err
+		}
+		if link.MaxDownloads > 0 && link.Downloads >= link.MaxDownloads {
+			return &ErrLinkExpired{}
+		}
+		link.Downloads++
+		return setLink(identifier, *link, txn)
+	})
+	if err != nil {
+		return nil, ValueVersion{}, err
+	}
+	return OpenVersionForIdentifierAndKey(s, identifier, key, 0)
+}
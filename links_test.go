@@ -0,0 +1,174 @@
+package main
+
+import (
+	"encoding/base64"
+	"io/ioutil"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/dgraph-io/badger/v3"
+	"github.com/mguentner/passwordless/crypto"
+	"github.com/mguentner/passwordless/state"
+)
+
+func TestLinks(t *testing.T) {
+	config := DefaultConfig()
+	config.StorageOptions.MaxLinkLifetimeSeconds = 3600
+	db, err := badger.Open(badger.DefaultOptions("").WithInMemory(true))
+	if err != nil {
+		t.Fatal(err)
+	}
+	appState := state.State{
+		DB:          db,
+		RSAKeyPairs: crypto.KeyPairForTesting(),
+	}
+	_, err = InsertKeyValueForIdentifier(&appState, config, "alice@example.com", "doc", []byte("alice"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	_, err = CreateLinkForIdentifier(&appState, config, "alice@example.com", "missing", time.Hour, 0)
+	if _, ok := err.(*ErrKeyNotFound); !ok {
+		t.Errorf("Expected ErrKeyNotFound, got %v", err)
+	}
+	link, err := CreateLinkForIdentifier(&appState, config, "alice@example.com", "doc", 24*time.Hour, 2)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if link.ExpiresAt.After(time.Now().Add(time.Hour)) {
+		t.Errorf("Expected the lifetime to be capped, expires at %v", link.ExpiresAt)
+	}
+	// the owner and the key are looked up using the ID of the link
+	parts := strings.Split(link.Token, ".")
+	payload, err := base64.RawURLEncoding.DecodeString(parts[1])
+	if err != nil {
+		t.Fatal(err)
+	}
+	if strings.Contains(string(payload), "alice") || strings.Contains(string(payload), "doc") {
+		t.Errorf("Expected the token to only contain the ID, got %s", payload)
+	}
+	for i := 0; i < 2; i++ {
+		reader, _, err := OpenLinkForToken(&appState, link.Token)
+		if err != nil {
+			t.Fatal(err)
+		}
+		value, err := ioutil.ReadAll(reader)
+		reader.Close()
+		if err != nil {
+			t.Fatal(err)
+		}
+		if string(value) != "alice" {
+			t.Errorf("Expected alice, got %s", value)
+		}
+	}
+	_, _, err = OpenLinkForToken(&appState, link.Token)
+	if _, ok := err.(*ErrLinkExpired); !ok {
+		t.Errorf("Expected ErrLinkExpired after the last download, got %v", err)
+	}
+	links, err := LinksForIdentifierAndKey(&appState, "alice@example.com", "doc")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(links) != 1 || links[0].Downloads != 2 {
+		t.Errorf("Unexpected links %+v", links)
+	}
+
+	// access tokens must not be accepted as links and the other way around
+	accessToken, err := crypto.CreateAccessToken(*config.GetConfig(), appState.RSAKeyPairs, "alice@example.com")
+	if err != nil {
+		t.Fatal(err)
+	}
+	for _, token := range []string{"", "invalid", accessToken} {
+		_, _, err = OpenLinkForToken(&appState, token)
+		if _, ok := err.(*ErrLinkNotFound); !ok {
+			t.Errorf("Expected ErrLinkNotFound for %q, got %v", token, err)
+		}
+	}
+	_, err = crypto.ValidateAccessToken(appState.RSAKeyPairs, link.Token)
+	if err == nil {
+		t.Errorf("Expected the link not to be accepted as an access token")
+	}
+
+	unlimited, err := CreateLinkForIdentifier(&appState, config, "alice@example.com", "doc", 0, 0)
+	if err != nil {
+		t.Fatal(err)
+	}
+	err = RevokeLinkForIdentifier(&appState, "alice@example.com", "doc", unlimited.ID)
+	if err != nil {
+		t.Fatal(err)
+	}
+	_, _, err = OpenLinkForToken(&appState, unlimited.Token)
+	if _, ok := err.(*ErrLinkNotFound); !ok {
+		t.Errorf("Expected ErrLinkNotFound after the revocation, got %v", err)
+	}
+	err = RevokeLinkForIdentifier(&appState, "alice@example.com", "doc", unlimited.ID)
+	if _, ok := err.(*ErrLinkNotFound); !ok {
+		t.Errorf("Expected ErrLinkNotFound, got %v", err)
+	}
+
+	// links are deleted together with the key
+	link, err = CreateLinkForIdentifier(&appState, config, "alice@example.com", "doc", 0, 0)
+	if err != nil {
+		t.Fatal(err)
+	}
+	err = DeleteKeyValueForIdentifier(&appState, config, "alice@example.com", "doc")
+	if err != nil {
+		t.Fatal(err)
+	}
+	_, err = InsertKeyValueForIdentifier(&appState, config, "alice@example.com", "doc", []byte("private"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	_, _, err = OpenLinkForToken(&appState, link.Token)
+	if _, ok := err.(*ErrLinkNotFound); !ok {
+		t.Errorf("Expected ErrLinkNotFound after the deletion, got %v", err)
+	}
+}
+
+func TestLinksInBucket(t *testing.T) {
+	config := DefaultConfig()
+	db, err := badger.Open(badger.DefaultOptions("").WithInMemory(true))
+	if err != nil {
+		t.Fatal(err)
+	}
+	appState := state.State{
+		DB:          db,
+		RSAKeyPairs: crypto.KeyPairForTesting(),
+	}
+	_, err = CreateBucketForIdentifier(&appState, config, "alice@example.com", Bucket{Name: "files"})
+	if err != nil {
+		t.Fatal(err)
+	}
+	files, err := scopedIdentifier("alice@example.com", "files")
+	if err != nil {
+		t.Fatal(err)
+	}
+	_, err = InsertKeyValueForIdentifier(&appState, config, files, "doc", []byte("files"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	link, err := CreateLinkForIdentifier(&appState, config, files, "doc", 0, 0)
+	if err != nil {
+		t.Fatal(err)
+	}
+	reader, _, err := OpenLinkForToken(&appState, link.Token)
+	if err != nil {
+		t.Fatal(err)
+	}
+	value, err := ioutil.ReadAll(reader)
+	reader.Close()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if string(value) != "files" {
+		t.Errorf("Expected files, got %s", value)
+	}
+	err = DeleteBucketForIdentifier(&appState, config, "alice@example.com", "files")
+	if err != nil {
+		t.Fatal(err)
+	}
+	_, _, err = OpenLinkForToken(&appState, link.Token)
+	if _, ok := err.(*ErrLinkNotFound); !ok {
+		t.Errorf("Expected ErrLinkNotFound after the bucket was deleted, got %v", err)
+	}
+}
@@ -16,23 +16,74 @@ import (
 )
 
 var (
-	configPath string
+	configPath           string
+	newEncryptionKeyPath string
+	disableEncryption    bool
 )
 
+// registerStoreRoutes is used for the default bucket as well as for
+// /buckets/{bucket}
+func registerStoreRoutes(router *mux.Router) {
+	// registered before /store/{key} so _batch is not treated as a key
+	router.HandleFunc("/store/_batch", BatchHandler).Methods("POST")
+	router.HandleFunc("/store/{key}", InsertHandler).Methods("POST")
+	router.HandleFunc("/store/{key}", InsertHandler).Methods("PUT")
+	router.HandleFunc("/store/{key}", RetrieveHandler).Methods("GET")
+	router.HandleFunc("/store/{key}", RetrieveHandler).Methods("HEAD")
+	router.HandleFunc("/store/{key}", DeleteHandler).Methods("DELETE")
+	router.HandleFunc("/store/{key}", PatchHandler).Methods("PATCH")
+	router.HandleFunc("/store/{key}/versions", VersionsHandler).Methods("GET")
+	router.HandleFunc("/store/{key}/increment", IncrementHandler).Methods("POST")
+	router.HandleFunc("/store/{key}/append", AppendHandler).Methods("POST")
+	router.HandleFunc("/store/{key}/versions/{version}/restore", RestoreHandler).Methods("POST")
+	router.HandleFunc("/store/{key}/grants", GrantsHandler).Methods("GET")
+	router.HandleFunc("/store/{key}/grants/{grantee}", GrantHandler).Methods("PUT")
+	router.HandleFunc("/store/{key}/grants/{grantee}", RevokeHandler).Methods("DELETE")
+	router.HandleFunc("/store/{key}/links", LinksHandler).Methods("GET")
+	router.HandleFunc("/store/{key}/links", CreateLinkHandler).Methods("POST")
+	router.HandleFunc("/store/{key}/links/{id}", RevokeLinkHandler).Methods("DELETE")
+	router.HandleFunc("/store", IndexHandler).Methods("GET")
+	router.HandleFunc("/trash", TrashHandler).Methods("GET")
+	router.HandleFunc("/trash/{key}/restore", RestoreTrashHandler).Methods("POST")
+}
+
+// registerSharedRoutes is used for /shared/{owner} as well as for
+// /shared/{owner}/buckets/{bucket}
+func registerSharedRoutes(router *mux.Router) {
+	router.HandleFunc("/store/{key}", SharedRetrieveHandler).Methods("GET")
+	router.HandleFunc("/store/{key}", SharedRetrieveHandler).Methods("HEAD")
+	router.HandleFunc("/store/{key}", SharedInsertHandler).Methods("PUT")
+}
+
 func SetupHandler(config *Config, state *state.State) http.HandlerFunc {
 	router := mux.NewRouter()
 	router.HandleFunc("/api/login", handlers.RequestTokenHandler).Methods("POST")
-	router.HandleFunc("/api/auth", handlers.AuthenticateHandler).Methods("POST")
+	router.HandleFunc("/api/auth", AuthenticateHandler).Methods("POST")
 	router.HandleFunc("/api/refresh", handlers.RefreshHandler).Methods("POST")
 	router.HandleFunc("/api/keys", handlers.PublicKeyHandler).Methods("GET")
+	router.HandleFunc("/s/{token}", PublicLinkHandler).Methods("GET")
 
 	protectedRouter := router.PathPrefix("/api").Subrouter()
 	protectedRouter.Use(middleware.WithJWTHandler)
 	protectedRouter.HandleFunc("/info", handlers.ClaimsInfoHandler).Methods("GET")
-	protectedRouter.HandleFunc("/store/{key}", InsertHandler).Methods("POST")
-	protectedRouter.HandleFunc("/store/{key}", RetrieveHandler).Methods("GET")
-	protectedRouter.HandleFunc("/store/{key}", DeleteHandler).Methods("DELETE")
-	protectedRouter.HandleFunc("/store", IndexHandler).Methods("GET")
+	registerStoreRoutes(protectedRouter)
+	protectedRouter.HandleFunc("/buckets", BucketsHandler).Methods("GET")
+	protectedRouter.HandleFunc("/buckets", CreateBucketHandler).Methods("POST")
+	protectedRouter.HandleFunc("/buckets/{bucket}", DeleteBucketHandler).Methods("DELETE")
+	registerStoreRoutes(protectedRouter.PathPrefix("/buckets/{bucket}").Subrouter())
+	protectedRouter.HandleFunc("/usage", UsageHandler).Methods("GET")
+	protectedRouter.HandleFunc("/export", ExportHandler).Methods("GET")
+	protectedRouter.HandleFunc("/import", ImportHandler).Methods("POST")
+	protectedRouter.HandleFunc("/account", DeleteAccountHandler).Methods("DELETE")
+	protectedRouter.HandleFunc("/shared", SharedHandler).Methods("GET")
+	protectedRouter.HandleFunc("/events", EventsHandler).Methods("GET")
+	protectedRouter.HandleFunc("/changes", ChangesHandler).Methods("GET")
+	protectedRouter.HandleFunc("/webhooks", WebhooksHandler).Methods("GET")
+	protectedRouter.HandleFunc("/webhooks", CreateWebhookHandler).Methods("POST")
+	protectedRouter.HandleFunc("/webhooks/{id}", DeleteWebhookHandler).Methods("DELETE")
+	protectedRouter.HandleFunc("/webhooks/{id}/deliveries", WebhookDeliveriesHandler).Methods("GET")
+	registerSharedRoutes(protectedRouter.PathPrefix("/shared/{owner}/buckets/{bucket}").Subrouter())
+	registerSharedRoutes(protectedRouter.PathPrefix("/shared/{owner}").Subrouter())
 
 	router.HandleFunc("/health", func(w http.ResponseWriter, r *http.Request) {
 		w.WriteHeader(http.StatusOK)
@@ -51,20 +102,87 @@ func SetupHandler(config *Config, state *state.State) http.HandlerFunc {
 
 func main() {
 	flag.StringVar(&configPath, "configPath", "config.yaml", "path to the config file")
+	flag.StringVar(&newEncryptionKeyPath, "newEncryptionKeyPath", "", "path to the new key for rotate-encryption-key and migrate-encryption")
+	flag.BoolVar(&disableEncryption, "disableEncryption", false, "disable encryption instead of rotating the key in rotate-encryption-key")
 	flag.Parse()
 	config, err := ReadConfigFromFile(configPath)
 	if err != nil {
 		log.Fatal().Msgf("Could not read config: %v", err)
 	}
+	if flag.Arg(0) == "rotate-encryption-key" && disableEncryption {
+		if len(newEncryptionKeyPath) > 0 {
+			log.Fatal().Msg("--disableEncryption cannot be combined with --newEncryptionKeyPath")
+		}
+		err = DisableEncryption(config)
+		if err != nil {
+			log.Fatal().Msgf("Could not disable encryption: %v", err)
+		}
+		log.Info().Msg("Disabled encryption, remove encryption.keyPath from the config")
+		return
+	}
+	if flag.Arg(0) == "rotate-encryption-key" {
+		err = RotateEncryptionKey(config, newEncryptionKeyPath)
+		if _, ok := err.(*ErrMissingEncryptionKey); ok {
+			log.Fatal().Msg("--newEncryptionKeyPath is required, use --disableEncryption to disable encryption")
+		}
+		if _, ok := err.(*ErrNotEncrypted); ok {
+			log.Fatal().Msg("The database is not encrypted, use migrate-encryption to encrypt it")
+		}
+		if err != nil {
+			log.Fatal().Msgf("Could not rotate encryption key: %v", err)
+		}
+		log.Info().Msg("Rotated encryption key, update encryption.keyPath in the config")
+		return
+	}
+	if flag.Arg(0) == "migrate-encryption" {
+		err = MigrateEncryption(config, newEncryptionKeyPath)
+		if _, ok := err.(*ErrMissingEncryptionKey); ok {
+			log.Fatal().Msg("--newEncryptionKeyPath is required")
+		}
+		if err != nil {
+			log.Fatal().Msgf("Could not migrate the database: %v", err)
+		}
+		log.Info().Msg("Encrypted the database, set encryption.keyPath in the config")
+		return
+	}
+	if flag.Arg(0) == "list-tombstones" {
+		err = printTombstones(config)
+		if err != nil {
+			log.Fatal().Msgf("Could not list tombstones: %v", err)
+		}
+		return
+	}
 	rsaKeys, err := crypto.ReadRSAKeysFromPath(config.KeyPath)
 	if err != nil {
 		log.Fatal().Msgf("Could setup crypto %v", err)
 	}
-	state, err := state.NewState(config.Config, rsaKeys)
+	state, err := OpenState(config, rsaKeys)
 	if err != nil {
 		log.Fatal().Msgf("Could create state: %v", err)
 	}
 
+	// values are only accepted afterwards, so no upload is removed while
+	// it is still written
+	removed, err := RemovePendingUploads(state)
+	if err != nil {
+		log.Fatal().Msgf("Could not remove pending uploads: %v", err)
+	}
+	if removed > 0 {
+		log.Info().Msgf("Removed the chunks of %d interrupted uploads", removed)
+	}
+
+	go func() {
+		resumed, err := ResumeBucketDeletions(state)
+		if err != nil {
+			log.Error().Msgf("Could not resume bucket deletions: %v", err)
+		}
+		if resumed > 0 {
+			log.Info().Msgf("Resumed the deletion of %d buckets", resumed)
+		}
+	}()
+	go purgeTrashPeriodically(state)
+	go deliverWebhooksPeriodically(state, *config)
+
 	log.Info().Msgf("Starting to listen on port %d", config.ListenPort)
 	handler := SetupHandler(config, state)
 	http.ListenAndServe(fmt.Sprintf(":%d", config.ListenPort), handler)
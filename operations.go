@@ -1,9 +1,14 @@
 package main
 
 import (
+	"crypto/sha256"
 	"encoding/base64"
+	"encoding/hex"
+	"encoding/json"
 	"fmt"
+	"mime"
 	"strings"
+	"time"
 
 	"github.com/dgraph-io/badger/v3"
 	"github.com/mguentner/passwordless/state"
@@ -16,21 +21,182 @@ func (e *ErrKeyLimitReached) Error() string {
 	return "KeyLimitReached"
 }
 
+type ErrQuotaExceeded struct{}
+
+func (e *ErrQuotaExceeded) Error() string {
+	return "QuotaExceeded"
+}
+
 type ErrDataTooBig struct{}
 
 func (e *ErrDataTooBig) Error() string {
 	return "DataTooBig"
 }
 
+type ErrContentTypeNotAllowed struct{}
+
+func (e *ErrContentTypeNotAllowed) Error() string {
+	return "ContentTypeNotAllowed"
+}
+
 type ErrKeyNotFound struct{}
 
 func (e *ErrKeyNotFound) Error() string {
 	return "KeyNotFound"
 }
 
+type ErrKeyExists struct{}
+
+func (e *ErrKeyExists) Error() string {
+	return "KeyExists"
+}
+
+// ErrKeyHasVersions is returned if a value with a TTL would replace a key
+// with previous versions, which the value can not keep
+type ErrKeyHasVersions struct{}
+
+func (e *ErrKeyHasVersions) Error() string {
+	return "KeyHasVersions"
+}
+
+type ErrInvalidCursor struct{}
+
+func (e *ErrInvalidCursor) Error() string {
+	return "InvalidCursor"
+}
+
+type ErrVersionNotFound struct{}
+
+func (e *ErrVersionNotFound) Error() string {
+	return "VersionNotFound"
+}
+
+type ErrPreconditionFailed struct{}
+
+func (e *ErrPreconditionFailed) Error() string {
+	return "PreconditionFailed"
+}
+
+type ValueVersion struct {
+	Version         uint64     `json:"version"`
+	Size            uint64     `json:"size"`
+	Timestamp       time.Time  `json:"timestamp"`
+	ETag            string     `json:"etag"`
+	ContentType     string     `json:"contentType,omitempty"`
+	ContentEncoding string     `json:"contentEncoding,omitempty"`
+	Filename        string     `json:"filename,omitempty"`
+	ExpiresAt       *time.Time `json:"expiresAt,omitempty"`
+}
+
+func (v ValueVersion) expired() bool {
+	return v.ExpiresAt != nil && !v.ExpiresAt.After(time.Now())
+}
+
+// valueMetadata is stored next to every value and describes the current
+// version as well as the previous versions that are still retained.
+// Values with a TTL do not keep a history and can not replace a key that
+// has one, so the metadata never expires before any of the versions it
+// references.
+type valueMetadata struct {
+	ValueVersion
+	CreatedAt time.Time      `json:"createdAt"`
+	History   []ValueVersion `json:"history"`
+}
+
+type KeyDetails struct {
+	Key         string     `json:"key"`
+	Size        uint64     `json:"size"`
+	CreatedAt   time.Time  `json:"createdAt"`
+	ModifiedAt  time.Time  `json:"modifiedAt"`
+	ContentType string     `json:"contentType,omitempty"`
+	ETag        string     `json:"etag"`
+	ExpiresAt   *time.Time `json:"expiresAt,omitempty"`
+}
+
+// Preconditions are evaluated against the ETag of the current value
+// within the same transaction as the operation itself.
+// "*" matches any existing value.
+type Preconditions struct {
+	IfMatch     []string
+	IfNoneMatch []string
+}
+
+type InsertOptions struct {
+	Preconditions Preconditions
+	// fail with ErrKeyExists instead of replacing an existing value
+	CreateOnly bool
+	// stored as part of the version
+	ContentType     string
+	ContentEncoding string
+	Filename        string
+	// 0 means the value does not expire
+	TTL time.Duration
+	// the caller checks the limits after all of its operations
+	deferLimits bool
+	// set if the value is written by another account using a grant
+	grantee string
+	// the current version is replaced instead of being kept as a previous
+	// version
+	replaceCurrent bool
+}
+
+func matchesETag(etags []string, metadata *valueMetadata) bool {
+	if metadata == nil {
+		return false
+	}
+	for _, etag := range etags {
+		if etag == "*" || etag == metadata.ETag {
+			return true
+		}
+	}
+	return false
+}
+
+// check expects metadata to be nil if the key does not exist
+func (p Preconditions) check(metadata *valueMetadata) error {
+	if len(p.IfMatch) > 0 && !matchesETag(p.IfMatch, metadata) {
+		return &ErrPreconditionFailed{}
+	}
+	if len(p.IfNoneMatch) > 0 && matchesETag(p.IfNoneMatch, metadata) {
+		return &ErrPreconditionFailed{}
+	}
+	return nil
+}
+
+// contentTypeAllowed accepts every content type if no allow-list is
+// configured. Entries of the allow-list can either be a media type like
+// `application/json` or a wildcard like `image/*`.
+func contentTypeAllowed(config Config, contentType string) bool {
+	allowed := config.StorageOptions.AllowedContentTypes
+	if len(allowed) == 0 {
+		return true
+	}
+	if len(contentType) == 0 {
+		contentType = "application/octet-stream"
+	}
+	mediaType, _, err := mime.ParseMediaType(contentType)
+	if err != nil {
+		return false
+	}
+	for _, allowedType := range allowed {
+		if allowedType == mediaType {
+			return true
+		}
+		if strings.HasSuffix(allowedType, "/*") && strings.HasPrefix(mediaType, strings.TrimSuffix(allowedType, "*")) {
+			return true
+		}
+	}
+	return false
+}
+
+func etagForValue(value []byte) string {
+	sum := sha256.Sum256(value)
+	return hex.EncodeToString(sum[:])
+}
+
 func keysForIdentifier(identifier string, txn *badger.Txn) []string {
 	keys := []string{}
-	encodedIdentifier := state.EncodeIdentifier(identifier)
+	encodedIdentifier := encodeScope(identifier)
 	it := txn.NewIterator(badger.DefaultIteratorOptions)
 	prefix := fmt.Sprintf("%s-store", encodedIdentifier)
 	defer it.Close()
@@ -48,26 +214,414 @@ func keysForIdentifier(identifier string, txn *badger.Txn) []string {
 	return keys
 }
 
+type ListOptions struct {
+	// only keys starting with Prefix are returned
+	Prefix string
+	// 0 returns all keys
+	Limit int
+	// Cursor of a previous page, the listing continues after its last key
+	Cursor string
+}
+
+// keysForIdentifierPage iterates in the order of the stored keys. The
+// cursor references the last returned key, so pages neither repeat nor
+// skip keys when other keys are added or removed in between.
+func keysForIdentifierPage(identifier string, options ListOptions, txn *badger.Txn) ([]string, string, error) {
+	_, err := bucketForIdentifier(identifier, txn)
+	if err != nil {
+		return nil, "", err
+	}
+	keys := []string{}
+	encodedIdentifier := encodeScope(identifier)
+	prefix := fmt.Sprintf("%s-store-", encodedIdentifier)
+	start := prefix
+	cursorKey := ""
+	if len(options.Cursor) > 0 {
+		decodedCursor, err := base64.RawURLEncoding.DecodeString(options.Cursor)
+		if err != nil {
+			return nil, "", &ErrInvalidCursor{}
+		}
+		cursorKey = string(decodedCursor)
+		start = prefix + cursorKey
+	}
+	opts := badger.DefaultIteratorOptions
+	opts.PrefetchValues = false
+	it := txn.NewIterator(opts)
+	defer it.Close()
+	lastKey := ""
+	for it.Seek([]byte(start)); it.ValidForPrefix([]byte(prefix)); it.Next() {
+		wholeKey := it.Item().Key()
+		encodedKey := strings.TrimPrefix(string(wholeKey), prefix)
+		if encodedKey == cursorKey {
+			continue
+		}
+		decodedKey, err := base64.StdEncoding.DecodeString(encodedKey)
+		if err != nil {
+			log.Warn().Msgf("Invalid key found for %s with key %v. Could not decode.", identifier, wholeKey)
+			continue
+		}
+		if !strings.HasPrefix(string(decodedKey), options.Prefix) {
+			continue
+		}
+		if options.Limit > 0 && len(keys) == options.Limit {
+			return keys, base64.RawURLEncoding.EncodeToString([]byte(lastKey)), nil
+		}
+		keys = append(keys, string(decodedKey))
+		lastKey = encodedKey
+	}
+	return keys, "", nil
+}
+
+type Usage struct {
+	Keys  uint64 `json:"keys"`
+	Bytes uint64 `json:"bytes"`
+}
+
 func fullKey(identifier string, key string) string {
-	encodedIdentifier := state.EncodeIdentifier(identifier)
+	encodedIdentifier := encodeScope(identifier)
 	encodedKey := base64.StdEncoding.EncodeToString([]byte(key))
 	return fmt.Sprintf("%s-store-%s", encodedIdentifier, encodedKey)
 }
 
+func metadataKey(identifier string, key string) string {
+	encodedIdentifier := encodeScope(identifier)
+	encodedKey := base64.StdEncoding.EncodeToString([]byte(key))
+	return fmt.Sprintf("%s-meta-%s", encodedIdentifier, encodedKey)
+}
+
+// versionKey is zero padded so that the versions of a key are ordered
+func versionKey(identifier string, key string, version uint64) string {
+	encodedIdentifier := encodeScope(identifier)
+	encodedKey := base64.StdEncoding.EncodeToString([]byte(key))
+	return fmt.Sprintf("%s-version-%s-%020d", encodedIdentifier, encodedKey, version)
+}
+
+func metadataForKey(identifier string, key string, txn *badger.Txn) (*valueMetadata, error) {
+	item, err := txn.Get([]byte(fullKey(identifier, key)))
+	if err != nil {
+		if err == badger.ErrKeyNotFound {
+			return nil, &ErrKeyNotFound{}
+		}
+		return nil, err
+	}
+	// values stored before versioning was introduced have no metadata
+	metadata := valueMetadata{
+		ValueVersion: ValueVersion{
+			Version: 1,
+			Size:    uint64(item.ValueSize()),
+		},
+		History: []ValueVersion{},
+	}
+	metadataItem, err := txn.Get([]byte(metadataKey(identifier, key)))
+	if err != nil {
+		if err == badger.ErrKeyNotFound {
+			err = item.Value(func(v []byte) error {
+				metadata.ETag = etagForValue(v)
+				return nil
+			})
+			if err != nil {
+				return nil, err
+			}
+			return &metadata, nil
+		}
+		return nil, err
+	}
+	err = metadataItem.Value(func(v []byte) error {
+		return json.Unmarshal(v, &metadata)
+	})
+	if err != nil {
+		return nil, err
+	}
+	history := []ValueVersion{}
+	for _, previous := range metadata.History {
+		if !previous.expired() {
+			history = append(history, previous)
+		}
+	}
+	metadata.History = history
+	return &metadata, nil
+}
+
+// itemForVersion returns the entry of the current value if version is 0
+func itemForVersion(identifier string, key string, version uint64, txn *badger.Txn) (*badger.Item, *ValueVersion, error) {
+	metadata, err := metadataForKey(identifier, key, txn)
+	if err != nil {
+		return nil, nil, err
+	}
+	if version == 0 || metadata.Version == version {
+		item, err := txn.Get([]byte(fullKey(identifier, key)))
+		if err != nil {
+			if err == badger.ErrKeyNotFound {
+				return nil, nil, &ErrKeyNotFound{}
+			}
+			return nil, nil, err
+		}
+		return item, &metadata.ValueVersion, nil
+	}
+	for _, previous := range metadata.History {
+		if previous.Version != version {
+			continue
+		}
+		item, err := txn.Get([]byte(versionKey(identifier, key, version)))
+		if err != nil {
+			if err == badger.ErrKeyNotFound {
+				return nil, nil, &ErrVersionNotFound{}
+			}
+			return nil, nil, err
+		}
+		return item, &previous, nil
+	}
+	return nil, nil, &ErrVersionNotFound{}
+}
+
+// valueForVersion returns the current value if version is 0
+func valueForVersion(identifier string, key string, version uint64, txn *badger.Txn) ([]byte, *ValueVersion, error) {
+	item, valueVersion, err := itemForVersion(identifier, key, version, txn)
+	if err != nil {
+		return nil, nil, err
+	}
+	value, err := readValue(identifier, item, txn)
+	if err != nil {
+		return nil, nil, err
+	}
+	return value, valueVersion, nil
+}
+
+// storedValue is what insertKeyValue writes to the store entry of a key.
+// The entry either contains the value itself or, if userMeta is
+// chunkedValue, the manifest of a chunked value. Entries and chunks can
+// be compressed, size always refers to the decompressed value.
+type storedValue struct {
+	entry     []byte
+	userMeta  byte
+	size      uint64
+	etag      string
+	expiresAt uint64
+}
+
+// expiresAtForTTL caps the TTL at MaxTTLSeconds and returns 0 if the
+// value does not expire
+func expiresAtForTTL(config Config, ttl time.Duration) uint64 {
+	if config.StorageOptions.MaxTTLSeconds > 0 && ttl > time.Duration(config.StorageOptions.MaxTTLSeconds)*time.Second {
+		ttl = time.Duration(config.StorageOptions.MaxTTLSeconds) * time.Second
+	}
+	if ttl <= 0 {
+		return 0
+	}
+	return uint64(time.Now().Add(ttl).Unix())
+}
+
+func inlineValue(config Config, value []byte, options InsertOptions) storedValue {
+	return storedValue{
+		entry:     value,
+		size:      uint64(len(value)),
+		etag:      etagForValue(value),
+		expiresAt: expiresAtForTTL(config, options.TTL),
+	}
+}
+
+// checkInsert applies the checks of insertKeyValue that do not depend on
+// the value itself. It returns the metadata of the key, which is nil if
+// the key does not exist or expired, and the bucket of the identifier.
+func checkInsert(config Config, identifier string, key string, expiresAt uint64, options InsertOptions, txn *badger.Txn) (*valueMetadata, *Bucket, error) {
+	if len(options.grantee) > 0 {
+		err := checkAccess(identifier, key, options.grantee, AccessReadWrite, txn)
+		if err != nil {
+			return nil, nil, err
+		}
+	}
+	if !contentTypeAllowed(config, options.ContentType) {
+		return nil, nil, &ErrContentTypeNotAllowed{}
+	}
+	metadata, err := metadataForKey(identifier, key, txn)
+	if err != nil {
+		if _, ok := err.(*ErrKeyNotFound); !ok {
+			return nil, nil, err
+		}
+		metadata = nil
+		// grantees can not create keys
+		if len(options.grantee) > 0 {
+			return nil, nil, &ErrAccessDenied{}
+		}
+	}
+	err = options.Preconditions.check(metadata)
+	if err != nil {
+		return nil, nil, err
+	}
+	if metadata != nil && options.CreateOnly {
+		return nil, nil, &ErrKeyExists{}
+	}
+	// the metadata expires together with the value, the previous versions
+	// would be dropped by this value or orphaned once it expired
+	if expiresAt > 0 && metadata != nil && len(metadata.History) > 0 {
+		return nil, nil, &ErrKeyHasVersions{}
+	}
+	bucket, err := bucketForIdentifier(identifier, txn)
+	if err != nil {
+		return nil, nil, err
+	}
+	return metadata, bucket, nil
+}
+
+func insertKeyValue(config Config, identifier string, key string, value storedValue, options InsertOptions, txn *badger.Txn) (*ValueVersion, error) {
+	metadata, bucket, err := checkInsert(config, identifier, key, value.expiresAt, options, txn)
+	if err != nil {
+		return nil, err
+	}
+	// grants and links of a key that expired must not apply to the new key
+	if metadata == nil {
+		err = deleteGrantsForKey(identifier, key, txn)
+		if err != nil {
+			return nil, err
+		}
+		err = deleteLinksForKey(identifier, key, txn)
+		if err != nil {
+			return nil, err
+		}
+	}
+	var usageBefore limitUsage
+	if !options.deferLimits {
+		usageBefore, err = limitUsageForIdentifier(identifier, txn)
+		if err != nil {
+			return nil, err
+		}
+	}
+	piecesBefore := usagePiecesForKey(key, metadata)
+	referencedChunks, err := manifestsForKey(identifier, key, metadata, txn)
+	if err != nil {
+		return nil, err
+	}
+	maxVersions := config.StorageOptions.MaxVersionsPerKey
+	if value.expiresAt > 0 {
+		maxVersions = 0
+	}
+	if metadata == nil {
+		metadata = &valueMetadata{
+			CreatedAt: time.Now(),
+			History:   []ValueVersion{},
+		}
+	} else if maxVersions > 0 && !options.replaceCurrent {
+		item, err := txn.Get([]byte(fullKey(identifier, key)))
+		if err != nil {
+			return nil, err
+		}
+		previousEntry, err := item.ValueCopy(nil)
+		if err != nil {
+			return nil, err
+		}
+		e := badger.NewEntry([]byte(versionKey(identifier, key, metadata.Version)), previousEntry).WithMeta(item.UserMeta())
+		if metadata.ExpiresAt != nil {
+			e.ExpiresAt = uint64(metadata.ExpiresAt.Unix())
+		}
+		err = txn.SetEntry(e)
+		if err != nil {
+			return nil, err
+		}
+		metadata.History = append(metadata.History, metadata.ValueVersion)
+	}
+	for uint64(len(metadata.History)) > maxVersions {
+		err = txn.Delete([]byte(versionKey(identifier, key, metadata.History[0].Version)))
+		if err != nil {
+			return nil, err
+		}
+		metadata.History = metadata.History[1:]
+	}
+	value, err = compressValue(config, value, options)
+	if err != nil {
+		return nil, err
+	}
+	e := badger.NewEntry([]byte(fullKey(identifier, key)), value.entry).WithMeta(value.userMeta)
+	e.ExpiresAt = value.expiresAt
+	metadata.ValueVersion = ValueVersion{
+		Version:         metadata.Version + 1,
+		Size:            value.size,
+		Timestamp:       time.Now(),
+		ETag:            value.etag,
+		ContentType:     options.ContentType,
+		ContentEncoding: options.ContentEncoding,
+		Filename:        options.Filename,
+	}
+	if value.expiresAt > 0 {
+		expiresAt := time.Unix(int64(value.expiresAt), 0)
+		metadata.ExpiresAt = &expiresAt
+	}
+	encodedMetadata, err := json.Marshal(metadata)
+	if err != nil {
+		return nil, err
+	}
+	err = updateUsage(identifier, piecesBefore, usagePiecesForKey(key, metadata), txn)
+	if err != nil {
+		return nil, err
+	}
+	// only new keys count against the key limit, values that shrink
+	// are always accepted
+	if !options.deferLimits {
+		usageAfter, err := limitUsageForIdentifier(identifier, txn)
+		if err != nil {
+			return nil, err
+		}
+		err = checkLimits(config, bucket, usageBefore, usageAfter)
+		if err != nil {
+			return nil, err
+		}
+	}
+	metadataEntry := badger.NewEntry([]byte(metadataKey(identifier, key)), encodedMetadata)
+	metadataEntry.ExpiresAt = e.ExpiresAt
+	err = txn.SetEntry(metadataEntry)
+	if err != nil {
+		return nil, err
+	}
+	err = txn.SetEntry(e)
+	if err != nil {
+		return nil, err
+	}
+	// chunks of replaced or trimmed versions are removed in the same
+	// transaction, so they never outlive the last reference
+	stillReferenced, err := manifestsForKey(identifier, key, metadata, txn)
+	if err != nil {
+		return nil, err
+	}
+	err = releaseChunks(identifier, referencedChunks, stillReferenced, txn)
+	if err != nil {
+		return nil, err
+	}
+	err = recordChange(config, identifier, Change{Type: ChangePut, Key: key, Version: &metadata.ValueVersion}, txn)
+	if err != nil {
+		return nil, err
+	}
+	return &metadata.ValueVersion, nil
+}
+
 func InsertKeyValueForIdentifier(s *state.State, config Config, identifier string, key string, value []byte) (string, error) {
-	fullKey := fullKey(identifier, key)
+	_, err := InsertKeyValueWithOptions(s, config, identifier, key, value, InsertOptions{})
+	return fullKey(identifier, key), err
+}
+
+// InsertKeyValueWithOptions returns the version that was written
+func InsertKeyValueWithOptions(s *state.State, config Config, identifier string, key string, value []byte, options InsertOptions) (ValueVersion, error) {
+	var version ValueVersion
 	if config.StorageOptions.MaxValueSizeBytes > 0 && len(value) > int(config.StorageOptions.MaxValueSizeBytes) {
-		return "", &ErrDataTooBig{}
+		return version, &ErrDataTooBig{}
 	}
-	err := s.DB.Update(func(txn *badger.Txn) error {
-		currentKeys := keysForIdentifier(identifier, txn)
-		if config.StorageOptions.MaxKeysPerAccount > 0 && uint64(len(currentKeys)) >= config.StorageOptions.MaxKeysPerAccount {
-			return &ErrKeyLimitReached{}
+	err := updateRetryingConflicts(s, func(txn *badger.Txn) error {
+		v, err := insertKeyValue(config, identifier, key, inlineValue(config, value, options), options, txn)
+		if err != nil {
+			return err
 		}
-		e := badger.NewEntry([]byte(fullKey), value)
-		return txn.SetEntry(e)
+		version = *v
+		return nil
 	})
-	return fullKey, err
+	return version, err
+}
+
+func UsageForIdentifier(s *state.State, identifier string) (Usage, error) {
+	var usage Usage
+	err := s.DB.View(func(txn *badger.Txn) error {
+		u, err := usageForIdentifier(identifier, txn)
+		usage = u
+		return err
+	})
+	return usage, err
 }
 
 func KeysForIdentifier(s *state.State, identifier string) ([]string, error) {
@@ -80,37 +634,188 @@ func KeysForIdentifier(s *state.State, identifier string) ([]string, error) {
 	return *keys, err
 }
 
+// KeysForIdentifierWithOptions returns a page of keys and the cursor of
+// the next page, which is empty if there are no more keys
+func KeysForIdentifierWithOptions(s *state.State, identifier string, options ListOptions) ([]string, string, error) {
+	keys := []string{}
+	nextCursor := ""
+	err := s.DB.View(func(txn *badger.Txn) error {
+		k, c, err := keysForIdentifierPage(identifier, options, txn)
+		if err != nil {
+			return err
+		}
+		keys = k
+		nextCursor = c
+		return nil
+	})
+	return keys, nextCursor, err
+}
+
+// KeyDetailsForIdentifierWithOptions works like KeysForIdentifierWithOptions
+// but returns the metadata of every key as well
+func KeyDetailsForIdentifierWithOptions(s *state.State, identifier string, options ListOptions) ([]KeyDetails, string, error) {
+	details := []KeyDetails{}
+	nextCursor := ""
+	err := s.DB.View(func(txn *badger.Txn) error {
+		keys, c, err := keysForIdentifierPage(identifier, options, txn)
+		if err != nil {
+			return err
+		}
+		for _, key := range keys {
+			metadata, err := metadataForKey(identifier, key, txn)
+			if err != nil {
+				return err
+			}
+			details = append(details, KeyDetails{
+				Key:         key,
+				Size:        metadata.Size,
+				CreatedAt:   metadata.CreatedAt,
+				ModifiedAt:  metadata.Timestamp,
+				ContentType: metadata.ContentType,
+				ETag:        metadata.ETag,
+				ExpiresAt:   metadata.ExpiresAt,
+			})
+		}
+		nextCursor = c
+		return nil
+	})
+	return details, nextCursor, err
+}
+
 func RetrieveValueIdentifierAndKey(s *state.State, identifier string, key string) ([]byte, error) {
-	fullKey := fullKey(identifier, key)
 	value := []byte{}
 	err := s.DB.View(func(txn *badger.Txn) error {
-		item, err := txn.Get([]byte(fullKey))
+		v, _, err := valueForVersion(identifier, key, 0, txn)
 		if err != nil {
-			if err == badger.ErrKeyNotFound {
-				return &ErrKeyNotFound{}
-			}
 			return err
 		}
-		item.Value(func(v []byte) error {
-			value = append([]byte{}, v...)
-			return nil
-		})
+		value = v
 		return nil
 	})
 	return value, err
 }
 
-func DeleteKeyValueForIdentifier(s *state.State, identifier string, key string) error {
-	fullKey := fullKey(identifier, key)
-	err := s.DB.Update(func(txn *badger.Txn) error {
-		_, err := txn.Get([]byte(fullKey))
+// RetrieveVersionForIdentifierAndKey returns the current value if version is 0
+func RetrieveVersionForIdentifierAndKey(s *state.State, identifier string, key string, version uint64) ([]byte, ValueVersion, error) {
+	value := []byte{}
+	var valueVersion ValueVersion
+	err := s.DB.View(func(txn *badger.Txn) error {
+		v, vv, err := valueForVersion(identifier, key, version, txn)
+		if err != nil {
+			return err
+		}
+		value = v
+		valueVersion = *vv
+		return nil
+	})
+	return value, valueVersion, err
+}
+
+// VersionsForIdentifierAndKey returns all retained versions of a key, oldest first
+func VersionsForIdentifierAndKey(s *state.State, identifier string, key string) ([]ValueVersion, error) {
+	versions := []ValueVersion{}
+	err := s.DB.View(func(txn *badger.Txn) error {
+		metadata, err := metadataForKey(identifier, key, txn)
 		if err != nil {
-			if err == badger.ErrKeyNotFound {
-				return &ErrKeyNotFound{}
-			}
 			return err
 		}
-		return txn.Delete([]byte(fullKey))
+		versions = append(versions, metadata.History...)
+		versions = append(versions, metadata.ValueVersion)
+		return nil
+	})
+	return versions, err
+}
+
+// RestoreVersionForIdentifierAndKey stores a previous version as the new
+// current version, so restoring can be undone as well.
+// Chunked values are not copied, the restored version references the
+// same chunks.
+func RestoreVersionForIdentifierAndKey(s *state.State, config Config, identifier string, key string, version uint64) error {
+	err := updateRetryingConflicts(s, func(txn *badger.Txn) error {
+		item, valueVersion, err := itemForVersion(identifier, key, version, txn)
+		if err != nil {
+			return err
+		}
+		entry, err := item.ValueCopy(nil)
+		if err != nil {
+			return err
+		}
+		value := storedValue{
+			entry:     entry,
+			userMeta:  item.UserMeta(),
+			size:      valueVersion.Size,
+			etag:      valueVersion.ETag,
+			expiresAt: item.ExpiresAt(),
+		}
+		options := InsertOptions{
+			ContentType:     valueVersion.ContentType,
+			ContentEncoding: valueVersion.ContentEncoding,
+			Filename:        valueVersion.Filename,
+		}
+		_, err = insertKeyValue(config, identifier, key, value, options, txn)
+		return err
 	})
 	return err
 }
+
+func DeleteKeyValueForIdentifier(s *state.State, config Config, identifier string, key string) error {
+	return DeleteKeyValueWithPreconditions(s, config, identifier, key, Preconditions{})
+}
+
+func deleteKeyValue(config Config, identifier string, key string, preconditions Preconditions, txn *badger.Txn) error {
+	metadata, err := metadataForKey(identifier, key, txn)
+	if err != nil {
+		if _, ok := err.(*ErrKeyNotFound); !ok {
+			return err
+		}
+		metadata = nil
+	}
+	err = preconditions.check(metadata)
+	if err != nil {
+		return err
+	}
+	if metadata == nil {
+		return &ErrKeyNotFound{}
+	}
+	err = updateUsage(identifier, usagePiecesForKey(key, metadata), nil, txn)
+	if err != nil {
+		return err
+	}
+	referencedChunks, err := manifestsForKey(identifier, key, metadata, txn)
+	if err != nil {
+		return err
+	}
+	err = releaseChunks(identifier, referencedChunks, nil, txn)
+	if err != nil {
+		return err
+	}
+	err = deleteGrantsForKey(identifier, key, txn)
+	if err != nil {
+		return err
+	}
+	err = deleteLinksForKey(identifier, key, txn)
+	if err != nil {
+		return err
+	}
+	for _, previous := range metadata.History {
+		err = txn.Delete([]byte(versionKey(identifier, key, previous.Version)))
+		if err != nil {
+			return err
+		}
+	}
+	err = txn.Delete([]byte(metadataKey(identifier, key)))
+	if err != nil {
+		return err
+	}
+	err = txn.Delete([]byte(fullKey(identifier, key)))
+	if err != nil {
+		return err
+	}
+	return recordChange(config, identifier, Change{Type: ChangeDelete, Key: key}, txn)
+}
+
+func DeleteKeyValueWithPreconditions(s *state.State, config Config, identifier string, key string, preconditions Preconditions) error {
+	return updateRetryingConflicts(s, func(txn *badger.Txn) error {
+		return deleteKeyValue(config, identifier, key, preconditions, txn)
+	})
+}
@@ -3,6 +3,7 @@ package main
 import (
 	"bytes"
 	"testing"
+	"time"
 
 	"github.com/dgraph-io/badger/v3"
 	"github.com/mguentner/passwordless/state"
@@ -123,13 +124,404 @@ func TestDelete(t *testing.T) {
 	appState := state.State{
 		DB: db,
 	}
-	err = DeleteKeyValueForIdentifier(&appState, "alice@example.com", "needle")
+	err = DeleteKeyValueForIdentifier(&appState, config, "alice@example.com", "needle")
 	if err == nil {
 		t.Fatal("Expected an error")
 	}
 	InsertKeyValueForIdentifier(&appState, config, "alice@example.com", "needle", []byte("value"))
-	err = DeleteKeyValueForIdentifier(&appState, "alice@example.com", "needle")
+	err = DeleteKeyValueForIdentifier(&appState, config, "alice@example.com", "needle")
 	if err != nil {
 		t.Fatal("Unexpected error")
 	}
 }
+
+func TestVersions(t *testing.T) {
+	config := DefaultConfig()
+	config.StorageOptions.MaxVersionsPerKey = 2
+	db, err := badger.Open(badger.DefaultOptions("").WithInMemory(true))
+	if err != nil {
+		t.Fatal(err)
+	}
+	appState := state.State{
+		DB: db,
+	}
+	_, err = VersionsForIdentifierAndKey(&appState, "alice@example.com", "needle")
+	if _, ok := err.(*ErrKeyNotFound); !ok {
+		t.Fatalf("Expected ErrKeyNotFound, got %v", err)
+	}
+	for _, value := range []string{"one", "two", "three", "four"} {
+		_, err = InsertKeyValueForIdentifier(&appState, config, "alice@example.com", "needle", []byte(value))
+		if err != nil {
+			t.Fatalf("Unexpected failure: %v", err)
+		}
+	}
+	versions, err := VersionsForIdentifierAndKey(&appState, "alice@example.com", "needle")
+	if err != nil {
+		t.Fatalf("Unexpected failure: %v", err)
+	}
+	if len(versions) != 3 {
+		t.Fatalf("Expected 3 versions, got %d", len(versions))
+	}
+	if versions[0].Version != 2 || versions[2].Version != 4 {
+		t.Fatalf("Unexpected versions: %v", versions)
+	}
+	if versions[2].Size != uint64(len("four")) {
+		t.Fatalf("Expected size %d, got %d", len("four"), versions[2].Size)
+	}
+	_, _, err = RetrieveVersionForIdentifierAndKey(&appState, "alice@example.com", "needle", 1)
+	if _, ok := err.(*ErrVersionNotFound); !ok {
+		t.Fatalf("Expected ErrVersionNotFound, got %v", err)
+	}
+	value, _, err := RetrieveVersionForIdentifierAndKey(&appState, "alice@example.com", "needle", 2)
+	if err != nil {
+		t.Fatalf("Unexpected failure: %v", err)
+	}
+	if bytes.Compare(value, []byte("two")) != 0 {
+		t.Fatalf("Expected two, got %s", value)
+	}
+	err = RestoreVersionForIdentifierAndKey(&appState, config, "alice@example.com", "needle", 2)
+	if err != nil {
+		t.Fatalf("Unexpected failure: %v", err)
+	}
+	value, err = RetrieveValueIdentifierAndKey(&appState, "alice@example.com", "needle")
+	if err != nil {
+		t.Fatalf("Unexpected failure: %v", err)
+	}
+	if bytes.Compare(value, []byte("two")) != 0 {
+		t.Fatalf("Expected two, got %s", value)
+	}
+	versions, err = VersionsForIdentifierAndKey(&appState, "alice@example.com", "needle")
+	if err != nil {
+		t.Fatalf("Unexpected failure: %v", err)
+	}
+	if len(versions) != 3 || versions[2].Version != 5 {
+		t.Fatalf("Unexpected versions: %v", versions)
+	}
+	err = DeleteKeyValueForIdentifier(&appState, config, "alice@example.com", "needle")
+	if err != nil {
+		t.Fatalf("Unexpected failure: %v", err)
+	}
+	_, _, err = RetrieveVersionForIdentifierAndKey(&appState, "alice@example.com", "needle", 4)
+	if _, ok := err.(*ErrKeyNotFound); !ok {
+		t.Fatalf("Expected ErrKeyNotFound, got %v", err)
+	}
+}
+
+func TestPreconditions(t *testing.T) {
+	config := DefaultConfig()
+	db, err := badger.Open(badger.DefaultOptions("").WithInMemory(true))
+	if err != nil {
+		t.Fatal(err)
+	}
+	appState := state.State{
+		DB: db,
+	}
+	_, err = InsertKeyValueWithOptions(&appState, config, "alice@example.com", "needle", []byte("value"), InsertOptions{Preconditions: Preconditions{IfMatch: []string{"*"}}})
+	if _, ok := err.(*ErrPreconditionFailed); !ok {
+		t.Fatalf("Expected ErrPreconditionFailed, got %v", err)
+	}
+	version, err := InsertKeyValueWithOptions(&appState, config, "alice@example.com", "needle", []byte("value"), InsertOptions{Preconditions: Preconditions{IfNoneMatch: []string{"*"}}})
+	if err != nil {
+		t.Fatalf("Unexpected failure: %v", err)
+	}
+	if len(version.ETag) == 0 {
+		t.Fatal("Expected non-empty ETag")
+	}
+	_, err = InsertKeyValueWithOptions(&appState, config, "alice@example.com", "needle", []byte("other"), InsertOptions{Preconditions: Preconditions{IfNoneMatch: []string{"*"}}})
+	if _, ok := err.(*ErrPreconditionFailed); !ok {
+		t.Fatalf("Expected ErrPreconditionFailed, got %v", err)
+	}
+	_, err = InsertKeyValueWithOptions(&appState, config, "alice@example.com", "needle", []byte("other"), InsertOptions{Preconditions: Preconditions{IfMatch: []string{"outdated"}}})
+	if _, ok := err.(*ErrPreconditionFailed); !ok {
+		t.Fatalf("Expected ErrPreconditionFailed, got %v", err)
+	}
+	updatedVersion, err := InsertKeyValueWithOptions(&appState, config, "alice@example.com", "needle", []byte("other"), InsertOptions{Preconditions: Preconditions{IfMatch: []string{version.ETag}}})
+	if err != nil {
+		t.Fatalf("Unexpected failure: %v", err)
+	}
+	if updatedVersion.ETag == version.ETag {
+		t.Fatal("Expected ETag to change")
+	}
+	err = DeleteKeyValueWithPreconditions(&appState, config, "alice@example.com", "needle", Preconditions{IfMatch: []string{version.ETag}})
+	if _, ok := err.(*ErrPreconditionFailed); !ok {
+		t.Fatalf("Expected ErrPreconditionFailed, got %v", err)
+	}
+	err = DeleteKeyValueWithPreconditions(&appState, config, "alice@example.com", "needle", Preconditions{IfMatch: []string{updatedVersion.ETag}})
+	if err != nil {
+		t.Fatalf("Unexpected failure: %v", err)
+	}
+}
+
+func TestTTL(t *testing.T) {
+	config := DefaultConfig()
+	config.StorageOptions.MaxKeysPerAccount = 1
+	config.StorageOptions.MaxTTLSeconds = 60
+	db, err := badger.Open(badger.DefaultOptions("").WithInMemory(true))
+	if err != nil {
+		t.Fatal(err)
+	}
+	appState := state.State{
+		DB: db,
+	}
+	version, err := InsertKeyValueWithOptions(&appState, config, "alice@example.com", "capped", []byte("value"), InsertOptions{TTL: time.Hour})
+	if err != nil {
+		t.Fatalf("Unexpected failure: %v", err)
+	}
+	if version.ExpiresAt == nil || version.ExpiresAt.After(time.Now().Add(time.Minute)) {
+		t.Fatalf("Expected TTL to be capped, got %v", version.ExpiresAt)
+	}
+	err = DeleteKeyValueForIdentifier(&appState, config, "alice@example.com", "capped")
+	if err != nil {
+		t.Fatalf("Unexpected failure: %v", err)
+	}
+	_, err = InsertKeyValueWithOptions(&appState, config, "alice@example.com", "short", []byte("value"), InsertOptions{TTL: time.Second})
+	if err != nil {
+		t.Fatalf("Unexpected failure: %v", err)
+	}
+	time.Sleep(2 * time.Second)
+	_, err = RetrieveValueIdentifierAndKey(&appState, "alice@example.com", "short")
+	if _, ok := err.(*ErrKeyNotFound); !ok {
+		t.Fatalf("Expected ErrKeyNotFound, got %v", err)
+	}
+	keys, err := KeysForIdentifier(&appState, "alice@example.com")
+	if err != nil {
+		t.Fatalf("Unexpected failure: %v", err)
+	}
+	if len(keys) != 0 {
+		t.Fatalf("Expected no keys, got %v", keys)
+	}
+	_, err = InsertKeyValueForIdentifier(&appState, config, "alice@example.com", "other", []byte("value"))
+	if err != nil {
+		t.Fatalf("Expected expired key to not count against the limit: %v", err)
+	}
+}
+
+func TestQuota(t *testing.T) {
+	config := DefaultConfig()
+	config.StorageOptions.MaxBytesPerAccount = 10
+	db, err := badger.Open(badger.DefaultOptions("").WithInMemory(true))
+	if err != nil {
+		t.Fatal(err)
+	}
+	appState := state.State{
+		DB: db,
+	}
+	_, err = InsertKeyValueForIdentifier(&appState, config, "alice@example.com", "1", []byte("123456"))
+	if err != nil {
+		t.Fatalf("Unexpected failure: %v", err)
+	}
+	_, err = InsertKeyValueForIdentifier(&appState, config, "alice@example.com", "2", []byte("12345"))
+	if _, ok := err.(*ErrQuotaExceeded); !ok {
+		t.Fatalf("Expected ErrQuotaExceeded, got %v", err)
+	}
+	_, err = InsertKeyValueForIdentifier(&appState, config, "alice@example.com", "1", []byte("1234567890"))
+	if err != nil {
+		t.Fatalf("Expected overwrite to replace the previous usage: %v", err)
+	}
+	_, err = InsertKeyValueForIdentifier(&appState, config, "alice@example.com", "1", []byte("12"))
+	if err != nil {
+		t.Fatalf("Unexpected failure: %v", err)
+	}
+	_, err = InsertKeyValueForIdentifier(&appState, config, "alice@example.com", "2", []byte("12345678"))
+	if err != nil {
+		t.Fatalf("Unexpected failure: %v", err)
+	}
+	usage, err := UsageForIdentifier(&appState, "alice@example.com")
+	if err != nil {
+		t.Fatalf("Unexpected failure: %v", err)
+	}
+	if usage.Keys != 2 || usage.Bytes != 10 {
+		t.Fatalf("Unexpected usage: %v", usage)
+	}
+	_, err = InsertKeyValueForIdentifier(&appState, config, "bob@example.com", "1", []byte("1234567890"))
+	if err != nil {
+		t.Fatalf("Expected quota to be per account: %v", err)
+	}
+}
+
+func TestUpdateAtKeyLimit(t *testing.T) {
+	config := DefaultConfig()
+	config.StorageOptions.MaxKeysPerAccount = 2
+	db, err := badger.Open(badger.DefaultOptions("").WithInMemory(true))
+	if err != nil {
+		t.Fatal(err)
+	}
+	appState := state.State{
+		DB: db,
+	}
+	for _, key := range []string{"1", "2"} {
+		_, err = InsertKeyValueForIdentifier(&appState, config, "alice@example.com", key, []byte("value"))
+		if err != nil {
+			t.Fatalf("Unexpected failure: %v", err)
+		}
+	}
+	_, err = InsertKeyValueForIdentifier(&appState, config, "alice@example.com", "2", []byte("updated"))
+	if err != nil {
+		t.Fatalf("Expected update at the key limit to succeed: %v", err)
+	}
+	value, err := RetrieveValueIdentifierAndKey(&appState, "alice@example.com", "2")
+	if err != nil {
+		t.Fatalf("Unexpected failure: %v", err)
+	}
+	if bytes.Compare(value, []byte("updated")) != 0 {
+		t.Fatalf("Expected updated, got %s", value)
+	}
+	_, err = InsertKeyValueForIdentifier(&appState, config, "alice@example.com", "3", []byte("value"))
+	if _, ok := err.(*ErrKeyLimitReached); !ok {
+		t.Fatalf("Expected ErrKeyLimitReached, got %v", err)
+	}
+}
+
+func TestCreateOnly(t *testing.T) {
+	config := DefaultConfig()
+	db, err := badger.Open(badger.DefaultOptions("").WithInMemory(true))
+	if err != nil {
+		t.Fatal(err)
+	}
+	appState := state.State{
+		DB: db,
+	}
+	_, err = InsertKeyValueWithOptions(&appState, config, "alice@example.com", "needle", []byte("value"), InsertOptions{CreateOnly: true})
+	if err != nil {
+		t.Fatalf("Unexpected failure: %v", err)
+	}
+	_, err = InsertKeyValueWithOptions(&appState, config, "alice@example.com", "needle", []byte("other"), InsertOptions{CreateOnly: true})
+	if _, ok := err.(*ErrKeyExists); !ok {
+		t.Fatalf("Expected ErrKeyExists, got %v", err)
+	}
+	value, err := RetrieveValueIdentifierAndKey(&appState, "alice@example.com", "needle")
+	if err != nil {
+		t.Fatalf("Unexpected failure: %v", err)
+	}
+	if bytes.Compare(value, []byte("value")) != 0 {
+		t.Fatalf("Expected value, got %s", value)
+	}
+}
+
+func TestKeysPagination(t *testing.T) {
+	config := DefaultConfig()
+	db, err := badger.Open(badger.DefaultOptions("").WithInMemory(true))
+	if err != nil {
+		t.Fatal(err)
+	}
+	appState := state.State{
+		DB: db,
+	}
+	for _, key := range []string{"settings/a", "settings/b", "settings/c", "other"} {
+		_, err = InsertKeyValueForIdentifier(&appState, config, "alice@example.com", key, []byte("value"))
+		if err != nil {
+			t.Fatalf("Unexpected failure: %v", err)
+		}
+	}
+	options := ListOptions{
+		Prefix: "settings/",
+		Limit:  2,
+	}
+	firstPage, cursor, err := KeysForIdentifierWithOptions(&appState, "alice@example.com", options)
+	if err != nil {
+		t.Fatalf("Unexpected failure: %v", err)
+	}
+	if len(firstPage) != 2 || len(cursor) == 0 {
+		t.Fatalf("Expected a full page and a cursor, got %v %s", firstPage, cursor)
+	}
+	// keys inserted during pagination must not lead to repeated keys
+	_, err = InsertKeyValueForIdentifier(&appState, config, "alice@example.com", "settings/d", []byte("value"))
+	if err != nil {
+		t.Fatalf("Unexpected failure: %v", err)
+	}
+	options.Cursor = cursor
+	secondPage, cursor, err := KeysForIdentifierWithOptions(&appState, "alice@example.com", options)
+	if err != nil {
+		t.Fatalf("Unexpected failure: %v", err)
+	}
+	seen := map[string]bool{}
+	for _, key := range append(firstPage, secondPage...) {
+		if seen[key] {
+			t.Fatalf("Key %s returned twice", key)
+		}
+		if key == "other" {
+			t.Fatal("Expected prefix to be applied")
+		}
+		seen[key] = true
+	}
+	for _, key := range []string{"settings/a", "settings/b", "settings/c"} {
+		if !seen[key] {
+			t.Fatalf("Expected %s to be listed", key)
+		}
+	}
+	if len(cursor) > 0 {
+		_, _, err = KeysForIdentifierWithOptions(&appState, "alice@example.com", ListOptions{Cursor: cursor})
+		if err != nil {
+			t.Fatalf("Unexpected failure: %v", err)
+		}
+	}
+	_, _, err = KeysForIdentifierWithOptions(&appState, "alice@example.com", ListOptions{Cursor: "!"})
+	if _, ok := err.(*ErrInvalidCursor); !ok {
+		t.Fatalf("Expected ErrInvalidCursor, got %v", err)
+	}
+}
+
+func TestKeyDetails(t *testing.T) {
+	config := DefaultConfig()
+	db, err := badger.Open(badger.DefaultOptions("").WithInMemory(true))
+	if err != nil {
+		t.Fatal(err)
+	}
+	appState := state.State{
+		DB: db,
+	}
+	first, err := InsertKeyValueWithOptions(&appState, config, "alice@example.com", "needle", []byte("value"), InsertOptions{ContentType: "text/plain"})
+	if err != nil {
+		t.Fatalf("Unexpected failure: %v", err)
+	}
+	second, err := InsertKeyValueWithOptions(&appState, config, "alice@example.com", "needle", []byte("{}"), InsertOptions{ContentType: "application/json"})
+	if err != nil {
+		t.Fatalf("Unexpected failure: %v", err)
+	}
+	details, _, err := KeyDetailsForIdentifierWithOptions(&appState, "alice@example.com", ListOptions{})
+	if err != nil {
+		t.Fatalf("Unexpected failure: %v", err)
+	}
+	if len(details) != 1 {
+		t.Fatalf("Expected one key, got %d", len(details))
+	}
+	detail := details[0]
+	if detail.Key != "needle" || detail.Size != 2 || detail.ContentType != "application/json" || detail.ETag != second.ETag {
+		t.Fatalf("Unexpected details: %v", detail)
+	}
+	if detail.CreatedAt.After(first.Timestamp) || !detail.ModifiedAt.Equal(second.Timestamp) {
+		t.Fatalf("Unexpected timestamps: %v", detail)
+	}
+}
+
+func TestAllowedContentTypes(t *testing.T) {
+	config := DefaultConfig()
+	config.StorageOptions.AllowedContentTypes = []string{"application/json", "image/*"}
+	db, err := badger.Open(badger.DefaultOptions("").WithInMemory(true))
+	if err != nil {
+		t.Fatal(err)
+	}
+	appState := state.State{
+		DB: db,
+	}
+	contentTypes := []struct {
+		contentType string
+		allowed     bool
+	}{
+		{contentType: "application/json", allowed: true},
+		{contentType: "application/json; charset=utf-8", allowed: true},
+		{contentType: "image/png", allowed: true},
+		{contentType: "text/plain", allowed: false},
+		{contentType: "", allowed: false},
+		{contentType: "invalid/", allowed: false},
+	}
+	for _, c := range contentTypes {
+		_, err = InsertKeyValueWithOptions(&appState, config, "alice@example.com", "needle", []byte("{}"), InsertOptions{ContentType: c.contentType})
+		if c.allowed && err != nil {
+			t.Errorf("Expected %s to be allowed: %v", c.contentType, err)
+		}
+		if _, ok := err.(*ErrContentTypeNotAllowed); !c.allowed && !ok {
+			t.Errorf("Expected ErrContentTypeNotAllowed for %s, got %v", c.contentType, err)
+		}
+	}
+}
@@ -0,0 +1,422 @@
+package main
+
+import (
+	"bytes"
+	"encoding/json"
+	"io"
+	"mime"
+	"strconv"
+	"strings"
+
+	"github.com/dgraph-io/badger/v3"
+	"github.com/mguentner/passwordless/state"
+)
+
+type ErrInvalidPatch struct{}
+
+func (e *ErrInvalidPatch) Error() string {
+	return "InvalidPatch"
+}
+
+type ErrUnsupportedPatchType struct{}
+
+func (e *ErrUnsupportedPatchType) Error() string {
+	return "UnsupportedPatchType"
+}
+
+type ErrValueNotJSON struct{}
+
+func (e *ErrValueNotJSON) Error() string {
+	return "ValueNotJSON"
+}
+
+const (
+	// RFC 7396
+	MergePatchContentType = "application/merge-patch+json"
+	// RFC 6902
+	JSONPatchContentType = "application/json-patch+json"
+)
+
+// isJSONContentType accepts application/json and every +json type
+func isJSONContentType(contentType string) bool {
+	mediaType, _, err := mime.ParseMediaType(contentType)
+	if err != nil {
+		return false
+	}
+	return mediaType == "application/json" || strings.HasSuffix(mediaType, "+json")
+}
+
+// decodeJSON keeps numbers as json.Number, so patching does not change
+// the precision of numbers that are not touched
+func decodeJSON(data []byte) (interface{}, error) {
+	decoder := json.NewDecoder(bytes.NewReader(data))
+	decoder.UseNumber()
+	var document interface{}
+	err := decoder.Decode(&document)
+	if err != nil {
+		return nil, err
+	}
+	if _, err := decoder.Token(); err != io.EOF {
+		return nil, &ErrInvalidPatch{}
+	}
+	return document, nil
+}
+
+func applyMergePatch(target interface{}, patch interface{}) interface{} {
+	patchObject, ok := patch.(map[string]interface{})
+	if !ok {
+		return patch
+	}
+	targetObject, ok := target.(map[string]interface{})
+	if !ok {
+		targetObject = map[string]interface{}{}
+	}
+	for name, value := range patchObject {
+		if value == nil {
+			delete(targetObject, name)
+			continue
+		}
+		targetObject[name] = applyMergePatch(targetObject[name], value)
+	}
+	return targetObject
+}
+
+type jsonPatchOperation struct {
+	Op    string          `json:"op"`
+	Path  *string         `json:"path"`
+	From  *string         `json:"from"`
+	Value json.RawMessage `json:"value"`
+}
+
+// parsePointer splits a RFC 6901 JSON pointer into its reference tokens
+func parsePointer(pointer string) ([]string, error) {
+	if len(pointer) == 0 {
+		return []string{}, nil
+	}
+	if !strings.HasPrefix(pointer, "/") {
+		return nil, &ErrInvalidPatch{}
+	}
+	tokens := strings.Split(pointer[1:], "/")
+	for i, token := range tokens {
+		tokens[i] = strings.ReplaceAll(strings.ReplaceAll(token, "~1", "/"), "~0", "~")
+	}
+	return tokens, nil
+}
+
+// arrayIndex rejects leading zeros as required by RFC 6901
+func arrayIndex(token string, length int) (int, error) {
+	if len(token) == 0 || (len(token) > 1 && token[0] == '0') {
+		return 0, &ErrInvalidPatch{}
+	}
+	index, err := strconv.Atoi(token)
+	if err != nil || index < 0 || index > length {
+		return 0, &ErrInvalidPatch{}
+	}
+	return index, nil
+}
+
+func getChild(document interface{}, token string) (interface{}, error) {
+	switch container := document.(type) {
+	case map[string]interface{}:
+		child, ok := container[token]
+		if !ok {
+			return nil, &ErrInvalidPatch{}
+		}
+		return child, nil
+	case []interface{}:
+		index, err := arrayIndex(token, len(container)-1)
+		if err != nil {
+			return nil, err
+		}
+		return container[index], nil
+	}
+	return nil, &ErrInvalidPatch{}
+}
+
+func getPointer(document interface{}, tokens []string) (interface{}, error) {
+	var err error
+	for _, token := range tokens {
+		document, err = getChild(document, token)
+		if err != nil {
+			return nil, err
+		}
+	}
+	return document, nil
+}
+
+// modifyPointer applies modify to the container referenced by all but
+// the last token and returns the modified document. Arrays can change
+// their length, so every parent stores the returned container again.
+func modifyPointer(document interface{}, tokens []string, modify func(container interface{}, token string) (interface{}, error)) (interface{}, error) {
+	if len(tokens) == 1 {
+		return modify(document, tokens[0])
+	}
+	child, err := getChild(document, tokens[0])
+	if err != nil {
+		return nil, err
+	}
+	child, err = modifyPointer(child, tokens[1:], modify)
+	if err != nil {
+		return nil, err
+	}
+	switch container := document.(type) {
+	case map[string]interface{}:
+		container[tokens[0]] = child
+	case []interface{}:
+		index, _ := arrayIndex(tokens[0], len(container)-1)
+		container[index] = child
+	}
+	return document, nil
+}
+
+func addValue(document interface{}, tokens []string, value interface{}) (interface{}, error) {
+	if len(tokens) == 0 {
+		return value, nil
+	}
+	return modifyPointer(document, tokens, func(container interface{}, token string) (interface{}, error) {
+		switch c := container.(type) {
+		case map[string]interface{}:
+			c[token] = value
+			return c, nil
+		case []interface{}:
+			index := len(c)
+			if token != "-" {
+				var err error
+				index, err = arrayIndex(token, len(c))
+				if err != nil {
+					return nil, err
+				}
+			}
+			c = append(c, nil)
+			copy(c[index+1:], c[index:])
+			c[index] = value
+			return c, nil
+		}
+		return nil, &ErrInvalidPatch{}
+	})
+}
+
+func removeValue(document interface{}, tokens []string) (interface{}, error) {
+	if len(tokens) == 0 {
+		return nil, &ErrInvalidPatch{}
+	}
+	return modifyPointer(document, tokens, func(container interface{}, token string) (interface{}, error) {
+		switch c := container.(type) {
+		case map[string]interface{}:
+			if _, ok := c[token]; !ok {
+				return nil, &ErrInvalidPatch{}
+			}
+			delete(c, token)
+			return c, nil
+		case []interface{}:
+			index, err := arrayIndex(token, len(c)-1)
+			if err != nil {
+				return nil, err
+			}
+			return append(c[:index], c[index+1:]...), nil
+		}
+		return nil, &ErrInvalidPatch{}
+	})
+}
+
+// jsonEqual compares numbers by value, so 1 and 1.0 are equal
+func jsonEqual(a interface{}, b interface{}) bool {
+	switch aValue := a.(type) {
+	case json.Number:
+		bValue, ok := b.(json.Number)
+		if !ok {
+			return false
+		}
+		aFloat, aErr := aValue.Float64()
+		bFloat, bErr := bValue.Float64()
+		if aErr != nil || bErr != nil {
+			return aValue == bValue
+		}
+		return aFloat == bFloat
+	case map[string]interface{}:
+		bValue, ok := b.(map[string]interface{})
+		if !ok || len(aValue) != len(bValue) {
+			return false
+		}
+		for name, value := range aValue {
+			other, ok := bValue[name]
+			if !ok || !jsonEqual(value, other) {
+				return false
+			}
+		}
+		return true
+	case []interface{}:
+		bValue, ok := b.([]interface{})
+		if !ok || len(aValue) != len(bValue) {
+			return false
+		}
+		for i := range aValue {
+			if !jsonEqual(aValue[i], bValue[i]) {
+				return false
+			}
+		}
+		return true
+	}
+	return a == b
+}
+
+func applyJSONPatchOperation(document interface{}, operation jsonPatchOperation) (interface{}, error) {
+	if operation.Path == nil {
+		return nil, &ErrInvalidPatch{}
+	}
+	tokens, err := parsePointer(*operation.Path)
+	if err != nil {
+		return nil, err
+	}
+	var value interface{}
+	switch operation.Op {
+	case "add", "replace", "test":
+		if operation.Value == nil {
+			return nil, &ErrInvalidPatch{}
+		}
+		value, err = decodeJSON(operation.Value)
+		if err != nil {
+			return nil, &ErrInvalidPatch{}
+		}
+	case "move", "copy":
+		if operation.From == nil {
+			return nil, &ErrInvalidPatch{}
+		}
+		fromTokens, err := parsePointer(*operation.From)
+		if err != nil {
+			return nil, err
+		}
+		fromValue, err := getPointer(document, fromTokens)
+		if err != nil {
+			return nil, err
+		}
+		if operation.Op == "move" {
+			// a value can not be moved into one of its children
+			if *operation.From == *operation.Path {
+				return document, nil
+			}
+			if strings.HasPrefix(*operation.Path, *operation.From+"/") {
+				return nil, &ErrInvalidPatch{}
+			}
+			document, err = removeValue(document, fromTokens)
+			if err != nil {
+				return nil, err
+			}
+			return addValue(document, tokens, fromValue)
+		}
+		// the copy must not share containers with the original
+		encoded, err := json.Marshal(fromValue)
+		if err != nil {
+			return nil, err
+		}
+		value, err = decodeJSON(encoded)
+		if err != nil {
+			return nil, err
+		}
+		return addValue(document, tokens, value)
+	}
+	switch operation.Op {
+	case "add":
+		return addValue(document, tokens, value)
+	case "remove":
+		return removeValue(document, tokens)
+	case "replace":
+		if _, err := getPointer(document, tokens); err != nil {
+			return nil, err
+		}
+		if len(tokens) == 0 {
+			return value, nil
+		}
+		document, err = removeValue(document, tokens)
+		if err != nil {
+			return nil, err
+		}
+		return addValue(document, tokens, value)
+	case "test":
+		current, err := getPointer(document, tokens)
+		if err != nil {
+			return nil, err
+		}
+		if !jsonEqual(current, value) {
+			return nil, &ErrInvalidPatch{}
+		}
+		return document, nil
+	}
+	return nil, &ErrInvalidPatch{}
+}
+
+// applyPatch returns ErrInvalidPatch if the patch is malformed or can
+// not be applied to the document, e.g. because a test operation fails
+func applyPatch(value []byte, patchType string, patch []byte) ([]byte, error) {
+	document, err := decodeJSON(value)
+	if err != nil {
+		return nil, &ErrValueNotJSON{}
+	}
+	switch patchType {
+	case MergePatchContentType:
+		patchDocument, err := decodeJSON(patch)
+		if err != nil {
+			return nil, &ErrInvalidPatch{}
+		}
+		document = applyMergePatch(document, patchDocument)
+	case JSONPatchContentType:
+		var operations []jsonPatchOperation
+		err := json.Unmarshal(patch, &operations)
+		if err != nil {
+			return nil, &ErrInvalidPatch{}
+		}
+		for _, operation := range operations {
+			document, err = applyJSONPatchOperation(document, operation)
+			if err != nil {
+				return nil, err
+			}
+		}
+	default:
+		return nil, &ErrUnsupportedPatchType{}
+	}
+	return json.Marshal(document)
+}
+
+func patchKeyValue(config Config, identifier string, key string, patchType string, patch []byte, preconditions Preconditions, txn *badger.Txn) (*ValueVersion, error) {
+	metadata, err := metadataForKey(identifier, key, txn)
+	if err != nil {
+		return nil, err
+	}
+	// the preconditions are checked before the patch is applied, so a
+	// stale client gets PreconditionFailed instead of InvalidPatch
+	err = preconditions.check(metadata)
+	if err != nil {
+		return nil, err
+	}
+	if !isJSONContentType(metadata.ContentType) || len(metadata.ContentEncoding) > 0 {
+		return nil, &ErrValueNotJSON{}
+	}
+	value, _, err := valueForVersion(identifier, key, 0, txn)
+	if err != nil {
+		return nil, err
+	}
+	patched, err := applyPatch(value, patchType, patch)
+	if err != nil {
+		return nil, err
+	}
+	if config.StorageOptions.MaxValueSizeBytes > 0 && uint64(len(patched)) > config.StorageOptions.MaxValueSizeBytes {
+		return nil, &ErrDataTooBig{}
+	}
+	options := modifyOptions(metadata, preconditions, "")
+	return insertKeyValue(config, identifier, key, modifiedValue(metadata, patched), options, txn)
+}
+
+// PatchKeyValueForIdentifier applies a merge patch or a JSON patch,
+// depending on patchType, to a value stored with a JSON content type
+func PatchKeyValueForIdentifier(s *state.State, config Config, identifier string, key string, patchType string, patch []byte, preconditions Preconditions) (ValueVersion, error) {
+	var version ValueVersion
+	err := updateRetryingConflicts(s, func(txn *badger.Txn) error {
+		v, err := patchKeyValue(config, identifier, key, patchType, patch, preconditions, txn)
+		if err != nil {
+			return err
+		}
+		version = *v
+		return nil
+	})
+	return version, err
+}
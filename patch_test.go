@@ -0,0 +1,199 @@
+package main
+
+import (
+	"testing"
+
+	"github.com/dgraph-io/badger/v3"
+	"github.com/mguentner/passwordless/state"
+)
+
+func TestApplyMergePatch(t *testing.T) {
+	// example of RFC 7396, section 3
+	target := `{"title": "Goodbye!", "author": {"givenName": "John", "familyName": "Doe"}, "tags": ["example", "sample"], "content": "This will be unchanged"}`
+	patch := `{"title": "Hello!", "phoneNumber": "+01-123-456-7890", "author": {"familyName": null}, "tags": ["example"]}`
+	expected := `{"author":{"givenName":"John"},"content":"This will be unchanged","phoneNumber":"+01-123-456-7890","tags":["example"],"title":"Hello!"}`
+	result, err := applyPatch([]byte(target), MergePatchContentType, []byte(patch))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if string(result) != expected {
+		t.Errorf("Expected %s, got %s", expected, result)
+	}
+	_, err = applyPatch([]byte(target), MergePatchContentType, []byte(`{"title": `))
+	if _, ok := err.(*ErrInvalidPatch); !ok {
+		t.Errorf("Expected ErrInvalidPatch, got %v", err)
+	}
+}
+
+func TestApplyJSONPatch(t *testing.T) {
+	// mostly taken from appendix A of RFC 6902
+	patches := []struct {
+		document string
+		patch    string
+		expected string
+	}{
+		{
+			document: `{"foo": "bar"}`,
+			patch:    `[{"op": "add", "path": "/baz", "value": "qux"}]`,
+			expected: `{"baz":"qux","foo":"bar"}`,
+		},
+		{
+			document: `{"foo": ["bar", "baz"]}`,
+			patch:    `[{"op": "add", "path": "/foo/1", "value": "qux"}]`,
+			expected: `{"foo":["bar","qux","baz"]}`,
+		},
+		{
+			document: `{"foo": ["bar"]}`,
+			patch:    `[{"op": "add", "path": "/foo/-", "value": ["abc", "def"]}]`,
+			expected: `{"foo":["bar",["abc","def"]]}`,
+		},
+		{
+			document: `{"baz": "qux", "foo": "bar"}`,
+			patch:    `[{"op": "remove", "path": "/baz"}]`,
+			expected: `{"foo":"bar"}`,
+		},
+		{
+			document: `{"foo": ["bar", "qux", "baz"]}`,
+			patch:    `[{"op": "remove", "path": "/foo/1"}]`,
+			expected: `{"foo":["bar","baz"]}`,
+		},
+		{
+			document: `{"baz": "qux", "foo": "bar"}`,
+			patch:    `[{"op": "replace", "path": "/baz", "value": "boo"}]`,
+			expected: `{"baz":"boo","foo":"bar"}`,
+		},
+		{
+			document: `{"foo": {"bar": "baz", "waldo": "fred"}, "qux": {"corge": "grault"}}`,
+			patch:    `[{"op": "move", "from": "/foo/waldo", "path": "/qux/thud"}]`,
+			expected: `{"foo":{"bar":"baz"},"qux":{"corge":"grault","thud":"fred"}}`,
+		},
+		{
+			document: `{"foo": ["all", "grass", "cows", "eat"]}`,
+			patch:    `[{"op": "move", "from": "/foo/1", "path": "/foo/3"}]`,
+			expected: `{"foo":["all","cows","eat","grass"]}`,
+		},
+		{
+			document: `{"baz": "qux", "foo": ["a", 2, "c"]}`,
+			patch:    `[{"op": "test", "path": "/baz", "value": "qux"}, {"op": "test", "path": "/foo/1", "value": 2.0}]`,
+			expected: `{"baz":"qux","foo":["a",2,"c"]}`,
+		},
+		{
+			document: `{"/": 9, "~1": 10}`,
+			patch:    `[{"op": "copy", "from": "/~01", "path": "/~1"}]`,
+			expected: `{"/":10,"~1":10}`,
+		},
+		{
+			document: `{"big": 12345678901234567890}`,
+			patch:    `[{"op": "add", "path": "/small", "value": 1}]`,
+			expected: `{"big":12345678901234567890,"small":1}`,
+		},
+	}
+	for _, p := range patches {
+		result, err := applyPatch([]byte(p.document), JSONPatchContentType, []byte(p.patch))
+		if err != nil {
+			t.Errorf("Unexpected failure for %s: %v", p.patch, err)
+			continue
+		}
+		if string(result) != p.expected {
+			t.Errorf("Expected %s, got %s", p.expected, result)
+		}
+	}
+
+	invalidPatches := []struct {
+		document string
+		patch    string
+	}{
+		{
+			document: `{"baz": "qux"}`,
+			patch:    `[{"op": "test", "path": "/baz", "value": "bar"}]`,
+		},
+		{
+			document: `{"foo": "bar"}`,
+			patch:    `[{"op": "add", "path": "/baz/bat", "value": "qux"}]`,
+		},
+		{
+			document: `{"foo": ["bar"]}`,
+			patch:    `[{"op": "add", "path": "/foo/01", "value": "qux"}]`,
+		},
+		{
+			document: `{"foo": "bar"}`,
+			patch:    `[{"op": "remove", "path": "/baz"}]`,
+		},
+		{
+			document: `{"foo": {"bar": 1}}`,
+			patch:    `[{"op": "move", "from": "/foo", "path": "/foo/bar/baz"}]`,
+		},
+		{
+			document: `{"foo": "bar"}`,
+			patch:    `[{"op": "add", "path": "/baz"}]`,
+		},
+		{
+			document: `{"foo": "bar"}`,
+			patch:    `[{"op": "rename", "path": "/foo"}]`,
+		},
+		{
+			document: `{"foo": "bar"}`,
+			patch:    `{"op": "add", "path": "/baz", "value": 1}`,
+		},
+	}
+	for _, p := range invalidPatches {
+		_, err := applyPatch([]byte(p.document), JSONPatchContentType, []byte(p.patch))
+		if _, ok := err.(*ErrInvalidPatch); !ok {
+			t.Errorf("Expected ErrInvalidPatch for %s, got %v", p.patch, err)
+		}
+	}
+}
+
+func TestPatchKeyValue(t *testing.T) {
+	config := DefaultConfig()
+	config.StorageOptions.MaxValueSizeBytes = 32
+	db, err := badger.Open(badger.DefaultOptions("").WithInMemory(true))
+	if err != nil {
+		t.Fatal(err)
+	}
+	appState := state.State{
+		DB: db,
+	}
+	options := InsertOptions{
+		ContentType: "application/json",
+	}
+	version, err := InsertKeyValueWithOptions(&appState, config, "alice@example.com", "settings", []byte(`{"theme": "dark"}`), options)
+	if err != nil {
+		t.Fatal(err)
+	}
+	patched, err := PatchKeyValueForIdentifier(&appState, config, "alice@example.com", "settings", MergePatchContentType, []byte(`{"lang": "de"}`), Preconditions{IfMatch: []string{version.ETag}})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if patched.Version != 2 || patched.ContentType != "application/json" {
+		t.Errorf("Unexpected version %+v", patched)
+	}
+	value, err := RetrieveValueIdentifierAndKey(&appState, "alice@example.com", "settings")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if string(value) != `{"lang":"de","theme":"dark"}` {
+		t.Errorf("Unexpected value %s", value)
+	}
+	_, err = PatchKeyValueForIdentifier(&appState, config, "alice@example.com", "settings", MergePatchContentType, []byte(`{"lang": "en"}`), Preconditions{IfMatch: []string{version.ETag}})
+	if _, ok := err.(*ErrPreconditionFailed); !ok {
+		t.Errorf("Expected ErrPreconditionFailed, got %v", err)
+	}
+	_, err = PatchKeyValueForIdentifier(&appState, config, "alice@example.com", "settings", MergePatchContentType, []byte(`{"description": "far too long for the limit"}`), Preconditions{})
+	if _, ok := err.(*ErrDataTooBig); !ok {
+		t.Errorf("Expected ErrDataTooBig, got %v", err)
+	}
+
+	_, err = InsertKeyValueForIdentifier(&appState, config, "alice@example.com", "blob", []byte(`{"theme": "dark"}`))
+	if err != nil {
+		t.Fatal(err)
+	}
+	_, err = PatchKeyValueForIdentifier(&appState, config, "alice@example.com", "blob", MergePatchContentType, []byte(`{"lang": "de"}`), Preconditions{})
+	if _, ok := err.(*ErrValueNotJSON); !ok {
+		t.Errorf("Expected ErrValueNotJSON, got %v", err)
+	}
+	_, err = PatchKeyValueForIdentifier(&appState, config, "alice@example.com", "missing", MergePatchContentType, []byte(`{}`), Preconditions{})
+	if _, ok := err.(*ErrKeyNotFound); !ok {
+		t.Errorf("Expected ErrKeyNotFound, got %v", err)
+	}
+}
@@ -0,0 +1,292 @@
+package main
+
+import (
+	"encoding/base64"
+	"encoding/json"
+	"fmt"
+	"io"
+	"strings"
+	"time"
+
+	"github.com/dgraph-io/badger/v3"
+	"github.com/mguentner/passwordless/state"
+)
+
+type ErrInvalidGrant struct{}
+
+func (e *ErrInvalidGrant) Error() string {
+	return "InvalidGrant"
+}
+
+type ErrGrantNotFound struct{}
+
+func (e *ErrGrantNotFound) Error() string {
+	return "GrantNotFound"
+}
+
+type ErrAccessDenied struct{}
+
+func (e *ErrAccessDenied) Error() string {
+	return "AccessDenied"
+}
+
+const (
+	AccessRead      = "read"
+	AccessReadWrite = "readwrite"
+)
+
+// Grant gives another account access to a single key. Grants are removed
+// together with the key.
+type Grant struct {
+	Grantee   string    `json:"grantee"`
+	Access    string    `json:"access"`
+	GrantedAt time.Time `json:"grantedAt"`
+}
+
+// SharedKey is a key of another account the grantee has access to
+type SharedKey struct {
+	Owner     string    `json:"owner"`
+	Bucket    string    `json:"bucket"`
+	Key       string    `json:"key"`
+	Access    string    `json:"access"`
+	GrantedAt time.Time `json:"grantedAt"`
+}
+
+// grantPrefix is shared by all grants of a key
+func grantPrefix(identifier string, key string) string {
+	encodedKey := base64.StdEncoding.EncodeToString([]byte(key))
+	return fmt.Sprintf("%s-grant-%s-", encodeScope(identifier), encodedKey)
+}
+
+// grantKey is stored with the key of the owner
+func grantKey(identifier string, key string, grantee string) string {
+	return grantPrefix(identifier, key) + state.EncodeIdentifier(grantee)
+}
+
+// sharedIndexPrefix contains `-`, so it never collides with the keys of an
+// account, which start with a base64 encoded identifier. The records must
+// not be stored below the prefix of the grantee: passwordless accepts any
+// value stored there as a login token.
+const sharedIndexPrefix = "shared-"
+
+// sharedPrefix is shared by all keys shared with the grantee
+func sharedPrefix(grantee string) string {
+	return fmt.Sprintf("%s%s-", sharedIndexPrefix, state.EncodeIdentifier(grantee))
+}
+
+// sharedKey is ordered by the grantee, so the keys shared with an account
+// can be listed without looking at other accounts. It can outlive the
+// grant if the bucket or the account of the owner is deleted, so the grant
+// is always checked as well.
+func sharedKey(grantee string, identifier string, key string) string {
+	encodedKey := base64.StdEncoding.EncodeToString([]byte(key))
+	return fmt.Sprintf("%s%s-%s", sharedPrefix(grantee), encodeScope(identifier), encodedKey)
+}
+
+// grantForKey returns nil if the grantee has no access
+func grantForKey(identifier string, key string, grantee string, txn *badger.Txn) (*Grant, error) {
+	item, err := txn.Get([]byte(grantKey(identifier, key, grantee)))
+	if err != nil {
+		if err == badger.ErrKeyNotFound {
+			return nil, nil
+		}
+		return nil, err
+	}
+	var grant Grant
+	err = item.Value(func(v []byte) error {
+		return json.Unmarshal(v, &grant)
+	})
+	if err != nil {
+		return nil, err
+	}
+	return &grant, nil
+}
+
+func grantsForKey(identifier string, key string, txn *badger.Txn) ([]Grant, error) {
+	grants := []Grant{}
+	prefix := []byte(grantPrefix(identifier, key))
+	it := txn.NewIterator(badger.DefaultIteratorOptions)
+	defer it.Close()
+	for it.Seek(prefix); it.ValidForPrefix(prefix); it.Next() {
+		var grant Grant
+		err := it.Item().Value(func(v []byte) error {
+			return json.Unmarshal(v, &grant)
+		})
+		if err != nil {
+			return nil, err
+		}
+		grants = append(grants, grant)
+	}
+	return grants, nil
+}
+
+// deleteGrantsForKey is called whenever a key is deleted, so a new key
+// with the same name is not shared
+func deleteGrantsForKey(identifier string, key string, txn *badger.Txn) error {
+	grants, err := grantsForKey(identifier, key, txn)
+	if err != nil {
+		return err
+	}
+	for _, grant := range grants {
+		err = txn.Delete([]byte(grantKey(identifier, key, grant.Grantee)))
+		if err != nil {
+			return err
+		}
+		err = txn.Delete([]byte(sharedKey(grant.Grantee, identifier, key)))
+		if err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// checkAccess returns ErrAccessDenied if the grantee has no grant for the
+// key or needs write access but only has read access
+func checkAccess(identifier string, key string, grantee string, access string, txn *badger.Txn) error {
+	grant, err := grantForKey(identifier, key, grantee, txn)
+	if err != nil {
+		return err
+	}
+	if grant == nil || (access == AccessReadWrite && grant.Access != AccessReadWrite) {
+		return &ErrAccessDenied{}
+	}
+	return nil
+}
+
+// GrantAccessForIdentifier shares an existing key with the grantee or
+// changes the access of an existing grant
+func GrantAccessForIdentifier(s *state.State, identifier string, key string, grantee string, access string) (Grant, error) {
+	grant := Grant{
+		Grantee:   grantee,
+		Access:    access,
+		GrantedAt: time.Now(),
+	}
+	owner, bucket := splitIdentifier(identifier)
+	if access != AccessRead && access != AccessReadWrite {
+		return Grant{}, &ErrInvalidGrant{}
+	}
+	if len(grantee) == 0 || grantee == owner || strings.Contains(grantee, bucketSeparator) {
+		return Grant{}, &ErrInvalidGrant{}
+	}
+	err := s.DB.Update(func(txn *badger.Txn) error {
+		_, err := metadataForKey(identifier, key, txn)
+		if err != nil {
+			return err
+		}
+		encodedGrant, err := json.Marshal(grant)
+		if err != nil {
+			return err
+		}
+		err = txn.Set([]byte(grantKey(identifier, key, grantee)), encodedGrant)
+		if err != nil {
+			return err
+		}
+		encodedShared, err := json.Marshal(SharedKey{
+			Owner:     owner,
+			Bucket:    bucket,
+			Key:       key,
+			Access:    access,
+			GrantedAt: grant.GrantedAt,
+		})
+		if err != nil {
+			return err
+		}
+		return txn.Set([]byte(sharedKey(grantee, identifier, key)), encodedShared)
+	})
+	return grant, err
+}
+
+func RevokeAccessForIdentifier(s *state.State, identifier string, key string, grantee string) error {
+	return s.DB.Update(func(txn *badger.Txn) error {
+		grant, err := grantForKey(identifier, key, grantee, txn)
+		if err != nil {
+			return err
+		}
+		if grant == nil {
+			return &ErrGrantNotFound{}
+		}
+		err = txn.Delete([]byte(grantKey(identifier, key, grantee)))
+		if err != nil {
+			return err
+		}
+		return txn.Delete([]byte(sharedKey(grantee, identifier, key)))
+	})
+}
+
+func GrantsForIdentifierAndKey(s *state.State, identifier string, key string) ([]Grant, error) {
+	var grants []Grant
+	err := s.DB.View(func(txn *badger.Txn) error {
+		_, err := metadataForKey(identifier, key, txn)
+		if err != nil {
+			return err
+		}
+		grants, err = grantsForKey(identifier, key, txn)
+		return err
+	})
+	return grants, err
+}
+
+// SharedKeysForIdentifier lists the keys of other accounts the identifier
+// has access to
+func SharedKeysForIdentifier(s *state.State, identifier string) ([]SharedKey, error) {
+	sharedKeys := []SharedKey{}
+	identifier, _ = splitIdentifier(identifier)
+	prefix := []byte(sharedPrefix(identifier))
+	err := s.DB.View(func(txn *badger.Txn) error {
+		it := txn.NewIterator(badger.DefaultIteratorOptions)
+		defer it.Close()
+		for it.Seek(prefix); it.ValidForPrefix(prefix); it.Next() {
+			var shared SharedKey
+			err := it.Item().Value(func(v []byte) error {
+				return json.Unmarshal(v, &shared)
+			})
+			if err != nil {
+				return err
+			}
+			owner, err := scopedIdentifier(shared.Owner, shared.Bucket)
+			if err != nil {
+				return err
+			}
+			grant, err := grantForKey(owner, shared.Key, identifier, txn)
+			if err != nil {
+				return err
+			}
+			if grant == nil {
+				continue
+			}
+			shared.Access = grant.Access
+			sharedKeys = append(sharedKeys, shared)
+		}
+		return nil
+	})
+	return sharedKeys, err
+}
+
+// OpenSharedVersionForIdentifierAndKey opens a version of a key of the
+// owner on behalf of the grantee
+func OpenSharedVersionForIdentifierAndKey(s *state.State, grantee string, owner string, key string, version uint64) (*ValueReader, ValueVersion, error) {
+	txn := s.DB.NewTransaction(false)
+	err := checkAccess(owner, key, grantee, AccessRead, txn)
+	if err != nil {
+		txn.Discard()
+		return nil, ValueVersion{}, err
+	}
+	return openVersion(owner, key, version, txn)
+}
+
+// InsertSharedKeyValueFromReader replaces the value of a key of the owner
+// on behalf of the grantee. The value counts against the limits of the
+// owner.
+func InsertSharedKeyValueFromReader(s *state.State, config Config, grantee string, owner string, key string, reader io.Reader, options InsertOptions) (ValueVersion, error) {
+	options.grantee, _ = splitIdentifier(grantee)
+	options.CreateOnly = false
+	// checked before the value is read, the transaction that writes the
+	// value checks the access again
+	err := s.DB.View(func(txn *badger.Txn) error {
+		return checkAccess(owner, key, options.grantee, AccessReadWrite, txn)
+	})
+	if err != nil {
+		return ValueVersion{}, err
+	}
+	return InsertKeyValueFromReader(s, config, owner, key, reader, options)
+}
@@ -0,0 +1,159 @@
+package main
+
+import (
+	"bytes"
+	"io/ioutil"
+	"testing"
+
+	"github.com/dgraph-io/badger/v3"
+	"github.com/mguentner/passwordless/state"
+)
+
+func TestSharing(t *testing.T) {
+	config := DefaultConfig()
+	db, err := badger.Open(badger.DefaultOptions("").WithInMemory(true))
+	if err != nil {
+		t.Fatal(err)
+	}
+	appState := state.State{
+		DB: db,
+	}
+	_, err = InsertKeyValueForIdentifier(&appState, config, "alice@example.com", "doc", []byte("alice"))
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	_, err = GrantAccessForIdentifier(&appState, "alice@example.com", "missing", "bob@example.com", AccessRead)
+	if _, ok := err.(*ErrKeyNotFound); !ok {
+		t.Errorf("Expected ErrKeyNotFound, got %v", err)
+	}
+	for _, grantee := range []string{"", "alice@example.com", "bob@example.com" + bucketSeparator + "files"} {
+		_, err = GrantAccessForIdentifier(&appState, "alice@example.com", "doc", grantee, AccessRead)
+		if _, ok := err.(*ErrInvalidGrant); !ok {
+			t.Errorf("Expected ErrInvalidGrant for %q, got %v", grantee, err)
+		}
+	}
+	_, err = GrantAccessForIdentifier(&appState, "alice@example.com", "doc", "bob@example.com", "write")
+	if _, ok := err.(*ErrInvalidGrant); !ok {
+		t.Errorf("Expected ErrInvalidGrant, got %v", err)
+	}
+
+	_, _, err = OpenSharedVersionForIdentifierAndKey(&appState, "bob@example.com", "alice@example.com", "doc", 0)
+	if _, ok := err.(*ErrAccessDenied); !ok {
+		t.Errorf("Expected ErrAccessDenied before the grant, got %v", err)
+	}
+	_, err = GrantAccessForIdentifier(&appState, "alice@example.com", "doc", "bob@example.com", AccessRead)
+	if err != nil {
+		t.Fatal(err)
+	}
+	reader, _, err := OpenSharedVersionForIdentifierAndKey(&appState, "bob@example.com", "alice@example.com", "doc", 0)
+	if err != nil {
+		t.Fatal(err)
+	}
+	value, err := ioutil.ReadAll(reader)
+	reader.Close()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if string(value) != "alice" {
+		t.Errorf("Expected alice, got %s", value)
+	}
+	_, _, err = OpenSharedVersionForIdentifierAndKey(&appState, "carol@example.com", "alice@example.com", "doc", 0)
+	if _, ok := err.(*ErrAccessDenied); !ok {
+		t.Errorf("Expected ErrAccessDenied for carol, got %v", err)
+	}
+	_, err = InsertSharedKeyValueFromReader(&appState, config, "bob@example.com", "alice@example.com", "doc", bytes.NewBufferString("bob"), InsertOptions{})
+	if _, ok := err.(*ErrAccessDenied); !ok {
+		t.Errorf("Expected ErrAccessDenied for read access, got %v", err)
+	}
+
+	_, err = GrantAccessForIdentifier(&appState, "alice@example.com", "doc", "bob@example.com", AccessReadWrite)
+	if err != nil {
+		t.Fatal(err)
+	}
+	_, err = InsertSharedKeyValueFromReader(&appState, config, "bob@example.com", "alice@example.com", "doc", bytes.NewBufferString("bob"), InsertOptions{})
+	if err != nil {
+		t.Fatal(err)
+	}
+	value, err = RetrieveValueIdentifierAndKey(&appState, "alice@example.com", "doc")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if string(value) != "bob" {
+		t.Errorf("Expected bob, got %s", value)
+	}
+	_, err = InsertSharedKeyValueFromReader(&appState, config, "bob@example.com", "alice@example.com", "other", bytes.NewBufferString("bob"), InsertOptions{})
+	if _, ok := err.(*ErrAccessDenied); !ok {
+		t.Errorf("Expected ErrAccessDenied for a key without grant, got %v", err)
+	}
+
+	grants, err := GrantsForIdentifierAndKey(&appState, "alice@example.com", "doc")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(grants) != 1 || grants[0].Grantee != "bob@example.com" || grants[0].Access != AccessReadWrite {
+		t.Errorf("Unexpected grants %+v", grants)
+	}
+	shared, err := SharedKeysForIdentifier(&appState, "bob@example.com")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(shared) != 1 || shared[0].Owner != "alice@example.com" || shared[0].Key != "doc" || shared[0].Bucket != DefaultBucket {
+		t.Errorf("Unexpected shared keys %+v", shared)
+	}
+
+	err = RevokeAccessForIdentifier(&appState, "alice@example.com", "doc", "bob@example.com")
+	if err != nil {
+		t.Fatal(err)
+	}
+	err = RevokeAccessForIdentifier(&appState, "alice@example.com", "doc", "bob@example.com")
+	if _, ok := err.(*ErrGrantNotFound); !ok {
+		t.Errorf("Expected ErrGrantNotFound, got %v", err)
+	}
+	shared, err = SharedKeysForIdentifier(&appState, "bob@example.com")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(shared) != 0 {
+		t.Errorf("Expected no shared keys after the revocation, got %+v", shared)
+	}
+}
+
+func TestSharingDeletedKey(t *testing.T) {
+	config := DefaultConfig()
+	db, err := badger.Open(badger.DefaultOptions("").WithInMemory(true))
+	if err != nil {
+		t.Fatal(err)
+	}
+	appState := state.State{
+		DB: db,
+	}
+	_, err = InsertKeyValueForIdentifier(&appState, config, "alice@example.com", "doc", []byte("alice"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	_, err = GrantAccessForIdentifier(&appState, "alice@example.com", "doc", "bob@example.com", AccessRead)
+	if err != nil {
+		t.Fatal(err)
+	}
+	err = DeleteKeyValueForIdentifier(&appState, config, "alice@example.com", "doc")
+	if err != nil {
+		t.Fatal(err)
+	}
+	// a new key with the same name must not be shared
+	_, err = InsertKeyValueForIdentifier(&appState, config, "alice@example.com", "doc", []byte("private"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	_, _, err = OpenSharedVersionForIdentifierAndKey(&appState, "bob@example.com", "alice@example.com", "doc", 0)
+	if _, ok := err.(*ErrAccessDenied); !ok {
+		t.Errorf("Expected ErrAccessDenied, got %v", err)
+	}
+	shared, err := SharedKeysForIdentifier(&appState, "bob@example.com")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(shared) != 0 {
+		t.Errorf("Expected no shared keys, got %+v", shared)
+	}
+}
@@ -3,11 +3,25 @@ package main
 import "github.com/mguentner/passwordless/test"
 
 func DefaultConfig() Config {
-	return Config{
+	config := Config{
 		Config: test.DefaultConfig(),
 		StorageOptions: StorageOptions{
-			MaxKeysPerAccount: 0,
-			MaxValueSizeBytes: 0,
+			MaxKeysPerAccount:      0,
+			MaxValueSizeBytes:      0,
+			MaxBytesPerAccount:     0,
+			MaxVersionsPerKey:      0,
+			MaxTTLSeconds:          0,
+			AllowedContentTypes:    []string{},
+			ChunkSizeBytes:         0,
+			MaxBucketsPerAccount:   0,
+			TrashRetentionSeconds:  0,
+			MaxLinkLifetimeSeconds: 0,
+			ChangeRetentionSeconds: 0,
+			Compression:            "",
 		},
 	}
+	// access tokens expire at the end of the second they were created in
+	// otherwise
+	config.AccessTokenLifetimeSeconds = 600
+	return config
 }
@@ -0,0 +1,382 @@
+package main
+
+import (
+	"encoding/base64"
+	"encoding/json"
+	"fmt"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/dgraph-io/badger/v3"
+	"github.com/mguentner/passwordless/state"
+	"github.com/rs/zerolog/log"
+)
+
+// trashPurgeInterval is how often trashed keys past their retention are
+// removed
+const trashPurgeInterval = time.Minute
+
+// trashIndexPrefix contains `-`, so it never collides with the keys of an
+// account, which start with a base64 encoded identifier
+const trashIndexPrefix = "trash-"
+
+// TrashedKey describes the value of a deleted key. Only the current
+// value is kept, previous versions are removed when the key is deleted.
+type TrashedKey struct {
+	Key       string       `json:"key"`
+	DeletedAt time.Time    `json:"deletedAt"`
+	PurgeAt   time.Time    `json:"purgeAt"`
+	Version   ValueVersion `json:"version"`
+}
+
+func trashKeyForScope(encodedScope string, encodedKey string) string {
+	return fmt.Sprintf("%s-trash-%s", encodedScope, encodedKey)
+}
+
+func trashValueKeyForScope(encodedScope string, encodedKey string) string {
+	return fmt.Sprintf("%s-trashvalue-%s", encodedScope, encodedKey)
+}
+
+// trashIndexKey orders the trashed keys of all accounts by the time they
+// are purged, so the purge does not have to look at any other keys
+func trashIndexKey(purgeAt time.Time, encodedScope string, encodedKey string) string {
+	return fmt.Sprintf("%s%020d-%s-%s", trashIndexPrefix, purgeAt.UnixNano(), encodedScope, encodedKey)
+}
+
+func trashedKeyForScope(encodedScope string, encodedKey string, txn *badger.Txn) (*TrashedKey, error) {
+	item, err := txn.Get([]byte(trashKeyForScope(encodedScope, encodedKey)))
+	if err != nil {
+		if err == badger.ErrKeyNotFound {
+			return nil, &ErrKeyNotFound{}
+		}
+		return nil, err
+	}
+	var trashed TrashedKey
+	err = item.Value(func(v []byte) error {
+		return json.Unmarshal(v, &trashed)
+	})
+	if err != nil {
+		return nil, err
+	}
+	return &trashed, nil
+}
+
+// removeTrashedKey deletes a trashed key and releases its usage. The
+// chunks of its value are only deleted if releaseValue is set.
+func removeTrashedKey(encodedScope string, encodedKey string, trashed *TrashedKey, releaseValue bool, txn *badger.Txn) error {
+	err := updateStoredUsage(encodedScope, usagePiecesForTrash(encodedKey, trashed), nil, txn)
+	if err != nil {
+		return err
+	}
+	valueKey := []byte(trashValueKeyForScope(encodedScope, encodedKey))
+	if releaseValue {
+		item, err := txn.Get(valueKey)
+		if err != nil && err != badger.ErrKeyNotFound {
+			return err
+		}
+		if err == nil {
+			manifest, err := manifestForItem(item)
+			if err != nil {
+				return err
+			}
+			if manifest != nil {
+				err = deleteChunks(encodedScope, *manifest, txn)
+				if err != nil {
+					return err
+				}
+			}
+		}
+	}
+	err = txn.Delete(valueKey)
+	if err != nil {
+		return err
+	}
+	err = txn.Delete([]byte(trashIndexKey(trashed.PurgeAt, encodedScope, encodedKey)))
+	if err != nil {
+		return err
+	}
+	return txn.Delete([]byte(trashKeyForScope(encodedScope, encodedKey)))
+}
+
+// trashKeyValue moves the current value of a key to the trash and deletes
+// the key. A value that was trashed before under the same key is
+// replaced. Without a retention the key is deleted permanently.
+func trashKeyValue(config Config, identifier string, key string, preconditions Preconditions, txn *badger.Txn) error {
+	retention := time.Duration(config.StorageOptions.TrashRetentionSeconds) * time.Second
+	if retention == 0 {
+		return deleteKeyValue(config, identifier, key, preconditions, txn)
+	}
+	metadata, err := metadataForKey(identifier, key, txn)
+	if err != nil {
+		if _, ok := err.(*ErrKeyNotFound); !ok {
+			return err
+		}
+		metadata = nil
+	}
+	err = preconditions.check(metadata)
+	if err != nil {
+		return err
+	}
+	if metadata == nil {
+		return &ErrKeyNotFound{}
+	}
+	encodedScope := encodeScope(identifier)
+	encodedKey := base64.StdEncoding.EncodeToString([]byte(key))
+	previous, err := trashedKeyForScope(encodedScope, encodedKey, txn)
+	if err != nil {
+		if _, ok := err.(*ErrKeyNotFound); !ok {
+			return err
+		}
+		previous = nil
+	}
+	if previous != nil {
+		err = removeTrashedKey(encodedScope, encodedKey, previous, true, txn)
+		if err != nil {
+			return err
+		}
+	}
+	now := time.Now()
+	trashed := TrashedKey{
+		Key:       key,
+		DeletedAt: now,
+		PurgeAt:   now.Add(retention),
+		Version:   metadata.ValueVersion,
+	}
+	// the trashed value keeps counting against the limits
+	err = updateUsage(identifier, usagePiecesForKey(key, metadata), usagePiecesForTrash(encodedKey, &trashed), txn)
+	if err != nil {
+		return err
+	}
+	item, err := txn.Get([]byte(fullKey(identifier, key)))
+	if err != nil {
+		return err
+	}
+	entry, err := item.ValueCopy(nil)
+	if err != nil {
+		return err
+	}
+	manifest, err := manifestForItem(item)
+	if err != nil {
+		return err
+	}
+	// the chunks of the trashed value are kept, the chunks that are only
+	// referenced by previous versions are released
+	referencedChunks, err := manifestsForKey(identifier, key, metadata, txn)
+	if err != nil {
+		return err
+	}
+	trashedChunks := map[string]chunkManifest{}
+	if manifest != nil {
+		trashedChunks[manifest.ID] = *manifest
+	}
+	err = releaseChunks(identifier, referencedChunks, trashedChunks, txn)
+	if err != nil {
+		return err
+	}
+	err = deleteGrantsForKey(identifier, key, txn)
+	if err != nil {
+		return err
+	}
+	err = deleteLinksForKey(identifier, key, txn)
+	if err != nil {
+		return err
+	}
+	for _, previous := range metadata.History {
+		err = txn.Delete([]byte(versionKey(identifier, key, previous.Version)))
+		if err != nil {
+			return err
+		}
+	}
+	err = txn.Delete([]byte(metadataKey(identifier, key)))
+	if err != nil {
+		return err
+	}
+	err = txn.Delete([]byte(fullKey(identifier, key)))
+	if err != nil {
+		return err
+	}
+	err = recordChange(config, identifier, Change{Type: ChangeDelete, Key: key}, txn)
+	if err != nil {
+		return err
+	}
+	encodedTrashed, err := json.Marshal(trashed)
+	if err != nil {
+		return err
+	}
+	// a value with a TTL still expires while it is in the trash
+	valueEntry := badger.NewEntry([]byte(trashValueKeyForScope(encodedScope, encodedKey)), entry).WithMeta(item.UserMeta())
+	valueEntry.ExpiresAt = item.ExpiresAt()
+	err = txn.SetEntry(valueEntry)
+	if err != nil {
+		return err
+	}
+	trashedEntry := badger.NewEntry([]byte(trashKeyForScope(encodedScope, encodedKey)), encodedTrashed)
+	trashedEntry.ExpiresAt = item.ExpiresAt()
+	err = txn.SetEntry(trashedEntry)
+	if err != nil {
+		return err
+	}
+	return txn.Set([]byte(trashIndexKey(trashed.PurgeAt, encodedScope, encodedKey)), []byte{})
+}
+
+// TrashKeyValueForIdentifier deletes a key and keeps its value in the
+// trash for StorageOptions.TrashRetentionSeconds
+func TrashKeyValueForIdentifier(s *state.State, config Config, identifier string, key string, preconditions Preconditions) error {
+	return updateRetryingConflicts(s, func(txn *badger.Txn) error {
+		return trashKeyValue(config, identifier, key, preconditions, txn)
+	})
+}
+
+// TrashForIdentifier lists the trashed keys ordered by their base64
+// encoded name
+func TrashForIdentifier(s *state.State, identifier string) ([]TrashedKey, error) {
+	trash := []TrashedKey{}
+	prefix := []byte(trashKeyForScope(encodeScope(identifier), ""))
+	err := s.DB.View(func(txn *badger.Txn) error {
+		it := txn.NewIterator(badger.DefaultIteratorOptions)
+		defer it.Close()
+		for it.Seek(prefix); it.ValidForPrefix(prefix); it.Next() {
+			var trashed TrashedKey
+			err := it.Item().Value(func(v []byte) error {
+				return json.Unmarshal(v, &trashed)
+			})
+			if err != nil {
+				return err
+			}
+			trash = append(trash, trashed)
+		}
+		return nil
+	})
+	return trash, err
+}
+
+// RestoreTrashedKeyForIdentifier stores the trashed value as the first
+// version of the key again. It fails with ErrKeyExists if the key was
+// created again in the meantime.
+func RestoreTrashedKeyForIdentifier(s *state.State, config Config, identifier string, key string) (ValueVersion, error) {
+	var version ValueVersion
+	encodedScope := encodeScope(identifier)
+	encodedKey := base64.StdEncoding.EncodeToString([]byte(key))
+	err := updateRetryingConflicts(s, func(txn *badger.Txn) error {
+		trashed, err := trashedKeyForScope(encodedScope, encodedKey, txn)
+		if err != nil {
+			return err
+		}
+		item, err := txn.Get([]byte(trashValueKeyForScope(encodedScope, encodedKey)))
+		if err != nil {
+			if err == badger.ErrKeyNotFound {
+				return &ErrKeyNotFound{}
+			}
+			return err
+		}
+		entry, err := item.ValueCopy(nil)
+		if err != nil {
+			return err
+		}
+		value := storedValue{
+			entry:     entry,
+			userMeta:  item.UserMeta(),
+			size:      trashed.Version.Size,
+			etag:      trashed.Version.ETag,
+			expiresAt: item.ExpiresAt(),
+		}
+		options := InsertOptions{
+			CreateOnly:      true,
+			ContentType:     trashed.Version.ContentType,
+			ContentEncoding: trashed.Version.ContentEncoding,
+			Filename:        trashed.Version.Filename,
+		}
+		// the trashed value is removed first, so its usage is not
+		// counted twice by the limits. The chunks are referenced by the
+		// restored value.
+		err = removeTrashedKey(encodedScope, encodedKey, trashed, false, txn)
+		if err != nil {
+			return err
+		}
+		v, err := insertKeyValue(config, identifier, key, value, options, txn)
+		if err != nil {
+			return err
+		}
+		version = *v
+		return nil
+	})
+	return version, err
+}
+
+// purgeTrashIndexKey removes the trashed key referenced by an index key.
+// Index keys of values that were restored, trashed again or removed
+// together with their bucket are stale and only deleted.
+func purgeTrashIndexKey(indexKey string, txn *badger.Txn) error {
+	parts := strings.SplitN(strings.TrimPrefix(indexKey, trashIndexPrefix), "-", 3)
+	if len(parts) != 3 {
+		return txn.Delete([]byte(indexKey))
+	}
+	purgeAt, err := strconv.ParseInt(parts[0], 10, 64)
+	if err != nil {
+		return txn.Delete([]byte(indexKey))
+	}
+	encodedScope, encodedKey := parts[1], parts[2]
+	trashed, err := trashedKeyForScope(encodedScope, encodedKey, txn)
+	if err != nil {
+		if _, ok := err.(*ErrKeyNotFound); !ok {
+			return err
+		}
+		trashed = nil
+	}
+	if trashed == nil || trashed.PurgeAt.UnixNano() != purgeAt {
+		return txn.Delete([]byte(indexKey))
+	}
+	return removeTrashedKey(encodedScope, encodedKey, trashed, true, txn)
+}
+
+// PurgeTrash removes all trashed keys that were deleted more than their
+// retention ago and returns how many index keys were processed. Every key
+// is purged in its own transaction.
+func PurgeTrash(s *state.State, now time.Time) (int, error) {
+	indexKeys := []string{}
+	end := fmt.Sprintf("%s%020d", trashIndexPrefix, now.UnixNano())
+	err := s.DB.View(func(txn *badger.Txn) error {
+		opts := badger.DefaultIteratorOptions
+		opts.PrefetchValues = false
+		it := txn.NewIterator(opts)
+		defer it.Close()
+		prefix := []byte(trashIndexPrefix)
+		for it.Seek(prefix); it.ValidForPrefix(prefix); it.Next() {
+			key := string(it.Item().Key())
+			if key > end {
+				break
+			}
+			indexKeys = append(indexKeys, key)
+		}
+		return nil
+	})
+	if err != nil {
+		return 0, err
+	}
+	for i, indexKey := range indexKeys {
+		err = s.DB.Update(func(txn *badger.Txn) error {
+			return purgeTrashIndexKey(indexKey, txn)
+		})
+		if err != nil {
+			return i, err
+		}
+	}
+	return len(indexKeys), nil
+}
+
+// purgeTrashPeriodically runs until the process exits
+func purgeTrashPeriodically(s *state.State) {
+	ticker := time.NewTicker(trashPurgeInterval)
+	defer ticker.Stop()
+	for now := range ticker.C {
+		purged, err := PurgeTrash(s, now)
+		if err != nil {
+			log.Error().Msgf("Could not purge trash: %v", err)
+			continue
+		}
+		if purged > 0 {
+			log.Debug().Msgf("Purged %d trashed keys", purged)
+		}
+	}
+}
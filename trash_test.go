@@ -0,0 +1,205 @@
+package main
+
+import (
+	"bytes"
+	"testing"
+	"time"
+
+	"github.com/dgraph-io/badger/v3"
+	"github.com/mguentner/passwordless/state"
+)
+
+func TestTrash(t *testing.T) {
+	config := DefaultConfig()
+	config.StorageOptions.TrashRetentionSeconds = 3600
+	config.StorageOptions.MaxVersionsPerKey = 2
+	db, err := badger.Open(badger.DefaultOptions("").WithInMemory(true))
+	if err != nil {
+		t.Fatal(err)
+	}
+	appState := state.State{
+		DB: db,
+	}
+	_, err = InsertKeyValueForIdentifier(&appState, config, "alice@example.com", "needle", []byte("first"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	_, err = InsertKeyValueForIdentifier(&appState, config, "alice@example.com", "needle", []byte("second"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	err = TrashKeyValueForIdentifier(&appState, config, "alice@example.com", "needle", Preconditions{})
+	if err != nil {
+		t.Fatal(err)
+	}
+	_, err = RetrieveValueIdentifierAndKey(&appState, "alice@example.com", "needle")
+	if _, ok := err.(*ErrKeyNotFound); !ok {
+		t.Errorf("Expected ErrKeyNotFound, got %v", err)
+	}
+	usage, err := AccountUsageForIdentifier(&appState, "alice@example.com")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if usage.Keys != 1 || usage.Bytes != 6 {
+		t.Errorf("Expected only the trashed value to be counted, got %+v", usage)
+	}
+	trash, err := TrashForIdentifier(&appState, "alice@example.com")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(trash) != 1 || trash[0].Key != "needle" || trash[0].Version.Size != 6 {
+		t.Errorf("Unexpected trash %+v", trash)
+	}
+	version, err := RestoreTrashedKeyForIdentifier(&appState, config, "alice@example.com", "needle")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if version.Version != 1 || version.ETag != trash[0].Version.ETag {
+		t.Errorf("Unexpected version %+v", version)
+	}
+	value, err := RetrieveValueIdentifierAndKey(&appState, "alice@example.com", "needle")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if string(value) != "second" {
+		t.Errorf("Expected second, got %s", value)
+	}
+	versions, err := VersionsForIdentifierAndKey(&appState, "alice@example.com", "needle")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(versions) != 1 {
+		t.Errorf("Expected the history to be removed, got %+v", versions)
+	}
+	_, err = RestoreTrashedKeyForIdentifier(&appState, config, "alice@example.com", "needle")
+	if _, ok := err.(*ErrKeyNotFound); !ok {
+		t.Errorf("Expected ErrKeyNotFound, got %v", err)
+	}
+
+	// without a retention keys are deleted immediately
+	config.StorageOptions.TrashRetentionSeconds = 0
+	err = TrashKeyValueForIdentifier(&appState, config, "alice@example.com", "needle", Preconditions{})
+	if err != nil {
+		t.Fatal(err)
+	}
+	trash, err = TrashForIdentifier(&appState, "alice@example.com")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(trash) != 0 {
+		t.Errorf("Expected an empty trash, got %+v", trash)
+	}
+}
+
+func TestPurgeTrash(t *testing.T) {
+	config := DefaultConfig()
+	config.StorageOptions.TrashRetentionSeconds = 3600
+	config.StorageOptions.ChunkSizeBytes = 4
+	db, err := badger.Open(badger.DefaultOptions("").WithInMemory(true))
+	if err != nil {
+		t.Fatal(err)
+	}
+	appState := state.State{
+		DB: db,
+	}
+	_, err = InsertKeyValueFromReader(&appState, config, "alice@example.com", "large", bytes.NewBufferString("0123456789"), InsertOptions{})
+	if err != nil {
+		t.Fatal(err)
+	}
+	err = TrashKeyValueForIdentifier(&appState, config, "alice@example.com", "large", Preconditions{})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if chunks := countChunks(t, &appState, "alice@example.com"); chunks != 3 {
+		t.Errorf("Expected the chunks of the trashed value to be kept, got %d", chunks)
+	}
+	purged, err := PurgeTrash(&appState, time.Now())
+	if err != nil {
+		t.Fatal(err)
+	}
+	if purged != 0 {
+		t.Errorf("Expected nothing to be purged before the retention, got %d", purged)
+	}
+	// restoring and deleting again leaves a stale index key behind
+	_, err = RestoreTrashedKeyForIdentifier(&appState, config, "alice@example.com", "large")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if string(readCurrentValue(t, &appState, "alice@example.com", "large")) != "0123456789" {
+		t.Error("Unexpected restored value")
+	}
+	err = TrashKeyValueForIdentifier(&appState, config, "alice@example.com", "large", Preconditions{})
+	if err != nil {
+		t.Fatal(err)
+	}
+	purged, err = PurgeTrash(&appState, time.Now().Add(2*time.Hour))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if purged != 1 {
+		t.Errorf("Expected one purged key, got %d", purged)
+	}
+	trash, err := TrashForIdentifier(&appState, "alice@example.com")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(trash) != 0 {
+		t.Errorf("Expected an empty trash, got %+v", trash)
+	}
+	if chunks := countChunks(t, &appState, "alice@example.com"); chunks != 0 {
+		t.Errorf("Expected the chunks to be purged, got %d", chunks)
+	}
+	usage, err := UsageForIdentifier(&appState, "alice@example.com")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if usage.Keys != 0 || usage.Bytes != 0 {
+		t.Errorf("Expected the usage to be released by the purge, got %+v", usage)
+	}
+}
+
+func TestTrashLimits(t *testing.T) {
+	config := DefaultConfig()
+	config.StorageOptions.TrashRetentionSeconds = 3600
+	config.StorageOptions.MaxKeysPerAccount = 2
+	config.StorageOptions.MaxBytesPerAccount = 10
+	db, err := badger.Open(badger.DefaultOptions("").WithInMemory(true))
+	if err != nil {
+		t.Fatal(err)
+	}
+	appState := state.State{
+		DB: db,
+	}
+	_, err = InsertKeyValueForIdentifier(&appState, config, "alice@example.com", "a", []byte("123456"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	err = TrashKeyValueForIdentifier(&appState, config, "alice@example.com", "a", Preconditions{})
+	if err != nil {
+		t.Fatal(err)
+	}
+	_, err = InsertKeyValueForIdentifier(&appState, config, "alice@example.com", "b", []byte("12345"))
+	if _, ok := err.(*ErrQuotaExceeded); !ok {
+		t.Errorf("Expected ErrQuotaExceeded, got %v", err)
+	}
+	_, err = InsertKeyValueForIdentifier(&appState, config, "alice@example.com", "b", []byte("1234"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	_, err = InsertKeyValueForIdentifier(&appState, config, "alice@example.com", "c", []byte(""))
+	if _, ok := err.(*ErrKeyLimitReached); !ok {
+		t.Errorf("Expected ErrKeyLimitReached, got %v", err)
+	}
+	// the restored value replaces its trashed copy in the usage
+	_, err = RestoreTrashedKeyForIdentifier(&appState, config, "alice@example.com", "a")
+	if err != nil {
+		t.Fatal(err)
+	}
+	usage, err := UsageForIdentifier(&appState, "alice@example.com")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if usage.Keys != 2 || usage.Bytes != 10 {
+		t.Errorf("Unexpected usage %+v", usage)
+	}
+}
@@ -0,0 +1,321 @@
+package main
+
+import (
+	"encoding/base64"
+	"encoding/json"
+	"fmt"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/dgraph-io/badger/v3"
+)
+
+// The usage of every bucket is stored as a counter that is updated in the
+// same transaction as the keys, so checking the limits does not have to
+// look at every key. Versions that expire are counted as well and
+// recorded in an expiry index of the bucket, which releases their usage
+// once they expired.
+
+// usagePiece is the usage of a single version of a key. Only the current
+// version counts against the key limit.
+type usagePiece struct {
+	id        string
+	usage     Usage
+	expiresAt *time.Time
+}
+
+func usageKey(encodedScope string) string {
+	return fmt.Sprintf("%s-usage", encodedScope)
+}
+
+func expiryPrefix(encodedScope string) string {
+	return fmt.Sprintf("%s-expiry-", encodedScope)
+}
+
+// expiryKey is zero padded so that the index is ordered by the time the
+// version expires
+func expiryKey(encodedScope string, piece usagePiece) string {
+	return fmt.Sprintf("%s%020d-%s", expiryPrefix(encodedScope), piece.expiresAt.Unix(), piece.id)
+}
+
+// usagePiecesForKey returns the pieces of the current value and of all
+// retained versions, metadata is nil for a missing key
+func usagePiecesForKey(key string, metadata *valueMetadata) map[string]usagePiece {
+	pieces := map[string]usagePiece{}
+	if metadata == nil {
+		return pieces
+	}
+	encodedKey := base64.StdEncoding.EncodeToString([]byte(key))
+	current := usagePiece{
+		id:        fmt.Sprintf("key-%s-%d", encodedKey, metadata.Version),
+		usage:     Usage{Keys: 1, Bytes: metadata.Size},
+		expiresAt: metadata.ExpiresAt,
+	}
+	pieces[current.id] = current
+	for _, previous := range metadata.History {
+		piece := usagePiece{
+			id:        fmt.Sprintf("version-%s-%d", encodedKey, previous.Version),
+			usage:     Usage{Bytes: previous.Size},
+			expiresAt: previous.ExpiresAt,
+		}
+		pieces[piece.id] = piece
+	}
+	return pieces
+}
+
+// usagePiecesForTrash returns the piece of a trashed value, which counts
+// against the limits like a key
+func usagePiecesForTrash(encodedKey string, trashed *TrashedKey) map[string]usagePiece {
+	pieces := map[string]usagePiece{}
+	if trashed == nil {
+		return pieces
+	}
+	piece := usagePiece{
+		id:        fmt.Sprintf("trash-%s", encodedKey),
+		usage:     Usage{Keys: 1, Bytes: trashed.Version.Size},
+		expiresAt: trashed.Version.ExpiresAt,
+	}
+	pieces[piece.id] = piece
+	return pieces
+}
+
+func (u *Usage) add(other Usage) {
+	u.Keys += other.Keys
+	u.Bytes += other.Bytes
+}
+
+// subtract stops at 0, so a counter that is off never wraps around
+func (u *Usage) subtract(other Usage) {
+	if other.Keys > u.Keys {
+		other.Keys = u.Keys
+	}
+	if other.Bytes > u.Bytes {
+		other.Bytes = u.Bytes
+	}
+	u.Keys -= other.Keys
+	u.Bytes -= other.Bytes
+}
+
+// expiredUsage calls fn for the usage of every version in the expiry
+// index that expired at now
+func expiredUsage(encodedScope string, now time.Time, txn *badger.Txn, fn func(key []byte, usage Usage) error) error {
+	prefix := []byte(expiryPrefix(encodedScope))
+	it := txn.NewIterator(badger.DefaultIteratorOptions)
+	defer it.Close()
+	for it.Seek(prefix); it.ValidForPrefix(prefix); it.Next() {
+		item := it.Item()
+		parts := strings.SplitN(strings.TrimPrefix(string(item.Key()), string(prefix)), "-", 2)
+		expiresAt, err := strconv.ParseInt(parts[0], 10, 64)
+		if err != nil {
+			return err
+		}
+		if expiresAt > now.Unix() {
+			return nil
+		}
+		var usage Usage
+		err = item.Value(func(v []byte) error {
+			return json.Unmarshal(v, &usage)
+		})
+		if err != nil {
+			return err
+		}
+		err = fn(item.KeyCopy(nil), usage)
+		if err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// countUsage adds a piece to usage, pieces that expire are added to the
+// expiry index as well
+func countUsage(encodedScope string, usage *Usage, piece usagePiece, txn *badger.Txn) error {
+	usage.add(piece.usage)
+	if piece.expiresAt == nil {
+		return nil
+	}
+	encodedUsage, err := json.Marshal(piece.usage)
+	if err != nil {
+		return err
+	}
+	return txn.Set([]byte(expiryKey(encodedScope, piece)), encodedUsage)
+}
+
+// releaseUsage removes a piece from usage. The usage of a piece that
+// expires is only removed if it was not released by the expiry index yet.
+func releaseUsage(encodedScope string, usage *Usage, piece usagePiece, txn *badger.Txn) error {
+	if piece.expiresAt == nil {
+		usage.subtract(piece.usage)
+		return nil
+	}
+	key := []byte(expiryKey(encodedScope, piece))
+	item, err := txn.Get(key)
+	if err == badger.ErrKeyNotFound {
+		return nil
+	}
+	if err != nil {
+		return err
+	}
+	var counted Usage
+	err = item.Value(func(v []byte) error {
+		return json.Unmarshal(v, &counted)
+	})
+	if err != nil {
+		return err
+	}
+	usage.subtract(counted)
+	return txn.Delete(key)
+}
+
+// scanUsage computes the usage of a bucket that has no counter yet, e.g.
+// because it was written before the counters were introduced. If count is
+// set the pieces that expire are added to the expiry index.
+func scanUsage(identifier string, count bool, txn *badger.Txn) (Usage, error) {
+	usage := Usage{}
+	encodedScope := encodeScope(identifier)
+	add := func(pieces map[string]usagePiece) error {
+		for _, piece := range pieces {
+			if !count {
+				usage.add(piece.usage)
+				continue
+			}
+			err := countUsage(encodedScope, &usage, piece, txn)
+			if err != nil {
+				return err
+			}
+		}
+		return nil
+	}
+	for _, key := range keysForIdentifier(identifier, txn) {
+		metadata, err := metadataForKey(identifier, key, txn)
+		if err != nil {
+			if _, ok := err.(*ErrKeyNotFound); ok {
+				continue
+			}
+			return usage, err
+		}
+		err = add(usagePiecesForKey(key, metadata))
+		if err != nil {
+			return usage, err
+		}
+	}
+	prefix := []byte(trashKeyForScope(encodedScope, ""))
+	it := txn.NewIterator(badger.DefaultIteratorOptions)
+	defer it.Close()
+	for it.Seek(prefix); it.ValidForPrefix(prefix); it.Next() {
+		var trashed TrashedKey
+		err := it.Item().Value(func(v []byte) error {
+			return json.Unmarshal(v, &trashed)
+		})
+		if err != nil {
+			return usage, err
+		}
+		encodedKey := strings.TrimPrefix(string(it.Item().Key()), string(prefix))
+		err = add(usagePiecesForTrash(encodedKey, &trashed))
+		if err != nil {
+			return usage, err
+		}
+	}
+	return usage, nil
+}
+
+// storedUsage returns the counter of a bucket, found is false if there is
+// no counter yet
+func storedUsage(encodedScope string, txn *badger.Txn) (usage Usage, found bool, err error) {
+	item, err := txn.Get([]byte(usageKey(encodedScope)))
+	if err == badger.ErrKeyNotFound {
+		return usage, false, nil
+	}
+	if err != nil {
+		return usage, false, err
+	}
+	err = item.Value(func(v []byte) error {
+		return json.Unmarshal(v, &usage)
+	})
+	return usage, true, err
+}
+
+// usageForIdentifier returns the usage of a bucket without the versions
+// that expired, it does not modify the counter
+func usageForIdentifier(identifier string, txn *badger.Txn) (Usage, error) {
+	encodedScope := encodeScope(identifier)
+	usage, found, err := storedUsage(encodedScope, txn)
+	if err != nil {
+		return usage, err
+	}
+	if !found {
+		return scanUsage(identifier, false, txn)
+	}
+	err = expiredUsage(encodedScope, time.Now(), txn, func(key []byte, expired Usage) error {
+		usage.subtract(expired)
+		return nil
+	})
+	return usage, err
+}
+
+// updateUsage applies the changes of a key or trashed value to the
+// counter of its bucket, a missing counter is created first
+func updateUsage(identifier string, before map[string]usagePiece, after map[string]usagePiece, txn *badger.Txn) error {
+	encodedScope := encodeScope(identifier)
+	_, found, err := storedUsage(encodedScope, txn)
+	if err != nil {
+		return err
+	}
+	if !found {
+		usage, err := scanUsage(identifier, true, txn)
+		if err != nil {
+			return err
+		}
+		encodedUsage, err := json.Marshal(usage)
+		if err != nil {
+			return err
+		}
+		err = txn.Set([]byte(usageKey(encodedScope)), encodedUsage)
+		if err != nil {
+			return err
+		}
+	}
+	return updateStoredUsage(encodedScope, before, after, txn)
+}
+
+// updateStoredUsage does nothing if the bucket has no counter, as the
+// counter is computed from the keys once it is created. Pieces that are
+// part of before and after are left untouched, the usage of versions that
+// expired in the meantime is released first.
+func updateStoredUsage(encodedScope string, before map[string]usagePiece, after map[string]usagePiece, txn *badger.Txn) error {
+	usage, found, err := storedUsage(encodedScope, txn)
+	if err != nil || !found {
+		return err
+	}
+	err = expiredUsage(encodedScope, time.Now(), txn, func(key []byte, expired Usage) error {
+		usage.subtract(expired)
+		return txn.Delete(key)
+	})
+	if err != nil {
+		return err
+	}
+	for id, piece := range before {
+		if _, ok := after[id]; ok {
+			continue
+		}
+		err = releaseUsage(encodedScope, &usage, piece, txn)
+		if err != nil {
+			return err
+		}
+	}
+	for id, piece := range after {
+		if _, ok := before[id]; ok {
+			continue
+		}
+		err = countUsage(encodedScope, &usage, piece, txn)
+		if err != nil {
+			return err
+		}
+	}
+	encodedUsage, err := json.Marshal(usage)
+	if err != nil {
+		return err
+	}
+	return txn.Set([]byte(usageKey(encodedScope)), encodedUsage)
+}
@@ -0,0 +1,167 @@
+package main
+
+import (
+	"testing"
+	"time"
+
+	"github.com/dgraph-io/badger/v3"
+	"github.com/mguentner/passwordless/state"
+)
+
+func storedUsageForTest(t *testing.T, appState *state.State, identifier string) (Usage, bool) {
+	var usage Usage
+	var found bool
+	err := appState.DB.View(func(txn *badger.Txn) error {
+		var err error
+		usage, found, err = storedUsage(encodeScope(identifier), txn)
+		return err
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	return usage, found
+}
+
+func TestUsageCountsVersions(t *testing.T) {
+	config := DefaultConfig()
+	config.StorageOptions.MaxVersionsPerKey = 1
+	config.StorageOptions.MaxBytesPerAccount = 10
+	db, err := badger.Open(badger.DefaultOptions("").WithInMemory(true))
+	if err != nil {
+		t.Fatal(err)
+	}
+	appState := state.State{
+		DB: db,
+	}
+	_, err = InsertKeyValueForIdentifier(&appState, config, "alice@example.com", "a", []byte("123456"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	// the previous version is kept, so the usage would grow to 11 bytes
+	_, err = InsertKeyValueForIdentifier(&appState, config, "alice@example.com", "a", []byte("12345"))
+	if _, ok := err.(*ErrQuotaExceeded); !ok {
+		t.Fatalf("Expected ErrQuotaExceeded, got %v", err)
+	}
+	_, err = InsertKeyValueForIdentifier(&appState, config, "alice@example.com", "a", []byte("1234"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	usage, err := UsageForIdentifier(&appState, "alice@example.com")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if usage.Keys != 1 || usage.Bytes != 10 {
+		t.Errorf("Unexpected usage %+v", usage)
+	}
+	// the oldest version is dropped, only 4 + 2 bytes remain
+	_, err = InsertKeyValueForIdentifier(&appState, config, "alice@example.com", "a", []byte("12"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if usage, found := storedUsageForTest(t, &appState, "alice@example.com"); !found || usage.Keys != 1 || usage.Bytes != 6 {
+		t.Errorf("Unexpected stored usage %+v", usage)
+	}
+	err = DeleteKeyValueForIdentifier(&appState, config, "alice@example.com", "a")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if usage, found := storedUsageForTest(t, &appState, "alice@example.com"); !found || usage.Keys != 0 || usage.Bytes != 0 {
+		t.Errorf("Expected no usage after the deletion, got %+v", usage)
+	}
+}
+
+func TestUsageWithoutCounter(t *testing.T) {
+	config := DefaultConfig()
+	config.StorageOptions.MaxVersionsPerKey = 1
+	db, err := badger.Open(badger.DefaultOptions("").WithInMemory(true))
+	if err != nil {
+		t.Fatal(err)
+	}
+	appState := state.State{
+		DB: db,
+	}
+	for _, value := range []string{"12", "345"} {
+		_, err = InsertKeyValueForIdentifier(&appState, config, "alice@example.com", "a", []byte(value))
+		if err != nil {
+			t.Fatal(err)
+		}
+	}
+	// databases written before the counters were introduced have none
+	err = db.Update(func(txn *badger.Txn) error {
+		return txn.Delete([]byte(usageKey(encodeScope("alice@example.com"))))
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	usage, err := UsageForIdentifier(&appState, "alice@example.com")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if usage.Keys != 1 || usage.Bytes != 5 {
+		t.Errorf("Unexpected usage %+v", usage)
+	}
+	_, err = InsertKeyValueForIdentifier(&appState, config, "alice@example.com", "b", []byte("6789"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if usage, found := storedUsageForTest(t, &appState, "alice@example.com"); !found || usage.Keys != 2 || usage.Bytes != 9 {
+		t.Errorf("Unexpected stored usage %+v", usage)
+	}
+}
+
+func TestUsageOfExpiredValues(t *testing.T) {
+	config := DefaultConfig()
+	config.StorageOptions.MaxVersionsPerKey = 1
+	db, err := badger.Open(badger.DefaultOptions("").WithInMemory(true))
+	if err != nil {
+		t.Fatal(err)
+	}
+	appState := state.State{
+		DB: db,
+	}
+	_, err = InsertKeyValueWithOptions(&appState, config, "alice@example.com", "short", []byte("12345"), InsertOptions{TTL: time.Second})
+	if err != nil {
+		t.Fatal(err)
+	}
+	// the expiring value becomes a previous version of "kept"
+	_, err = InsertKeyValueWithOptions(&appState, config, "alice@example.com", "kept", []byte("12"), InsertOptions{TTL: time.Second})
+	if err != nil {
+		t.Fatal(err)
+	}
+	_, err = InsertKeyValueForIdentifier(&appState, config, "alice@example.com", "kept", []byte("345"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	usage, err := UsageForIdentifier(&appState, "alice@example.com")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if usage.Keys != 2 || usage.Bytes != 10 {
+		t.Errorf("Unexpected usage %+v", usage)
+	}
+	time.Sleep(2 * time.Second)
+	usage, err = UsageForIdentifier(&appState, "alice@example.com")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if usage.Keys != 1 || usage.Bytes != 3 {
+		t.Errorf("Expected the expired values to be released, got %+v", usage)
+	}
+	// the counter is settled by the next write
+	_, err = InsertKeyValueForIdentifier(&appState, config, "alice@example.com", "short", []byte("6"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if usage, found := storedUsageForTest(t, &appState, "alice@example.com"); !found || usage.Keys != 2 || usage.Bytes != 4 {
+		t.Errorf("Unexpected stored usage %+v", usage)
+	}
+	err = db.View(func(txn *badger.Txn) error {
+		return expiredUsage(encodeScope("alice@example.com"), time.Now().Add(time.Hour), txn, func(key []byte, usage Usage) error {
+			t.Errorf("Unexpected expiry index key %s", key)
+			return nil
+		})
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+}
@@ -0,0 +1,786 @@
+package main
+
+import (
+	"bytes"
+	"context"
+	"crypto/hmac"
+	"crypto/rand"
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"net"
+	"net/http"
+	"net/url"
+	"strconv"
+	"strings"
+	"sync"
+	"syscall"
+	"time"
+
+	"github.com/dgraph-io/badger/v3"
+	"github.com/mguentner/passwordless/state"
+	"github.com/rs/zerolog/log"
+)
+
+type ErrInvalidWebhook struct{}
+
+func (e *ErrInvalidWebhook) Error() string {
+	return "InvalidWebhook"
+}
+
+type ErrWebhookNotFound struct{}
+
+func (e *ErrWebhookNotFound) Error() string {
+	return "WebhookNotFound"
+}
+
+type ErrWebhooksDisabled struct{}
+
+func (e *ErrWebhooksDisabled) Error() string {
+	return "WebhooksDisabled"
+}
+
+type ErrWebhookLimitReached struct{}
+
+func (e *ErrWebhookLimitReached) Error() string {
+	return "WebhookLimitReached"
+}
+
+// Types of the events sent to webhooks
+const (
+	WebhookKeyCreated    = "key.created"
+	WebhookKeyUpdated    = "key.updated"
+	WebhookKeyDeleted    = "key.deleted"
+	WebhookBucketDeleted = "bucket.deleted"
+)
+
+const (
+	// webhookQueuePrefix is ordered by the time of the next attempt
+	webhookQueuePrefix = "webhookqueue-"
+	// webhookBackoffPrefix marks the webhooks whose deliveries are
+	// postponed because the last attempt failed
+	webhookBackoffPrefix = "webhookbackoff-"
+	// operatorWebhookPrefix marks the IDs of webhooks from the config
+	operatorWebhookPrefix = "operator-"
+	// defaultWebhookMaxAttempts is used if WebhookOptions.MaxAttempts
+	// is 0
+	defaultWebhookMaxAttempts = 8
+	// the delay before the second attempt, it doubles with every attempt
+	webhookInitialBackoff = 10 * time.Second
+	webhookMaxBackoff     = time.Hour
+	webhookTimeout        = 10 * time.Second
+	webhookDeliveryLog    = 7 * 24 * time.Hour
+	// webhookDeliveryBatch bounds the deliveries attempted in one run
+	webhookDeliveryBatch = 100
+	// webhookDeliveryWorkers bounds the webhooks that are called at the
+	// same time, the deliveries of a single webhook are sent in order
+	webhookDeliveryWorkers = 8
+	// webhookDeliveriesPerWebhook bounds the deliveries of a single webhook
+	// in one run, so a slow webhook does not hold up the next run for long
+	webhookDeliveriesPerWebhook = 10
+	webhookDeliveryInterval     = time.Second
+	webhookSignatureHeader      = "X-Safestore-Signature"
+	webhookDeliveryHeader       = "X-Safestore-Delivery"
+	webhookEventHeader          = "X-Safestore-Event"
+	webhookSecretSizeInBytes    = 32
+)
+
+// Webhook is registered by an account and receives the changes of all its
+// buckets. The secret is only returned when the webhook is created.
+type Webhook struct {
+	ID        string    `json:"id"`
+	URL       string    `json:"url"`
+	Secret    string    `json:"secret,omitempty"`
+	CreatedAt time.Time `json:"createdAt"`
+}
+
+// WebhookPayload is the body of a callback, it is signed using HMAC-SHA256
+// with the secret of the webhook
+type WebhookPayload struct {
+	ID         string `json:"id"`
+	Type       string `json:"type"`
+	Identifier string `json:"identifier"`
+	Change     Change `json:"change"`
+}
+
+// queuedDelivery is stored until the payload was delivered or all
+// attempts failed
+type queuedDelivery struct {
+	WebhookID  string          `json:"webhookId"`
+	Identifier string          `json:"identifier"`
+	Payload    json.RawMessage `json:"payload"`
+	Attempts   uint64          `json:"attempts"`
+}
+
+// webhookEndpointBackoff is stored once a delivery to a webhook failed.
+// Until it ends, the deliveries to the webhook are postponed instead of
+// being attempted.
+type webhookEndpointBackoff struct {
+	Failures uint64    `json:"failures"`
+	Until    time.Time `json:"until"`
+}
+
+// WebhookDelivery is logged for every attempt to deliver to a webhook of
+// an account
+type WebhookDelivery struct {
+	ID          string    `json:"id"`
+	Type        string    `json:"type"`
+	Sequence    uint64    `json:"sequence"`
+	Attempt     uint64    `json:"attempt"`
+	AttemptedAt time.Time `json:"attemptedAt"`
+	StatusCode  int       `json:"statusCode,omitempty"`
+	Error       string    `json:"error,omitempty"`
+	Delivered   bool      `json:"delivered"`
+	// NextAttemptAt is set if the delivery is retried
+	NextAttemptAt *time.Time `json:"nextAttemptAt,omitempty"`
+}
+
+func webhookKey(identifier string, id string) string {
+	return fmt.Sprintf("%s-webhook-%s", state.EncodeIdentifier(identifier), id)
+}
+
+func webhookDeliveryPrefix(identifier string, id string) string {
+	return fmt.Sprintf("%s-webhookdelivery-%s-", state.EncodeIdentifier(identifier), id)
+}
+
+func webhookQueueKey(nextAttemptAt time.Time, deliveryID string) string {
+	return fmt.Sprintf("%s%020d-%s", webhookQueuePrefix, nextAttemptAt.UnixNano(), deliveryID)
+}
+
+func webhookBackoffKey(webhookID string) string {
+	return webhookBackoffPrefix + webhookID
+}
+
+func webhookEventType(change Change) string {
+	switch change.Type {
+	case ChangePut:
+		if change.Version != nil && change.Version.Version == 1 {
+			return WebhookKeyCreated
+		}
+		return WebhookKeyUpdated
+	case ChangeDelete:
+		return WebhookKeyDeleted
+	}
+	return WebhookBucketDeleted
+}
+
+// webhookBackoff returns the delay after the given number of failed
+// attempts
+func webhookBackoff(attempts uint64) time.Duration {
+	backoff := webhookInitialBackoff
+	for i := uint64(1); i < attempts && backoff < webhookMaxBackoff; i++ {
+		backoff *= 2
+	}
+	if backoff > webhookMaxBackoff {
+		return webhookMaxBackoff
+	}
+	return backoff
+}
+
+func signWebhookPayload(secret string, payload []byte) string {
+	mac := hmac.New(sha256.New, []byte(secret))
+	mac.Write(payload)
+	return "sha256=" + hex.EncodeToString(mac.Sum(nil))
+}
+
+func validateWebhookURL(rawURL string) error {
+	parsed, err := url.Parse(rawURL)
+	if err != nil || (parsed.Scheme != "http" && parsed.Scheme != "https") || len(parsed.Host) == 0 {
+		return &ErrInvalidWebhook{}
+	}
+	return nil
+}
+
+func webhooksForIdentifier(identifier string, txn *badger.Txn) ([]Webhook, error) {
+	webhooks := []Webhook{}
+	prefix := []byte(webhookKey(identifier, ""))
+	it := txn.NewIterator(badger.DefaultIteratorOptions)
+	defer it.Close()
+	for it.Seek(prefix); it.ValidForPrefix(prefix); it.Next() {
+		var webhook Webhook
+		err := it.Item().Value(func(v []byte) error {
+			return json.Unmarshal(v, &webhook)
+		})
+		if err != nil {
+			return nil, err
+		}
+		webhooks = append(webhooks, webhook)
+	}
+	return webhooks, nil
+}
+
+func webhookForIdentifier(identifier string, id string, txn *badger.Txn) (*Webhook, error) {
+	item, err := txn.Get([]byte(webhookKey(identifier, id)))
+	if err != nil {
+		if err == badger.ErrKeyNotFound {
+			return nil, &ErrWebhookNotFound{}
+		}
+		return nil, err
+	}
+	var webhook Webhook
+	err = item.Value(func(v []byte) error {
+		return json.Unmarshal(v, &webhook)
+	})
+	if err != nil {
+		return nil, err
+	}
+	return &webhook, nil
+}
+
+// enqueueWebhooks queues a delivery of the change for the webhooks of the
+// operator and of the account. It is called in the transaction of the
+// change, so a change is only delivered if it was committed.
+func enqueueWebhooks(config Config, identifier string, change Change, txn *badger.Txn) error {
+	webhookIDs := []string{}
+	for i := range config.Webhooks.Operator {
+		webhookIDs = append(webhookIDs, operatorWebhookPrefix+strconv.Itoa(i))
+	}
+	if config.Webhooks.MaxWebhooksPerAccount > 0 {
+		webhooks, err := webhooksForIdentifier(identifier, txn)
+		if err != nil {
+			return err
+		}
+		for _, webhook := range webhooks {
+			webhookIDs = append(webhookIDs, webhook.ID)
+		}
+	}
+	for _, webhookID := range webhookIDs {
+		id, err := newChunkID()
+		if err != nil {
+			return err
+		}
+		payload, err := json.Marshal(WebhookPayload{
+			ID:         id,
+			Type:       webhookEventType(change),
+			Identifier: identifier,
+			Change:     change,
+		})
+		if err != nil {
+			return err
+		}
+		encodedDelivery, err := json.Marshal(queuedDelivery{
+			WebhookID:  webhookID,
+			Identifier: identifier,
+			Payload:    payload,
+		})
+		if err != nil {
+			return err
+		}
+		err = txn.Set([]byte(webhookQueueKey(change.Timestamp, id)), encodedDelivery)
+		if err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// CreateWebhookForIdentifier registers a webhook with a random secret
+func CreateWebhookForIdentifier(s *state.State, config Config, identifier string, rawURL string) (Webhook, error) {
+	maxWebhooks := config.Webhooks.MaxWebhooksPerAccount
+	if maxWebhooks == 0 {
+		return Webhook{}, &ErrWebhooksDisabled{}
+	}
+	err := validateWebhookURL(rawURL)
+	if err != nil {
+		return Webhook{}, err
+	}
+	id, err := newChunkID()
+	if err != nil {
+		return Webhook{}, err
+	}
+	secret := make([]byte, webhookSecretSizeInBytes)
+	_, err = rand.Read(secret)
+	if err != nil {
+		return Webhook{}, err
+	}
+	webhook := Webhook{
+		ID:        id,
+		URL:       rawURL,
+		Secret:    hex.EncodeToString(secret),
+		CreatedAt: time.Now(),
+	}
+	identifier, _ = splitIdentifier(identifier)
+	err = s.DB.Update(func(txn *badger.Txn) error {
+		webhooks, err := webhooksForIdentifier(identifier, txn)
+		if err != nil {
+			return err
+		}
+		if uint64(len(webhooks)) >= maxWebhooks {
+			return &ErrWebhookLimitReached{}
+		}
+		encodedWebhook, err := json.Marshal(webhook)
+		if err != nil {
+			return err
+		}
+		return txn.Set([]byte(webhookKey(identifier, id)), encodedWebhook)
+	})
+	if err != nil {
+		return Webhook{}, err
+	}
+	return webhook, nil
+}
+
+// WebhooksForIdentifier lists the webhooks of an account without their
+// secrets
+func WebhooksForIdentifier(s *state.State, identifier string) ([]Webhook, error) {
+	identifier, _ = splitIdentifier(identifier)
+	var webhooks []Webhook
+	err := s.DB.View(func(txn *badger.Txn) error {
+		var err error
+		webhooks, err = webhooksForIdentifier(identifier, txn)
+		return err
+	})
+	for i := range webhooks {
+		webhooks[i].Secret = ""
+	}
+	return webhooks, err
+}
+
+// DeleteWebhookForIdentifier deletes a webhook together with its delivery
+// log, queued deliveries are dropped when they are due
+func DeleteWebhookForIdentifier(s *state.State, identifier string, id string) error {
+	identifier, _ = splitIdentifier(identifier)
+	err := s.DB.Update(func(txn *badger.Txn) error {
+		_, err := webhookForIdentifier(identifier, id, txn)
+		if err != nil {
+			return err
+		}
+		err = txn.Delete([]byte(webhookBackoffKey(id)))
+		if err != nil {
+			return err
+		}
+		return txn.Delete([]byte(webhookKey(identifier, id)))
+	})
+	if err != nil {
+		return err
+	}
+	return deleteKeysWithPrefix(s, []byte(webhookDeliveryPrefix(identifier, id)))
+}
+
+// WebhookDeliveriesForIdentifier lists the logged attempts of a webhook,
+// the oldest attempt first
+func WebhookDeliveriesForIdentifier(s *state.State, identifier string, id string) ([]WebhookDelivery, error) {
+	identifier, _ = splitIdentifier(identifier)
+	deliveries := []WebhookDelivery{}
+	err := s.DB.View(func(txn *badger.Txn) error {
+		_, err := webhookForIdentifier(identifier, id, txn)
+		if err != nil {
+			return err
+		}
+		prefix := []byte(webhookDeliveryPrefix(identifier, id))
+		it := txn.NewIterator(badger.DefaultIteratorOptions)
+		defer it.Close()
+		for it.Seek(prefix); it.ValidForPrefix(prefix); it.Next() {
+			var delivery WebhookDelivery
+			err := it.Item().Value(func(v []byte) error {
+				return json.Unmarshal(v, &delivery)
+			})
+			if err != nil {
+				return err
+			}
+			deliveries = append(deliveries, delivery)
+		}
+		return nil
+	})
+	return deliveries, err
+}
+
+// webhookTarget returns the URL and the secret of a webhook, nil if the
+// webhook no longer exists
+func webhookTarget(config Config, delivery queuedDelivery, txn *badger.Txn) (*Webhook, error) {
+	if strings.HasPrefix(delivery.WebhookID, operatorWebhookPrefix) {
+		index, err := strconv.Atoi(strings.TrimPrefix(delivery.WebhookID, operatorWebhookPrefix))
+		if err != nil || index >= len(config.Webhooks.Operator) {
+			return nil, nil
+		}
+		operator := config.Webhooks.Operator[index]
+		return &Webhook{ID: delivery.WebhookID, URL: operator.URL, Secret: operator.Secret}, nil
+	}
+	webhook, err := webhookForIdentifier(delivery.Identifier, delivery.WebhookID, txn)
+	if err != nil {
+		if _, ok := err.(*ErrWebhookNotFound); ok {
+			return nil, nil
+		}
+		return nil, err
+	}
+	return webhook, nil
+}
+
+// privateNetworks are not reachable by webhooks unless
+// AllowPrivateAddresses is set
+var privateNetworks = []string{
+	"0.0.0.0/8",
+	"10.0.0.0/8",
+	"100.64.0.0/10",
+	"127.0.0.0/8",
+	"169.254.0.0/16",
+	"172.16.0.0/12",
+	"192.168.0.0/16",
+	"::1/128",
+	"fc00::/7",
+	"fe80::/10",
+}
+
+// denyPrivateAddresses is used as the Control function of the dialer, so
+// that the address is checked after it was resolved
+func denyPrivateAddresses(network string, address string, c syscall.RawConn) error {
+	host, _, err := net.SplitHostPort(address)
+	if err != nil {
+		return err
+	}
+	ip := net.ParseIP(host)
+	if ip == nil || ip.IsUnspecified() || ip.IsMulticast() {
+		return errors.New("webhook address is not public")
+	}
+	for _, cidr := range privateNetworks {
+		_, network, err := net.ParseCIDR(cidr)
+		if err != nil {
+			return err
+		}
+		if network.Contains(ip) {
+			return errors.New("webhook address is not public")
+		}
+	}
+	return nil
+}
+
+// NewWebhookClient returns the client used for deliveries. Unless
+// AllowPrivateAddresses is set, webhooks can not reach the loopback and
+// private networks of the server.
+func NewWebhookClient(config Config) *http.Client {
+	dialer := &net.Dialer{Timeout: webhookTimeout}
+	if !config.Webhooks.AllowPrivateAddresses {
+		dialer.Control = denyPrivateAddresses
+	}
+	return &http.Client{
+		Timeout: webhookTimeout,
+		Transport: &http.Transport{
+			DialContext: dialer.DialContext,
+		},
+		// redirects could lead to any address
+		CheckRedirect: func(req *http.Request, via []*http.Request) error {
+			return http.ErrUseLastResponse
+		},
+	}
+}
+
+// postWebhook returns the status code, which is 0 if the request failed
+func postWebhook(client *http.Client, webhook Webhook, payload WebhookPayload, body []byte) (int, error) {
+	ctx, cancel := context.WithTimeout(context.Background(), webhookTimeout)
+	defer cancel()
+	req, err := http.NewRequestWithContext(ctx, "POST", webhook.URL, bytes.NewReader(body))
+	if err != nil {
+		return 0, err
+	}
+	req.Header.Set("Content-Type", "application/json")
+	req.Header.Set(webhookSignatureHeader, signWebhookPayload(webhook.Secret, body))
+	req.Header.Set(webhookDeliveryHeader, payload.ID)
+	req.Header.Set(webhookEventHeader, payload.Type)
+	resp, err := client.Do(req)
+	if err != nil {
+		return 0, err
+	}
+	resp.Body.Close()
+	if resp.StatusCode < 200 || resp.StatusCode >= 300 {
+		return resp.StatusCode, fmt.Errorf("unexpected status %d", resp.StatusCode)
+	}
+	return resp.StatusCode, nil
+}
+
+// webhookBackoffForID returns nil if the webhook is not backed off
+func webhookBackoffForID(webhookID string, txn *badger.Txn) (*webhookEndpointBackoff, error) {
+	item, err := txn.Get([]byte(webhookBackoffKey(webhookID)))
+	if err == badger.ErrKeyNotFound {
+		return nil, nil
+	}
+	if err != nil {
+		return nil, err
+	}
+	var backoff webhookEndpointBackoff
+	err = item.Value(func(v []byte) error {
+		return json.Unmarshal(v, &backoff)
+	})
+	if err != nil {
+		return nil, err
+	}
+	return &backoff, nil
+}
+
+// updateWebhookBackoff removes the backoff of a webhook once a delivery
+// succeeded and extends it after every failed delivery. The backoff of a
+// failing webhook is returned.
+func updateWebhookBackoff(webhookID string, delivered bool, now time.Time, txn *badger.Txn) (*webhookEndpointBackoff, error) {
+	if delivered {
+		return nil, txn.Delete([]byte(webhookBackoffKey(webhookID)))
+	}
+	backoff, err := webhookBackoffForID(webhookID, txn)
+	if err != nil {
+		return nil, err
+	}
+	if backoff == nil {
+		backoff = &webhookEndpointBackoff{}
+	}
+	backoff.Failures++
+	backoff.Until = now.Add(webhookBackoff(backoff.Failures))
+	encodedBackoff, err := json.Marshal(backoff)
+	if err != nil {
+		return nil, err
+	}
+	// the record is kept past the backoff, so the next failure continues
+	// from the current delay
+	e := badger.NewEntry([]byte(webhookBackoffKey(webhookID)), encodedBackoff)
+	e.ExpiresAt = uint64(backoff.Until.Add(webhookMaxBackoff).Unix())
+	return backoff, txn.SetEntry(e)
+}
+
+// postponeDeliveries queues deliveries again for a later attempt without
+// counting an attempt
+func postponeDeliveries(s *state.State, queueKeys []string, until time.Time) error {
+	return s.DB.Update(func(txn *badger.Txn) error {
+		for _, queueKey := range queueKeys {
+			item, err := txn.Get([]byte(queueKey))
+			if err == badger.ErrKeyNotFound {
+				continue
+			}
+			if err != nil {
+				return err
+			}
+			encodedDelivery, err := item.ValueCopy(nil)
+			if err != nil {
+				return err
+			}
+			err = txn.Delete([]byte(queueKey))
+			if err != nil {
+				return err
+			}
+			parts := strings.SplitN(strings.TrimPrefix(queueKey, webhookQueuePrefix), "-", 2)
+			if len(parts) != 2 {
+				continue
+			}
+			err = txn.Set([]byte(webhookQueueKey(until, parts[1])), encodedDelivery)
+			if err != nil {
+				return err
+			}
+		}
+		return nil
+	})
+}
+
+// deliverQueued attempts a single delivery and either removes it from the
+// queue or queues it again for the next attempt. The backoff of the
+// webhook is returned if the delivery failed.
+func deliverQueued(s *state.State, config Config, client *http.Client, queueKey string, now time.Time) (*webhookEndpointBackoff, error) {
+	var delivery queuedDelivery
+	var webhook *Webhook
+	err := s.DB.View(func(txn *badger.Txn) error {
+		item, err := txn.Get([]byte(queueKey))
+		if err != nil {
+			return err
+		}
+		err = item.Value(func(v []byte) error {
+			return json.Unmarshal(v, &delivery)
+		})
+		if err != nil {
+			return err
+		}
+		webhook, err = webhookTarget(config, delivery, txn)
+		return err
+	})
+	if err == badger.ErrKeyNotFound {
+		return nil, nil
+	}
+	if err != nil {
+		return nil, err
+	}
+	if webhook == nil {
+		return nil, s.DB.Update(func(txn *badger.Txn) error {
+			return txn.Delete([]byte(queueKey))
+		})
+	}
+	var payload WebhookPayload
+	err = json.Unmarshal(delivery.Payload, &payload)
+	if err != nil {
+		return nil, err
+	}
+	delivery.Attempts++
+	statusCode, deliveryErr := postWebhook(client, *webhook, payload, delivery.Payload)
+	logged := WebhookDelivery{
+		ID:          payload.ID,
+		Type:        payload.Type,
+		Sequence:    payload.Change.Sequence,
+		Attempt:     delivery.Attempts,
+		AttemptedAt: now,
+		StatusCode:  statusCode,
+		Delivered:   deliveryErr == nil,
+	}
+	maxAttempts := config.Webhooks.MaxAttempts
+	if maxAttempts == 0 {
+		maxAttempts = defaultWebhookMaxAttempts
+	}
+	if deliveryErr != nil {
+		logged.Error = deliveryErr.Error()
+		if delivery.Attempts < maxAttempts {
+			nextAttemptAt := now.Add(webhookBackoff(delivery.Attempts))
+			logged.NextAttemptAt = &nextAttemptAt
+		}
+	}
+	var backoff *webhookEndpointBackoff
+	err = s.DB.Update(func(txn *badger.Txn) error {
+		err := txn.Delete([]byte(queueKey))
+		if err != nil {
+			return err
+		}
+		backoff, err = updateWebhookBackoff(delivery.WebhookID, deliveryErr == nil, now, txn)
+		if err != nil {
+			return err
+		}
+		if logged.NextAttemptAt != nil {
+			encodedDelivery, err := json.Marshal(delivery)
+			if err != nil {
+				return err
+			}
+			err = txn.Set([]byte(webhookQueueKey(*logged.NextAttemptAt, payload.ID)), encodedDelivery)
+			if err != nil {
+				return err
+			}
+		}
+		if strings.HasPrefix(delivery.WebhookID, operatorWebhookPrefix) {
+			if deliveryErr != nil {
+				log.Warn().Msgf("Webhook delivery %s to %s failed: %v", payload.ID, webhook.URL, deliveryErr)
+			}
+			return nil
+		}
+		encodedLogged, err := json.Marshal(logged)
+		if err != nil {
+			return err
+		}
+		logKey := fmt.Sprintf("%s%020d-%s", webhookDeliveryPrefix(delivery.Identifier, delivery.WebhookID), now.UnixNano(), payload.ID)
+		e := badger.NewEntry([]byte(logKey), encodedLogged)
+		e.ExpiresAt = uint64(now.Add(webhookDeliveryLog).Unix())
+		return txn.SetEntry(e)
+	})
+	return backoff, err
+}
+
+// deliverToWebhook attempts the due deliveries of a single webhook in
+// order. While the webhook is backed off its deliveries are postponed, as
+// are the remaining ones once a delivery failed. It returns how many
+// deliveries were attempted.
+func deliverToWebhook(s *state.State, config Config, client *http.Client, webhookID string, queueKeys []string, now time.Time) (int, error) {
+	var backoff *webhookEndpointBackoff
+	err := s.DB.View(func(txn *badger.Txn) error {
+		var err error
+		backoff, err = webhookBackoffForID(webhookID, txn)
+		return err
+	})
+	if err != nil {
+		return 0, err
+	}
+	if backoff != nil && backoff.Until.After(now) {
+		return 0, postponeDeliveries(s, queueKeys, backoff.Until)
+	}
+	for i, queueKey := range queueKeys {
+		backoff, err = deliverQueued(s, config, client, queueKey, now)
+		if err != nil {
+			return i, err
+		}
+		if backoff != nil {
+			return i + 1, postponeDeliveries(s, queueKeys[i+1:], backoff.Until)
+		}
+	}
+	return len(queueKeys), nil
+}
+
+// dueWebhookDeliveries returns the keys of the due deliveries grouped by
+// their webhook, each group is ordered by the time of the next attempt
+func dueWebhookDeliveries(s *state.State, now time.Time) ([]string, map[string][]string, error) {
+	webhookIDs := []string{}
+	queueKeys := map[string][]string{}
+	end := fmt.Sprintf("%s%020d", webhookQueuePrefix, now.UnixNano())
+	err := s.DB.View(func(txn *badger.Txn) error {
+		it := txn.NewIterator(badger.DefaultIteratorOptions)
+		defer it.Close()
+		prefix := []byte(webhookQueuePrefix)
+		selected := 0
+		// deliveries beyond the limit of their webhook are skipped, the
+		// scan stops eventually so a long queue of a single webhook is
+		// not read on every run
+		scanned := 0
+		for it.Seek(prefix); it.ValidForPrefix(prefix) && selected < webhookDeliveryBatch && scanned < webhookDeliveryBatch*webhookDeliveriesPerWebhook; it.Next() {
+			scanned++
+			key := string(it.Item().Key())
+			if key > end {
+				break
+			}
+			var delivery queuedDelivery
+			err := it.Item().Value(func(v []byte) error {
+				return json.Unmarshal(v, &delivery)
+			})
+			if err != nil {
+				return err
+			}
+			keys, ok := queueKeys[delivery.WebhookID]
+			if !ok {
+				webhookIDs = append(webhookIDs, delivery.WebhookID)
+			}
+			if len(keys) >= webhookDeliveriesPerWebhook {
+				continue
+			}
+			queueKeys[delivery.WebhookID] = append(keys, key)
+			selected++
+		}
+		return nil
+	})
+	return webhookIDs, queueKeys, err
+}
+
+// DeliverWebhooks attempts the deliveries that are due and returns how
+// many were attempted. Up to webhookDeliveryWorkers webhooks are called at
+// the same time.
+func DeliverWebhooks(s *state.State, config Config, client *http.Client, now time.Time) (int, error) {
+	webhookIDs, queueKeys, err := dueWebhookDeliveries(s, now)
+	if err != nil {
+		return 0, err
+	}
+	webhooks := make(chan string)
+	var mutex sync.Mutex
+	var wg sync.WaitGroup
+	attempted := 0
+	var firstErr error
+	for i := 0; i < webhookDeliveryWorkers; i++ {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			for webhookID := range webhooks {
+				n, err := deliverToWebhook(s, config, client, webhookID, queueKeys[webhookID], now)
+				mutex.Lock()
+				attempted += n
+				if err != nil && firstErr == nil {
+					firstErr = err
+				}
+				mutex.Unlock()
+			}
+		}()
+	}
+	for _, webhookID := range webhookIDs {
+		webhooks <- webhookID
+	}
+	close(webhooks)
+	wg.Wait()
+	return attempted, firstErr
+}
+
+// deliverWebhooksPeriodically runs until the process exits
+func deliverWebhooksPeriodically(s *state.State, config Config) {
+	client := NewWebhookClient(config)
+	ticker := time.NewTicker(webhookDeliveryInterval)
+	defer ticker.Stop()
+	for now := range ticker.C {
+		_, err := DeliverWebhooks(s, config, client, now)
+		if err != nil {
+			log.Error().Msgf("Could not deliver webhooks: %v", err)
+		}
+	}
+}
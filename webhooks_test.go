@@ -0,0 +1,269 @@
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"io/ioutil"
+	"net/http"
+	"net/http/httptest"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/dgraph-io/badger/v3"
+	"github.com/mguentner/passwordless/crypto"
+	"github.com/mguentner/passwordless/state"
+)
+
+type webhookReceiver struct {
+	sync.Mutex
+	secret   string
+	fail     bool
+	payloads []WebhookPayload
+}
+
+func (receiver *webhookReceiver) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	receiver.Lock()
+	defer receiver.Unlock()
+	body, err := ioutil.ReadAll(r.Body)
+	if err != nil || r.Header.Get(webhookSignatureHeader) != signWebhookPayload(receiver.secret, body) {
+		w.WriteHeader(http.StatusUnauthorized)
+		return
+	}
+	if receiver.fail {
+		w.WriteHeader(http.StatusServiceUnavailable)
+		return
+	}
+	var payload WebhookPayload
+	err = json.Unmarshal(body, &payload)
+	if err != nil || r.Header.Get(webhookDeliveryHeader) != payload.ID {
+		w.WriteHeader(http.StatusBadRequest)
+		return
+	}
+	receiver.payloads = append(receiver.payloads, payload)
+}
+
+func (receiver *webhookReceiver) types() []string {
+	receiver.Lock()
+	defer receiver.Unlock()
+	types := []string{}
+	for _, payload := range receiver.payloads {
+		types = append(types, payload.Type)
+	}
+	return types
+}
+
+func TestWebhooks(t *testing.T) {
+	operator := &webhookReceiver{secret: "operator-secret"}
+	operatorServer := httptest.NewServer(operator)
+	defer operatorServer.Close()
+	account := &webhookReceiver{}
+	accountServer := httptest.NewServer(account)
+	defer accountServer.Close()
+
+	config := DefaultConfig()
+	config.Webhooks.Operator = []OperatorWebhook{{URL: operatorServer.URL, Secret: operator.secret}}
+	config.Webhooks.MaxWebhooksPerAccount = 1
+	config.Webhooks.MaxAttempts = 2
+	config.Webhooks.AllowPrivateAddresses = true
+	db, err := badger.Open(badger.DefaultOptions("").WithInMemory(true))
+	if err != nil {
+		t.Fatal(err)
+	}
+	appState := state.State{
+		DB:          db,
+		RSAKeyPairs: crypto.KeyPairForTesting(),
+	}
+	client := NewWebhookClient(config)
+
+	_, err = CreateWebhookForIdentifier(&appState, config, "alice@example.com", "ftp://example.com")
+	if _, ok := err.(*ErrInvalidWebhook); !ok {
+		t.Errorf("Expected ErrInvalidWebhook, got %v", err)
+	}
+	webhook, err := CreateWebhookForIdentifier(&appState, config, "alice@example.com", accountServer.URL)
+	if err != nil {
+		t.Fatal(err)
+	}
+	account.secret = webhook.Secret
+	_, err = CreateWebhookForIdentifier(&appState, config, "alice@example.com", accountServer.URL)
+	if _, ok := err.(*ErrWebhookLimitReached); !ok {
+		t.Errorf("Expected ErrWebhookLimitReached, got %v", err)
+	}
+	webhooks, err := WebhooksForIdentifier(&appState, "alice@example.com")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(webhooks) != 1 || webhooks[0].ID != webhook.ID || len(webhooks[0].Secret) != 0 {
+		t.Errorf("Expected the webhook without its secret, got %v", webhooks)
+	}
+
+	_, err = InsertKeyValueForIdentifier(&appState, config, "alice@example.com", "foo", []byte("1"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	_, err = InsertKeyValueForIdentifier(&appState, config, "alice@example.com", "foo", []byte("2"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	err = DeleteKeyValueForIdentifier(&appState, config, "alice@example.com", "foo")
+	if err != nil {
+		t.Fatal(err)
+	}
+	// bob has no webhook, only the operator is notified
+	_, err = InsertKeyValueForIdentifier(&appState, config, "bob@example.com", "bar", []byte("1"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	delivered, err := DeliverWebhooks(&appState, config, client, time.Now())
+	if err != nil {
+		t.Fatal(err)
+	}
+	if delivered != 7 {
+		t.Errorf("Expected 7 deliveries, got %d", delivered)
+	}
+	expected := []string{WebhookKeyCreated, WebhookKeyUpdated, WebhookKeyDeleted}
+	if types := account.types(); fmt.Sprint(types) != fmt.Sprint(expected) {
+		t.Errorf("Expected %v, got %v", expected, types)
+	}
+	expected = append(expected, WebhookKeyCreated)
+	if types := operator.types(); fmt.Sprint(types) != fmt.Sprint(expected) {
+		t.Errorf("Expected %v for the operator, got %v", expected, types)
+	}
+	if account.payloads[0].Change.Key != "foo" || account.payloads[0].Identifier != "alice@example.com" {
+		t.Errorf("Unexpected payload %v", account.payloads[0])
+	}
+
+	// failed deliveries are retried after a backoff until MaxAttempts
+	account.fail = true
+	_, err = InsertKeyValueForIdentifier(&appState, config, "alice@example.com", "foo", []byte("3"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	now := time.Now()
+	for _, at := range []time.Time{now, now.Add(webhookInitialBackoff / 2), now.Add(webhookInitialBackoff), now.Add(time.Hour)} {
+		_, err = DeliverWebhooks(&appState, config, client, at)
+		if err != nil {
+			t.Fatal(err)
+		}
+	}
+	deliveries, err := WebhookDeliveriesForIdentifier(&appState, "alice@example.com", webhook.ID)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(deliveries) != 5 {
+		t.Fatalf("Expected 5 logged deliveries, got %d", len(deliveries))
+	}
+	first, second := deliveries[3], deliveries[4]
+	if first.Delivered || first.Attempt != 1 || first.StatusCode != http.StatusServiceUnavailable || first.NextAttemptAt == nil {
+		t.Errorf("Expected a failed first attempt to be retried, got %v", first)
+	}
+	if second.Delivered || second.Attempt != 2 || second.NextAttemptAt != nil {
+		t.Errorf("Expected the second attempt to be the last, got %v", second)
+	}
+
+	err = DeleteWebhookForIdentifier(&appState, "alice@example.com", webhook.ID)
+	if err != nil {
+		t.Fatal(err)
+	}
+	_, err = WebhookDeliveriesForIdentifier(&appState, "alice@example.com", webhook.ID)
+	if _, ok := err.(*ErrWebhookNotFound); !ok {
+		t.Errorf("Expected ErrWebhookNotFound, got %v", err)
+	}
+}
+
+func TestWebhooksPrivateAddresses(t *testing.T) {
+	receiver := &webhookReceiver{secret: "secret"}
+	server := httptest.NewServer(receiver)
+	defer server.Close()
+	config := DefaultConfig()
+	config.Webhooks.Operator = []OperatorWebhook{{URL: server.URL, Secret: receiver.secret}}
+	config.Webhooks.MaxAttempts = 1
+	db, err := badger.Open(badger.DefaultOptions("").WithInMemory(true))
+	if err != nil {
+		t.Fatal(err)
+	}
+	appState := state.State{
+		DB:          db,
+		RSAKeyPairs: crypto.KeyPairForTesting(),
+	}
+	_, err = CreateWebhookForIdentifier(&appState, config, "alice@example.com", server.URL)
+	if _, ok := err.(*ErrWebhooksDisabled); !ok {
+		t.Errorf("Expected ErrWebhooksDisabled, got %v", err)
+	}
+	_, err = InsertKeyValueForIdentifier(&appState, config, "alice@example.com", "foo", []byte("1"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	_, err = DeliverWebhooks(&appState, config, NewWebhookClient(config), time.Now())
+	if err != nil {
+		t.Fatal(err)
+	}
+	if types := receiver.types(); len(types) != 0 {
+		t.Errorf("Expected the loopback receiver not to be called, got %v", types)
+	}
+}
+
+func TestWebhookBackoff(t *testing.T) {
+	receiver := &webhookReceiver{secret: "secret", fail: true}
+	server := httptest.NewServer(receiver)
+	defer server.Close()
+	config := DefaultConfig()
+	config.Webhooks.Operator = []OperatorWebhook{{URL: server.URL, Secret: receiver.secret}}
+	config.Webhooks.AllowPrivateAddresses = true
+	db, err := badger.Open(badger.DefaultOptions("").WithInMemory(true))
+	if err != nil {
+		t.Fatal(err)
+	}
+	appState := state.State{
+		DB:          db,
+		RSAKeyPairs: crypto.KeyPairForTesting(),
+	}
+	client := NewWebhookClient(config)
+	for _, key := range []string{"a", "b"} {
+		_, err = InsertKeyValueForIdentifier(&appState, config, "alice@example.com", key, []byte("1"))
+		if err != nil {
+			t.Fatal(err)
+		}
+	}
+	// the second delivery is postponed once the first one failed
+	now := time.Now()
+	attempted, err := DeliverWebhooks(&appState, config, client, now)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if attempted != 1 {
+		t.Errorf("Expected 1 attempt, got %d", attempted)
+	}
+	// new deliveries wait for the backoff of the webhook as well
+	_, err = InsertKeyValueForIdentifier(&appState, config, "alice@example.com", "c", []byte("1"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	attempted, err = DeliverWebhooks(&appState, config, client, now.Add(time.Second))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if attempted != 0 {
+		t.Errorf("Expected no attempt during the backoff, got %d", attempted)
+	}
+	receiver.Lock()
+	receiver.fail = false
+	receiver.Unlock()
+	attempted, err = DeliverWebhooks(&appState, config, client, now.Add(webhookInitialBackoff+time.Second))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if attempted != 3 || len(receiver.types()) != 3 {
+		t.Errorf("Expected all deliveries after the backoff, got %d attempts and %v", attempted, receiver.types())
+	}
+	err = db.View(func(txn *badger.Txn) error {
+		backoff, err := webhookBackoffForID(operatorWebhookPrefix+"0", txn)
+		if backoff != nil {
+			t.Errorf("Expected the backoff to be removed, got %+v", backoff)
+		}
+		return err
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+}